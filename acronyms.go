@@ -0,0 +1,377 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/jackmbuda/go-mdrefactor/mdrefactor"
+)
+
+// Acronyms readers are expected to know, which need no expansion. The
+// acronyms section of the config file adds to them with empty expansions.
+var wellKnownAcronyms = map[string]bool{
+	"API": true, "ASCII": true, "CD": true, "CI": true, "CLI": true, "CPU": true, "CSS": true, "CSV": true,
+	"DNS": true, "FAQ": true, "GB": true, "GPU": true, "HTML": true, "HTTP": true, "HTTPS": true, "ID": true,
+	"IP": true, "JSON": true, "KB": true, "MB": true, "OK": true, "OS": true, "PDF": true, "PR": true,
+	"RAM": true, "README": true, "SDK": true, "SQL": true, "SSH": true, "TB": true, "TCP": true, "TLS": true,
+	"UDP": true, "UI": true, "URI": true, "URL": true, "USB": true, "UTC": true, "UTF": true, "UX": true,
+	"XML": true, "YAML": true,
+	// Admonition labels and markers written in capitals
+	"CAUTION": true, "FIXME": true, "IMPORTANT": true, "NOTE": true, "TIP": true, "TODO": true, "WARNING": true,
+}
+
+// Project acronyms by their expansion, from the acronyms section of the
+// config file. An empty expansion marks an acronym as well known.
+var configAcronyms = map[string]string{}
+
+// applyAcronymConfig applies the acronyms section of the config file
+func applyAcronymConfig(cfg map[string]string) error {
+	acronyms := make(map[string]string, len(cfg))
+	for acronym, expansion := range cfg {
+		if !acronymRe.MatchString(acronym) {
+			return fmt.Errorf("invalid acronym %q, expected two or more capital letters or digits", acronym)
+		}
+		acronyms[acronym] = strings.TrimSpace(expansion)
+	}
+	configAcronyms = acronyms
+	return nil
+}
+
+// Words skipped when matching an expansion against the letters of its acronym
+var acronymStopWords = map[string]bool{"a": true, "an": true, "and": true, "for": true, "in": true, "of": true, "on": true, "the": true, "to": true, "with": true}
+
+var (
+	// Words of two to ten capital letters or digits starting with a letter, with an optional plural s
+	acronymRe    = regexp.MustCompile(`^[A-Z][A-Z0-9]{1,9}$`)
+	acronymUseRe = regexp.MustCompile(`\b([A-Z][A-Z0-9]{1,9})s?\b`)
+	// service level objective (SLO)
+	acronymAfterExpansionRe = regexp.MustCompile(`((?:[\w'-]+\s+){0,9}[\w'-]+)\s+\(([A-Z][A-Z0-9]{1,9})s?\)`)
+	acronymWordRe           = regexp.MustCompile(`[\w'-]+`)
+	// SLO (service level objective)
+	acronymBeforeExpansionRe = regexp.MustCompile(`\b([A-Z][A-Z0-9]{1,9})s?\s+\(([^()]{3,100})\)`)
+)
+
+// isAcronym reports whether word is an acronym rather than a number or a
+// shouted word
+func isAcronym(word string) bool {
+	letters := 0
+	for _, r := range word {
+		if unicode.IsUpper(r) {
+			letters++
+		}
+	}
+	return letters >= 2
+}
+
+// acronymInitials returns the letters an expansion abbreviates: the first
+// letter of every word and word part, and the inner capitals of words like
+// JavaScript. Stop words are left out unless withStopWords is set, for
+// acronyms such as MTTR (mean time to recovery).
+func acronymInitials(words []string, withStopWords bool) string {
+	var b strings.Builder
+	for _, word := range words {
+		if !withStopWords && acronymStopWords[strings.ToLower(word)] {
+			continue
+		}
+		for _, part := range strings.FieldsFunc(word, func(r rune) bool { return r == '-' || r == '\'' }) {
+			for i, r := range part {
+				if i == 0 || unicode.IsUpper(r) || unicode.IsDigit(r) {
+					b.WriteRune(unicode.ToUpper(r))
+				}
+			}
+		}
+	}
+	return b.String()
+}
+
+// spells reports whether words abbreviate to acronym
+func spells(words []string, acronym string) bool {
+	return acronymInitials(words, false) == acronym || acronymInitials(words, true) == acronym
+}
+
+// matchExpansion returns the shortest run of words at the end of words that
+// spells acronym, or "" if there is none
+func matchExpansion(words []string, acronym string) string {
+	for n := 1; n <= len(words); n++ {
+		candidate := words[len(words)-n:]
+		if acronymStopWords[strings.ToLower(candidate[0])] {
+			continue
+		}
+		if spells(candidate, acronym) {
+			return strings.Join(candidate, " ")
+		}
+		if len(acronymInitials(candidate, false)) > len(acronym)+2 {
+			break
+		}
+	}
+	return ""
+}
+
+// acronymDefinition is an acronym spelled out in a document
+type acronymDefinition struct {
+	acronym, expansion string
+	start, end         int // Byte offsets of the whole definition in its line
+}
+
+// findAcronymDefinitions returns the acronyms line spells out, as
+// "expansion (ACRONYM)" or "ACRONYM (expansion)"
+func findAcronymDefinitions(line string) []acronymDefinition {
+	var defs []acronymDefinition
+	for _, m := range acronymAfterExpansionRe.FindAllStringSubmatchIndex(line, -1) {
+		acronym := line[m[4]:m[5]]
+		words := acronymWordRe.FindAllStringIndex(line[m[2]:m[3]], -1)
+		texts := make([]string, len(words))
+		for i, w := range words {
+			texts[i] = line[m[2]+w[0] : m[2]+w[1]]
+		}
+		expansion := matchExpansion(texts, acronym)
+		if expansion == "" || !isAcronym(acronym) {
+			continue
+		}
+		start := m[2] + words[len(words)-len(strings.Fields(expansion))][0]
+		if line[m[5]] == 's' {
+			// Service level objectives (SLOs) spell out SLO
+			expansion = strings.TrimSuffix(expansion, "s")
+		}
+		defs = append(defs, acronymDefinition{acronym: acronym, expansion: expansion, start: start, end: m[1]})
+	}
+	for _, m := range acronymBeforeExpansionRe.FindAllStringSubmatchIndex(line, -1) {
+		acronym := line[m[2]:m[3]]
+		expansion := strings.TrimSpace(line[m[4]:m[5]])
+		if m[3] < len(line) && line[m[3]] == 's' {
+			expansion = strings.TrimSuffix(expansion, "s")
+		}
+		if isAcronym(acronym) && spells(strings.Fields(expansion), acronym) {
+			defs = append(defs, acronymDefinition{acronym: acronym, expansion: expansion, start: m[0], end: m[1]})
+		}
+	}
+	return defs
+}
+
+// acronymUse is an acronym's first use in the prose of a document
+type acronymUse struct {
+	line     int // 0-based line of the document
+	start    int // Byte offset in the line
+	expanded bool
+}
+
+// acronymScan is what a document says about its acronyms
+type acronymScan struct {
+	first      map[string]acronymUse
+	expansions map[string]string // First expansion the document gives
+	definedAt  map[string]int    // Line of that expansion
+}
+
+// maskAcronymLine blanks the parts of a line that are not prose, so offsets
+// stay valid: inline code, link targets and HTML tags
+func maskAcronymLine(line string) string {
+	for _, re := range []*regexp.Regexp{inlineCodeRe, linkTargetRe, htmlTagRe} {
+		line = re.ReplaceAllStringFunc(line, func(m string) string { return strings.Repeat(" ", len(m)) })
+	}
+	return line
+}
+
+// scanAcronyms finds the first use and the expansion of every acronym in the
+// prose of content. Headings, code and front matter do not count as uses.
+func scanAcronyms(content string) acronymScan {
+	scan := acronymScan{first: make(map[string]acronymUse), expansions: make(map[string]string), definedAt: make(map[string]int)}
+	frontMatter, body := mdrefactor.SplitFrontMatter(content)
+	offset := strings.Count(frontMatter, "\n")
+	code := codeLines(body)
+	for i, line := range strings.Split(body, "\n") {
+		if code[i] || strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		line = maskAcronymLine(line)
+		defs := findAcronymDefinitions(line)
+		for _, d := range defs {
+			if _, ok := scan.expansions[d.acronym]; !ok {
+				scan.expansions[d.acronym] = d.expansion
+				scan.definedAt[d.acronym] = offset + i
+			}
+		}
+		for _, m := range acronymUseRe.FindAllStringSubmatchIndex(line, -1) {
+			acronym := line[m[2]:m[3]]
+			if _, ok := scan.first[acronym]; ok || !isAcronym(acronym) {
+				continue
+			}
+			use := acronymUse{line: offset + i, start: m[2]}
+			for _, d := range defs {
+				if d.acronym == acronym && d.start <= m[2] && m[3] <= d.end {
+					use.expanded = true
+				}
+			}
+			scan.first[acronym] = use
+		}
+	}
+	return scan
+}
+
+// needsExpansion reports whether an acronym must be spelled out on first use
+func needsExpansion(acronym string) bool {
+	expansion, configured := configAcronyms[acronym]
+	if configured {
+		return expansion != ""
+	}
+	return !wellKnownAcronyms[acronym]
+}
+
+// acronymProblems returns the acronyms of content that are not spelled out
+// on first use, or spelled out differently than in the config file
+func acronymProblems(content string) []string {
+	scan := scanAcronyms(content)
+	var problems []string
+	for _, acronym := range sortedKeys(scan.first) {
+		use := scan.first[acronym]
+		if use.expanded || !needsExpansion(acronym) {
+			continue
+		}
+		switch line, ok := scan.definedAt[acronym]; {
+		case ok:
+			problems = append(problems, fmt.Sprintf("%d: %s is used before it is spelled out on line %d", use.line+1, acronym, line+1))
+		case configAcronyms[acronym] != "":
+			problems = append(problems, fmt.Sprintf("%d: %s is not spelled out on first use (%s)", use.line+1, acronym, configAcronyms[acronym]))
+		default:
+			problems = append(problems, fmt.Sprintf("%d: %s is not spelled out on first use and not in the acronym list", use.line+1, acronym))
+		}
+	}
+	for _, acronym := range sortedKeys(scan.expansions) {
+		if want := configAcronyms[acronym]; want != "" && !strings.EqualFold(want, scan.expansions[acronym]) {
+			problems = append(problems, fmt.Sprintf("%d: %s is spelled out as %q, the acronym list has %q", scan.definedAt[acronym]+1, acronym, scan.expansions[acronym], want))
+		}
+	}
+	return problems
+}
+
+// acronymConflict is an acronym spelled out differently across a docs tree
+type acronymConflict struct {
+	Acronym    string              `json:"acronym"`
+	Expansions map[string][]string `json:"expansions"` // Files by expansion, the config file as "config"
+}
+
+// findAcronymConflicts returns the acronyms spelled out in more than one way
+// across the documents of contents or the config file
+func findAcronymConflicts(contents map[string]string) []acronymConflict {
+	expansions := make(map[string]map[string][]string)
+	add := func(acronym, expansion, file string) {
+		if expansions[acronym] == nil {
+			expansions[acronym] = make(map[string][]string)
+		}
+		// Expansions differing in case only are the same
+		for known := range expansions[acronym] {
+			if strings.EqualFold(known, expansion) {
+				expansion = known
+			}
+		}
+		expansions[acronym][expansion] = append(expansions[acronym][expansion], file)
+	}
+	for acronym, expansion := range configAcronyms {
+		if expansion != "" {
+			add(acronym, expansion, "config")
+		}
+	}
+	for _, file := range sortedKeys(contents) {
+		for acronym, expansion := range scanAcronyms(contents[file]).expansions {
+			add(acronym, expansion, file)
+		}
+	}
+
+	var conflicts []acronymConflict
+	for _, acronym := range sortedKeys(expansions) {
+		if len(expansions[acronym]) > 1 {
+			conflicts = append(conflicts, acronymConflict{Acronym: acronym, Expansions: expansions[acronym]})
+		}
+	}
+	return conflicts
+}
+
+// expandAcronyms spells out every acronym at its first use in content, with
+// the expansion the document gives later, which is then removed, or else the
+// one of known or the config file. It returns the acronyms it could not
+// spell out, since no expansion is known.
+func expandAcronyms(content string, known map[string]string) (string, []string) {
+	scan := scanAcronyms(content)
+	lines := strings.Split(content, "\n")
+	var unknown []string
+	for _, acronym := range sortedKeys(scan.first) {
+		use := scan.first[acronym]
+		if use.expanded || !needsExpansion(acronym) {
+			continue
+		}
+		expansion, defined := scan.expansions[acronym]
+		if !defined {
+			expansion = configAcronyms[acronym]
+		}
+		if expansion == "" {
+			expansion = known[acronym]
+		}
+		if expansion == "" {
+			unknown = append(unknown, acronym)
+			continue
+		}
+		if defined {
+			line := scan.definedAt[acronym]
+			for _, d := range findAcronymDefinitions(maskAcronymLine(lines[line])) {
+				if d.acronym == acronym {
+					lines[line] = lines[line][:d.start] + acronym + lines[line][d.end:]
+					break
+				}
+			}
+		}
+		// The definition may have been on the same line, look the use up again
+		rescan := scanAcronyms(strings.Join(lines, "\n")).first[acronym]
+		line := lines[rescan.line]
+		end := rescan.start + len(acronym)
+		if strings.HasPrefix(line[end:], "s") {
+			expansion, acronym, end = expansion+"s", acronym+"s", end+1
+		}
+		lines[rescan.line] = line[:rescan.start] + expansion + " (" + acronym + ")" + line[end:]
+	}
+	return strings.Join(lines, "\n"), unknown
+}
+
+// acronymInstruction returns the system prompt addition listing the
+// expansions of the acronyms content uses
+func acronymInstruction(content string) string {
+	scan := scanAcronyms(content)
+	var known []string
+	for _, acronym := range sortedKeys(scan.first) {
+		expansion := configAcronyms[acronym]
+		if expansion == "" {
+			expansion = scan.expansions[acronym]
+		}
+		if expansion != "" {
+			known = append(known, fmt.Sprintf("%s: %s", acronym, expansion))
+		}
+	}
+	instruction := "Spell out every acronym that is not common knowledge on its first use in the prose of the document, " +
+		"as \"expansion (ACRONYM)\", and use the acronym alone afterwards."
+	if len(known) > 0 {
+		instruction += " Use these expansions: " + strings.Join(known, "; ") + "."
+	}
+	return instruction
+}
+
+// withAcronymExpansion wraps refactor so that every acronym of the output is
+// spelled out on its first use. The model is asked to, and acronyms it left
+// unexpanded are spelled out afterwards with the expansion of the document
+// or the config file.
+func withAcronymExpansion(refactor refactorFunc) refactorFunc {
+	return func(systemPrompt, content string) (string, error) {
+		refactored, err := refactor(systemPrompt+"\n\n"+acronymInstruction(content), content)
+		if err != nil {
+			return "", err
+		}
+		// Expansions the input gives are kept even if the model dropped them
+		refactored, unknown := expandAcronyms(refactored, scanAcronyms(content).expansions)
+		if len(unknown) > 0 {
+			sort.Strings(unknown)
+			fmt.Fprintf(os.Stderr, "Warning: acronyms not spelled out on first use and not in the acronym list: %s\n", strings.Join(unknown, ", "))
+		}
+		return refactored, nil
+	}
+}
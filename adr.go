@@ -0,0 +1,252 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// System prompt used to draft a decision record from the git history of a feature
+const adrBackfillSystemPrompt = "You are a software architect backfilling an architecture decision record from the git " +
+	"history of a feature. From the commits, oldest first, reconstruct the problem the feature addressed, the decisions " +
+	"taken along the way and what followed from them. Write a Markdown record with a # title naming the decision, a " +
+	"Date line with the date of the first commit, and the sections ## Status (Accepted, or Superseded if later commits " +
+	"replaced the approach), ## Context, ## Decision, ## Consequences and ## History, the latter summarizing " +
+	"how the feature evolved with dates and short commit hashes. Only state what the commits support and say so " +
+	"where the reasoning is not recorded. Reply with the Markdown record only."
+
+// Maximum number of bytes of a single commit message body sent to the model
+const maxCommitBodyBytes = 1500
+
+// Directories where decision records are commonly kept, the first is the default
+var adrDirs = []string{"docs/adr", "doc/adr", "docs/decisions", "adr"}
+
+// Number prefix of decision record files, e.g. 0007-use-postgres.md
+var adrNumberRe = regexp.MustCompile(`^(\d+)-.*\.md$`)
+
+// adrTemplate is the skeleton of a new decision record
+const adrTemplate = `# %d. %s
+
+Date: %s
+
+## Status
+
+%s
+
+## Context
+
+<!-- What is the issue motivating this decision? Which forces are at play? -->
+
+## Decision
+
+<!-- What is the change being proposed or done? Use active voice: "We will ..." -->
+
+## Consequences
+
+<!-- What becomes easier or harder because of this change? -->
+`
+
+// findADRDir returns the first decision record directory that exists, or the default
+func findADRDir() string {
+	for _, dir := range adrDirs {
+		if info, err := os.Stat(filepath.FromSlash(dir)); err == nil && info.IsDir() {
+			return filepath.FromSlash(dir)
+		}
+	}
+	return filepath.FromSlash(adrDirs[0])
+}
+
+// nextADRNumber returns the number following the highest numbered record in dir
+func nextADRNumber(dir string) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return 1, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	highest := 0
+	for _, entry := range entries {
+		if m := adrNumberRe.FindStringSubmatch(entry.Name()); m != nil {
+			if n, err := strconv.Atoi(m[1]); err == nil && n > highest {
+				highest = n
+			}
+		}
+	}
+	return highest + 1, nil
+}
+
+// commitInfo is a commit of the history of a path
+type commitInfo struct {
+	hash    string
+	author  string
+	date    string
+	subject string
+	body    string
+}
+
+// gitHistory returns the commits of the repository at dir that touch path,
+// oldest first, at most limit of the most recent ones
+func gitHistory(dir, path, since string, limit int) ([]commitInfo, error) {
+	// Fields are separated by unit separators and commits by record separators
+	args := []string{"-C", dir, "log", "--no-merges", "--date=short", "--format=%h%x1f%an%x1f%ad%x1f%s%x1f%b%x1e"}
+	if limit > 0 {
+		args = append(args, fmt.Sprintf("--max-count=%d", limit))
+	}
+	if since != "" {
+		args = append(args, "--since="+since)
+	}
+	out, err := exec.Command("git", append(args, "--", path)...).Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return nil, fmt.Errorf("git log failed: %s", strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return nil, fmt.Errorf("git log failed: %w", err)
+	}
+
+	var commits []commitInfo
+	for _, record := range strings.Split(string(out), "\x1e") {
+		fields := strings.Split(strings.TrimLeft(record, "\n"), "\x1f")
+		if len(fields) < 5 {
+			continue
+		}
+		commits = append(commits, commitInfo{hash: fields[0], author: fields[1], date: fields[2], subject: fields[3], body: strings.TrimSpace(fields[4])})
+	}
+	// git log lists the newest commit first
+	for i, j := 0, len(commits)-1; i < j; i, j = i+1, j-1 {
+		commits[i], commits[j] = commits[j], commits[i]
+	}
+	return commits, nil
+}
+
+// formatHistory renders commits for the prompt within budget bytes. Once the
+// budget is used up, only the subjects of the remaining commits are listed.
+func formatHistory(commits []commitInfo, budget int) string {
+	var b strings.Builder
+	for _, c := range commits {
+		fmt.Fprintf(&b, "%s %s (%s): %s\n", c.date, c.hash, c.author, c.subject)
+		body := c.body
+		if len(body) > maxCommitBodyBytes {
+			body = body[:maxCommitBodyBytes] + " [truncated]"
+		}
+		if body != "" && b.Len()+len(body) < budget {
+			for _, line := range strings.Split(body, "\n") {
+				fmt.Fprintf(&b, "    %s\n", line)
+			}
+		}
+	}
+	return b.String()
+}
+
+// runADRCommand implements the adr subcommand
+func runADRCommand(args []string) error {
+	usage := "Usage: mdrefactor adr new [flags] <title>\n       mdrefactor adr backfill [flags] <path>"
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		return fmt.Errorf("an adr command is required")
+	}
+	switch args[0] {
+	case "new":
+		return runADRNew(args[1:])
+	case "backfill":
+		return runADRBackfill(args[1:])
+	}
+	fmt.Fprintln(os.Stderr, usage)
+	return fmt.Errorf("unknown adr command %q", args[0])
+}
+
+// runADRNew creates the next numbered decision record from the template
+func runADRNew(args []string) error {
+	fs := flag.NewFlagSet("adr new", flag.ExitOnError)
+	dir := fs.String("dir", "", "Directory of the decision records (default: the first of docs/adr, doc/adr, docs/decisions and adr that exists, else docs/adr)")
+	status := fs.String("status", "Proposed", "Initial status of the record")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: mdrefactor adr new [flags] <title>")
+		fmt.Fprintln(fs.Output(), "Creates the next numbered decision record with Status, Context, Decision and Consequences sections.")
+		fs.PrintDefaults()
+	}
+	positional := parseArgs(fs, args)
+	title := strings.TrimSpace(strings.Join(positional, " "))
+	if title == "" {
+		fs.Usage()
+		return fmt.Errorf("a title is required")
+	}
+	if *dir == "" {
+		*dir = findADRDir()
+	}
+
+	number, err := nextADRNumber(*dir)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(*dir, fmt.Sprintf("%04d-%s.md", number, slugify(title)))
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%s already exists", path)
+	}
+	if err := os.MkdirAll(*dir, 0755); err != nil {
+		return err
+	}
+	content := fmt.Sprintf(adrTemplate, number, title, time.Now().Format("2006-01-02"), *status)
+	if err := writeFileAtomic(path, []byte(content), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	fmt.Println(path)
+	return nil
+}
+
+// runADRBackfill drafts a decision record from the commits touching a path
+func runADRBackfill(args []string) error {
+	fs := flag.NewFlagSet("adr backfill", flag.ExitOnError)
+	apiKey := fs.String("apikey", os.Getenv("OPENAI_API_KEY"), "OpenAI API key (can also be set via OPENAI_API_KEY environment variable)")
+	addAPIFlags(fs)
+	model := fs.String("model", defaultModel, "OpenAI model to use")
+	repo := fs.String("repo", ".", "Path of the git repository")
+	since := fs.String("since", "", "Only consider commits after this date, e.g. 2023-01-01 or \"2 years ago\"")
+	maxCommits := fs.Int("max-commits", 300, "Only consider this many of the most recent commits, 0 for all")
+	output := fs.String("o", "", "Write the record to this file instead of stdout")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: mdrefactor adr backfill [flags] <path>")
+		fmt.Fprintln(fs.Output(), "Drafts a decision record summarizing how the feature at path evolved, from the commits touching it.")
+		fs.PrintDefaults()
+	}
+	positional := parseArgs(fs, args)
+	if len(positional) != 1 {
+		fs.Usage()
+		return fmt.Errorf("the path of a feature is required")
+	}
+	path := positional[0]
+
+	commits, err := gitHistory(*repo, path, *since, *maxCommits)
+	if err != nil {
+		return err
+	}
+	if len(commits) == 0 {
+		return fmt.Errorf("no commits touch %s", path)
+	}
+	fmt.Fprintf(os.Stderr, "Drafting a decision record from %d commits touching %s (%s to %s)...\n", len(commits), path, commits[0].date, commits[len(commits)-1].date)
+	record, err := chatCompletion(*apiKey, *model, []Message{
+		{Role: "system", Content: adrBackfillSystemPrompt},
+		{Role: "user", Content: fmt.Sprintf("Commits touching %s:\n\n%s", path, formatHistory(commits, chunkSizeFor(*model)))},
+	})
+	if err != nil {
+		return err
+	}
+	record = strings.TrimSpace(record) + "\n"
+
+	if *output == "" {
+		fmt.Print(record)
+		return nil
+	}
+	if err := writeFileAtomic(*output, []byte(record), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", *output, err)
+	}
+	fmt.Fprintf(os.Stderr, "Decision record written to %s\n", *output)
+	return nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Minimum word overlap for a renamed heading to be matched to its old version
+const headingMatchThreshold = 0.3
+
+// redirect maps an old page or anchor URL to its new location
+type redirect struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// pagePath converts a Markdown file path into the site URL path it is usually
+// published under, e.g. docs/setup/index.md -> /docs/setup/
+func pagePath(file string) string {
+	file = filepath.Clean(file)
+	p := filepath.ToSlash(strings.TrimPrefix(file, filepath.VolumeName(file)))
+	p = strings.TrimSuffix(p, path.Ext(p))
+	base := strings.ToLower(path.Base(p))
+	if base == "index" || base == "readme" {
+		p = strings.TrimSuffix(path.Dir(p), ".") + "/"
+	}
+	return "/" + strings.TrimPrefix(p, "/")
+}
+
+// wordSet returns the set of lowercase words in s
+func wordSet(s string) map[string]bool {
+	set := make(map[string]bool)
+	for _, w := range strings.Fields(strings.ToLower(s)) {
+		set[w] = true
+	}
+	return set
+}
+
+// jaccard returns the Jaccard similarity of two sets
+func jaccard(a, b map[string]bool) float64 {
+	if len(a) == 0 && len(b) == 0 {
+		return 1
+	}
+	shared := 0
+	for k := range a {
+		if b[k] {
+			shared++
+		}
+	}
+	return float64(shared) / float64(len(a)+len(b)-shared)
+}
+
+// mapAnchors compares the headings of the original and refactored documents
+// and returns an old -> new map for every anchor that no longer exists.
+// Anchors of removed headings map to "" (the top of the page).
+func mapAnchors(original, refactored string) map[string]string {
+	oldHeadings := parseHeadings(original)
+	newHeadings := parseHeadings(refactored)
+	oldAnchors := headingAnchors(oldHeadings)
+	newAnchors := headingAnchors(newHeadings)
+
+	existing := make(map[string]bool)
+	for _, a := range newAnchors {
+		existing[a] = true
+	}
+
+	// Anchors that survived unchanged need no redirect and cannot be reused
+	used := make(map[int]bool)
+	for j, a := range newAnchors {
+		for _, old := range oldAnchors {
+			if a == old {
+				used[j] = true
+			}
+		}
+	}
+
+	changes := make(map[string]string)
+	for i, old := range oldAnchors {
+		if existing[old] {
+			continue
+		}
+
+		// Match the renamed heading to the most similar unused new heading
+		best, bestScore := -1, headingMatchThreshold
+		// Section numbers change when sections move, they say nothing about the heading
+		oldWords := wordSet(stripSectionNumber(oldHeadings[i].text))
+		for j, h := range newHeadings {
+			if used[j] {
+				continue
+			}
+			if score := jaccard(oldWords, wordSet(stripSectionNumber(h.text))); score >= bestScore {
+				best, bestScore = j, score
+			}
+		}
+
+		if best >= 0 {
+			used[best] = true
+			changes[old] = newAnchors[best]
+		} else {
+			changes[old] = ""
+		}
+	}
+	return changes
+}
+
+// buildRedirects turns a page move and its anchor changes into redirects
+func buildRedirects(oldFile, newFile string, anchors map[string]string) []redirect {
+	oldPage, newPage := pagePath(oldFile), pagePath(newFile)
+
+	redirects := []redirect{}
+	if oldPage != newPage {
+		redirects = append(redirects, redirect{From: oldPage, To: newPage})
+	}
+	for _, old := range sortedKeys(anchors) {
+		to := newPage
+		if anchors[old] != "" {
+			to += "#" + anchors[old]
+		}
+		redirects = append(redirects, redirect{From: oldPage + "#" + old, To: to})
+	}
+	return redirects
+}
+
+// writeAnchorMap writes redirects to path as JSON or in Netlify _redirects format
+func writeAnchorMap(path, format string, redirects []redirect) error {
+	var out []byte
+	switch format {
+	case "json":
+		data, err := json.MarshalIndent(redirects, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal anchor map: %w", err)
+		}
+		out = append(data, '\n')
+	case "redirects":
+		var b strings.Builder
+		for _, r := range redirects {
+			if strings.Contains(r.From, "#") {
+				// Fragments never reach the server, so these can only be documented
+				fmt.Fprintf(&b, "# %s -> %s (anchor change, needs client-side handling)\n", r.From, r.To)
+				continue
+			}
+			fmt.Fprintf(&b, "%s %s 301\n", r.From, r.To)
+		}
+		out = []byte(b.String())
+	default:
+		return fmt.Errorf("unknown anchor map format %q, expected json or redirects", format)
+	}
+
+	if err := writeFileAtomic(path, out, 0644); err != nil {
+		return fmt.Errorf("failed to write anchor map %s: %w", path, err)
+	}
+	return nil
+}
+
+// sortedKeys returns the keys of m in sorted order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
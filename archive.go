@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackmbuda/go-mdrefactor/mdrefactor"
+)
+
+const (
+	// An archived copy is linked after each external link
+	archiveInline = "inline"
+	// An archived copy is linked from a footnote
+	archiveFootnote = "footnote"
+
+	// Wayback Machine API returning the snapshot of a URL closest to a time
+	waybackAvailableURL = "https://archive.org/wayback/available"
+	// Wayback Machine endpoint archiving a URL on request
+	waybackSaveURL = "https://web.archive.org/save/"
+)
+
+var (
+	// A Wayback Machine snapshot URL with its 14-digit timestamp
+	waybackSnapshotRe = regexp.MustCompile(`^https?://web\.archive\.org/web/(\d{14})`)
+	// An inline link followed by its archived copy as written by archiveInline
+	archivedInlineRe = regexp.MustCompile(`(\[[^\]]*\]\(\s*<?(https?://[^)\s>]+)>?(?:\s+["'(][^)]*)?\)) \(\[archived\]\((https?://web\.archive\.org/web/[^)\s]+)\)\)`)
+	// An inline link followed by the reference of its archive footnote
+	archivedFootnoteRefRe = regexp.MustCompile(`(\[[^\]]*\]\(\s*<?(https?://[^)\s>]+)>?(?:\s+["'(][^)]*)?\))\[\^archived-(\d+)\]`)
+	// The reference of an archive footnote
+	archivedFootnoteLabelRe = regexp.MustCompile(`\[\^archived-(\d+)\]`)
+	// The definition of an archive footnote, with the line break ending it
+	archivedFootnoteDefRe = regexp.MustCompile(`(?m)^\[\^archived-(\d+)\]:[^\n]*?<(https?://web\.archive\.org/web/[^>\s]+)>[^\n]*(?:\n|$)`)
+	// Hosts never archived: the archive itself and placeholder or local addresses
+	archiveSkipHostRe = regexp.MustCompile(`(?i)^(?:(?:[^.]+\.)*archive\.org|localhost|127\.0\.0\.1|\[::1\]|(?:[^.]+\.)*example\.(?:com|org|net))(?::\d+)?$`)
+)
+
+// parseArchiveStyle validates the value of -archive-links
+func parseArchiveStyle(s string) (string, error) {
+	switch s {
+	case "", archiveInline, archiveFootnote:
+		return s, nil
+	}
+	return "", fmt.Errorf("invalid link archive style %q, expected inline or footnote", s)
+}
+
+// linkArchiver finds Wayback Machine snapshots of external links and adds
+// them to documents. It is safe for concurrent use by the workers of a -dir
+// run; every URL is looked up once.
+type linkArchiver struct {
+	style string
+	save  bool // Ask the Wayback Machine to archive URLs it has no snapshot of
+
+	mu        sync.Mutex
+	snapshots map[string]string // By URL, empty if there is none
+}
+
+// newLinkArchiver returns an archiver writing snapshots in style
+func newLinkArchiver(style string, save bool) *linkArchiver {
+	return &linkArchiver{style: style, save: save, snapshots: make(map[string]string)}
+}
+
+// archivable reports whether target is an external web link worth archiving
+func archivable(target string) bool {
+	u, err := url.Parse(target)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" && !archiveSkipHostRe.MatchString(u.Host)
+}
+
+// lookupSnapshot returns the snapshot of target closest to now, or "" if the
+// Wayback Machine has none
+func lookupSnapshot(target string) (string, error) {
+	query := url.Values{"url": {target}, "timestamp": {time.Now().UTC().Format("20060102")}}
+	resp, err := httpClient.Get(waybackAvailableURL + "?" + query.Encode())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Wayback Machine returned HTTP %d", resp.StatusCode)
+	}
+	var result struct {
+		ArchivedSnapshots struct {
+			Closest struct {
+				Available bool   `json:"available"`
+				URL       string `json:"url"`
+				Status    string `json:"status"`
+			} `json:"closest"`
+		} `json:"archived_snapshots"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("failed to parse Wayback Machine response: %w", err)
+	}
+	closest := result.ArchivedSnapshots.Closest
+	// A snapshot of an error page does not preserve anything
+	if !closest.Available || !strings.HasPrefix(closest.Status, "2") {
+		return "", nil
+	}
+	return strings.Replace(closest.URL, "http://", "https://", 1), nil
+}
+
+// saveSnapshot asks the Wayback Machine to archive target and returns the
+// new snapshot
+func saveSnapshot(target string) (string, error) {
+	resp, err := httpClient.Get(waybackSaveURL + target)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Wayback Machine could not archive the page: HTTP %d", resp.StatusCode)
+	}
+	// The request is redirected to the snapshot
+	if snapshot := resp.Request.URL.String(); waybackSnapshotRe.MatchString(snapshot) {
+		return snapshot, nil
+	}
+	if location := resp.Header.Get("Content-Location"); strings.HasPrefix(location, "/web/") {
+		return "https://web.archive.org" + location, nil
+	}
+	return "", fmt.Errorf("Wayback Machine did not return a snapshot")
+}
+
+// snapshot returns the snapshot of target, looking it up (and with save,
+// creating it) on first use
+func (a *linkArchiver) snapshot(target string) (string, error) {
+	a.mu.Lock()
+	snapshot, ok := a.snapshots[target]
+	a.mu.Unlock()
+	if ok {
+		return snapshot, nil
+	}
+
+	snapshot, err := lookupSnapshot(target)
+	if err == nil && snapshot == "" && a.save {
+		snapshot, err = saveSnapshot(target)
+	}
+	if err != nil {
+		return "", err
+	}
+	a.mu.Lock()
+	a.snapshots[target] = snapshot
+	a.mu.Unlock()
+	return snapshot, nil
+}
+
+// stripArchives removes the archived copies added by annotate from content,
+// returning the content and the snapshots by URL
+func stripArchives(content string) (string, map[string]string) {
+	known := make(map[string]string)
+	byLabel := make(map[string]string)
+	for _, m := range archivedFootnoteDefRe.FindAllStringSubmatch(content, -1) {
+		byLabel[m[1]] = m[2]
+	}
+	if len(byLabel) > 0 {
+		content = strings.TrimRight(archivedFootnoteDefRe.ReplaceAllString(content, ""), "\n") + "\n"
+	}
+	content = archivedFootnoteRefRe.ReplaceAllStringFunc(content, func(match string) string {
+		m := archivedFootnoteRefRe.FindStringSubmatch(match)
+		if byLabel[m[3]] != "" {
+			known[m[2]] = byLabel[m[3]]
+		}
+		return m[1]
+	})
+	content = archivedInlineRe.ReplaceAllStringFunc(content, func(match string) string {
+		m := archivedInlineRe.FindStringSubmatch(match)
+		known[m[2]] = m[3]
+		return m[1]
+	})
+	return content, known
+}
+
+// snapshotDate returns the date of a snapshot as YYYY-MM-DD
+func snapshotDate(snapshot string) string {
+	m := waybackSnapshotRe.FindStringSubmatch(snapshot)
+	if m == nil {
+		return ""
+	}
+	t, err := time.Parse("20060102150405", m[1])
+	if err != nil {
+		return ""
+	}
+	return t.Format("2006-01-02")
+}
+
+// annotate adds the archived copy of every external link of content without
+// one, using the snapshots of known first. It returns the new content, the
+// number of links archived and the links without a snapshot or whose lookup
+// failed.
+func (a *linkArchiver) annotate(content string, known map[string]string) (string, int, []string) {
+	frontMatter, body := mdrefactor.SplitFrontMatter(content)
+	next := 1
+	for _, m := range archivedFootnoteLabelRe.FindAllStringSubmatch(body, -1) {
+		if n, _ := strconv.Atoi(m[1]); n >= next {
+			next = n + 1
+		}
+	}
+
+	archived := 0
+	var missing, footnotes []string
+	lines := strings.Split(body, "\n")
+	code := codeLines(body)
+	for i, line := range lines {
+		if code[i] {
+			continue
+		}
+		lines[i] = mapOutside(line, inlineCodeRe, func(text string) string {
+			var b strings.Builder
+			last := 0
+			for _, m := range inlineLinkRe.FindAllStringSubmatchIndex(text, -1) {
+				target, end := text[m[6]:m[7]], m[1]
+				rest := text[end:]
+				b.WriteString(text[last:end])
+				last = end
+				if text[m[2]:m[3]] == "!" || !archivable(target) || strings.HasPrefix(rest, " ([archived](") || strings.HasPrefix(rest, "[^archived-") {
+					continue
+				}
+				snapshot := known[target]
+				if snapshot == "" {
+					var err error
+					if snapshot, err = a.snapshot(target); err != nil {
+						missing = append(missing, fmt.Sprintf("%s: %v", target, err))
+						continue
+					}
+				}
+				if snapshot == "" {
+					missing = append(missing, target+": no snapshot")
+					continue
+				}
+				archived++
+				if a.style == archiveFootnote {
+					fmt.Fprintf(&b, "[^archived-%d]", next)
+					footnotes = append(footnotes, fmt.Sprintf("[^archived-%d]: Archived copy of %s from %s: <%s>", next, target, snapshotDate(snapshot), snapshot))
+					next++
+				} else {
+					fmt.Fprintf(&b, " ([archived](%s))", snapshot)
+				}
+			}
+			b.WriteString(text[last:])
+			return b.String()
+		})
+	}
+
+	body = strings.Join(lines, "\n")
+	if len(footnotes) > 0 {
+		body = strings.TrimRight(body, "\n") + "\n\n" + strings.Join(footnotes, "\n") + "\n"
+	}
+	return frontMatter + body, archived, missing
+}
+
+// withLinkArchive wraps refactor so that the external links of the output
+// link to archived copies. Copies the input already links are removed before
+// the model sees it and restored afterwards, so they survive rewording and
+// are not looked up again.
+func withLinkArchive(a *linkArchiver, refactor refactorFunc) refactorFunc {
+	return func(systemPrompt, content string) (string, error) {
+		content, known := stripArchives(content)
+		refactored, err := refactor(systemPrompt, content)
+		if err != nil {
+			return "", err
+		}
+		refactored, _ = stripArchives(refactored)
+		refactored, _, missing := a.annotate(refactored, known)
+		for _, m := range missing {
+			fmt.Fprintf(os.Stderr, "Warning: link not archived: %s\n", m)
+		}
+		return refactored, nil
+	}
+}
+
+// runArchiveCommand implements the archive subcommand
+func runArchiveCommand(args []string) error {
+	fs := flag.NewFlagSet("archive", flag.ExitOnError)
+	style := fs.String("style", archiveInline, "How archived copies are linked: inline after each link, or footnote")
+	save := fs.Bool("save", false, "Ask the Wayback Machine to archive pages it has no snapshot of (slow, rate-limited)")
+	dryRun := fs.Bool("dry-run", false, "Only report the links that would be archived")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: mdrefactor archive [flags] <file-or-dir>...")
+		fmt.Fprintln(fs.Output(), "Links the external links of documents to their Wayback Machine snapshots, protecting them against link rot.")
+		fs.PrintDefaults()
+	}
+	positional := parseArgs(fs, args)
+	if len(positional) == 0 {
+		fs.Usage()
+		return fmt.Errorf("at least one file or directory is required")
+	}
+	if *style != archiveInline && *style != archiveFootnote {
+		return fmt.Errorf("invalid style %q, expected inline or footnote", *style)
+	}
+	files, err := expandMarkdownArgs(positional)
+	if err != nil {
+		return err
+	}
+
+	archiver := newLinkArchiver(*style, *save)
+	total, unarchived := 0, 0
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", file, err)
+		}
+		source := decodeSource(data)
+		// Stripping first switches documents archived in the other style
+		stripped, known := stripArchives(source.text)
+		updated, archived, missing := archiver.annotate(stripped, known)
+		for _, m := range missing {
+			fmt.Printf("%s: not archived: %s\n", file, m)
+		}
+		unarchived += len(missing)
+		if updated == source.text {
+			continue
+		}
+		if *dryRun {
+			fmt.Printf("%s: %d links would be archived\n", file, archived)
+			continue
+		}
+		out, err := source.encode(updated, outputPolicy{eol: "preserve", encoding: "preserve"})
+		if err != nil {
+			return fmt.Errorf("failed to encode %s: %w", file, err)
+		}
+		if err := writeFileAtomic(file, out, 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %w", file, err)
+		}
+		fmt.Printf("%s: %d links archived\n", file, archived)
+		total += archived
+	}
+	fmt.Printf("Archived %d links, %d without a snapshot (%d files checked).\n", total, unarchived, len(files))
+	return nil
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jackmbuda/go-mdrefactor/mdrefactor"
+)
+
+// System prompt used to answer questions from documentation excerpts
+const askSystemPrompt = "You answer questions about a project using only the numbered documentation excerpts provided. " +
+	"Cite every statement with the numbers of the excerpts it comes from, such as [1] or [2][3]. Do not use outside " +
+	"knowledge: if the excerpts do not answer the question, or only answer it in part, say so by setting answered to " +
+	"false and explain in the answer what is missing."
+
+// System prompt used to draft a section covering a question the docs do not answer
+const proposeSystemPrompt = "You are a technical writer filling a gap in a project's documentation. Draft one new section " +
+	"for the given document that answers the question. Use only facts stated in the document and the related excerpts; " +
+	"where the answer needs details they do not give, write a TODO placeholder for the maintainer instead of inventing " +
+	"them. Match the document's tone, terminology and heading levels. Reply with the section only, starting with its heading."
+
+// askResponseFormat makes the API return the answer and its sources as JSON
+var askResponseFormat = map[string]any{
+	"type": "json_schema",
+	"json_schema": map[string]any{
+		"name":   "docs_answer",
+		"strict": true,
+		"schema": map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"answered":  map[string]any{"type": "boolean", "description": "Whether the excerpts fully answer the question"},
+				"answer":    map[string]any{"type": "string", "description": "Markdown answer with [n] citations, or what the excerpts lack"},
+				"citations": map[string]any{"type": "array", "items": map[string]any{"type": "integer"}, "description": "Numbers of the excerpts the answer relies on"},
+			},
+			"required":             []string{"answered", "answer", "citations"},
+			"additionalProperties": false,
+		},
+	},
+}
+
+// docsAnswer is the answer to a question about a docs tree
+type docsAnswer struct {
+	Answered  bool   `json:"answered"`
+	Answer    string `json:"answer"`
+	Citations []int  `json:"citations"`
+
+	sources []searchHit // The excerpts given to the model, cited by their 1-based number
+}
+
+// hitText returns the full text of the section a search hit points at
+func hitText(dir string, hit searchHit) (string, error) {
+	data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(hit.File)))
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", hit.File, err)
+	}
+	frontMatter, body := mdrefactor.SplitFrontMatter(decodeSource(data).text)
+	offset := strings.Count(frontMatter, "\n")
+	for _, s := range splitSections(body) {
+		if offset+s.StartLine+1 == hit.Line {
+			return s.Text, nil
+		}
+	}
+	return hit.Excerpt, nil
+}
+
+// askDocs answers question from the sections of the docs tree in dir most relevant to it
+func askDocs(apiKey, model string, embedder embeddingProvider, dir, indexFile, question string, k int, minSimilarity float64) (*docsAnswer, error) {
+	hits, err := searchDocs(embedder, dir, indexFile, question, k, minSimilarity)
+	if err != nil {
+		return nil, err
+	}
+	if len(hits) == 0 {
+		return &docsAnswer{Answer: "No section of the docs is related to the question."}, nil
+	}
+
+	var excerpts strings.Builder
+	for i, hit := range hits {
+		text, err := hitText(dir, hit)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&excerpts, "[%d] %s (%s)\n%s\n\n", i+1, hit.location(), hit.Title, strings.TrimSpace(text))
+	}
+
+	reply, err := chatCompletionParams(context.Background(), apiKey, model, []Message{
+		{Role: "system", Content: askSystemPrompt},
+		{Role: "user", Content: "Question: " + question + "\n\nDocumentation excerpts:\n\n" + excerpts.String()},
+	}, completionParams{responseFormat: askResponseFormat})
+	if err != nil {
+		return nil, err
+	}
+	answer := &docsAnswer{sources: hits}
+	if err := decodeJSONReply(reply, answer); err != nil {
+		return nil, err
+	}
+	return answer, nil
+}
+
+// proposeSection drafts a section answering question for the document file
+// below dir, based on the excerpts the question was asked against, and
+// returns the document with the section appended, marked as a proposal
+func proposeSection(apiKey, model, dir, file, question string, answer *docsAnswer) (string, string, error) {
+	var original string
+	if data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(file))); err == nil {
+		original = decodeSource(data).text
+	} else if !os.IsNotExist(err) {
+		return "", "", fmt.Errorf("failed to read %s: %w", file, err)
+	}
+
+	var excerpts strings.Builder
+	for i, hit := range answer.sources {
+		fmt.Fprintf(&excerpts, "[%d] %s (%s)\n%s\n\n", i+1, hit.location(), hit.name(), hit.Excerpt)
+	}
+	draft, err := chatCompletion(apiKey, model, []Message{
+		{Role: "system", Content: proposeSystemPrompt},
+		{Role: "user", Content: fmt.Sprintf("Question the docs do not answer: %s\n\nWhat the docs lack: %s\n\nRelated excerpts:\n\n%s"+
+			"Document %s:\n\n%s", question, answer.Answer, excerpts.String(), file, original)},
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	marker := fmt.Sprintf("<!-- Proposal drafted by mdrefactor ask for the unanswered question %q. "+
+		"Verify every statement, fill in the TODOs and remove this comment before publishing. -->", question)
+	proposed := strings.TrimSpace(draft)
+	if original = strings.TrimRight(original, "\n"); original != "" {
+		proposed = original + "\n\n" + marker + "\n" + proposed + "\n"
+	} else {
+		proposed = marker + "\n" + proposed + "\n"
+	}
+	if original != "" {
+		original += "\n"
+	}
+	return original, proposed, nil
+}
+
+// cited returns the numbers of the sources the answer cites, without
+// duplicates and numbers out of range
+func (a *docsAnswer) cited() []int {
+	var numbers []int
+	seen := make(map[int]bool)
+	for _, n := range a.Citations {
+		if n >= 1 && n <= len(a.sources) && !seen[n] {
+			seen[n] = true
+			numbers = append(numbers, n)
+		}
+	}
+	return numbers
+}
+
+// runAskCommand implements the ask subcommand
+func runAskCommand(args []string) error {
+	fs := flag.NewFlagSet("ask", flag.ExitOnError)
+	apiKey := fs.String("apikey", os.Getenv("OPENAI_API_KEY"), "OpenAI API key (can also be set via OPENAI_API_KEY environment variable)")
+	addAPIFlags(fs)
+	model := fs.String("model", defaultModel, "OpenAI model to use (must support structured outputs)")
+	embedding := addEmbeddingFlags(fs)
+	k := fs.Int("k", 6, "Number of sections retrieved to answer from")
+	minSimilarity := fs.Float64("min-similarity", 0.2, "Minimum cosine similarity (0-1) for a section to be retrieved")
+	indexFile := fs.String("index", "", "Path of the embedding index (defaults to <docs-dir>/"+defaultIndexFile+")")
+	propose := fs.Bool("propose", false, "If the docs do not answer the question, draft a section covering it and add it to the review queue")
+	proposeFile := fs.String("propose-file", "", "With -propose, the document (relative to the docs directory) the section is proposed for, defaults to the one of the most relevant section")
+	reviewDir := fs.String("review-dir", defaultReviewDir, "With -propose, the directory of the review queue")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: mdrefactor ask [flags] <question> <docs-dir>")
+		fmt.Fprintln(fs.Output(), "Answers a question from the most relevant sections of the docs tree, citing them, or reports that the docs do not cover it.")
+		fs.PrintDefaults()
+	}
+	positional := parseArgs(fs, args)
+	if len(positional) != 2 {
+		fs.Usage()
+		return fmt.Errorf("a question and a docs directory are required")
+	}
+	question, dir := positional[0], positional[1]
+
+	embedder, err := embedding.open(*apiKey)
+	if err != nil {
+		return err
+	}
+	answer, err := askDocs(*apiKey, *model, embedder, dir, *indexFile, question, *k, *minSimilarity)
+	if err != nil {
+		return err
+	}
+
+	if !answer.Answered {
+		fmt.Println("The docs do not answer this question.")
+	}
+	fmt.Println(strings.TrimSpace(answer.Answer))
+	if cited := answer.cited(); len(cited) > 0 {
+		fmt.Println("\nSources:")
+		for _, n := range cited {
+			hit := answer.sources[n-1]
+			fmt.Printf("  [%d] %s:%d  %s\n", n, hit.File, hit.Line, hit.name())
+		}
+	}
+	if answer.Answered || !*propose {
+		return nil
+	}
+
+	file := filepath.ToSlash(*proposeFile)
+	if file == "" {
+		if len(answer.sources) == 0 {
+			return fmt.Errorf("no document is related to the question, use -propose-file to choose one for the proposed section")
+		}
+		file = answer.sources[0].File
+	}
+	fmt.Fprintf(os.Stderr, "Drafting a section for %s...\n", file)
+	original, proposed, err := proposeSection(*apiKey, *model, dir, file, question, answer)
+	if err != nil {
+		return err
+	}
+	target := filepath.Join(dir, filepath.FromSlash(file))
+	entryDir, err := saveForReview(*reviewDir, reviewEntry{
+		Target:   target,
+		Changed:  changedFraction(original, proposed),
+		Problems: []string{fmt.Sprintf("proposed section for the unanswered question %q", question)},
+	}, original, proposed)
+	if err != nil {
+		return fmt.Errorf("failed to queue the proposed section: %w", err)
+	}
+	fmt.Printf("\nProposed a section for %s, see %s and accept it with: mdrefactor review accept %s\n", target, filepath.Join(entryDir, reviewDiffFile), target)
+	return nil
+}
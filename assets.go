@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Images larger than this are reported by -check-images and images
+const defaultMaxImageSize = 1 << 20
+
+// Remote images that are fine to hotlink: status badges change with the
+// state of the project, so a vendored copy would go stale
+var badgeImageRe = regexp.MustCompile(`(?i)^(?:https?:)?//(?:img\.shields\.io|badgen\.net|codecov\.io|goreportcard\.com|pkg\.go\.dev/badge|github\.com/[^?#]+/badge\.svg)`)
+
+var byteSizeRe = regexp.MustCompile(`^(\d+(?:\.\d+)?)\s*([kKMG]i?B|B)?$`)
+
+// byteSize is a number of bytes set from flags like 500KB or 2MiB
+type byteSize int64
+
+// String implements flag.Value
+func (s *byteSize) String() string {
+	if s == nil {
+		return ""
+	}
+	return formatByteSize(int64(*s))
+}
+
+// Set implements flag.Value
+func (s *byteSize) Set(value string) error {
+	m := byteSizeRe.FindStringSubmatch(strings.TrimSpace(value))
+	if m == nil {
+		return fmt.Errorf("invalid size %q, expected bytes or a size such as 500KB or 2MiB", value)
+	}
+	n, _ := strconv.ParseFloat(m[1], 64)
+	units := map[string]float64{"": 1, "B": 1, "kB": 1e3, "KB": 1e3, "MB": 1e6, "GB": 1e9, "KiB": 1 << 10, "kiB": 1 << 10, "MiB": 1 << 20, "GiB": 1 << 30}
+	*s = byteSize(n * units[m[2]])
+	return nil
+}
+
+// formatByteSize returns n as a human-readable size such as 1.5 MiB
+func formatByteSize(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GiB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.0f KiB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}
+
+// isHotlinked reports whether an image is served from a remote host and
+// should be vendored into the repository instead
+func isHotlinked(target string) bool {
+	return isRemoteURL(target) && !badgeImageRe.MatchString(target)
+}
+
+// sameFileContent reports whether two files exist and have the same content
+func sameFileContent(a, b string) bool {
+	dataA, errA := os.ReadFile(a)
+	dataB, errB := os.ReadFile(b)
+	return errA == nil && errB == nil && bytes.Equal(dataA, dataB)
+}
+
+// imageRelocator copies the local images of documents into one assets
+// directory and points the documents at the copies. It is safe for
+// concurrent use by the workers of a -dir run.
+type imageRelocator struct {
+	root   string // Root of the tree, against which root-relative targets resolve
+	assets string // The assets directory
+
+	mu     sync.Mutex
+	copies map[string]string // Path of the copy by path of the original
+	copied int
+}
+
+// newImageRelocator returns a relocator into assets, relative to root unless absolute
+func newImageRelocator(root, assets string) *imageRelocator {
+	if !filepath.IsAbs(assets) {
+		assets = filepath.Join(root, assets)
+	}
+	return &imageRelocator{root: root, assets: filepath.Clean(assets), copies: make(map[string]string)}
+}
+
+// copyOf returns the path of the copy of the image at src in the assets
+// directory, copying it there first. Images with the same name but different
+// content get numbered names, identical ones share a copy.
+func (r *imageRelocator) copyOf(src string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if dst, ok := r.copies[src]; ok {
+		return dst, nil
+	}
+
+	ext := filepath.Ext(src)
+	name := strings.TrimSuffix(filepath.Base(src), ext)
+	dst := ""
+	for i := 1; ; i++ {
+		candidate := filepath.Join(r.assets, name+ext)
+		if i > 1 {
+			candidate = filepath.Join(r.assets, fmt.Sprintf("%s-%d%s", name, i, ext))
+		}
+		if !fileExists(candidate) {
+			dst = candidate
+			break
+		}
+		if sameFileContent(src, candidate) {
+			r.copies[src] = candidate
+			return candidate, nil
+		}
+	}
+
+	if err := os.MkdirAll(r.assets, 0755); err != nil {
+		return "", fmt.Errorf("failed to create %s: %w", r.assets, err)
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return "", fmt.Errorf("failed to copy %s to %s: %w", src, dst, err)
+	}
+	if err := out.Close(); err != nil {
+		return "", err
+	}
+	r.copies[src] = dst
+	r.copied++
+	return dst, nil
+}
+
+// relocate rewrites the local images of content, a document in docDir, to
+// their copies in the assets directory. Images already in it, remote and
+// missing images are left as they are. Root-relative targets stay
+// root-relative.
+func (r *imageRelocator) relocate(content, docDir string) (string, error) {
+	var firstErr error
+	relocated := rewriteLinks(content, func(target string, image bool) string {
+		if !image || firstErr != nil || target == "" || isRemoteURL(target) || strings.HasPrefix(target, "data:") {
+			return target
+		}
+		src := resolveLocalPath(target, docDir, r.root)
+		if !fileExists(src) {
+			return target
+		}
+		if rel, err := filepath.Rel(r.assets, src); err == nil && !strings.HasPrefix(rel, "..") {
+			return target
+		}
+		dst, err := r.copyOf(src)
+		if err != nil {
+			firstErr = err
+			return target
+		}
+
+		base := docDir
+		if strings.HasPrefix(target, "/") {
+			base = r.root
+		}
+		rel, err := filepath.Rel(base, dst)
+		if err != nil {
+			return target
+		}
+		rel = (&url.URL{Path: filepath.ToSlash(rel)}).EscapedPath()
+		if strings.HasPrefix(target, "/") {
+			return "/" + rel
+		}
+		return rel
+	})
+	if firstErr != nil {
+		return "", firstErr
+	}
+	return relocated, nil
+}
+
+// auditImages reports the images of content, a document in docDir, that are
+// missing, larger than maxSize (unless 0) or hotlinked from remote hosts
+func auditImages(content, docDir, rootDir string, maxSize int64) []string {
+	var problems []string
+	for _, img := range parseImages(content) {
+		switch {
+		case strings.HasPrefix(img.target, "data:"):
+		case isRemoteURL(img.target):
+			if isHotlinked(img.target) {
+				problems = append(problems, fmt.Sprintf("hotlinked image %s: vendor it into the repository", img.target))
+			}
+		default:
+			info, err := os.Stat(resolveLocalPath(img.target, docDir, rootDir))
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("missing image %s: file not found", img.target))
+			} else if maxSize > 0 && info.Size() > maxSize {
+				problems = append(problems, fmt.Sprintf("oversized image %s: %s, over %s", img.target, formatByteSize(info.Size()), formatByteSize(maxSize)))
+			}
+		}
+	}
+	return problems
+}
+
+// runImagesCommand implements the images subcommand
+func runImagesCommand(args []string) error {
+	fs := flag.NewFlagSet("images", flag.ExitOnError)
+	relocate := fs.String("relocate", "", "Copy the local images into this directory, relative to the docs directory (e.g. assets), and point the documents at the copies")
+	maxSize := byteSize(defaultMaxImageSize)
+	fs.Var(&maxSize, "max-size", "Report local images larger than this (e.g. 500KB, 2MiB; 0 disables the check)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: mdrefactor images [flags] <docs-dir>")
+		fmt.Fprintln(fs.Output(), "Reports missing, oversized and hotlinked images of a docs tree. No API calls are made.")
+		fs.PrintDefaults()
+	}
+	positional := parseArgs(fs, args)
+	if len(positional) != 1 {
+		fs.Usage()
+		return fmt.Errorf("a docs directory is required")
+	}
+	root := positional[0]
+	files, err := findMarkdownFiles(root)
+	if err != nil {
+		return err
+	}
+
+	var relocator *imageRelocator
+	if *relocate != "" {
+		relocator = newImageRelocator(root, *relocate)
+	}
+	problems, rewritten := 0, 0
+	for _, file := range files {
+		path := filepath.Join(root, file)
+		docDir := filepath.Dir(path)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		source := decodeSource(data)
+		content := source.text
+
+		if relocator != nil {
+			if content, err = relocator.relocate(content, docDir); err != nil {
+				return err
+			}
+			if content != source.text {
+				out, err := source.encode(content, outputPolicy{eol: "preserve", encoding: "preserve"})
+				if err != nil {
+					return fmt.Errorf("failed to encode %s: %w", path, err)
+				}
+				if err := writeFileAtomic(path, out, 0644); err != nil {
+					return fmt.Errorf("failed to write %s: %w", path, err)
+				}
+				rewritten++
+			}
+		}
+
+		for _, p := range auditImages(content, docDir, root, int64(maxSize)) {
+			fmt.Printf("%s: %s\n", path, p)
+			problems++
+		}
+	}
+
+	if relocator != nil {
+		fmt.Printf("Copied %d images to %s and updated %d documents; the originals are kept.\n", relocator.copied, relocator.assets, rewritten)
+	}
+	if problems > 0 {
+		return fmt.Errorf("%d image problems found (%d files checked)", problems, len(files))
+	}
+	fmt.Printf("No image problems found (%d files checked).\n", len(files))
+	return nil
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// batchResult is the outcome of refactoring one file of a batch run
+type batchResult struct {
+	path       string // Path relative to the batch directory
+	target     string // Path the refactored content is written to
+	original   string
+	refactored string
+	changed    bool // Whether the file on disk was modified
+	err        error
+}
+
+// isMarkdownFile reports whether path has a Markdown file extension
+func isMarkdownFile(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".md", ".markdown":
+		return true
+	}
+	return false
+}
+
+// findMarkdownFiles returns the paths of all Markdown files below dir,
+// relative to dir and sorted, skipping hidden directories
+func findMarkdownFiles(dir string) ([]string, error) {
+	var files []string
+	root := fsPath(dir)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != root && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if isMarkdownFile(path) {
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			files = append(files, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to walk directory %s: %w", dir, err)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// readFileList reads a list of paths separated by NULs, if the list contains
+// any, or by newlines otherwise, as printed by find -print0 or git diff --name-only
+func readFileList(r io.Reader) ([]string, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	sep := "\n"
+	if bytes.IndexByte(data, 0) >= 0 {
+		sep = "\x00"
+	}
+	var paths []string
+	for _, p := range strings.Split(string(data), sep) {
+		if p = strings.TrimRight(p, "\r"); strings.TrimSpace(p) != "" {
+			paths = append(paths, p)
+		}
+	}
+	return paths, nil
+}
+
+// batchFiles returns the files of a batch run relative to dir: the Markdown
+// files named in the list read from filesFrom ("-" for stdin) or, if no list
+// is given, every Markdown file below dir
+func batchFiles(dir, filesFrom string) ([]string, error) {
+	if filesFrom == "" {
+		files, err := findMarkdownFiles(dir)
+		if err != nil {
+			return nil, err
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("no Markdown files found in %s", dir)
+		}
+		return files, nil
+	}
+
+	var r io.Reader = os.Stdin
+	if filesFrom != "-" {
+		f, err := os.Open(filesFrom)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open file list: %w", err)
+		}
+		defer f.Close()
+		r = f
+	}
+	paths, err := readFileList(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file list: %w", err)
+	}
+
+	var files []string
+	seen := make(map[string]bool)
+	for _, p := range paths {
+		// Lists often come from git and include files of every kind
+		if !isMarkdownFile(p) {
+			continue
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return nil, fmt.Errorf("%s is not inside %s", p, dir)
+		}
+		if !seen[rel] {
+			seen[rel] = true
+			files = append(files, rel)
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no Markdown files in the file list")
+	}
+	return files, nil
+}
+
+// runBatch refactors the given Markdown files below dir, using the system
+// prompt returned by promptFor for each file and passing the result and the
+// original content through finish before it is written to the path returned
+// by targetFor (the file itself for in-place runs) in the line endings and
+// encoding chosen by the output policy. Failures are reported
+// and recorded in the results, but do not stop the batch unless the circuit
+// breaker trips, in which case the remaining files are recorded as failed
+// without calling the API. Past the batchDeadline, the remaining files, and
+// the one whose API requests the deadline cut off, are recorded as left for
+// the next run.
+func runBatch(dir string, files []string, refactor refactorFunc, promptFor func(rel string) string, finish func(rel, original, content string) (string, error), targetFor func(rel string) string, policy outputPolicy) []batchResult {
+	results := make([]batchResult, 0, len(files))
+	var stopped error
+	for i, rel := range files {
+		path := filepath.Join(dir, rel)
+		fmt.Printf("[%d/%d] %s\n", i+1, len(files), path)
+		result := batchResult{path: rel, target: targetFor(rel)}
+
+		content, err := os.ReadFile(fsPath(path))
+		if err != nil {
+			result.err = fmt.Errorf("failed to read %s: %w", path, err)
+			fmt.Fprintf(os.Stderr, "Error: %v\n", result.err)
+			results = append(results, result)
+			continue
+		}
+		source := decodeSource(content)
+		result.original = source.text
+		if stopped == nil && pastDeadline() {
+			stopped = errDeadlineReached
+		}
+		if stopped != nil {
+			result.err = stopped
+			results = append(results, result)
+			continue
+		}
+
+		refactored, err := refactorByDeadline(refactor, promptFor(rel), result.original)
+		if err != nil && pastDeadline() {
+			// Cut off by the deadline, the file is left for the next run
+			fmt.Printf("Deadline reached while refactoring %s\n", path)
+			stopped, result.err = errDeadlineReached, errDeadlineReached
+			results = append(results, result)
+			continue
+		}
+		if err != nil {
+			result.err = fmt.Errorf("failed to refactor %s: %w", path, err)
+			if !errors.Is(err, errQueuedInBatch) {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", result.err)
+			}
+			results = append(results, result)
+			if errors.Is(err, ErrCircuitOpen) {
+				stopped = err
+				fmt.Fprintf(os.Stderr, "Skipping the remaining %d files\n", len(files)-i-1)
+			}
+			continue
+		}
+		if refactored, err = finish(rel, result.original, refactored); err != nil {
+			result.err = err
+			if !errors.Is(err, errHeldForReview) {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", result.err)
+			}
+			results = append(results, result)
+			continue
+		}
+
+		data, err := source.encode(refactored, policy)
+		if err != nil {
+			result.err = fmt.Errorf("failed to encode %s: %w", path, err)
+			fmt.Fprintf(os.Stderr, "Error: %v\n", result.err)
+			results = append(results, result)
+			continue
+		}
+		existing := content
+		if result.target != path {
+			existing, _ = os.ReadFile(fsPath(result.target))
+		}
+		if bytes.Equal(data, existing) {
+			// Leave files the model did not change untouched
+			result.refactored = refactored
+			results = append(results, result)
+			continue
+		}
+		if result.target != path {
+			err = os.MkdirAll(fsPath(filepath.Dir(result.target)), 0755)
+		}
+		if err == nil {
+			err = writeFileAtomic(result.target, data, 0644)
+		}
+		if err != nil {
+			result.err = fmt.Errorf("failed to write %s: %w", result.target, err)
+			fmt.Fprintf(os.Stderr, "Error: %v\n", result.err)
+			results = append(results, result)
+			continue
+		}
+		result.refactored = refactored
+		result.changed = true
+		results = append(results, result)
+	}
+	return results
+}
+
+// finalContent returns the refactored content of a result, or the original
+// content if refactoring the file failed
+func (r batchResult) finalContent() string {
+	if r.err != nil {
+		return r.original
+	}
+	return r.refactored
+}
+
+// countFailures returns the number of results that failed, not counting
+// those held for review or left at the deadline
+func countFailures(results []batchResult) int {
+	failed := 0
+	for _, r := range results {
+		if r.err != nil && !errors.Is(r.err, errHeldForReview) && !errors.Is(r.err, errDeadlineReached) {
+			failed++
+		}
+	}
+	return failed
+}
+
+// printChangedFiles writes the paths of the modified files to w, terminated
+// by NULs if nul is set (for xargs -0) and by newlines otherwise
+func printChangedFiles(w io.Writer, paths []string, nul bool) {
+	term := "\n"
+	if nul {
+		term = "\x00"
+	}
+	for _, p := range paths {
+		fmt.Fprint(w, p+term)
+	}
+}
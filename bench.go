@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Markdown links with an empty target, e.g. [text]()
+var emptyLinkRe = regexp.MustCompile(`\[[^\]]*\]\(\s*\)`)
+
+// applyPrices applies -prices overrides of the form "model=input/output,..." to the model registry
+func applyPrices(s string) error {
+	for _, field := range strings.Split(s, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		model, value, ok := strings.Cut(field, "=")
+		in, out, ok2 := strings.Cut(value, "/")
+		input, err1 := strconv.ParseFloat(strings.TrimSpace(in), 64)
+		output, err2 := strconv.ParseFloat(strings.TrimSpace(out), 64)
+		if !ok || !ok2 || err1 != nil || err2 != nil {
+			return fmt.Errorf("invalid price %q, expected model=input/output in USD per million tokens", field)
+		}
+		registerModels(map[string]modelInfo{strings.TrimSpace(model): {InputPrice: input, OutputPrice: output}})
+	}
+	return nil
+}
+
+// lintMarkdown returns basic well-formedness problems of a document:
+// unclosed code fences, skipped heading levels, several H1s and empty links
+func lintMarkdown(content string) []string {
+	var problems []string
+	fences := 0
+	for _, line := range strings.Split(content, "\n") {
+		if isFenceLine(line) {
+			fences++
+		}
+	}
+	if fences%2 != 0 {
+		problems = append(problems, "unclosed code fence")
+	}
+
+	h1s, prev := 0, 0
+	for _, h := range parseHeadings(content) {
+		if h.level == 1 {
+			h1s++
+		}
+		if prev > 0 && h.level > prev+1 {
+			problems = append(problems, fmt.Sprintf("heading %q skips from level %d to %d", h.text, prev, h.level))
+		}
+		prev = h.level
+	}
+	if h1s > 1 {
+		problems = append(problems, fmt.Sprintf("%d top-level headings", h1s))
+	}
+
+	code := codeLines(content)
+	for i, line := range strings.Split(content, "\n") {
+		if !code[i] && emptyLinkRe.MatchString(inlineCodeRe.ReplaceAllString(line, "")) {
+			problems = append(problems, fmt.Sprintf("empty link target on line %d", i+1))
+		}
+	}
+	return problems
+}
+
+// benchResult aggregates the runs of one model over the corpus
+type benchResult struct {
+	model        string
+	runs, failed int // Documents refactored and API calls that failed
+	lintPass     int // Outputs without lint problems the input did not have
+	invPass      int // Outputs keeping headings, code blocks and tables
+	lengthPass   int // Outputs within the allowed length growth
+	latency      time.Duration
+	cost         float64
+	priced       bool
+	fingerprints []string // Distinct system_fingerprint values of the responses
+}
+
+// passRate returns the share of all post-checks on successful runs that passed
+func (r benchResult) passRate() float64 {
+	ok := r.runs - r.failed
+	if ok == 0 {
+		return 0
+	}
+	return float64(r.lintPass+r.invPass+r.lengthPass) / float64(3*ok)
+}
+
+// percent formats n of the successful runs as a percentage
+func (r benchResult) percent(n int) string {
+	if r.runs == r.failed {
+		return "n/a"
+	}
+	return fmt.Sprintf("%.0f%%", 100*float64(n)/float64(r.runs-r.failed))
+}
+
+// benchModel refactors every document of the corpus with the model and runs the post-checks
+func benchModel(apiKey, model, systemPrompt, corpus string, files []string, growth lengthPolicy) benchResult {
+	r := benchResult{model: model}
+	price, ok := lookupModel(model)
+	r.priced = ok && (price.InputPrice > 0 || price.OutputPrice > 0)
+	inv := structureInvariants{headings: true, code: true, tables: true}
+
+	for _, rel := range files {
+		data, err := os.ReadFile(filepath.Join(corpus, rel))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading %s: %v\n", rel, err)
+			continue
+		}
+		input := decodeSource(data).text
+		r.runs++
+
+		fmt.Printf("Benchmarking %s on %s...\n", model, rel)
+		start := time.Now()
+		resp, err := chatCompletionResponse(context.Background(), apiKey, model, []Message{
+			{Role: "system", Content: systemPrompt},
+			{Role: "user", Content: fmt.Sprintf("Refactor the following Markdown content:\n\n%s", input)},
+		}, completionParams{})
+		elapsed := time.Since(start)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error benchmarking %s on %s: %v\n", model, rel, err)
+			r.failed++
+			continue
+		}
+		r.latency += elapsed
+		if fp := resp.SystemFingerprint; fp != "" && !slices.Contains(r.fingerprints, fp) {
+			r.fingerprints = append(r.fingerprints, fp)
+		}
+		r.cost += (float64(resp.Usage.PromptTokens)*price.InputPrice + float64(resp.Usage.CompletionTokens)*price.OutputPrice) / 1e6
+
+		output := resp.Choices[0].Message.Content
+		if len(lintMarkdown(output)) <= len(lintMarkdown(input)) {
+			r.lintPass++
+		}
+		if len(inv.violations(input, output)) == 0 {
+			r.invPass++
+		}
+		if _, max := growth.bounds(countWords(input)); countWords(output) <= max {
+			r.lengthPass++
+		}
+	}
+	return r
+}
+
+// printBenchTable prints the results ranked by pass rate, then cost, then latency
+func printBenchTable(results []benchResult) {
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if a.passRate() != b.passRate() {
+			return a.passRate() > b.passRate()
+		}
+		if a.cost != b.cost {
+			return a.cost < b.cost
+		}
+		return a.latency < b.latency
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "RANK\tMODEL\tPASS\tLINT\tINVARIANTS\tLENGTH\tAVG LATENCY\tCOST\tFAILED\tFINGERPRINT")
+	for i, r := range results {
+		latency, cost := "n/a", "n/a"
+		if ok := r.runs - r.failed; ok > 0 {
+			latency = (r.latency / time.Duration(ok)).Round(time.Millisecond).String()
+		}
+		if r.priced {
+			cost = fmt.Sprintf("$%.4f", r.cost)
+		}
+		fingerprint := "n/a"
+		if len(r.fingerprints) > 0 {
+			fingerprint = strings.Join(r.fingerprints, ",")
+		}
+		fmt.Fprintf(w, "%d\t%s\t%.0f%%\t%s\t%s\t%s\t%s\t%s\t%d/%d\t%s\n", i+1, r.model, 100*r.passRate(),
+			r.percent(r.lintPass), r.percent(r.invPass), r.percent(r.lengthPass), latency, cost, r.failed, r.runs, fingerprint)
+	}
+	w.Flush()
+}
+
+// runBenchCommand implements the bench subcommand
+func runBenchCommand(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	apiKey := fs.String("apikey", os.Getenv("OPENAI_API_KEY"), "OpenAI API key (can also be set via OPENAI_API_KEY environment variable)")
+	addAPIFlags(fs)
+	corpus := fs.String("corpus", "", "Directory of sample Markdown documents to refactor (required)")
+	models := fs.String("models", defaultModel, "Comma-separated list of models to benchmark")
+	systemPrompt := fs.String("prompt", defaultSystemPrompt, "System prompt to guide the AI refactoring")
+	maxGrowth := fs.String("max-growth", "20%", "Maximum length growth an output may have to pass the length check")
+	prices := fs.String("prices", "", "Model prices overriding the built-in and configured ones, as model=input/output in USD per million tokens, comma-separated")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: mdrefactor bench -corpus <dir> [flags]")
+		fmt.Fprintln(fs.Output(), "Measures latency, cost and post-check pass rates (lint, structure invariants, length growth) per model and prints a ranked table.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *corpus == "" {
+		fs.Usage()
+		return fmt.Errorf("a sample corpus directory is required")
+	}
+
+	growth, err := newLengthPolicy(*maxGrowth, "")
+	if err != nil {
+		return err
+	}
+	if err := applyPrices(*prices); err != nil {
+		return err
+	}
+	files, err := findMarkdownFiles(*corpus)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no Markdown files found in %s", *corpus)
+	}
+
+	var results []benchResult
+	for _, model := range strings.Split(*models, ",") {
+		if model = strings.TrimSpace(model); model != "" {
+			results = append(results, benchModel(*apiKey, model, *systemPrompt, *corpus, files, growth))
+		}
+	}
+	fmt.Println()
+	printBenchTable(results)
+	return nil
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// Number of times a single API request is retried after a provider failure
+	maxRequestRetries = 2
+	// Default number of retries allowed across a whole run
+	defaultRetryBudget = 20
+	// Default number of consecutive failed API requests that trip the circuit breaker
+	defaultBreakerThreshold = 5
+	// Upper bound for the delay requested by a Retry-After header
+	maxRetryDelay = time.Minute
+)
+
+// ErrCircuitOpen is returned for API requests that are refused because the
+// circuit breaker tripped and is set to abort
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// circuitBreaker tracks provider failures (network errors, 429 and 5xx
+// responses) across a run. Once threshold consecutive requests have failed it
+// trips and either pauses before letting the next request through or refuses
+// all further requests.
+type circuitBreaker struct {
+	mu          sync.Mutex
+	threshold   int           // Consecutive failures that trip the breaker, 0 disables it
+	pause       time.Duration // How long to pause once tripped, 0 aborts instead
+	retryBudget int           // Retries allowed in one run
+	retries     *retryBudget  // Retries left for the rest of the run, nil until the first is needed
+	failures    int           // Consecutive failed requests
+	trippedAt   time.Time
+	probing     bool          // Whether the one request let through after the pause is in flight
+	settled     chan struct{} // Closed when the request probing the provider settles
+}
+
+// retryBudget counts the retries left to a run
+type retryBudget struct {
+	mu   sync.Mutex
+	left int
+}
+
+// take reports whether the budget allows another retry and uses it up
+func (r *retryBudget) take() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.left <= 0 {
+		return false
+	}
+	r.left--
+	return true
+}
+
+// Key of the retry budget of a context
+type retryBudgetKey struct{}
+
+// withRetryBudget returns ctx with a retry budget of its own, so that
+// requests of one run, such as an RPC request, cannot use up the retries of
+// the others
+func withRetryBudget(ctx context.Context) context.Context {
+	return context.WithValue(ctx, retryBudgetKey{}, &retryBudget{left: breaker.retryBudget})
+}
+
+// Shared by every API call of the run
+var breaker = &circuitBreaker{threshold: defaultBreakerThreshold, retryBudget: defaultRetryBudget}
+
+// addBreakerFlags registers the circuit breaker and retry budget flags
+func addBreakerFlags(fs *flag.FlagSet) {
+	fs.IntVar(&breaker.threshold, "max-failures", defaultBreakerThreshold, "Consecutive failed API requests after which the circuit breaker trips (0 disables it)")
+	fs.DurationVar(&breaker.pause, "breaker-pause", 0, "How long to pause once the circuit breaker trips before trying again (0 aborts instead)")
+	fs.IntVar(&breaker.retryBudget, "retry-budget", defaultRetryBudget, "Total number of retries of failed API requests allowed in one run")
+}
+
+// allow returns an error if the breaker is open and set to abort. If it is
+// set to pause, allow waits out the pause, unless ctx ends first, and then
+// lets a single request through to probe the provider, reporting it as the
+// probe; the others wait for it to settle. The lock is not held while
+// waiting.
+func (b *circuitBreaker) allow(ctx context.Context) (probe bool, err error) {
+	for {
+		b.mu.Lock()
+		if b.threshold <= 0 || b.failures < b.threshold {
+			b.mu.Unlock()
+			return false, nil
+		}
+		if b.pause <= 0 {
+			failures := b.failures
+			b.mu.Unlock()
+			return false, fmt.Errorf("%w: %d consecutive API requests failed, the provider appears to be down; giving up (use -breaker-pause to wait instead)", ErrCircuitOpen, failures)
+		}
+		wait := b.pause - time.Since(b.trippedAt)
+		if wait <= 0 && !b.probing {
+			b.probing = true
+			b.settled = make(chan struct{})
+			b.mu.Unlock()
+			return true, nil
+		}
+		failures, settled := b.failures, b.settled
+		b.mu.Unlock()
+
+		if wait > 0 {
+			fmt.Fprintf(os.Stderr, "Circuit breaker open after %d consecutive failures, pausing for %s...\n", failures, wait.Round(time.Second))
+			if err := sleepContext(ctx, wait); err != nil {
+				return false, err
+			}
+			continue
+		}
+		select {
+		case <-settled:
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+}
+
+// success records a request that reached the provider
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.settleProbe()
+}
+
+// failure records a request that failed after all its retries
+func (b *circuitBreaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.threshold > 0 && b.failures >= b.threshold {
+		b.trippedAt = time.Now()
+	}
+	b.settleProbe()
+}
+
+// endProbe lets the next waiting request probe the provider if the probe
+// ended without reaching a verdict, e.g. because it was cancelled
+func (b *circuitBreaker) endProbe() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.settleProbe()
+}
+
+// settleProbe wakes the requests waiting for the probe; b.mu must be held
+func (b *circuitBreaker) settleProbe() {
+	if b.probing {
+		b.probing = false
+		close(b.settled)
+	}
+}
+
+// takeRetry reports whether the retry budget of ctx, or else of the run,
+// allows another retry and uses it up
+func (b *circuitBreaker) takeRetry(ctx context.Context) bool {
+	if budget, ok := ctx.Value(retryBudgetKey{}).(*retryBudget); ok {
+		return budget.take()
+	}
+	b.mu.Lock()
+	if b.retries == nil {
+		b.retries = &retryBudget{left: b.retryBudget}
+	}
+	budget := b.retries
+	b.mu.Unlock()
+	return budget.take()
+}
+
+// sleepContext waits for d, or returns the error of ctx if it ends first
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// isProviderFailure reports whether a request failed because of the provider
+// rather than the request itself, so retrying it may succeed
+func isProviderFailure(resp *http.Response, err error) bool {
+	return err != nil || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+}
+
+// retryDelay returns how long to wait before the given retry, honouring a
+// Retry-After header in seconds and backing off exponentially otherwise
+func retryDelay(attempt int, resp *http.Response) time.Duration {
+	if resp != nil {
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds >= 0 {
+			return min(time.Duration(seconds)*time.Second, maxRetryDelay)
+		}
+	}
+	return time.Second << attempt
+}
+
+// doAPIRequest sends req, retrying provider failures while the run's retry
+// budget lasts. Requests that still fail count towards tripping the circuit
+// breaker; the last response is returned so its error body can be reported.
+// Requests cancelled or past their deadline return at once, as they are no
+// failure of the provider.
+func doAPIRequest(req *http.Request) (*http.Response, error) {
+	if err := checkEgress(req.URL); err != nil {
+		return nil, err
+	}
+	ctx := req.Context()
+	probe, err := breaker.allow(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if probe {
+		defer breaker.endProbe()
+	}
+	client := httpClient
+	if req.Header.Get("Accept") == "text/event-stream" {
+		client = streamClient
+	}
+	started := time.Now()
+	for attempt := 0; ; attempt++ {
+		resp, err := client.Do(req)
+		if err != nil && ctx.Err() != nil {
+			recordRequest(req, started, attempt+1, resp, err)
+			return nil, fmt.Errorf("failed to send HTTP request: %w", err)
+		}
+		if !isProviderFailure(resp, err) {
+			breaker.success()
+			recordRequest(req, started, attempt+1, resp, nil)
+			return resp, nil
+		}
+		if attempt == maxRequestRetries || !breaker.takeRetry(ctx) {
+			breaker.failure()
+			recordRequest(req, started, attempt+1, resp, err)
+			if err != nil {
+				return nil, fmt.Errorf("failed to send HTTP request: %w", err)
+			}
+			return resp, nil
+		}
+
+		reason := ""
+		if err != nil {
+			reason = err.Error()
+		} else {
+			reason = resp.Status
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		wait := retryDelay(attempt, resp)
+		fmt.Fprintf(os.Stderr, "API request failed (%s), retrying in %s...\n", reason, wait)
+		if err := sleepContext(ctx, wait); err != nil {
+			recordRequest(req, started, attempt+1, nil, err)
+			return nil, fmt.Errorf("failed to send HTTP request: %w", err)
+		}
+
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, fmt.Errorf("failed to rewind HTTP request body: %w", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Default path of the change notes saved by a run with -change-notes
+const defaultChangeNotesFile = ".mdrefactor/change-notes.json"
+
+// Line separating the refactored document from the change notes in the reply
+const changeNotesMarker = "<!-- mdrefactor:changes -->"
+
+// Instruction appended to the system prompt to get the change notes
+const changeNotesInstruction = "After the document, write a line containing only " + changeNotesMarker + " followed by a " +
+	"JSON object {\"changes\": [...]} listing every change you made, such as reorganized, merged, renamed or removed " +
+	"sections. Each change is an object with section (the heading of the section in your output, empty for the part " +
+	"before the first heading), change (what you changed) and reason (why it helps the reader). Use an empty list if " +
+	"you changed nothing."
+
+// changeNote is a change the model says it made to a document, and why
+type changeNote struct {
+	Section string `json:"section"`
+	Change  string `json:"change"`
+	Reason  string `json:"reason"`
+}
+
+func (n changeNote) String() string {
+	section := n.Section
+	if section == "" {
+		section = "Top of the document"
+	}
+	if n.Reason == "" {
+		return fmt.Sprintf("%s: %s", section, n.Change)
+	}
+	return fmt.Sprintf("%s: %s (%s)", section, n.Change, n.Reason)
+}
+
+// changeNotes collects the change notes of the documents of a run. Runs
+// refactor one document at a time, so it is not safe for concurrent use.
+type changeNotes struct {
+	pending []changeNote            // Notes of the model call in progress
+	done    []changeNote            // Notes of the document in progress, over all its chunks
+	files   map[string][]changeNote // Notes by document
+}
+
+// newChangeNotes returns an empty collection
+func newChangeNotes() *changeNotes {
+	return &changeNotes{files: make(map[string][]changeNote)}
+}
+
+// splitChangeNotes splits a reply into the document and the change notes
+// after it. ok is false if the reply has no readable notes.
+func splitChangeNotes(reply string) (string, []changeNote, bool) {
+	i := strings.LastIndex(reply, changeNotesMarker)
+	if i < 0 {
+		return reply, nil, false
+	}
+	content := strings.TrimRight(reply[:i], " \t\n") + "\n"
+	var notes struct {
+		Changes []changeNote `json:"changes"`
+	}
+	if err := decodeJSONReply(reply[i+len(changeNotesMarker):], &notes); err != nil {
+		return content, nil, false
+	}
+	return content, notes.Changes, true
+}
+
+// withChangeNotes wraps the base of the refactoring pipeline to ask the
+// model for notes on its changes and take them out of the reply before any
+// check sees it
+func withChangeNotes(n *changeNotes, refactor refactorFunc) refactorFunc {
+	return func(systemPrompt, content string) (string, error) {
+		reply, err := refactor(systemPrompt+"\n\n"+changeNotesInstruction, content)
+		if err != nil {
+			return "", err
+		}
+		refactored, notes, ok := splitChangeNotes(reply)
+		if !ok {
+			fmt.Fprintln(os.Stderr, "Warning: the model returned no readable change notes")
+		}
+		// A retry after a rejected reply replaces that reply's notes
+		n.pending = notes
+		return refactored, nil
+	}
+}
+
+// collect wraps the whole refactoring pipeline to keep the change notes of
+// the calls that succeed, dropping those of outputs rejected by a check
+func (n *changeNotes) collect(refactor refactorFunc) refactorFunc {
+	return func(systemPrompt, content string) (string, error) {
+		n.pending = nil
+		refactored, err := refactor(systemPrompt, content)
+		if err == nil {
+			n.done = append(n.done, n.pending...)
+		}
+		n.pending = nil
+		return refactored, err
+	}
+}
+
+// record files the notes collected since the last call under file
+func (n *changeNotes) record(file string) {
+	if n == nil {
+		return
+	}
+	if len(n.done) > 0 {
+		n.files[file] = append(n.files[file], n.done...)
+	}
+	n.done = nil
+}
+
+// formatChangeNotes returns the notes as a Markdown list per document
+func formatChangeNotes(files map[string][]changeNote) string {
+	var b strings.Builder
+	for _, file := range sortedKeys(files) {
+		fmt.Fprintf(&b, "%s:\n", file)
+		for _, note := range files[file] {
+			fmt.Fprintf(&b, "  - %s\n", note)
+		}
+	}
+	return b.String()
+}
+
+// printSummary prints the change notes of the run
+func (n *changeNotes) printSummary() {
+	if n == nil || len(n.files) == 0 {
+		return
+	}
+	fmt.Printf("Changes made by the model:\n%s", formatChangeNotes(n.files))
+}
+
+// save writes the change notes of the run to path as JSON, for
+// review-comments and pr-description. The refactored files are written
+// already, so a failure is only a warning.
+func (n *changeNotes) save(path string) {
+	if n == nil || len(n.files) == 0 {
+		return
+	}
+	data, err := json.MarshalIndent(n.files, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+	}
+	if err == nil {
+		err = writeFileAtomic(path, append(data, '\n'), 0644)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to save the change notes to %s: %v\n", path, err)
+		return
+	}
+	fmt.Printf("Change notes written to %s\n", path)
+}
+
+// loadChangeNotes reads the change notes saved by a run, keyed by the
+// documents as they were named in the run. A missing file means no notes.
+func loadChangeNotes(path string) (map[string][]changeNote, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	var files map[string][]changeNote
+	if err := json.Unmarshal(data, &files); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return files, nil
+}
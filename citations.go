@@ -0,0 +1,400 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/jackmbuda/go-mdrefactor/mdrefactor"
+)
+
+const (
+	// Citations in parentheses after the text they support: (Smith, 2020)
+	citationInline = "inline"
+	// Footnote references with definitions at the end: text[^1]
+	citationFootnote = "footnote"
+	// Numbered markers and a references section at the end: text [1]
+	citationReferences = "references"
+)
+
+// citationConfig is the citations section of the config file
+type citationConfig struct {
+	Style   string `json:"style"`   // Style citations are converted to, none if empty
+	Heading string `json:"heading"` // Heading of a references section created by the conversion
+}
+
+// Citation style of the project, set from the citations section of the config file
+var configCitations = citationConfig{Heading: "References"}
+
+// applyCitationConfig applies the citations section of the config file
+func applyCitationConfig(cfg citationConfig) error {
+	if _, err := parseCitationStyle(cfg.Style); err != nil {
+		return fmt.Errorf("citations: %w", err)
+	}
+	if cfg.Heading == "" {
+		cfg.Heading = configCitations.Heading
+	}
+	configCitations = cfg
+	return nil
+}
+
+// parseCitationStyle validates a citation style
+func parseCitationStyle(s string) (string, error) {
+	switch s {
+	case "", citationInline, citationFootnote, citationReferences:
+		return s, nil
+	}
+	return "", fmt.Errorf("invalid citation style %q, expected inline, footnote or references", s)
+}
+
+var (
+	// A footnote definition; archive footnotes (see archive.go) are not citations
+	footnoteDefRe = regexp.MustCompile(`^\[\^([^\]\s]+)\]:\s*(.*)$`)
+	// A footnote reference, a numbered reference marker or an inline citation:
+	// a parenthesized link, optionally after see, cf. or source:, or an author
+	// and year such as (Smith et al., 2020, p. 4)
+	citationMarkerRe = regexp.MustCompile(`\[\^([^\]\s]+)\]|\s?\[(\d{1,3})\]|\s?\(((?:(?i:see|cf\.|source:)\s+)?\[([^\]]+)\]\([^)\s]+\)|\p{Lu}[\p{L}'-]+(?: et al\.| (?:and|&) \p{Lu}[\p{L}'-]+)?,? (?:1[5-9]|20)\d{2}[a-z]?(?:, pp?\. ?\d+(?:[-–]\d+)?)?(?:; [^()]+)?)\)`)
+	// Words leading an inline citation that are dropped in footnotes and references
+	citationPrefixRe = regexp.MustCompile(`(?i)^(?:see|cf\.|source:)\s+`)
+	// Headings of a references section
+	referencesHeadingRe = regexp.MustCompile(`(?i)^(?:references|bibliography|sources|works cited|citations)$`)
+	// An entry of a references section: 1. body, - [1] body or [1] body
+	referenceItemRe = regexp.MustCompile(`^\s*(?:(\d+)[.)]|[-*+])\s+(?:\[(\d+)\]\s*)?(.+)$|^\s*\[(\d+)\]:?\s+(.+)$`)
+)
+
+// citationDoc is a document with its footnote and reference citations parsed
+type citationDoc struct {
+	lines      []string
+	code       []bool
+	footnotes  map[string]string // Citation footnote bodies by label
+	defLines   map[string][2]int // First and last line of each footnote definition
+	labels     map[string]bool   // All footnote labels, archive footnotes included
+	references map[string]string // Reference bodies by number
+	refLines   map[string]int    // Line of each reference
+	// The references section: heading line, end (exclusive) and whether its
+	// entries are written as [1] rather than 1.
+	refStart, refEnd int
+	refBrackets      bool
+}
+
+// parseCitations parses the footnotes and references section of body
+func parseCitations(body string) *citationDoc {
+	d := &citationDoc{
+		lines:     strings.Split(body, "\n"),
+		code:      codeLines(body),
+		footnotes: make(map[string]string), defLines: make(map[string][2]int), labels: make(map[string]bool),
+		references: make(map[string]string), refLines: make(map[string]int),
+		refStart: -1,
+	}
+	for i := 0; i < len(d.lines); i++ {
+		m := footnoteDefRe.FindStringSubmatch(d.lines[i])
+		if d.code[i] || m == nil {
+			continue
+		}
+		d.labels[m[1]] = true
+		if strings.HasPrefix(m[1], "archived-") {
+			continue
+		}
+		// Indented lines continue the definition
+		first, text := i, m[2]
+		for i+1 < len(d.lines) && !d.code[i+1] && strings.TrimSpace(d.lines[i+1]) != "" && (strings.HasPrefix(d.lines[i+1], "    ") || strings.HasPrefix(d.lines[i+1], "\t")) {
+			i++
+			text += " " + strings.TrimSpace(d.lines[i])
+		}
+		d.footnotes[m[1]], d.defLines[m[1]] = strings.TrimSpace(text), [2]int{first, i}
+	}
+
+	headings := parseHeadings(body)
+	for n, h := range headings {
+		if !referencesHeadingRe.MatchString(stripSectionNumber(strings.TrimSpace(h.text))) {
+			continue
+		}
+		end := len(d.lines)
+		for _, next := range headings[n+1:] {
+			if next.level <= h.level {
+				end = next.line
+				break
+			}
+		}
+		// Only a section of nothing but entries is taken over
+		refs, refLines, brackets := make(map[string]string), make(map[string]int), false
+		for i := h.endLine + 1; i < end; i++ {
+			if strings.TrimSpace(d.lines[i]) == "" {
+				continue
+			}
+			m := referenceItemRe.FindStringSubmatch(d.lines[i])
+			if m == nil || d.code[i] {
+				refs = nil
+				break
+			}
+			number, text := m[2], m[3]
+			switch {
+			case m[4] != "":
+				number, text, brackets = m[4], m[5], true
+			case number == "" && m[1] != "":
+				number = m[1]
+			case number == "":
+				number = strconv.Itoa(len(refs) + 1)
+			}
+			refs[number], refLines[number] = strings.TrimSpace(text), i
+		}
+		if len(refs) > 0 {
+			d.references, d.refLines = refs, refLines
+			d.refStart, d.refEnd, d.refBrackets = h.line, end, brackets
+			break
+		}
+	}
+	return d
+}
+
+// convertCitations converts the citations of content to style. Citations
+// already in style are kept as they are; the others are converted, reusing
+// the footnote or reference of an identical citation, and the footnote
+// definitions and references section entries they leave unused are removed.
+// A references section is created with heading if there is none. It returns
+// the new content and the number of citations converted.
+func convertCitations(content, style, heading string) (string, int) {
+	frontMatter, body := mdrefactor.SplitFrontMatter(content)
+	d := parseCitations(body)
+
+	// Footnotes or references to reuse for identical citations
+	byText := make(map[string]string)
+	if style == citationFootnote {
+		for label, text := range d.footnotes {
+			byText[text] = label
+		}
+	}
+	maxRef := 0
+	for number, text := range d.references {
+		n, _ := strconv.Atoi(number)
+		maxRef = max(maxRef, n)
+		if style == citationReferences {
+			byText[text] = number
+		}
+	}
+
+	var added []string
+	nextLabel := 1
+	cite := func(text string) string {
+		switch style {
+		case citationInline:
+			return " (" + strings.TrimSuffix(text, ".") + ")"
+		case citationFootnote:
+			label, ok := byText[text]
+			if !ok {
+				for d.labels[strconv.Itoa(nextLabel)] {
+					nextLabel++
+				}
+				label = strconv.Itoa(nextLabel)
+				d.labels[label], byText[text] = true, label
+				added = append(added, fmt.Sprintf("[^%s]: %s", label, text))
+			}
+			return "[^" + label + "]"
+		default:
+			number, ok := byText[text]
+			if !ok {
+				maxRef++
+				number = strconv.Itoa(maxRef)
+				byText[text] = number
+				if d.refBrackets {
+					added = append(added, fmt.Sprintf("[%s] %s", number, text))
+				} else {
+					added = append(added, fmt.Sprintf("%s. %s", number, text))
+				}
+			}
+			return " [" + number + "]"
+		}
+	}
+
+	skip := make([]bool, len(d.lines))
+	for _, r := range d.defLines {
+		for i := r[0]; i <= r[1]; i++ {
+			skip[i] = true
+		}
+	}
+	for i := d.refStart; i >= 0 && i < d.refEnd; i++ {
+		skip[i] = true
+	}
+
+	converted := 0
+	convertedFootnotes, convertedRefs := make(map[string]bool), make(map[string]bool)
+	for i, line := range d.lines {
+		if d.code[i] || skip[i] {
+			continue
+		}
+		d.lines[i] = mapOutside(line, inlineCodeRe, func(text string) string {
+			var b strings.Builder
+			last := 0
+			for _, m := range citationMarkerRe.FindAllStringSubmatchIndex(text, -1) {
+				group := func(n int) string {
+					if m[2*n] < 0 {
+						return ""
+					}
+					return text[m[2*n]:m[2*n+1]]
+				}
+				var replacement string
+				switch {
+				case group(1) != "":
+					label := group(1)
+					if _, ok := d.footnotes[label]; !ok || style == citationFootnote {
+						continue
+					}
+					replacement, convertedFootnotes[label] = cite(d.footnotes[label]), true
+				case group(2) != "":
+					number := group(2)
+					// Link text, link references and task list boxes are not citations
+					next, prev := text[m[1]:], text[:m[0]]
+					if _, ok := d.references[number]; !ok || style == citationReferences ||
+						strings.HasPrefix(next, "(") || strings.HasPrefix(next, "[") || strings.HasPrefix(next, ":") || strings.HasSuffix(prev, "]") {
+						continue
+					}
+					replacement, convertedRefs[number] = cite(d.references[number]), true
+				default:
+					// Archived copies of links are not citations
+					if style == citationInline || group(4) == "archived" {
+						continue
+					}
+					replacement = cite(citationPrefixRe.ReplaceAllString(group(3), ""))
+				}
+				b.WriteString(text[last:m[0]])
+				b.WriteString(replacement)
+				last = m[1]
+				converted++
+			}
+			b.WriteString(text[last:])
+			return b.String()
+		})
+	}
+
+	// Drop what the converted citations leave unused, from the end so line
+	// numbers stay valid
+	remove := make([]bool, len(d.lines))
+	for label := range convertedFootnotes {
+		for i := d.defLines[label][0]; i <= d.defLines[label][1]; i++ {
+			remove[i] = true
+		}
+	}
+	left := len(d.references)
+	for number := range convertedRefs {
+		remove[d.refLines[number]] = true
+		left--
+	}
+	if d.refStart >= 0 && left == 0 {
+		for i := d.refStart; i < d.refEnd; i++ {
+			remove[i] = true
+		}
+	}
+	if style == citationReferences && d.refStart >= 0 && len(added) > 0 {
+		// New entries follow the last one of the section
+		last := 0
+		for _, i := range d.refLines {
+			last = max(last, i)
+		}
+		d.lines[last] += "\n" + strings.Join(added, "\n")
+		added = nil
+	}
+	var kept []string
+	removed := false
+	for i, line := range d.lines {
+		if remove[i] {
+			removed = true
+			continue
+		}
+		// A removed block leaves no second blank line behind
+		if removed && strings.TrimSpace(line) == "" && len(kept) > 0 && strings.TrimSpace(kept[len(kept)-1]) == "" {
+			continue
+		}
+		removed = false
+		kept = append(kept, line)
+	}
+	body = strings.TrimRight(strings.Join(kept, "\n"), "\n")
+
+	if len(added) > 0 {
+		if style == citationReferences {
+			level := 2
+			if base := minHeadingLevel(body); base > 1 {
+				level = base
+			}
+			body += "\n\n" + strings.Repeat("#", level) + " " + heading
+		}
+		body += "\n\n" + strings.Join(added, "\n")
+	}
+	if converted == 0 {
+		return content, 0
+	}
+	return frontMatter + body + "\n", converted
+}
+
+// citationInstruction returns the system prompt addition for style
+func citationInstruction(style string) string {
+	return "Keep citations, footnote references and footnotes, and the entries of a references section exactly as they are; " +
+		"they are converted to the project's citation style (" + style + ") afterwards."
+}
+
+// withCitationStyle wraps refactor so that the citations of the output are
+// converted to style, creating a references section with heading if needed
+func withCitationStyle(style, heading string, refactor refactorFunc) refactorFunc {
+	return func(systemPrompt, content string) (string, error) {
+		refactored, err := refactor(systemPrompt+"\n\n"+citationInstruction(style), content)
+		if err != nil {
+			return "", err
+		}
+		refactored, _ = convertCitations(refactored, style, heading)
+		return refactored, nil
+	}
+}
+
+// runCitationsCommand implements the citations subcommand
+func runCitationsCommand(args []string) error {
+	fs := flag.NewFlagSet("citations", flag.ExitOnError)
+	style := fs.String("style", configCitations.Style, "Style to convert citations to: inline, footnote or references (defaults to the citations section of the config file)")
+	heading := fs.String("heading", configCitations.Heading, "Heading of a references section created by the conversion")
+	dryRun := fs.Bool("dry-run", false, "Only report the number of citations that would be converted")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: mdrefactor citations [flags] <file-or-dir>...")
+		fmt.Fprintln(fs.Output(), "Converts the citations of documents between inline citations, footnotes and a references section. No API calls are made.")
+		fs.PrintDefaults()
+	}
+	positional := parseArgs(fs, args)
+	if len(positional) == 0 {
+		fs.Usage()
+		return fmt.Errorf("at least one file or directory is required")
+	}
+	if s, err := parseCitationStyle(*style); err != nil || s == "" {
+		return fmt.Errorf("-style inline, footnote or references is required")
+	}
+	files, err := expandMarkdownArgs(positional)
+	if err != nil {
+		return err
+	}
+
+	total, changed := 0, 0
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", file, err)
+		}
+		source := decodeSource(data)
+		updated, n := convertCitations(source.text, *style, *heading)
+		if n == 0 {
+			continue
+		}
+		total, changed = total+n, changed+1
+		fmt.Printf("%s: %d citations\n", file, n)
+		if *dryRun {
+			continue
+		}
+		out, err := source.encode(updated, outputPolicy{eol: "preserve", encoding: "preserve"})
+		if err != nil {
+			return fmt.Errorf("failed to encode %s: %w", file, err)
+		}
+		if err := writeFileAtomic(file, out, 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %w", file, err)
+		}
+	}
+	fmt.Printf("Converted %d citations to %s style in %d of %d files.\n", total, *style, changed, len(files))
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// clipboardTool is a command line program that reads or writes the system clipboard
+type clipboardTool struct {
+	paste []string
+	copy  []string
+}
+
+// clipboardTools returns the clipboard programs to try on this platform, in order of preference
+func clipboardTools() []clipboardTool {
+	switch runtime.GOOS {
+	case "darwin":
+		return []clipboardTool{{paste: []string{"pbpaste"}, copy: []string{"pbcopy"}}}
+	case "windows":
+		return []clipboardTool{{
+			paste: []string{"powershell", "-NoProfile", "-Command", "[Console]::OutputEncoding = [Text.Encoding]::UTF8; Get-Clipboard -Raw"},
+			copy:  []string{"powershell", "-NoProfile", "-Command", "[Console]::InputEncoding = [Text.Encoding]::UTF8; Set-Clipboard -Value ([Console]::In.ReadToEnd())"},
+		}}
+	}
+	tools := []clipboardTool{
+		{paste: []string{"xclip", "-selection", "clipboard", "-o"}, copy: []string{"xclip", "-selection", "clipboard"}},
+		{paste: []string{"xsel", "--clipboard", "--output"}, copy: []string{"xsel", "--clipboard", "--input"}},
+	}
+	if os.Getenv("WAYLAND_DISPLAY") != "" {
+		tools = append([]clipboardTool{{paste: []string{"wl-paste", "--no-newline"}, copy: []string{"wl-copy"}}}, tools...)
+	}
+	return tools
+}
+
+// findClipboardTool returns the first clipboard program that is installed
+func findClipboardTool() (clipboardTool, error) {
+	var names []string
+	for _, tool := range clipboardTools() {
+		if _, err := exec.LookPath(tool.paste[0]); err == nil {
+			return tool, nil
+		}
+		names = append(names, tool.paste[0])
+	}
+	return clipboardTool{}, fmt.Errorf("no clipboard program found, install one of: %s", strings.Join(names, ", "))
+}
+
+// readClipboard returns the text on the system clipboard
+func readClipboard() (string, error) {
+	tool, err := findClipboardTool()
+	if err != nil {
+		return "", err
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command(tool.paste[0], tool.paste[1:]...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", clipboardError("read", err, stderr.String())
+	}
+	// Editors and browsers on Windows put CRLF line endings on the clipboard
+	return strings.ReplaceAll(string(out), "\r\n", "\n"), nil
+}
+
+// writeClipboard replaces the text on the system clipboard
+func writeClipboard(text string) error {
+	tool, err := findClipboardTool()
+	if err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command(tool.copy[0], tool.copy[1:]...)
+	cmd.Stdin = strings.NewReader(text)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return clipboardError("write", err, stderr.String())
+	}
+	return nil
+}
+
+// clipboardError describes a failed clipboard program, including its error output
+func clipboardError(op string, err error, stderr string) error {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && strings.TrimSpace(stderr) != "" {
+		return fmt.Errorf("failed to %s clipboard: %s", op, strings.TrimSpace(stderr))
+	}
+	return fmt.Errorf("failed to %s clipboard: %w", op, err)
+}
+
+// runClipboard refactors the text on the system clipboard and puts the result
+// back, keeping a trailing newline only if the original text had one
+func runClipboard(systemPrompt string, refactor refactorFunc) error {
+	text, err := readClipboard()
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(text) == "" {
+		return fmt.Errorf("the clipboard does not contain any text")
+	}
+
+	refactored, err := refactor(systemPrompt, text)
+	if err != nil {
+		return err
+	}
+	refactored = strings.TrimRight(refactored, "\n")
+	if strings.HasSuffix(text, "\n") {
+		refactored += "\n"
+	}
+	return writeClipboard(refactored)
+}
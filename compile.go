@@ -0,0 +1,323 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/jackmbuda/go-mdrefactor/mdrefactor"
+)
+
+// Inserted before every chapter with -page-breaks. Browsers, wkhtmltopdf and
+// pandoc's HTML-based PDF engines start a new page there.
+const pageBreak = `<div style="page-break-before: always;"></div>` + "\n\n"
+
+var (
+	// - [Title](path.md) entries of a SUMMARY.md, with their indentation
+	summaryEntryRe = regexp.MustCompile(`^(\s*)[-*+]\s+\[([^\]]*)\]\(([^)]*)\)`)
+	// # Part headings of a SUMMARY.md
+	summaryPartRe = regexp.MustCompile(`^#{1,6}\s+(.+)$`)
+	// - Title: path.md, - path.md and - Section: entries of an mkdocs.yml nav
+	mkdocsEntryRe = regexp.MustCompile(`^(\s*)-\s+(?:(?:"([^"]*)"|'([^']*)'|([^:]+?))\s*:\s*)?(\S+\.(?:md|markdown))?\s*$`)
+)
+
+// compileEntry is a page or section of the manual, in reading order
+type compileEntry struct {
+	path  string // Slash-separated path relative to the docs directory, empty for sections
+	title string
+	depth int // Nesting in the navigation, 0 for chapters
+}
+
+// depthTracker turns indentation into nesting depth
+type depthTracker []int
+
+// depth returns the nesting depth of a line indented by indent
+func (t *depthTracker) depth(indent int) int {
+	for len(*t) > 0 && (*t)[len(*t)-1] >= indent {
+		*t = (*t)[:len(*t)-1]
+	}
+	*t = append(*t, indent)
+	return len(*t) - 1
+}
+
+// summaryOrder reads the pages of a GitBook or mdBook SUMMARY.md in order.
+// Paths are relative to the directory of the summary.
+func summaryOrder(content string) []compileEntry {
+	var entries []compileEntry
+	var tracker depthTracker
+	// Pages below a part title are nested in it
+	inPart := false
+	code := codeLines(content)
+	for i, line := range strings.Split(content, "\n") {
+		if code[i] {
+			continue
+		}
+		if m := summaryPartRe.FindStringSubmatch(line); m != nil && i > 0 {
+			// Part titles group the chapters after them
+			entries = append(entries, compileEntry{title: strings.TrimSpace(m[1])})
+			tracker, inPart = nil, true
+			continue
+		}
+		m := summaryEntryRe.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		entry := compileEntry{title: m[2], depth: tracker.depth(len(m[1]))}
+		if inPart {
+			entry.depth++
+		}
+		// Draft chapters have no target and become sections
+		if target, _, _ := strings.Cut(m[3], "#"); target != "" {
+			entry.path = path.Clean(strings.TrimPrefix(target, "./"))
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// mkdocsOrder reads the pages of the nav key of an mkdocs.yml in order.
+// Paths are relative to the docs directory.
+func mkdocsOrder(content string) []compileEntry {
+	var entries []compileEntry
+	var tracker depthTracker
+	inNav := false
+	for _, line := range strings.Split(content, "\n") {
+		if mkdocsTopLevelKeyRe.MatchString(line) {
+			inNav = strings.HasPrefix(line, "nav:")
+			continue
+		}
+		m := mkdocsEntryRe.FindStringSubmatch(line)
+		if !inNav || m == nil {
+			continue
+		}
+		title := strings.TrimSpace(m[2] + m[3] + m[4])
+		entry := compileEntry{title: title, depth: tracker.depth(len(m[1]))}
+		if m[5] != "" {
+			entry.path = path.Clean(m[5])
+		} else if title == "" {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// indexOrder orders the pages as the index page of the tree links to them,
+// followed by the pages it does not link to in directory order
+func indexOrder(g *linkGraph) []compileEntry {
+	var entries []compileEntry
+	listed := make(map[string]bool)
+	add := func(file string, depth int) {
+		if !listed[file] {
+			listed[file] = true
+			entries = append(entries, compileEntry{path: file, title: documentTitle(g.contents[file], file), depth: depth})
+		}
+	}
+	for _, file := range g.files {
+		if isIndexPage(file) && path.Dir(file) == "." {
+			add(file, 0)
+			for _, l := range g.links[file] {
+				if _, ok := g.contents[l.file]; ok {
+					add(l.file, 0)
+				}
+			}
+			break
+		}
+	}
+
+	// The rest in the layout of a generated navigation
+	titles := make(map[string]string)
+	for _, file := range g.files {
+		titles[file] = documentTitle(g.contents[file], file)
+	}
+	var unlisted func(n *navNode) bool
+	unlisted = func(n *navNode) bool {
+		if n.path != "" {
+			return !listed[n.path]
+		}
+		for _, c := range n.children {
+			if unlisted(c) {
+				return true
+			}
+		}
+		return false
+	}
+	var walk func(nodes []*navNode, depth int)
+	walk = func(nodes []*navNode, depth int) {
+		for _, n := range nodes {
+			if n.path != "" {
+				add(n.path, depth)
+				continue
+			}
+			if !unlisted(n) {
+				continue
+			}
+			children := n.children
+			if len(children) > 0 && children[0].path != "" && isIndexPage(children[0].path) {
+				// The index page stands for its section
+				add(children[0].path, depth)
+				children = children[1:]
+			} else {
+				entries = append(entries, compileEntry{title: n.title, depth: depth})
+			}
+			walk(children, depth+1)
+		}
+	}
+	walk(buildNavTree(g.files, titles).children, 0)
+	return entries
+}
+
+// compileOrder returns the pages of the docs tree in the order of its
+// navigation: the nav file if given, else a SUMMARY.md in the tree, an
+// mkdocs.yml next to it or the links of its index page. The second value
+// names the source of the order.
+func compileOrder(dir, navFile string, g *linkGraph) ([]compileEntry, string, error) {
+	if navFile == "" {
+		for _, candidate := range []string{filepath.Join(dir, "SUMMARY.md"), filepath.Join(filepath.Dir(mustAbs(dir)), "mkdocs.yml"), filepath.Join(dir, "mkdocs.yml")} {
+			if fileExists(candidate) {
+				navFile = candidate
+				break
+			}
+		}
+	}
+	if navFile == "" {
+		return indexOrder(g), "the index page", nil
+	}
+
+	data, err := os.ReadFile(navFile)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read navigation %s: %w", navFile, err)
+	}
+	if strings.HasSuffix(navFile, ".yml") || strings.HasSuffix(navFile, ".yaml") {
+		return mkdocsOrder(string(data)), navFile, nil
+	}
+	entries := summaryOrder(string(data))
+	// Summary paths are relative to the summary, make them relative to the tree
+	rel, err := filepath.Rel(dir, filepath.Dir(navFile))
+	if err == nil && rel != "." {
+		for i := range entries {
+			if entries[i].path != "" {
+				entries[i].path = path.Join(filepath.ToSlash(rel), entries[i].path)
+			}
+		}
+	}
+	return entries, navFile, nil
+}
+
+// tocLines returns the entries of a TOC generated for content down to depth
+// levels below the title
+func tocLines(content string, depth int) string {
+	var b strings.Builder
+	for _, line := range strings.SplitAfter(generateTOC(content), "\n") {
+		if line != "" && (len(line)-len(strings.TrimLeft(line, " ")))/2 < depth {
+			b.WriteString(line)
+		}
+	}
+	return b.String()
+}
+
+// runCompileCommand implements the compile subcommand
+func runCompileCommand(args []string) error {
+	fs := flag.NewFlagSet("compile", flag.ExitOnError)
+	output := fs.String("o", "", "Path of the compiled manual (required)")
+	title := fs.String("title", "", "Title of the manual (defaults to the title of the index page or the directory name)")
+	navFile := fs.String("nav", "", "SUMMARY.md or mkdocs.yml giving the page order (found in or next to the docs directory by default)")
+	tocDepth := fs.Int("toc-depth", 2, "Heading levels below the title listed in the table of contents, 0 for none")
+	pageBreaks := fs.Bool("page-breaks", false, "Start every chapter on a new page when printed or converted to PDF")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: mdrefactor compile [flags] <docs-dir> -o <manual.md>")
+		fmt.Fprintln(fs.Output(), "Compiles a docs tree into one print-friendly document, in the order of its navigation. No API calls are made.")
+		fs.PrintDefaults()
+	}
+	positional := parseArgs(fs, args)
+	if len(positional) != 1 || *output == "" {
+		fs.Usage()
+		return fmt.Errorf("a docs directory and -o are required")
+	}
+	dir := positional[0]
+
+	g, err := buildLinkGraph(dir)
+	if err != nil {
+		return err
+	}
+	entries, source, err := compileOrder(dir, *navFile, g)
+	if err != nil {
+		return err
+	}
+
+	if *title == "" {
+		*title = humanize(filepath.Base(mustAbs(dir)))
+		for _, file := range g.files {
+			if isIndexPage(file) && path.Dir(file) == "." {
+				*title = documentTitle(g.contents[file], file)
+			}
+		}
+	}
+
+	absOutput := mustAbs(*output)
+	var inputs []mergeInput
+	included := make(map[string]bool)
+	for i, e := range entries {
+		level := min(e.depth+2, 6)
+		in := mergeInput{level: level}
+		if *pageBreaks && e.depth == 0 && i > 0 {
+			in.before = pageBreak
+		}
+		if e.path == "" {
+			in.content = strings.Repeat("#", level) + " " + e.title
+			inputs = append(inputs, in)
+			continue
+		}
+		content, ok := g.contents[e.path]
+		file := filepath.Join(dir, filepath.FromSlash(e.path))
+		if !ok || included[e.path] || mustAbs(file) == absOutput {
+			if !ok {
+				fmt.Fprintf(os.Stderr, "Warning: %s lists %s, which is not in %s\n", source, e.path, dir)
+			}
+			continue
+		}
+		included[e.path] = true
+		_, body := mdrefactor.SplitFrontMatter(content)
+		if minHeadingLevel(body) == 0 {
+			// Every page gets a heading, so links to it have a target
+			content = "# " + documentTitle(content, e.path) + "\n\n" + body
+		}
+		in.file, in.content = file, content
+		inputs = append(inputs, in)
+	}
+
+	var left []string
+	for _, file := range g.files {
+		if !included[file] && !strings.EqualFold(path.Base(file), "SUMMARY.md") && mustAbs(filepath.Join(dir, filepath.FromSlash(file))) != absOutput {
+			left = append(left, file)
+		}
+	}
+	if len(left) > 0 {
+		fmt.Fprintf(os.Stderr, "Warning: %d pages are not in %s and were left out: %s\n", len(left), source, strings.Join(left, ", "))
+	}
+	if len(inputs) == 0 {
+		return fmt.Errorf("no pages to compile in %s", dir)
+	}
+
+	manual, err := assembleDocuments(inputs, *output, *title, false, 0)
+	if err != nil {
+		return err
+	}
+	if *tocDepth > 0 {
+		if toc := tocLines(manual, *tocDepth); toc != "" {
+			// A paragraph rather than a heading, so no anchor of the manual changes
+			head, rest, _ := strings.Cut(manual, "\n\n")
+			manual = head + "\n\n**Contents**\n\n" + toc + "\n" + rest
+		}
+	}
+
+	if err := writeFileAtomic(*output, []byte(manual), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", *output, err)
+	}
+	fmt.Printf("Compiled %d pages of %s in the order of %s into %s\n", len(included), dir, source, *output)
+	return nil
+}
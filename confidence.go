@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// Directory of the queue of outputs held for review
+	defaultReviewDir = ".mdrefactor/review"
+	// Thresholds of -review unless set explicitly
+	defaultReviewThreshold = 0.8
+	defaultReviewMaxChange = 0.5
+	// Word overlap with the input at and above which the similarity check passes fully.
+	// Refactoring rewords text, so identical vocabulary is not expected.
+	fullSimilarity = 0.6
+	// Deduction from a check's score for every problem it finds
+	problemPenalty = 0.25
+
+	// Weights of the post-checks in the confidence score
+	structureWeight  = 0.4
+	similarityWeight = 0.3
+	lintWeight       = 0.3
+)
+
+// errHeldForReview marks outputs that were saved for review instead of written
+var errHeldForReview = errors.New("held for review")
+
+// confidence is how likely a refactored document is fine to apply unreviewed,
+// from 0 to 1, with the problems that lowered it
+type confidence struct {
+	score    float64
+	problems []string
+}
+
+// scoreConfidence combines the post-checks of a refactoring into a
+// confidence score: the structure invariants, the word overlap of input and
+// output, and the lint problems the output has that the input did not
+func scoreConfidence(input, output string) confidence {
+	var c confidence
+	violations := structureInvariants{headings: true, code: true, tables: true}.violations(input, output)
+	structure := max(1-problemPenalty*float64(len(violations)), 0)
+	c.problems = append(c.problems, violations...)
+
+	similarity := jaccard(wordSet(input), wordSet(output))
+	c.score = structureWeight*structure + similarityWeight*min(similarity/fullSimilarity, 1)
+	if similarity < fullSimilarity {
+		c.problems = append(c.problems, fmt.Sprintf("only %.0f%% of the words are shared with the input", 100*similarity))
+	}
+
+	known := make(map[string]bool)
+	for _, p := range lintMarkdown(input) {
+		known[p] = true
+	}
+	var lint []string
+	for _, p := range lintMarkdown(output) {
+		if !known[p] {
+			lint = append(lint, p)
+		}
+	}
+	c.score += lintWeight * max(1-problemPenalty*float64(len(lint)), 0)
+	c.problems = append(c.problems, lint...)
+	return c
+}
+
+// autoApply decides whether refactored documents are written or held in the
+// review queue, by their confidence score and the size of their changes
+type autoApply struct {
+	threshold float64 // Minimum confidence score to write an output, 0 writes all
+	maxChange float64 // Maximum share of changed lines to write an output, 0 for no limit
+	reviewDir string
+}
+
+// gate returns content if its confidence score reaches the threshold and
+// it changes no more lines than allowed. Otherwise content is added to the
+// review queue for target and errHeldForReview is returned.
+func (a autoApply) gate(target, original, content string) (string, error) {
+	if a.threshold <= 0 && a.maxChange <= 0 {
+		return content, nil
+	}
+	c := scoreConfidence(original, content)
+	changed := changedFraction(original, content)
+	var reasons []string
+	if a.threshold > 0 && c.score < a.threshold {
+		reasons = append(reasons, fmt.Sprintf("confidence %.2f is below %.2f", c.score, a.threshold))
+	}
+	if a.maxChange > 0 && changed > a.maxChange {
+		reasons = append(reasons, fmt.Sprintf("%.0f%% of lines changed, more than %.0f%%", 100*changed, 100*a.maxChange))
+	}
+	if len(reasons) == 0 {
+		return content, nil
+	}
+	entryDir, err := saveForReview(a.reviewDir, reviewEntry{Target: target, Confidence: c.score, Changed: changed, Problems: c.problems}, original, content)
+	if err != nil {
+		return "", err
+	}
+	fmt.Printf("Held %s for review in %s: %s\n", target, entryDir, strings.Join(reasons, ", "))
+	if len(c.problems) > 0 {
+		fmt.Printf("  %s\n", strings.Join(c.problems, "\n  "))
+	}
+	return "", fmt.Errorf("%s %w (%s)", target, errHeldForReview, strings.Join(reasons, ", "))
+}
+
+// countHeld returns the number of results that were saved for review
+func countHeld(results []batchResult) int {
+	held := 0
+	for _, r := range results {
+		if errors.Is(r.err, errHeldForReview) {
+			held++
+		}
+	}
+	return held
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/jackmbuda/go-mdrefactor/mdrefactor"
+)
+
+// Config file read from the working directory unless -config or MDREFACTOR_CONFIG names another
+const defaultConfigFile = ".mdrefactor.json"
+
+// config holds settings that can be kept in a config file instead of being
+// passed as flags on every run
+type config struct {
+	Headers       map[string]string    `json:"headers"`         // Extra headers sent with every API request
+	APIKeyCommand string               `json:"api_key_command"` // Shell command printing the API key, e.g. from a password manager
+	HTTP          httpConfig           `json:"http"`            // Timeouts and connection settings of API requests
+	Models        map[string]modelInfo `json:"models"`          // Context sizes, output limits and prices by model name
+	Slugs         slugConfig           `json:"slugs"`           // Style and language of generated anchors and file names
+	Staleness     stalenessConfig      `json:"staleness"`       // When documents are due for review
+	Formats       formatStyle          `json:"formats"`         // How dates, numbers and units are written
+	Acronyms      map[string]string    `json:"acronyms"`        // Project acronyms by expansion, "" for well-known ones
+	Terminology   map[string]string    `json:"terminology"`     // Replacements by term to avoid, alternatives separated by |
+	URLRewrites   urlRewriteConfig     `json:"url_rewrites"`    // Rules rewriting the links of refactored documents
+	Citations     citationConfig       `json:"citations"`       // Citation style of the project
+	HeadingCase   headingCaseConfig    `json:"heading_case"`    // Capitalization of headings and words it keeps
+	Routing       routingConfig        `json:"routing"`         // Which documents are sent to a cheaper model
+	Embeddings    embeddingConfig      `json:"embeddings"`      // Provider and model of search, related and ask
+}
+
+// Command from the config file fetching the API key when none is given with
+// -apikey or OPENAI_API_KEY, and the key it printed once it has run
+var (
+	apiKeyCommand string
+	apiKeyOnce    sync.Once
+	commandAPIKey string
+	commandErr    error
+)
+
+// Path of the config file in effect, the one given with -config if any,
+// empty if there is none
+var loadedConfig string
+
+// configPath returns the config file to use when no -config flag is given
+func configPath() string {
+	if path := os.Getenv("MDREFACTOR_CONFIG"); path != "" {
+		return path
+	}
+	return defaultConfigFile
+}
+
+// loadConfig reads the config file at path and applies it. A missing file is
+// only an error if it was explicitly requested.
+func loadConfig(path string, required bool) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && !required {
+		return nil
+	}
+	loadedConfig = path
+	if err != nil {
+		return fmt.Errorf("failed to read config file %s: %w", path, err)
+	}
+
+	var cfg config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	// A config file in the working directory may come with a checked out
+	// repository, so only one the user named runs a command
+	apiKeyCommand = ""
+	if required || os.Getenv("MDREFACTOR_CONFIG") != "" {
+		apiKeyCommand = cfg.APIKeyCommand
+	} else if cfg.APIKeyCommand != "" {
+		fmt.Fprintf(os.Stderr, "Warning: ignoring api_key_command of %s in the working directory, set it in a config file named with -config or MDREFACTOR_CONFIG\n", path)
+	}
+	applyHTTPConfig(cfg.HTTP)
+	registerModels(cfg.Models)
+	applyStalenessConfig(cfg.Staleness)
+	applyTerminologyConfig(cfg.Terminology)
+	if err := applySlugConfig(cfg.Slugs); err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	if err := applyFormatConfig(cfg.Formats); err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	if err := applyAcronymConfig(cfg.Acronyms); err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	if err := applyURLRewriteConfig(cfg.URLRewrites); err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	if err := applyCitationConfig(cfg.Citations); err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	if err := applyHeadingCaseConfig(cfg.HeadingCase); err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	if err := applyRoutingConfig(cfg.Routing); err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	if err := applyEmbeddingConfig(cfg.Embeddings); err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	configHeaders = http.Header{}
+	for name, value := range cfg.Headers {
+		configHeaders.Set(name, value)
+	}
+	return nil
+}
+
+// resolveAPIKey returns apiKey, or if it is empty the key printed by the
+// api_key_command of the config file. The command runs at most once per process.
+func resolveAPIKey(apiKey string) (string, error) {
+	if apiKey != "" {
+		return apiKey, nil
+	}
+	if apiKeyCommand == "" {
+		return "", fmt.Errorf("%w: OpenAI API key is not set. Please set the OPENAI_API_KEY environment variable, use the -apikey flag or set api_key_command in the config file", mdrefactor.ErrAuth)
+	}
+	apiKeyOnce.Do(func() {
+		commandAPIKey, commandErr = runAPIKeyCommand(apiKeyCommand)
+	})
+	return commandAPIKey, commandErr
+}
+
+// shellCommand returns a command running command through the shell
+func shellCommand(command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.Command("cmd", "/C", command)
+	}
+	return exec.Command("sh", "-c", command)
+}
+
+// runAPIKeyCommand runs a credential helper command through the shell and
+// returns the first line it prints
+func runAPIKeyCommand(command string) (string, error) {
+	cmd := shellCommand(command)
+	var stderr bytes.Buffer
+	// Helpers may prompt for a password on the terminal, but must not read
+	// documents or RPC requests piped to mdrefactor
+	if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		cmd.Stdin = os.Stdin
+	}
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		// The output is never included, it may hold part of the secret
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%w: api_key_command failed: %v: %s", mdrefactor.ErrAuth, err, msg)
+		}
+		return "", fmt.Errorf("%w: api_key_command failed: %v", mdrefactor.ErrAuth, err)
+	}
+	key, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+	if key = strings.TrimSpace(key); key == "" {
+		return "", fmt.Errorf("%w: api_key_command printed no API key", mdrefactor.ErrAuth)
+	}
+	return key, nil
+}
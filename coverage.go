@@ -0,0 +1,320 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// Priorities of undocumented surface area, most important first
+const (
+	priorityHigh = iota
+	priorityMedium
+	priorityLow
+)
+
+var priorityNames = []string{"high", "medium", "low"}
+
+var (
+	// Flag constructors taking the name first, e.g. fs.String("name", ...)
+	flagFuncs = map[string]bool{"String": true, "Bool": true, "Int": true, "Int64": true, "Uint": true, "Uint64": true, "Float64": true, "Duration": true, "Func": true, "BoolFunc": true}
+	// Flag constructors taking the name second, e.g. fs.StringVar(&v, "name", ...)
+	flagVarFuncs = map[string]bool{"StringVar": true, "BoolVar": true, "IntVar": true, "Int64Var": true, "UintVar": true, "Uint64Var": true, "Float64Var": true, "DurationVar": true, "TextVar": true, "Var": true}
+	// Names of structs whose tagged fields are configuration options
+	configTypeRe = regexp.MustCompile(`(?i)(config|options|settings)`)
+)
+
+// stringArg returns the value of a string literal argument
+func stringArg(args []ast.Expr, i int) (string, bool) {
+	if i >= len(args) {
+		return "", false
+	}
+	lit, ok := args[i].(*ast.BasicLit)
+	if !ok || lit.Kind != token.STRING {
+		return "", false
+	}
+	s, err := strconv.Unquote(lit.Value)
+	return s, err == nil && s != ""
+}
+
+// surfaceItem is one piece of user-facing surface area found in the source
+type surfaceItem struct {
+	kind     string // command, flag, config or the kind of Go declaration
+	name     string // Name as users would write it
+	term     string // Text searched for in the docs
+	location string // file:line of the definition
+	priority int
+}
+
+// scanSourceSurface walks the Go sources below root and returns their CLI
+// commands, flags, configuration options and exported API
+func scanSourceSurface(root string) ([]surfaceItem, error) {
+	var items []surfaceItem
+	seen := make(map[string]bool)
+	add := func(item surfaceItem) {
+		key := item.kind + "\x00" + item.name
+		if !seen[key] {
+			seen[key] = true
+			items = append(items, item)
+		}
+	}
+
+	fset := token.NewFileSet()
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			name := d.Name()
+			if path != root && (strings.HasPrefix(name, ".") || name == "vendor" || name == "testdata" || name == "node_modules") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(path, ".go") || strings.HasSuffix(path, "_test.go") {
+			return nil
+		}
+		src, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		file, err := parser.ParseFile(fset, path, src, 0)
+		if err != nil {
+			// Files that do not parse are skipped rather than failing the report
+			return nil
+		}
+		rel, _ := filepath.Rel(root, path)
+		rel = filepath.ToSlash(rel)
+		location := func(pos token.Pos) string {
+			return fmt.Sprintf("%s:%d", rel, fset.Position(pos).Line)
+		}
+		ast.Inspect(file, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.CallExpr:
+				sel, ok := n.Fun.(*ast.SelectorExpr)
+				if !ok {
+					return true
+				}
+				name, ok := "", false
+				if flagFuncs[sel.Sel.Name] {
+					name, ok = stringArg(n.Args, 0)
+				} else if flagVarFuncs[sel.Sel.Name] {
+					name, ok = stringArg(n.Args, 1)
+				}
+				if ok {
+					add(surfaceItem{kind: "flag", name: "-" + name, term: "-" + name, location: location(n.Pos()), priority: priorityHigh})
+				}
+			case *ast.KeyValueExpr:
+				// Use: "serve [flags]" of cobra commands
+				if key, ok := n.Key.(*ast.Ident); ok && key.Name == "Use" {
+					if use, ok := stringArg([]ast.Expr{n.Value}, 0); ok && strings.TrimSpace(use) != "" {
+						name := strings.Fields(use)[0]
+						add(surfaceItem{kind: "command", name: name, term: name, location: location(n.Pos()), priority: priorityHigh})
+					}
+				}
+			case *ast.CompositeLit:
+				// Subcommand tables: map[string]func(...){"name": handler}
+				if t, ok := n.Type.(*ast.MapType); ok {
+					if _, isFunc := t.Value.(*ast.FuncType); isFunc {
+						for _, elt := range n.Elts {
+							if kv, ok := elt.(*ast.KeyValueExpr); ok {
+								if lit, ok := kv.Key.(*ast.BasicLit); ok && lit.Kind == token.STRING {
+									name, _ := strconv.Unquote(lit.Value)
+									add(surfaceItem{kind: "command", name: name, term: name, location: location(lit.Pos()), priority: priorityHigh})
+								}
+							}
+						}
+					}
+				}
+			case *ast.TypeSpec:
+				st, ok := n.Type.(*ast.StructType)
+				if !ok || !configTypeRe.MatchString(n.Name.Name) {
+					return true
+				}
+				for _, field := range st.Fields.List {
+					if field.Tag == nil {
+						continue
+					}
+					tag, _ := strconv.Unquote(field.Tag.Value)
+					for _, key := range []string{"json", "yaml", "toml"} {
+						value, ok := reflect.StructTag(tag).Lookup(key)
+						name, _, _ := strings.Cut(value, ",")
+						if ok && name != "" && name != "-" {
+							add(surfaceItem{kind: "config", name: name, term: name, location: location(field.Pos()), priority: priorityMedium})
+							break
+						}
+					}
+				}
+			}
+			return true
+		})
+
+		// Package main has no importable API
+		if file.Name.Name == "main" || strings.Contains("/"+filepath.ToSlash(rel), "/internal/") {
+			return nil
+		}
+		for _, decl := range file.Decls {
+			switch decl := decl.(type) {
+			case *ast.FuncDecl:
+				if !decl.Name.IsExported() {
+					continue
+				}
+				if decl.Recv == nil {
+					add(surfaceItem{kind: "func", name: decl.Name.Name, term: decl.Name.Name, location: location(decl.Pos()), priority: priorityMedium})
+					continue
+				}
+				recv := receiverName(decl.Recv.List[0].Type)
+				if ast.IsExported(recv) {
+					add(surfaceItem{kind: "method", name: recv + "." + decl.Name.Name, term: decl.Name.Name, location: location(decl.Pos()), priority: priorityLow})
+				}
+			case *ast.GenDecl:
+				for _, spec := range decl.Specs {
+					switch spec := spec.(type) {
+					case *ast.TypeSpec:
+						if spec.Name.IsExported() {
+							add(surfaceItem{kind: "type", name: spec.Name.Name, term: spec.Name.Name, location: location(spec.Pos()), priority: priorityMedium})
+						}
+					case *ast.ValueSpec:
+						for _, name := range spec.Names {
+							if name.IsExported() {
+								add(surfaceItem{kind: strings.ToLower(decl.Tok.String()), name: name.Name, term: name.Name, location: location(name.Pos()), priority: priorityLow})
+							}
+						}
+					}
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan %s: %w", root, err)
+	}
+	return items, nil
+}
+
+// receiverName returns the type name of a method receiver
+func receiverName(expr ast.Expr) string {
+	switch t := expr.(type) {
+	case *ast.StarExpr:
+		return receiverName(t.X)
+	case *ast.IndexExpr:
+		return receiverName(t.X)
+	case *ast.IndexListExpr:
+		return receiverName(t.X)
+	case *ast.Ident:
+		return t.Name
+	}
+	return ""
+}
+
+// isDocumented reports whether term appears as a whole word in docs
+func isDocumented(docs, term string) bool {
+	re := regexp.MustCompile(`(^|[^A-Za-z0-9_])` + regexp.QuoteMeta(term) + `($|[^A-Za-z0-9_-])`)
+	return re.MatchString(docs)
+}
+
+// runCoverageCommand implements the coverage subcommand
+func runCoverageCommand(args []string) error {
+	fs := flag.NewFlagSet("coverage", flag.ExitOnError)
+	src := fs.String("src", ".", "Root of the Go sources to scan")
+	minPriority := fs.String("min-priority", "low", "Only list undocumented items of at least this priority: high, medium or low")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: mdrefactor coverage [flags] <docs-dir>")
+		fmt.Fprintln(fs.Output(), "Reports CLI commands, flags, configuration options and exported API of the sources that the docs never mention.")
+		fs.PrintDefaults()
+	}
+	positional := parseArgs(fs, args)
+	if len(positional) != 1 {
+		fs.Usage()
+		return fmt.Errorf("a docs directory is required")
+	}
+	limit := -1
+	for i, name := range priorityNames {
+		if name == *minPriority {
+			limit = i
+		}
+	}
+	if limit < 0 {
+		return fmt.Errorf("unknown priority %q, expected high, medium or low", *minPriority)
+	}
+
+	docsDir := positional[0]
+	files, err := findMarkdownFiles(docsDir)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no Markdown files found in %s", docsDir)
+	}
+	var docs strings.Builder
+	for _, rel := range files {
+		data, err := os.ReadFile(filepath.Join(docsDir, rel))
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", rel, err)
+		}
+		docs.WriteString(decodeSource(data).text)
+		docs.WriteString("\n")
+	}
+
+	items, err := scanSourceSurface(*src)
+	if err != nil {
+		return err
+	}
+	if len(items) == 0 {
+		return fmt.Errorf("no commands, flags, configuration options or exported API found in %s", *src)
+	}
+
+	total, documented := make(map[string]int), make(map[string]int)
+	var missing []surfaceItem
+	for _, item := range items {
+		total[item.kind]++
+		if isDocumented(docs.String(), item.term) {
+			documented[item.kind]++
+		} else {
+			missing = append(missing, item)
+		}
+	}
+	sort.SliceStable(missing, func(i, j int) bool {
+		if missing[i].priority != missing[j].priority {
+			return missing[i].priority < missing[j].priority
+		}
+		if missing[i].kind != missing[j].kind {
+			return missing[i].kind < missing[j].kind
+		}
+		return missing[i].name < missing[j].name
+	})
+
+	fmt.Printf("Documentation coverage of %s by %s (%d files):\n", *src, docsDir, len(files))
+	for _, kind := range sortedKeys(total) {
+		fmt.Printf("  %-8s %d/%d documented (%.0f%%)\n", kind, documented[kind], total[kind], 100*float64(documented[kind])/float64(total[kind]))
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	shown := 0
+	for _, item := range missing {
+		if item.priority > limit {
+			continue
+		}
+		if shown == 0 {
+			fmt.Fprintln(w, "\nPRIORITY\tKIND\tNAME\tDEFINED AT")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", priorityNames[item.priority], item.kind, item.name, item.location)
+		shown++
+	}
+	w.Flush()
+	if shown == 0 {
+		fmt.Println("\nNothing undocumented.")
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errDeadlineReached marks the files of a batch run left for the next run
+// because the -deadline passed before they were started
+var errDeadlineReached = errors.New("left for the next run at the deadline")
+
+// Time after which a batch run starts no more files and cuts off the API
+// requests of the file in progress, none if zero
+var batchDeadline time.Time
+
+// Deadline of the API requests of the batch refactor call in progress, zero
+// outside of them, so that passes after the batch such as -metadata are not
+// cut off
+var requestDeadline struct {
+	sync.Mutex
+	at time.Time
+}
+
+// pastDeadline reports whether the batchDeadline has passed
+func pastDeadline() bool {
+	return !batchDeadline.IsZero() && time.Now().After(batchDeadline)
+}
+
+// refactorByDeadline runs refactor with its API requests cut off at the
+// batchDeadline
+func refactorByDeadline(refactor refactorFunc, systemPrompt, content string) (string, error) {
+	requestDeadline.Lock()
+	requestDeadline.at = batchDeadline
+	requestDeadline.Unlock()
+	defer func() {
+		requestDeadline.Lock()
+		requestDeadline.at = time.Time{}
+		requestDeadline.Unlock()
+	}()
+	return refactor(systemPrompt, content)
+}
+
+// withBatchDeadline bounds ctx by the batchDeadline during a batch refactor
+// call, so that a request still running when it passes does not hold up the
+// end of the run
+func withBatchDeadline(ctx context.Context) (context.Context, context.CancelFunc) {
+	requestDeadline.Lock()
+	deadline := requestDeadline.at
+	requestDeadline.Unlock()
+	if deadline.IsZero() {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadline(ctx, deadline)
+}
+
+// prioritizeFiles orders the files below dir so that a run cut short by the
+// deadline gets the most done: the smallest files first with order
+// "smallest", the most recently changed ones first with order "changed"
+func prioritizeFiles(dir string, files []string, order string) ([]string, error) {
+	sorted := append([]string(nil), files...)
+	switch order {
+	case "smallest":
+		sizes := make(map[string]int64, len(files))
+		for _, rel := range files {
+			if info, err := os.Stat(fsPath(filepath.Join(dir, rel))); err == nil {
+				sizes[rel] = info.Size()
+			}
+		}
+		sort.SliceStable(sorted, func(i, j int) bool { return sizes[sorted[i]] < sizes[sorted[j]] })
+	case "changed":
+		// Files without a commit are newer than any commit
+		changed := gitLastChanged(dir)
+		now := time.Now()
+		dateOf := func(rel string) time.Time {
+			if date, ok := changed[filepath.ToSlash(rel)]; ok {
+				return date
+			}
+			return now
+		}
+		sort.SliceStable(sorted, func(i, j int) bool { return dateOf(sorted[i]).After(dateOf(sorted[j])) })
+	default:
+		return nil, fmt.Errorf("unknown deadline order %q, expected smallest or changed", order)
+	}
+	return sorted, nil
+}
+
+// countRemaining returns the number of results left at the deadline
+func countRemaining(results []batchResult) int {
+	remaining := 0
+	for _, r := range results {
+		if errors.Is(r.err, errDeadlineReached) {
+			remaining++
+		}
+	}
+	return remaining
+}
+
+// reportRemaining prints the files of a batch run left at the deadline and,
+// if remainingFile is set, writes their paths to it for -files-from, or
+// removes it if no file is left
+func reportRemaining(dir string, results []batchResult, remainingFile string) error {
+	var remaining []string
+	for _, r := range results {
+		if errors.Is(r.err, errDeadlineReached) {
+			remaining = append(remaining, filepath.Join(dir, r.path))
+		}
+	}
+	if len(remaining) == 0 {
+		// A list left by an earlier run is done now
+		if remainingFile != "" {
+			if err := os.Remove(remainingFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+		return nil
+	}
+	fmt.Printf("Deadline reached, %d files remain for the next run:\n", len(remaining))
+	for _, path := range remaining {
+		fmt.Printf("  %s\n", path)
+	}
+	if remainingFile == "" {
+		return nil
+	}
+	if err := writeFileAtomic(remainingFile, []byte(strings.Join(remaining, "\n")+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", remainingFile, err)
+	}
+	fmt.Printf("Remaining files written to %s, continue with -files-from %s\n", remainingFile, remainingFile)
+	return nil
+}
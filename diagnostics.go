@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Number of API requests and error lines kept for the diagnostic bundle
+	maxDiagnosticRequests = 50
+	maxDiagnosticMessages = 20
+	// Longest error line kept, longer ones are cut so they cannot carry much content
+	maxDiagnosticMessageLen = 300
+)
+
+// Environment variables whose presence, but not value, goes into the bundle
+var diagnosticEnv = []string{"OPENAI_API_KEY", "MDREFACTOR_CONFIG", "MDREFACTOR_POLICY", "GITHUB_TOKEN", "GITHUB_API_URL", "HTTPS_PROXY", "HTTP_PROXY", "NO_PROXY"}
+
+var (
+	// Flags whose values are credentials
+	secretFlagRe = regexp.MustCompile(`(?i)(key|token|secret|password|header)`)
+	// Credentials that may show up in error messages
+	secretValueRe = regexp.MustCompile(`(?i)(sk-[A-Za-z0-9_-]{8,}|bearer\s+\S+|gh[pousr]_[A-Za-z0-9]{16,})`)
+	// Provider error bodies and raw responses in error messages, which may
+	// echo document content
+	providerMessageRe = regexp.MustCompile(`(?s)(API error: )(.*)( \(Type: [^()]*, Code: [^()]*\))`)
+	rawResponseRe     = regexp.MustCompile(`(?s)(Raw response: )(.+)()$`)
+)
+
+// diagnosticRequest is an API request of the run, without its content
+type diagnosticRequest struct {
+	Started      time.Time `json:"started"`
+	URL          string    `json:"url"` // Without query
+	Model        string    `json:"model,omitempty"`
+	RequestBytes int64     `json:"request_bytes"`
+	Status       int       `json:"status,omitempty"`
+	Attempts     int       `json:"attempts"`
+	DurationMS   int64     `json:"duration_ms"`
+	RequestID    string    `json:"request_id,omitempty"` // Provider's ID of the request, for its support
+	Error        string    `json:"error,omitempty"`
+}
+
+// diagnosticBundle describes a failed run for an issue report. It holds no
+// document content, API keys or header values.
+type diagnosticBundle struct {
+	Time        time.Time           `json:"time"`
+	Error       string              `json:"error"`
+	Go          string              `json:"go"`
+	Platform    string              `json:"platform"`
+	Args        []string            `json:"args"`
+	Config      any                 `json:"config,omitempty"`
+	Environment map[string]string   `json:"environment"`
+	Provider    string              `json:"provider"`
+	DurationMS  int64               `json:"duration_ms"`
+	Requests    []diagnosticRequest `json:"requests"`
+	Messages    []string            `json:"messages,omitempty"` // Error and warning lines written to stderr
+}
+
+// diagnostics collects what goes into the bundle while the run goes on
+var diagnostics struct {
+	sync.Mutex
+	path     string // Bundle written on failure, empty if disabled
+	started  time.Time
+	requests []diagnosticRequest
+	messages []string
+	stderr   *os.File      // The real stderr while it is captured
+	done     chan struct{} // Closed once the captured stderr is drained
+}
+
+// diagnosticsFlag is a flag enabling the diagnostic bundle
+type diagnosticsFlag struct{}
+
+func (diagnosticsFlag) String() string { return diagnostics.path }
+
+func (diagnosticsFlag) Set(path string) error {
+	diagnostics.Lock()
+	defer diagnostics.Unlock()
+	if diagnostics.path == "" {
+		diagnostics.started = time.Now()
+		captureStderr()
+	}
+	diagnostics.path = path
+	return nil
+}
+
+// captureStderr passes everything written to stderr on while keeping the
+// error and warning lines for the bundle
+func captureStderr() {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return
+	}
+	diagnostics.stderr, diagnostics.done = os.Stderr, make(chan struct{})
+	os.Stderr = w
+	go func() {
+		defer close(diagnostics.done)
+		var line bytes.Buffer
+		buf := make([]byte, 4096)
+		for {
+			n, err := r.Read(buf)
+			diagnostics.stderr.Write(buf[:n])
+			for _, c := range buf[:n] {
+				if c != '\n' {
+					line.WriteByte(c)
+					continue
+				}
+				recordMessage(line.String())
+				line.Reset()
+			}
+			if err != nil {
+				recordMessage(line.String())
+				return
+			}
+		}
+	}()
+}
+
+// recordMessage keeps a line written to stderr if it reports a problem
+func recordMessage(line string) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "Error") && !strings.HasPrefix(line, "Warning") {
+		return
+	}
+	line = redactMessage(line)
+	if len(line) > maxDiagnosticMessageLen {
+		line = line[:maxDiagnosticMessageLen] + "..."
+	}
+	diagnostics.Lock()
+	defer diagnostics.Unlock()
+	diagnostics.messages = append(diagnostics.messages, line)
+	if len(diagnostics.messages) > maxDiagnosticMessages {
+		diagnostics.messages = diagnostics.messages[1:]
+	}
+}
+
+// recordRequest adds an API request to the bundle, if it is enabled
+func recordRequest(req *http.Request, started time.Time, attempts int, resp *http.Response, err error) {
+	diagnostics.Lock()
+	defer diagnostics.Unlock()
+	if diagnostics.path == "" {
+		return
+	}
+	r := diagnosticRequest{
+		Started:      started,
+		URL:          req.URL.Scheme + "://" + req.URL.Host + req.URL.Path,
+		RequestBytes: req.ContentLength,
+		Attempts:     attempts,
+		DurationMS:   time.Since(started).Milliseconds(),
+	}
+	if req.GetBody != nil {
+		if body, err := req.GetBody(); err == nil {
+			var payload struct {
+				Model string `json:"model"`
+			}
+			json.NewDecoder(io.LimitReader(body, maxRequestSize)).Decode(&payload)
+			r.Model = payload.Model
+		}
+	}
+	if resp != nil {
+		r.Status = resp.StatusCode
+		r.RequestID = resp.Header.Get("X-Request-Id")
+	}
+	if err != nil {
+		r.Error = redactMessage(err.Error())
+	}
+	diagnostics.requests = append(diagnostics.requests, r)
+	if len(diagnostics.requests) > maxDiagnosticRequests {
+		diagnostics.requests = diagnostics.requests[1:]
+	}
+}
+
+// redactMessage returns an error message with credentials removed and
+// provider error bodies and raw responses reduced to their length
+func redactMessage(message string) string {
+	for _, re := range []*regexp.Regexp{providerMessageRe, rawResponseRe} {
+		message = re.ReplaceAllStringFunc(message, func(match string) string {
+			m := re.FindStringSubmatch(match)
+			return m[1] + fmt.Sprintf("[%d characters]", len(m[2])) + m[3]
+		})
+	}
+	return secretValueRe.ReplaceAllString(message, "[redacted]")
+}
+
+// redactArgs returns the command line with the values of credential flags
+// removed and arguments that read like prose, such as prompts, questions or
+// titles, reduced to their length
+func redactArgs(args []string) []string {
+	redacted := make([]string, 0, len(args))
+	secretNext := false
+	for _, arg := range args {
+		switch {
+		case secretNext:
+			arg, secretNext = "[redacted]", false
+		case strings.HasPrefix(arg, "-"):
+			name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+			switch {
+			case !secretFlagRe.MatchString(name):
+				if strings.ContainsAny(value, " \t\n") {
+					arg = fmt.Sprintf("-%s=[%d characters]", name, len(value))
+				}
+			case hasValue:
+				arg = "-" + name + "=[redacted]"
+			default:
+				secretNext = true
+			}
+		case strings.ContainsAny(arg, " \t\n"):
+			arg = fmt.Sprintf("[%d characters]", len(arg))
+		}
+		redacted = append(redacted, arg)
+	}
+	return redacted
+}
+
+// redactedConfig returns the config file at path with header values and the
+// API key command replaced, or nil if there is none
+func redactedConfig(path string) any {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var cfg map[string]any
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return "unparsable: " + err.Error()
+	}
+	if headers, ok := cfg["headers"].(map[string]any); ok {
+		for name := range headers {
+			headers[name] = "[redacted]"
+		}
+	}
+	if _, ok := cfg["api_key_command"]; ok {
+		cfg["api_key_command"] = "[redacted]"
+	}
+	return cfg
+}
+
+// writeDiagnostics writes the diagnostic bundle of a run that failed with
+// err, if -diagnostics is set
+func writeDiagnostics(runErr error) {
+	diagnostics.Lock()
+	path := diagnostics.path
+	diagnostics.Unlock()
+	if path == "" {
+		return
+	}
+	// Let the messages written so far reach the bundle
+	restoreStderr()
+
+	diagnostics.Lock()
+	defer diagnostics.Unlock()
+	bundle := diagnosticBundle{
+		Time:        time.Now(),
+		Go:          runtime.Version(),
+		Platform:    runtime.GOOS + "/" + runtime.GOARCH,
+		Args:        redactArgs(os.Args[1:]),
+		Config:      redactedConfig(loadedConfig),
+		Environment: make(map[string]string),
+		Provider:    openaiProvider,
+		DurationMS:  time.Since(diagnostics.started).Milliseconds(),
+		Requests:    diagnostics.requests,
+		Messages:    diagnostics.messages,
+	}
+	if runErr != nil {
+		bundle.Error = redactMessage(runErr.Error())
+	} else if len(bundle.Messages) > 0 {
+		bundle.Error = bundle.Messages[len(bundle.Messages)-1]
+	}
+	for _, name := range diagnosticEnv {
+		if os.Getenv(name) != "" {
+			bundle.Environment[name] = "set"
+		}
+	}
+	if bundle.Requests == nil {
+		bundle.Requests = []diagnosticRequest{}
+	}
+
+	data, err := json.MarshalIndent(bundle, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(path, append(data, '\n'), 0600)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to write diagnostic bundle %s: %v\n", path, err)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Diagnostic bundle written to %s, it holds no document content or credentials and can be attached to an issue\n", path)
+}
+
+// restoreStderr stops capturing stderr, once everything written to it so
+// far has been passed on to the real one
+func restoreStderr() {
+	if diagnostics.stderr != nil && os.Stderr != diagnostics.stderr {
+		w := os.Stderr
+		os.Stderr = diagnostics.stderr
+		w.Close()
+		<-diagnostics.done
+	}
+}
+
+// exit ends the run, first writing the diagnostic bundle if it failed
+func exit(code int) {
+	if code != 0 {
+		writeDiagnostics(nil)
+	}
+	restoreStderr()
+	os.Exit(code)
+}
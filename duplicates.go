@@ -0,0 +1,174 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/jackmbuda/go-mdrefactor/mdrefactor"
+)
+
+const (
+	// Number of consecutive words forming one shingle
+	shingleSize = 5
+	// Sections with fewer words are too short to compare meaningfully
+	minDuplicateWords = 30
+	// Default similarity above which two sections are reported as duplicates
+	defaultDuplicateThreshold = 0.5
+)
+
+// docSection is a section of a document in a docs tree
+type docSection struct {
+	file     string // Path relative to the docs directory
+	section  section
+	shingles map[uint64]bool
+	words    int
+}
+
+// duplicate is a pair of near-identical sections in different files
+type duplicate struct {
+	a, b       docSection
+	similarity float64
+}
+
+// location returns the file#anchor location of a section
+func (s docSection) location() string {
+	if s.section.Anchor == "" {
+		return filepath.ToSlash(s.file)
+	}
+	return filepath.ToSlash(s.file) + "#" + s.section.Anchor
+}
+
+// shingles returns the hashed word n-grams of the prose in text
+func shingles(text string) (map[uint64]bool, int) {
+	var words []string
+	for _, unit := range proseUnits(text) {
+		for _, w := range strings.Fields(strings.ToLower(unit)) {
+			words = append(words, strings.Trim(w, ".,;:!?()\"'"))
+		}
+	}
+
+	set := make(map[uint64]bool)
+	for i := 0; i+shingleSize <= len(words); i++ {
+		h := fnv.New64a()
+		h.Write([]byte(strings.Join(words[i:i+shingleSize], " ")))
+		set[h.Sum64()] = true
+	}
+	return set, len(words)
+}
+
+// shingleSimilarity returns the Jaccard similarity of two shingle sets
+func shingleSimilarity(a, b map[uint64]bool) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	shared := 0
+	for k := range a {
+		if b[k] {
+			shared++
+		}
+	}
+	return float64(shared) / float64(len(a)+len(b)-shared)
+}
+
+// findDuplicates returns all pairs of sections in different files of dir
+// whose similarity is at least threshold, most similar first
+func findDuplicates(dir string, threshold float64) ([]duplicate, error) {
+	files, err := findMarkdownFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var all []docSection
+	for _, rel := range files {
+		content, err := os.ReadFile(filepath.Join(dir, rel))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", rel, err)
+		}
+		_, body := mdrefactor.SplitFrontMatter(string(content))
+		for _, s := range splitSections(body) {
+			set, words := shingles(s.Text)
+			if words < minDuplicateWords {
+				continue
+			}
+			all = append(all, docSection{file: rel, section: s, shingles: set, words: words})
+		}
+	}
+
+	var duplicates []duplicate
+	for i := range all {
+		for j := i + 1; j < len(all); j++ {
+			if all[i].file == all[j].file {
+				continue
+			}
+			if sim := shingleSimilarity(all[i].shingles, all[j].shingles); sim >= threshold {
+				duplicates = append(duplicates, duplicate{a: all[i], b: all[j], similarity: sim})
+			}
+		}
+	}
+	sort.SliceStable(duplicates, func(i, j int) bool {
+		return duplicates[i].similarity > duplicates[j].similarity
+	})
+	return duplicates, nil
+}
+
+// consolidationTarget returns the section that should keep the shared content:
+// the longer, more complete one
+func (d duplicate) consolidationTarget() (docSection, docSection) {
+	if d.b.words > d.a.words {
+		return d.b, d.a
+	}
+	return d.a, d.b
+}
+
+// duplicateNotes builds, per file, the prompt notes telling the model which
+// of its sections are duplicated elsewhere in the tree
+func duplicateNotes(duplicates []duplicate) map[string][]string {
+	notes := make(map[string][]string)
+	for _, d := range duplicates {
+		keep, drop := d.consolidationTarget()
+		notes[drop.file] = append(notes[drop.file], fmt.Sprintf(
+			"The section %q is duplicated in %s. Replace it with a short summary that links to that page instead of repeating the content.",
+			drop.section.Heading, keep.location()))
+		notes[keep.file] = append(notes[keep.file], fmt.Sprintf(
+			"The section %q is the canonical version of content duplicated in %s. Keep it complete.",
+			keep.section.Heading, drop.location()))
+	}
+	return notes
+}
+
+// runDuplicatesCommand implements the duplicates subcommand
+func runDuplicatesCommand(args []string) error {
+	fs := flag.NewFlagSet("duplicates", flag.ExitOnError)
+	threshold := fs.Float64("threshold", defaultDuplicateThreshold, "Minimum similarity (0-1) for two sections to be reported")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: mdrefactor duplicates [flags] <docs-dir>")
+		fs.PrintDefaults()
+	}
+	positional := parseArgs(fs, args)
+	if len(positional) != 1 {
+		fs.Usage()
+		return fmt.Errorf("a docs directory is required")
+	}
+
+	duplicates, err := findDuplicates(positional[0], *threshold)
+	if err != nil {
+		return err
+	}
+	if len(duplicates) == 0 {
+		fmt.Println("No duplicate sections found.")
+		return nil
+	}
+
+	for _, d := range duplicates {
+		keep, drop := d.consolidationTarget()
+		fmt.Printf("%.0f%% similar: %s and %s\n", d.similarity*100, d.a.location(), d.b.location())
+		fmt.Printf("  consolidate into %s and link to it from %s\n", keep.location(), drop.location())
+	}
+	fmt.Printf("Found %d duplicate section pairs\n", len(duplicates))
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ErrEgressBlocked marks requests to hosts that are not on the -allow-hosts list
+var ErrEgressBlocked = errors.New("host not on the egress allowlist")
+
+// Hosts outgoing requests may go to, set by -allow-hosts; nil allows every host
+var allowedHosts []string
+
+// allowHostsFlag is a flag adding comma-separated hosts to allowedHosts
+type allowHostsFlag struct{}
+
+func (allowHostsFlag) String() string { return strings.Join(allowedHosts, ",") }
+
+func (allowHostsFlag) Set(s string) error {
+	for _, host := range strings.Split(s, ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			allowedHosts = append(allowedHosts, host)
+		}
+	}
+	if len(allowedHosts) == 0 {
+		return fmt.Errorf("no hosts given")
+	}
+	return nil
+}
+
+// hostAllowed reports whether host (with the port of u, if any) matches an
+// allowlist entry: a host name, a host:port or a *.domain wildcard
+func hostAllowed(u *url.URL) bool {
+	host, port := strings.ToLower(u.Hostname()), u.Port()
+	if port == "" {
+		port = map[string]string{"https": "443", "http": "80"}[u.Scheme]
+	}
+	for _, entry := range allowedHosts {
+		name, entryPort, err := net.SplitHostPort(entry)
+		if err != nil {
+			name, entryPort = entry, ""
+		}
+		if entryPort != "" && entryPort != port {
+			continue
+		}
+		if name == host || strings.HasPrefix(name, "*.") && strings.HasSuffix(host, name[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkEgress returns an error wrapping ErrEgressBlocked if content sent to
+// u would leave the allowed hosts
+func checkEgress(u *url.URL) error {
+	if allowedHosts == nil || hostAllowed(u) {
+		return nil
+	}
+	return fmt.Errorf("%w: refusing to connect to %s (allowed: %s)", ErrEgressBlocked, u.Host, strings.Join(allowedHosts, ", "))
+}
+
+// checkEgressURL is checkEgress for a URL given as text, such as the URL of
+// a repository to clone, including scp-like git URLs (git@host:path)
+func checkEgressURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		host := raw
+		if _, rest, ok := strings.Cut(host, "@"); ok {
+			host = rest
+		}
+		host, _, _ = strings.Cut(host, ":")
+		u = &url.URL{Host: host}
+	}
+	return checkEgress(u)
+}
+
+// egressTransport refuses requests, redirects included, to hosts that are
+// not on the allowlist before they are sent
+type egressTransport struct {
+	next http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper
+func (t egressTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := checkEgress(req.URL); err != nil {
+		return nil, err
+	}
+	return t.next.RoundTrip(req)
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/jackmbuda/go-mdrefactor/mdrefactor"
+)
+
+const (
+	// OpenAI API endpoint for embeddings
+	openaiEmbeddingsURL = "https://api.openai.com/v1/embeddings"
+	// Default model used to embed documents
+	defaultEmbeddingModel = "text-embedding-3-small"
+	// Default Ollama server and model for local embeddings
+	defaultOllamaURL            = "http://localhost:11434"
+	defaultOllamaEmbeddingModel = "nomic-embed-text"
+	// Inputs are truncated to roughly stay within the embedding model's context window
+	maxEmbeddingInputChars = 24000
+	// Number of inputs sent per embeddings request
+	embeddingBatchSize = 100
+)
+
+// Embeddings providers besides openaiProvider
+const (
+	ollamaProvider  = "ollama"
+	commandProvider = "command"
+	// Name the policy knows a server compatible with the OpenAI API by,
+	// the openai provider with a url
+	openaiCompatibleProvider = "openai-compatible"
+)
+
+// EmbeddingRequest represents the request payload for the OpenAI embeddings API
+type EmbeddingRequest struct {
+	Model string   `json:"model"`
+	Input []string `json:"input"`
+}
+
+// EmbeddingResponse represents the expected response structure from the OpenAI embeddings API
+type EmbeddingResponse struct {
+	Data []struct {
+		Index     int       `json:"index"`
+		Embedding []float64 `json:"embedding"`
+	} `json:"data"`
+	Error *mdrefactor.APIError `json:"error,omitempty"`
+}
+
+// localEmbeddingResponse is the reply of Ollama's embed API and what an
+// embeddings command prints
+type localEmbeddingResponse struct {
+	Embeddings [][]float64 `json:"embeddings"`
+	Error      string      `json:"error,omitempty"`
+}
+
+// embeddingConfig is the embeddings section of the config file. It chooses
+// the embeddings provider independently from the chat provider, so that
+// search, related and ask can run on a local model.
+type embeddingConfig struct {
+	Provider  string `json:"provider"`    // openai (default), ollama or command
+	Model     string `json:"model"`       // Embedding model, the provider's default if empty
+	URL       string `json:"url"`         // Embeddings endpoint of an OpenAI-compatible server, or the Ollama server
+	APIKeyEnv string `json:"api_key_env"` // Environment variable holding the key of the OpenAI-compatible server, none if empty
+	Command   string `json:"command"`     // Shell command of the command provider
+}
+
+// Embeddings provider of the project, set from the embeddings section of the config file
+var configEmbeddings embeddingConfig
+
+// applyEmbeddingConfig applies the embeddings section of the config file
+func applyEmbeddingConfig(cfg embeddingConfig) error {
+	switch cfg.Provider {
+	case "", openaiProvider, ollamaProvider:
+	case commandProvider:
+		if cfg.Command == "" {
+			return fmt.Errorf("embeddings: the command provider needs a command")
+		}
+	default:
+		return fmt.Errorf("embeddings: unknown provider %q, expected openai, ollama or command", cfg.Provider)
+	}
+	configEmbeddings = cfg
+	return nil
+}
+
+// embeddingProvider computes embedding vectors
+type embeddingProvider interface {
+	// embed returns one vector per input, in input order
+	embed(inputs []string) ([][]float64, error)
+	// provider returns the name the organization policy knows the provider by
+	provider() string
+	// model returns the embedding model
+	model() string
+	// id identifies the provider and model, so that an index built with
+	// another one is rebuilt
+	id() string
+}
+
+// embeddingFlags are the flags choosing the embeddings provider of a subcommand
+type embeddingFlags struct {
+	provider *string
+	model    *string
+}
+
+// addEmbeddingFlags registers the embeddings flags on fs
+func addEmbeddingFlags(fs *flag.FlagSet) embeddingFlags {
+	return embeddingFlags{
+		provider: fs.String("embedding-provider", "", "Embeddings provider: openai, ollama or command (defaults to the embeddings section of the config file, or openai)"),
+		model:    fs.String("embedding-model", "", "Embedding model to use (defaults to the embeddings section of the config file, or the provider's default)"),
+	}
+}
+
+// open returns the provider the flags and the config file choose. The
+// OpenAI API key is only needed by the openai provider.
+func (f embeddingFlags) open(apiKey string) (embeddingProvider, error) {
+	cfg := configEmbeddings
+	if *f.provider != "" && *f.provider != cfg.Provider {
+		// The model and endpoint of the config file belong to its provider
+		cfg = embeddingConfig{Provider: *f.provider}
+	}
+	if *f.model != "" {
+		cfg.Model = *f.model
+	}
+	return newEmbeddingProvider(apiKey, cfg)
+}
+
+// newEmbeddingProvider returns the embeddings provider cfg describes
+func newEmbeddingProvider(apiKey string, cfg embeddingConfig) (embeddingProvider, error) {
+	switch cfg.Provider {
+	case "", openaiProvider:
+		p := &openaiEmbeddings{name: cfg.Model, url: openaiEmbeddingsURL}
+		if p.name == "" {
+			p.name = defaultEmbeddingModel
+		}
+		if cfg.URL != "" {
+			p.url = strings.TrimSuffix(cfg.URL, "/")
+		}
+		if p.url != openaiEmbeddingsURL {
+			// The OpenAI API key is never sent to another server; compatible
+			// local servers usually need no key
+			if cfg.APIKeyEnv != "" {
+				if p.apiKey = os.Getenv(cfg.APIKeyEnv); p.apiKey == "" {
+					return nil, fmt.Errorf("embeddings: %s is not set", cfg.APIKeyEnv)
+				}
+			}
+			return p, nil
+		}
+		key, err := resolveAPIKey(apiKey)
+		if err != nil {
+			return nil, err
+		}
+		p.apiKey = key
+		return p, nil
+	case ollamaProvider:
+		p := &ollamaEmbeddings{name: cfg.Model, url: strings.TrimSuffix(cfg.URL, "/")}
+		if p.name == "" {
+			p.name = defaultOllamaEmbeddingModel
+		}
+		if p.url == "" {
+			p.url = defaultOllamaURL
+		}
+		return p, nil
+	case commandProvider:
+		if cfg.Command == "" {
+			return nil, fmt.Errorf("the command embeddings provider needs the command of the embeddings section of the config file")
+		}
+		return &commandEmbeddings{command: cfg.Command, name: cfg.Model}, nil
+	}
+	return nil, fmt.Errorf("unknown embeddings provider %q, expected openai, ollama or command", cfg.Provider)
+}
+
+// createEmbeddings returns one embedding vector per input, in input order
+func createEmbeddings(p embeddingProvider, inputs []string) ([][]float64, error) {
+	if err := activePolicy.check(p.provider(), p.model()); err != nil {
+		return nil, err
+	}
+	vectors := make([][]float64, 0, len(inputs))
+	for start := 0; start < len(inputs); start += embeddingBatchSize {
+		end := min(start+embeddingBatchSize, len(inputs))
+		batch := make([]string, end-start)
+		for i, input := range inputs[start:end] {
+			if len(input) > maxEmbeddingInputChars {
+				input = strings.ToValidUTF8(input[:maxEmbeddingInputChars], "")
+			}
+			if scrubPII {
+				// Placeholders keep the meaning of the text, nothing needs restoring
+				input = newPIIScrubber().scrub(input)
+			}
+			batch[i] = input
+		}
+		embedded, err := p.embed(batch)
+		if err != nil {
+			return nil, err
+		}
+		if len(embedded) != len(batch) {
+			return nil, fmt.Errorf("expected %d embeddings, received %d", len(batch), len(embedded))
+		}
+		vectors = append(vectors, embedded...)
+	}
+	return vectors, nil
+}
+
+// openaiEmbeddings embeds with the OpenAI embeddings API, or a server
+// compatible with it such as LocalAI or Text Embeddings Inference
+type openaiEmbeddings struct {
+	apiKey string
+	name   string
+	url    string
+}
+
+func (p *openaiEmbeddings) model() string { return p.name }
+
+// provider tells the OpenAI API apart from compatible servers, which
+// policies may allow or refuse separately
+func (p *openaiEmbeddings) provider() string {
+	if p.url == openaiEmbeddingsURL {
+		return openaiProvider
+	}
+	return openaiCompatibleProvider
+}
+
+// id is the model name alone for the OpenAI API, as in indexes built
+// before there were other providers
+func (p *openaiEmbeddings) id() string {
+	if p.url == openaiEmbeddingsURL {
+		return p.name
+	}
+	return p.url + "/" + p.name
+}
+
+// newRequest creates the embeddings request. Only the OpenAI API gets the
+// OpenAI API key and the extra headers, which may hold credentials too.
+func (p *openaiEmbeddings) newRequest(body []byte) (*http.Request, error) {
+	if p.url == openaiEmbeddingsURL {
+		return newAPIRequest(p.url, p.apiKey, body)
+	}
+	req, err := http.NewRequest("POST", p.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+p.apiKey)
+	}
+	return req, nil
+}
+
+// embed sends a single embeddings request for inputs
+func (p *openaiEmbeddings) embed(inputs []string) ([][]float64, error) {
+	requestBody, err := json.Marshal(EmbeddingRequest{Model: p.name, Input: inputs})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal embeddings request: %w", err)
+	}
+
+	req, err := p.newRequest(requestBody)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := doAPIRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read API response body: %w", err)
+	}
+
+	var apiResponse EmbeddingResponse
+	if err := json.Unmarshal(responseBody, &apiResponse); err != nil {
+		if err := mdrefactor.ResponseError(resp, responseBody); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to unmarshal embeddings response: %w", err)
+	}
+	if apiResponse.Error != nil {
+		apiResponse.Error.StatusCode = resp.StatusCode
+		return nil, apiResponse.Error
+	}
+	if len(apiResponse.Data) != len(inputs) {
+		return nil, fmt.Errorf("expected %d embeddings, received %d", len(inputs), len(apiResponse.Data))
+	}
+
+	vectors := make([][]float64, len(inputs))
+	for _, d := range apiResponse.Data {
+		if d.Index < 0 || d.Index >= len(inputs) {
+			return nil, fmt.Errorf("embedding index %d out of range", d.Index)
+		}
+		vectors[d.Index] = d.Embedding
+	}
+	return vectors, nil
+}
+
+// ollamaEmbeddings embeds with a model served by Ollama, locally by default
+type ollamaEmbeddings struct {
+	name string
+	url  string
+}
+
+func (p *ollamaEmbeddings) provider() string { return ollamaProvider }
+func (p *ollamaEmbeddings) model() string    { return p.name }
+func (p *ollamaEmbeddings) id() string       { return ollamaProvider + "/" + p.name }
+
+// embed sends a single request to Ollama's embed API
+func (p *ollamaEmbeddings) embed(inputs []string) ([][]float64, error) {
+	requestBody, err := json.Marshal(EmbeddingRequest{Model: p.name, Input: inputs})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal embeddings request: %w", err)
+	}
+	// No credentials: the OpenAI API key is not for Ollama
+	req, err := http.NewRequest("POST", p.url+"/api/embed", bytes.NewReader(requestBody))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := doAPIRequest(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach Ollama at %s (is it running?): %w", p.url, err)
+	}
+	defer resp.Body.Close()
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Ollama response body: %w", err)
+	}
+	var reply localEmbeddingResponse
+	if err := json.Unmarshal(responseBody, &reply); err != nil {
+		if err := mdrefactor.ResponseError(resp, responseBody); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to unmarshal Ollama response: %w", err)
+	}
+	if reply.Error != "" {
+		// Usually a model that was not pulled
+		return nil, fmt.Errorf("ollama: %s (try: ollama pull %s)", reply.Error, p.name)
+	}
+	return reply.Embeddings, nil
+}
+
+// commandEmbeddings embeds with a shell command, such as a script running
+// an ONNX model. The command reads {"model": ..., "input": [...]} on stdin
+// and prints {"embeddings": [[...], ...]}, one vector per input.
+type commandEmbeddings struct {
+	command string
+	name    string
+}
+
+func (p *commandEmbeddings) provider() string { return commandProvider }
+func (p *commandEmbeddings) model() string    { return p.name }
+func (p *commandEmbeddings) id() string       { return commandProvider + "/" + p.command + "/" + p.name }
+
+// embed runs the command once for inputs
+func (p *commandEmbeddings) embed(inputs []string) ([][]float64, error) {
+	request, err := json.Marshal(EmbeddingRequest{Model: p.name, Input: inputs})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal embeddings request: %w", err)
+	}
+	cmd := shellCommand(p.command)
+	cmd.Stdin = bytes.NewReader(request)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("embeddings command failed: %v: %s", err, msg)
+		}
+		return nil, fmt.Errorf("embeddings command failed: %v", err)
+	}
+	if stderr.Len() > 0 {
+		os.Stderr.Write(stderr.Bytes())
+	}
+	var reply localEmbeddingResponse
+	if err := json.Unmarshal(out, &reply); err != nil {
+		return nil, fmt.Errorf("failed to parse the output of the embeddings command: %w", err)
+	}
+	if reply.Error != "" {
+		return nil, fmt.Errorf("embeddings command: %s", reply.Error)
+	}
+	return reply.Embeddings, nil
+}
+
+// cosineSimilarity returns the cosine similarity of two vectors
+func cosineSimilarity(a, b []float64) float64 {
+	var dot, normA, normB float64
+	for i := range a {
+		if i >= len(b) {
+			break
+		}
+		dot += a[i] * b[i]
+		normA += a[i] * a[i]
+		normB += b[i] * b[i]
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Text encodings recognized in input files
+const (
+	encodingUTF8    = "utf-8"
+	encodingUTF16LE = "utf-16le"
+	encodingUTF16BE = "utf-16be"
+	encodingLatin1  = "latin-1"
+)
+
+var (
+	utf8BOM    = []byte{0xEF, 0xBB, 0xBF}
+	utf16LEBOM = []byte{0xFF, 0xFE}
+	utf16BEBOM = []byte{0xFE, 0xFF}
+)
+
+// textEncoding describes how the bytes of a file encode its text. The zero
+// value is UTF-8 without a byte order mark.
+type textEncoding struct {
+	name string
+	bom  bool
+}
+
+// String returns the name of the encoding for messages
+func (e textEncoding) String() string {
+	name := e.name
+	if name == "" {
+		name = encodingUTF8
+	}
+	if e.bom {
+		name += " with BOM"
+	}
+	return name
+}
+
+// outputPolicy controls the line endings and encoding of written files
+type outputPolicy struct {
+	eol      string // lf, crlf or preserve
+	encoding string // utf8 or preserve
+}
+
+// validateEncoding checks the value of the -encoding flag
+func validateEncoding(policy string) error {
+	switch policy {
+	case "preserve", "utf8":
+		return nil
+	}
+	return fmt.Errorf("unknown encoding policy %q, expected utf8 or preserve", policy)
+}
+
+// sourceFile is an input file decoded for processing, remembering its
+// original format so the refactored content can be written back the same way
+type sourceFile struct {
+	text string // UTF-8 content with LF line endings
+	eol  string // Dominant line ending of the file
+	enc  textEncoding
+}
+
+// looksUTF16 guesses whether data is UTF-16 without a byte order mark from
+// the NUL bytes that ASCII characters leave in every other byte
+func looksUTF16(data []byte) (littleEndian, ok bool) {
+	if len(data) < 4 || len(data)%2 != 0 {
+		return false, false
+	}
+	sample := data[:min(len(data), 1024)]
+	var even, odd int
+	for i, b := range sample {
+		if b != 0 {
+			continue
+		}
+		if i%2 == 0 {
+			even++
+		} else {
+			odd++
+		}
+	}
+	pairs := len(sample) / 2
+	switch {
+	case odd > pairs/3 && even == 0:
+		return true, true
+	case even > pairs/3 && odd == 0:
+		return false, true
+	}
+	return false, false
+}
+
+// decodeUTF16 decodes UTF-16 data in the given byte order
+func decodeUTF16(data []byte, order binary.ByteOrder) string {
+	units := make([]uint16, len(data)/2)
+	for i := range units {
+		units[i] = order.Uint16(data[2*i:])
+	}
+	return string(utf16.Decode(units))
+}
+
+// decodeSource detects the encoding of data (UTF-8 with or without BOM,
+// UTF-16 or Latin-1) and converts it to UTF-8 with LF line endings
+func decodeSource(data []byte) sourceFile {
+	var text string
+	var enc textEncoding
+	switch {
+	case bytes.HasPrefix(data, utf8BOM):
+		text, enc = string(data[len(utf8BOM):]), textEncoding{name: encodingUTF8, bom: true}
+	case bytes.HasPrefix(data, utf16LEBOM):
+		text, enc = decodeUTF16(data[2:], binary.LittleEndian), textEncoding{name: encodingUTF16LE, bom: true}
+	case bytes.HasPrefix(data, utf16BEBOM):
+		text, enc = decodeUTF16(data[2:], binary.BigEndian), textEncoding{name: encodingUTF16BE, bom: true}
+	case utf8.Valid(data):
+		text = string(data)
+	default:
+		if littleEndian, ok := looksUTF16(data); ok {
+			if littleEndian {
+				text, enc = decodeUTF16(data, binary.LittleEndian), textEncoding{name: encodingUTF16LE}
+			} else {
+				text, enc = decodeUTF16(data, binary.BigEndian), textEncoding{name: encodingUTF16BE}
+			}
+			break
+		}
+		// Every byte is a valid Latin-1 character
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+		}
+		text, enc = string(runes), textEncoding{name: encodingLatin1}
+	}
+	return sourceFile{text: normalizeEOL(text), eol: detectEOL(text), enc: enc}
+}
+
+// encode converts refactored content to bytes with the line endings and
+// encoding chosen by the policy
+func (f sourceFile) encode(refactored string, p outputPolicy) ([]byte, error) {
+	eol := f.eol
+	switch p.eol {
+	case "lf":
+		eol = "\n"
+	case "crlf":
+		eol = "\r\n"
+	}
+	refactored = normalizeEOL(refactored)
+	if eol == "\r\n" {
+		refactored = strings.ReplaceAll(refactored, "\n", "\r\n")
+	}
+
+	enc := f.enc
+	if p.encoding == "utf8" {
+		enc = textEncoding{}
+	}
+
+	switch enc.name {
+	case encodingUTF16LE, encodingUTF16BE:
+		var order binary.AppendByteOrder = binary.LittleEndian
+		bom := utf16LEBOM
+		if enc.name == encodingUTF16BE {
+			order, bom = binary.BigEndian, utf16BEBOM
+		}
+		var b []byte
+		if enc.bom {
+			b = append(b, bom...)
+		}
+		for _, unit := range utf16.Encode([]rune(refactored)) {
+			b = order.AppendUint16(b, unit)
+		}
+		return b, nil
+	case encodingLatin1:
+		b := make([]byte, 0, len(refactored))
+		for _, r := range refactored {
+			if r > 0xFF {
+				return nil, fmt.Errorf("refactored content contains %q, which cannot be written as Latin-1 (use -encoding utf8)", r)
+			}
+			b = append(b, byte(r))
+		}
+		return b, nil
+	}
+
+	if enc.bom {
+		return append(append([]byte{}, utf8BOM...), refactored...), nil
+	}
+	return []byte(refactored), nil
+}
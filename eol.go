@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// validateEOL checks the value of the -eol flag
+func validateEOL(policy string) error {
+	switch policy {
+	case "preserve", "lf", "crlf":
+		return nil
+	}
+	return fmt.Errorf("unknown line ending policy %q, expected lf, crlf or preserve", policy)
+}
+
+// detectEOL returns "\r\n" if most line breaks of content are CRLF, "\n" otherwise
+func detectEOL(content string) string {
+	crlf := strings.Count(content, "\r\n")
+	if crlf > 0 && crlf >= strings.Count(content, "\n")-crlf {
+		return "\r\n"
+	}
+	return "\n"
+}
+
+// normalizeEOL converts all line breaks of content to LF, so that the model
+// and every structural pass only ever see one kind of line ending
+func normalizeEOL(content string) string {
+	return strings.ReplaceAll(content, "\r\n", "\n")
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// System prompt of the model judging which of two refactorings is better
+const judgeSystemPrompt = "You are a documentation reviewer comparing two refactorings of the same Markdown document. " +
+	"Prefer the one that is clearer, better structured and more accurate to the original, without lost content, " +
+	"invented facts or broken Markdown. Answer tie if neither is clearly better."
+
+// judgeResponseFormat makes the judge return its verdict as JSON
+var judgeResponseFormat = map[string]any{
+	"type": "json_schema",
+	"json_schema": map[string]any{
+		"name":   "judge_verdict",
+		"strict": true,
+		"schema": map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"winner": map[string]any{"type": "string", "enum": []string{"1", "2", "tie"}, "description": "The better refactoring"},
+				"reason": map[string]any{"type": "string", "description": "One sentence explaining the verdict"},
+			},
+			"required":             []string{"winner", "reason"},
+			"additionalProperties": false,
+		},
+	},
+}
+
+// evalVariants are the names of the compared prompt variants
+var evalVariants = [2]string{"A", "B"}
+
+// evalOutput is the refactoring of one corpus document with one prompt variant
+type evalOutput struct {
+	output     string
+	lengthDiff float64 // Change of the word count relative to the input, e.g. -0.1 for 10% shorter
+	lint       int     // Lint problems the input did not have
+	structure  int     // Broken structure invariants
+	err        error
+}
+
+// evalCase is the comparison of both variants on one corpus document
+type evalCase struct {
+	file    string
+	outputs [2]evalOutput
+	winner  string // A, B, tie or empty without a judge
+	reason  string
+}
+
+// evaluateVariant refactors input with a prompt variant and measures the output
+func evaluateVariant(apiKey, model, prompt, input string) evalOutput {
+	output, err := chatCompletion(apiKey, model, []Message{
+		{Role: "system", Content: prompt},
+		{Role: "user", Content: fmt.Sprintf("Refactor the following Markdown content:\n\n%s", input)},
+	})
+	if err != nil {
+		return evalOutput{err: err}
+	}
+	r := evalOutput{output: output}
+	if words := countWords(input); words > 0 {
+		r.lengthDiff = float64(countWords(output)-words) / float64(words)
+	}
+	r.lint = max(len(lintMarkdown(output))-len(lintMarkdown(input)), 0)
+	r.structure = len(structureInvariants{headings: true, code: true, tables: true}.violations(input, output))
+	return r
+}
+
+// judgePair asks the judge model which output is better. The order in which
+// the outputs are shown alternates with swap, to cancel out position bias.
+func judgePair(apiKey, model, input string, outputs [2]evalOutput, swap bool) (string, string, error) {
+	first, second := 0, 1
+	if swap {
+		first, second = 1, 0
+	}
+	reply, err := chatCompletionParams(context.Background(), apiKey, model, []Message{
+		{Role: "system", Content: judgeSystemPrompt},
+		{Role: "user", Content: fmt.Sprintf("Original:\n\n%s\n\n---\n\nRefactoring 1:\n\n%s\n\n---\n\nRefactoring 2:\n\n%s",
+			input, outputs[first].output, outputs[second].output)},
+	}, completionParams{responseFormat: judgeResponseFormat})
+	if err != nil {
+		return "", "", err
+	}
+	var verdict struct {
+		Winner string `json:"winner"`
+		Reason string `json:"reason"`
+	}
+	if err := decodeJSONReply(reply, &verdict); err != nil {
+		return "", "", err
+	}
+	switch verdict.Winner {
+	case "1":
+		return evalVariants[first], verdict.Reason, nil
+	case "2":
+		return evalVariants[second], verdict.Reason, nil
+	}
+	return "tie", verdict.Reason, nil
+}
+
+// writeEvalReport writes the comparison report of both variants as Markdown
+func writeEvalReport(path string, promptFiles []string, model, judge string, cases []evalCase) (string, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Prompt evaluation\n\n")
+	for i, file := range promptFiles {
+		fmt.Fprintf(&b, "- Variant %s: `%s`\n", evalVariants[i], file)
+	}
+	fmt.Fprintf(&b, "- Model: %s\n", model)
+	if judge != "" {
+		fmt.Fprintf(&b, "- Judge: %s\n", judge)
+	}
+	if requestSeed != nil {
+		fmt.Fprintf(&b, "- Seed: %d\n", *requestSeed)
+	}
+
+	var summary strings.Builder
+	summary.WriteString("| Variant | Avg length change | New lint problems | Structure violations | Judge wins | Failed |\n")
+	summary.WriteString("| --- | --- | --- | --- | --- | --- |\n")
+	for v := range evalVariants {
+		ok, failed, lint, structure, wins := 0, 0, 0, 0, 0
+		length := 0.0
+		for _, c := range cases {
+			r := c.outputs[v]
+			if r.err != nil {
+				failed++
+				continue
+			}
+			ok++
+			length += r.lengthDiff
+			lint += r.lint
+			structure += r.structure
+			if c.winner == evalVariants[v] {
+				wins++
+			}
+		}
+		avg, winCol := "n/a", "n/a"
+		if ok > 0 {
+			avg = fmt.Sprintf("%+.0f%%", 100*length/float64(ok))
+		}
+		if judge != "" {
+			winCol = fmt.Sprint(wins)
+		}
+		fmt.Fprintf(&summary, "| %s | %s | %d | %d | %s | %d |\n", evalVariants[v], avg, lint, structure, winCol, failed)
+	}
+	fmt.Fprintf(&b, "\n## Summary\n\n%s", summary.String())
+
+	b.WriteString("\n## Documents\n\n| Document | Length A | Length B | Lint A | Lint B | Structure A | Structure B | Judge |\n")
+	b.WriteString("| --- | --- | --- | --- | --- | --- | --- | --- |\n")
+	cell := func(r evalOutput, f func(evalOutput) string) string {
+		if r.err != nil {
+			return "failed"
+		}
+		return f(r)
+	}
+	for _, c := range cases {
+		verdict := c.winner
+		if c.reason != "" {
+			verdict += ": " + strings.ReplaceAll(c.reason, "|", `\|`)
+		}
+		fmt.Fprintf(&b, "| %s | %s | %s | %s | %s | %s | %s | %s |\n", c.file,
+			cell(c.outputs[0], func(r evalOutput) string { return fmt.Sprintf("%+.0f%%", 100*r.lengthDiff) }),
+			cell(c.outputs[1], func(r evalOutput) string { return fmt.Sprintf("%+.0f%%", 100*r.lengthDiff) }),
+			cell(c.outputs[0], func(r evalOutput) string { return fmt.Sprint(r.lint) }),
+			cell(c.outputs[1], func(r evalOutput) string { return fmt.Sprint(r.lint) }),
+			cell(c.outputs[0], func(r evalOutput) string { return fmt.Sprint(r.structure) }),
+			cell(c.outputs[1], func(r evalOutput) string { return fmt.Sprint(r.structure) }),
+			verdict)
+	}
+	return summary.String(), writeFileAtomic(path, []byte(b.String()), 0644)
+}
+
+// runEvalCommand implements the eval subcommand
+func runEvalCommand(args []string) error {
+	fs := flag.NewFlagSet("eval", flag.ExitOnError)
+	apiKey := fs.String("apikey", os.Getenv("OPENAI_API_KEY"), "OpenAI API key (can also be set via OPENAI_API_KEY environment variable)")
+	addAPIFlags(fs)
+	model := fs.String("model", defaultModel, "OpenAI model to refactor with")
+	prompts := fs.String("prompts", "", "Two files with the system prompts to compare, comma-separated (required)")
+	corpus := fs.String("corpus", "", "Directory of sample Markdown documents to refactor (required)")
+	judge := fs.Bool("judge", false, "Have a model judge which variant's output is better for every document")
+	judgeModel := fs.String("judge-model", "", "Model judging the outputs, the -model by default")
+	outDir := fs.String("o", "eval", "Directory to write the outputs of both variants and the report to")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: mdrefactor eval -prompts a.txt,b.txt -corpus <dir> [flags]")
+		fmt.Fprintln(fs.Output(), "Runs two prompt variants over a corpus and compares length change, lint problems, structure and optionally a model's preference.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	var promptFiles []string
+	for _, p := range strings.Split(*prompts, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			promptFiles = append(promptFiles, p)
+		}
+	}
+	if len(promptFiles) != 2 || *corpus == "" {
+		fs.Usage()
+		return fmt.Errorf("two prompt files and a corpus directory are required")
+	}
+	var variants [2]string
+	for i, file := range promptFiles {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("failed to read prompt %s: %w", file, err)
+		}
+		variants[i] = strings.TrimSpace(string(data))
+	}
+	if *judgeModel == "" {
+		*judgeModel = *model
+	}
+	files, err := findMarkdownFiles(*corpus)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no Markdown files found in %s", *corpus)
+	}
+
+	var cases []evalCase
+	for i, rel := range files {
+		data, err := os.ReadFile(filepath.Join(*corpus, rel))
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", rel, err)
+		}
+		input := decodeSource(data).text
+		c := evalCase{file: filepath.ToSlash(rel)}
+		for v, prompt := range variants {
+			fmt.Printf("Refactoring %s with variant %s...\n", rel, evalVariants[v])
+			c.outputs[v] = evaluateVariant(*apiKey, *model, prompt, input)
+			if err := c.outputs[v].err; err != nil {
+				fmt.Fprintf(os.Stderr, "Error refactoring %s with variant %s: %v\n", rel, evalVariants[v], err)
+				continue
+			}
+			out := filepath.Join(*outDir, evalVariants[v], rel)
+			if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+				return err
+			}
+			if err := writeFileAtomic(out, []byte(c.outputs[v].output), 0644); err != nil {
+				return fmt.Errorf("failed to write %s: %w", out, err)
+			}
+		}
+		if *judge && c.outputs[0].err == nil && c.outputs[1].err == nil {
+			fmt.Printf("Judging %s...\n", rel)
+			if c.winner, c.reason, err = judgePair(*apiKey, *judgeModel, input, c.outputs, i%2 == 1); err != nil {
+				fmt.Fprintf(os.Stderr, "Error judging %s: %v\n", rel, err)
+			}
+		}
+		cases = append(cases, c)
+	}
+
+	judgeName := ""
+	if *judge {
+		judgeName = *judgeModel
+	}
+	if err := os.MkdirAll(*outDir, 0755); err != nil {
+		return err
+	}
+	report := filepath.Join(*outDir, "report.md")
+	summary, err := writeEvalReport(report, promptFiles, *model, judgeName, cases)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", report, err)
+	}
+	fmt.Printf("\n%s\nReport written to %s\n", summary, report)
+	return nil
+}
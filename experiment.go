@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// experimentRun is the outcome of refactoring the sample document with one
+// combination of parameters
+type experimentRun struct {
+	model       string
+	temperature *float64
+	file        string // Output file, relative to the output directory
+	output      string
+	fingerprint string // system_fingerprint of the response
+	duration    time.Duration
+	err         error
+}
+
+// label returns the temperature of the run as shown in file names and the report
+func (r experimentRun) label() string {
+	if r.temperature == nil {
+		return "default"
+	}
+	return strconv.FormatFloat(*r.temperature, 'f', -1, 64)
+}
+
+// parseTemperatures parses a comma-separated list of sampling temperatures.
+// An empty list stands for a single run at the API default.
+func parseTemperatures(s string) ([]*float64, error) {
+	if strings.TrimSpace(s) == "" {
+		return []*float64{nil}, nil
+	}
+	var temperatures []*float64
+	for _, field := range strings.Split(s, ",") {
+		t, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil || t < 0 || t > 2 {
+			return nil, fmt.Errorf("invalid temperature %q, expected a number between 0 and 2", field)
+		}
+		temperatures = append(temperatures, &t)
+	}
+	return temperatures, nil
+}
+
+// experimentFileName returns the output file name of a run, safe for model
+// names such as "org/model:tag"
+func experimentFileName(model, temperature string) string {
+	name := strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`/\:*?"<>| `, r) {
+			return '-'
+		}
+		return r
+	}, model)
+	return fmt.Sprintf("%s_t%s.md", name, temperature)
+}
+
+// writeExperimentReport writes a Markdown table comparing the runs against the input
+func writeExperimentReport(path, input, inputName, prompt string, runs []experimentRun) error {
+	before := analyzeStructure(input)
+	inputWords := countWords(input)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Refactoring experiment\n\n")
+	fmt.Fprintf(&b, "Input: `%s` (%d words, grade level %.1f, %d headings, %d code blocks)\n\n", inputName, inputWords, gradeLevel(input), before.headings, len(before.codeBlocks))
+	fmt.Fprintf(&b, "System prompt:\n\n> %s\n\n", strings.ReplaceAll(prompt, "\n", "\n> "))
+	if requestSeed != nil {
+		fmt.Fprintf(&b, "Seed: %d\n\n", *requestSeed)
+	}
+	b.WriteString("| Model | Temperature | Words | Length | Grade level | Headings | Code blocks kept | Time | Fingerprint | Output |\n")
+	b.WriteString("| --- | --- | --- | --- | --- | --- | --- | --- | --- | --- |\n")
+	for _, r := range runs {
+		if r.err != nil {
+			fmt.Fprintf(&b, "| %s | %s | | | | | | %s | | Error: %s |\n", r.model, r.label(), r.duration.Round(time.Millisecond),
+				strings.ReplaceAll(r.err.Error(), "|", `\|`))
+			continue
+		}
+		after := analyzeStructure(r.output)
+		words := countWords(r.output)
+		length := "n/a"
+		if inputWords > 0 {
+			length = fmt.Sprintf("%+.0f%%", 100*float64(words-inputWords)/float64(inputWords))
+		}
+		kept := len(before.codeBlocks) - len(missing(before.codeBlocks, after.codeBlocks))
+		fmt.Fprintf(&b, "| %s | %s | %d | %s | %.1f | %d | %d/%d | %s | %s | [%s](%s) |\n", r.model, r.label(), words, length,
+			gradeLevel(r.output), after.headings, kept, len(before.codeBlocks), r.duration.Round(time.Millisecond), r.fingerprint, r.file, r.file)
+	}
+	return writeFileAtomic(path, []byte(b.String()), 0644)
+}
+
+// runExperimentCommand implements the experiment subcommand
+func runExperimentCommand(args []string) error {
+	fs := flag.NewFlagSet("experiment", flag.ExitOnError)
+	apiKey := fs.String("apikey", os.Getenv("OPENAI_API_KEY"), "OpenAI API key (can also be set via OPENAI_API_KEY environment variable)")
+	addAPIFlags(fs)
+	models := fs.String("models", defaultModel, "Comma-separated list of models to compare")
+	temperatures := fs.String("temperatures", "", "Comma-separated list of sampling temperatures to compare (e.g. 0,0.3,0.7; defaults to the API default)")
+	systemPrompt := fs.String("prompt", defaultSystemPrompt, "System prompt to guide the AI refactoring")
+	outDir := fs.String("o", "experiment", "Directory to write the outputs and the comparison report to")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: mdrefactor experiment [flags] <document>")
+		fmt.Fprintln(fs.Output(), "Refactors the document with every combination of model and temperature and writes a comparison report.")
+		fs.PrintDefaults()
+	}
+	positional := parseArgs(fs, args)
+	if len(positional) != 1 {
+		fs.Usage()
+		return fmt.Errorf("a sample document is required")
+	}
+	inputFile := positional[0]
+
+	temps, err := parseTemperatures(*temperatures)
+	if err != nil {
+		return err
+	}
+	var modelList []string
+	for _, m := range strings.Split(*models, ",") {
+		if m = strings.TrimSpace(m); m != "" {
+			modelList = append(modelList, m)
+		}
+	}
+	if len(modelList) == 0 {
+		return fmt.Errorf("at least one model is required")
+	}
+
+	data, err := os.ReadFile(inputFile)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", inputFile, err)
+	}
+	input := decodeSource(data).text
+	if err := os.MkdirAll(*outDir, 0755); err != nil {
+		return fmt.Errorf("failed to create output directory %s: %w", *outDir, err)
+	}
+
+	messages := []Message{
+		{Role: "system", Content: *systemPrompt},
+		{Role: "user", Content: fmt.Sprintf("Refactor the following Markdown content:\n\n%s", input)},
+	}
+	var runs []experimentRun
+	for _, model := range modelList {
+		for _, t := range temps {
+			r := experimentRun{model: model, temperature: t}
+			fmt.Printf("Running %s at temperature %s...\n", model, r.label())
+			start := time.Now()
+			resp, err := chatCompletionResponse(context.Background(), *apiKey, model, messages, completionParams{temperature: t})
+			r.duration = time.Since(start)
+			if err != nil {
+				r.err = err
+				fmt.Fprintf(os.Stderr, "Error running %s at temperature %s: %v\n", model, r.label(), err)
+			} else {
+				r.output, r.fingerprint = resp.Choices[0].Message.Content, resp.SystemFingerprint
+				r.file = experimentFileName(model, r.label())
+				if err := writeFileAtomic(filepath.Join(*outDir, r.file), []byte(strings.TrimRight(r.output, "\n")+"\n"), 0644); err != nil {
+					return fmt.Errorf("failed to write %s: %w", r.file, err)
+				}
+			}
+			runs = append(runs, r)
+		}
+	}
+
+	report := filepath.Join(*outDir, "report.md")
+	if err := writeExperimentReport(report, input, filepath.Base(inputFile), *systemPrompt, runs); err != nil {
+		return fmt.Errorf("failed to write report %s: %w", report, err)
+	}
+	fmt.Printf("Report of %d runs written to %s\n", len(runs), report)
+	return nil
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	// System prompt used to distill questions from support conversations
+	faqSystemPrompt = "You are a support engineer building an FAQ from support conversations. Find the questions users " +
+		"ask, merge variants of the same question into one, and answer each one with what the conversation established, " +
+		"in a few sentences of Markdown. Leave out questions that were not answered, small talk and anything specific " +
+		"to a single user's account. Write questions the way a user would ask them."
+	// Word overlap above which two questions are considered the same
+	faqDuplicateThreshold = 0.6
+)
+
+var (
+	// Blocks whose content is not part of the conversation
+	htmlNoiseRe = regexp.MustCompile(`(?is)<(script|style|head)\b.*?</(script|style|head)>`)
+	// Tags ending a line of text
+	htmlBreakRe = regexp.MustCompile(`(?i)<br\s*/?>|</(p|div|li|tr|h[1-6]|blockquote|pre)>`)
+	// Slack user mentions and links, <@U123> or <https://example.com|text>
+	slackMarkupRe = regexp.MustCompile(`<([^<>|]+)\|([^<>]+)>`)
+)
+
+// faqEntry is a question distilled from the conversations
+type faqEntry struct {
+	Question string `json:"question"`
+	Answer   string `json:"answer"`
+	Count    int    `json:"count"`
+}
+
+// faqResponseFormat makes the API return the distilled entries as JSON
+var faqResponseFormat = map[string]any{
+	"type": "json_schema",
+	"json_schema": map[string]any{
+		"name":   "faq_entries",
+		"strict": true,
+		"schema": map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"entries": map[string]any{
+					"type": "array",
+					"items": map[string]any{
+						"type": "object",
+						"properties": map[string]any{
+							"question": map[string]any{"type": "string", "description": "The question as a user would ask it"},
+							"answer":   map[string]any{"type": "string", "description": "Markdown answer based on the conversation"},
+							"count":    map[string]any{"type": "integer", "description": "How many times the question or a variant of it was asked"},
+						},
+						"required":             []string{"question", "answer", "count"},
+						"additionalProperties": false,
+					},
+				},
+			},
+			"required":             []string{"entries"},
+			"additionalProperties": false,
+		},
+	},
+}
+
+// chatMessages collects the messages of a JSON chat export as "author: text"
+// lines. Slack exports (arrays of messages with text and user_profile) and
+// exports with messages holding content and author both work.
+func chatMessages(v any, lines *[]string) {
+	switch v := v.(type) {
+	case []any:
+		for _, item := range v {
+			chatMessages(item, lines)
+		}
+	case map[string]any:
+		text, _ := v["text"].(string)
+		if text == "" {
+			text, _ = v["content"].(string)
+		}
+		if strings.TrimSpace(text) != "" {
+			// Rich text blocks and attachments of a message repeat its text
+			*lines = append(*lines, fmt.Sprintf("%s: %s", chatAuthor(v), slackMarkupRe.ReplaceAllString(strings.TrimSpace(text), "$2")))
+			return
+		}
+		for _, key := range sortedKeys(v) {
+			chatMessages(v[key], lines)
+		}
+	}
+}
+
+// chatAuthor returns the name of the author of a JSON chat message
+func chatAuthor(msg map[string]any) string {
+	for _, key := range []string{"user_profile", "author"} {
+		if profile, ok := msg[key].(map[string]any); ok {
+			for _, field := range []string{"real_name", "display_name", "name"} {
+				if name, ok := profile[field].(string); ok && name != "" {
+					return name
+				}
+			}
+		}
+	}
+	for _, key := range []string{"user_name", "username", "author", "user"} {
+		if name, ok := msg[key].(string); ok && name != "" {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// htmlText returns the text of an HTML page, one line per block
+func htmlText(page string) string {
+	page = htmlNoiseRe.ReplaceAllString(page, "")
+	page = htmlBreakRe.ReplaceAllString(page, "\n")
+	page = html.UnescapeString(htmlTagRe.ReplaceAllString(page, ""))
+	var lines []string
+	for _, line := range strings.Split(page, "\n") {
+		if line = strings.Join(strings.Fields(line), " "); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// readChatExport returns the conversation of an exported support thread as text
+func readChatExport(file string) (string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", file, err)
+	}
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".json":
+		var v any
+		if err := json.Unmarshal(data, &v); err != nil {
+			return "", fmt.Errorf("failed to parse %s: %w", file, err)
+		}
+		var lines []string
+		chatMessages(v, &lines)
+		if len(lines) == 0 {
+			return "", fmt.Errorf("no messages found in %s", file)
+		}
+		return strings.Join(lines, "\n"), nil
+	case ".html", ".htm":
+		return htmlText(decodeSource(data).text), nil
+	}
+	return decodeSource(data).text, nil
+}
+
+// questionWords returns the set of lowercase words of a question
+func questionWords(q string) map[string]bool {
+	words := make(map[string]bool)
+	for _, w := range strings.Fields(strings.ToLower(q)) {
+		if w = strings.Trim(w, ".,;:!?()\"'`*"); w != "" {
+			words[w] = true
+		}
+	}
+	return words
+}
+
+// sameQuestion reports whether two questions share most of their words
+func sameQuestion(a, b string) bool {
+	wa, wb := questionWords(a), questionWords(b)
+	if len(wa) == 0 || len(wb) == 0 {
+		return false
+	}
+	shared := 0
+	for w := range wa {
+		if wb[w] {
+			shared++
+		}
+	}
+	return float64(shared)/float64(len(wa)+len(wb)-shared) >= faqDuplicateThreshold
+}
+
+// distillFAQ asks the model for the questions of each chunk of the
+// conversations and merges repeated questions across chunks
+func distillFAQ(apiKey, model, conversations string, existing []string) ([]faqEntry, error) {
+	known := ""
+	if len(existing) > 0 {
+		known = "\n\nThe FAQ already answers these questions, leave them out:\n- " + strings.Join(existing, "\n- ")
+	}
+
+	var entries []faqEntry
+	chunks := splitIntoChunks(conversations, chunkSizeFor(model))
+	for i, chunk := range chunks {
+		if len(chunks) > 1 {
+			fmt.Printf("Distilling questions from part %d of %d...\n", i+1, len(chunks))
+		}
+		reply, err := chatCompletionParams(context.Background(), apiKey, model, []Message{
+			{Role: "system", Content: faqSystemPrompt + known},
+			{Role: "user", Content: "Distill the frequently asked questions from these support conversations.\n\n" + chunk},
+		}, completionParams{responseFormat: faqResponseFormat})
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Entries []faqEntry `json:"entries"`
+		}
+		if err := decodeJSONReply(reply, &result); err != nil {
+			return nil, err
+		}
+
+	next:
+		for _, e := range result.Entries {
+			e.Question, e.Answer = strings.TrimSpace(e.Question), strings.TrimSpace(e.Answer)
+			if e.Question == "" || e.Answer == "" {
+				continue
+			}
+			for j := range entries {
+				if sameQuestion(entries[j].Question, e.Question) {
+					entries[j].Count += max(e.Count, 1)
+					if len(e.Answer) > len(entries[j].Answer) {
+						entries[j].Answer = e.Answer
+					}
+					continue next
+				}
+			}
+			e.Count = max(e.Count, 1)
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+// splitIntoChunks splits text at line boundaries into chunks of about size bytes
+func splitIntoChunks(text string, size int) []string {
+	var chunks []string
+	var b strings.Builder
+	for _, line := range strings.Split(text, "\n") {
+		if b.Len() > 0 && b.Len()+len(line) > size {
+			chunks = append(chunks, b.String())
+			b.Reset()
+		}
+		b.WriteString(line)
+		b.WriteString("\n")
+	}
+	if b.Len() > 0 {
+		chunks = append(chunks, b.String())
+	}
+	return chunks
+}
+
+// faqQuestions returns the questions of an FAQ document: its headings below the title
+func faqQuestions(content string) []string {
+	var questions []string
+	for _, h := range parseHeadings(content) {
+		if h.level >= 2 {
+			questions = append(questions, h.text)
+		}
+	}
+	return questions
+}
+
+// runFAQCommand implements the faq subcommand
+func runFAQCommand(args []string) error {
+	fs := flag.NewFlagSet("faq", flag.ExitOnError)
+	apiKey := fs.String("apikey", os.Getenv("OPENAI_API_KEY"), "OpenAI API key (can also be set via OPENAI_API_KEY environment variable)")
+	addAPIFlags(fs)
+	model := fs.String("model", defaultModel, "OpenAI model to use (must support structured outputs)")
+	output := fs.String("o", "FAQ.md", "FAQ document to create or add the new questions to")
+	minCount := fs.Int("min-count", 2, "Only add questions asked at least this many times")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: mdrefactor faq [flags] <export>...")
+		fmt.Fprintln(fs.Output(), "Distills the recurring questions of exported support threads (Slack or other JSON exports, HTML or text) into an FAQ.")
+		fs.PrintDefaults()
+	}
+	positional := parseArgs(fs, args)
+	if len(positional) == 0 {
+		fs.Usage()
+		return fmt.Errorf("at least one exported thread is required")
+	}
+
+	var conversations []string
+	for _, file := range positional {
+		text, err := readChatExport(file)
+		if err != nil {
+			return err
+		}
+		conversations = append(conversations, text)
+	}
+
+	faq := "# Frequently asked questions\n"
+	if data, err := os.ReadFile(*output); err == nil {
+		faq = decodeSource(data).text
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read %s: %w", *output, err)
+	}
+	existing := faqQuestions(faq)
+
+	entries, err := distillFAQ(*apiKey, *model, strings.Join(conversations, "\n\n"), existing)
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Count > entries[j].Count })
+
+	var b strings.Builder
+	added, skipped := 0, 0
+	for _, e := range entries {
+		if e.Count < *minCount {
+			continue
+		}
+		duplicate := false
+		for _, q := range existing {
+			if sameQuestion(q, e.Question) {
+				duplicate = true
+				break
+			}
+		}
+		if duplicate {
+			fmt.Printf("Skipped %q, already answered by the FAQ\n", e.Question)
+			skipped++
+			continue
+		}
+		fmt.Fprintf(&b, "\n## %s\n\n%s\n", e.Question, e.Answer)
+		existing = append(existing, e.Question)
+		added++
+	}
+	if added == 0 {
+		fmt.Printf("No new recurring questions found (%d distilled, %d already in %s)\n", len(entries), skipped, *output)
+		return nil
+	}
+
+	if err := writeFileAtomic(*output, []byte(strings.TrimRight(faq, "\n")+"\n"+b.String()), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", *output, err)
+	}
+	fmt.Printf("Added %d questions to %s\n", added, *output)
+	return nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// Input files larger than this are refactored chunk by chunk instead of being loaded whole
+	defaultStreamThreshold = 4 << 20
+	// Target size in bytes of a chunk sent to the model when streaming a large file
+	defaultChunkSize = 32 << 10
+)
+
+// writeFileAtomic writes data to a temporary file next to path and renames it
+// into place, so an interrupted run never leaves a half-written file behind.
+// An existing file keeps its permissions.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	f, err := createTempFor(path, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	return commitTemp(f, path)
+}
+
+// createTempFor creates a temporary file in the directory of path that
+// commitTemp later renames to path
+func createTempFor(path string, perm os.FileMode) (*os.File, error) {
+	path = fsPath(path)
+	if info, err := os.Stat(path); err == nil {
+		perm = info.Mode().Perm()
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return f, nil
+}
+
+// commitTemp flushes and closes a file created by createTempFor and renames it to path
+func commitTemp(f *os.File, path string) error {
+	err := f.Sync()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), fsPath(path))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// chunkReader reads a Markdown document incrementally and returns it in
+// chunks of roughly size bytes that end at a blank line outside code fences
+type chunkReader struct {
+	r       *bufio.Reader
+	size    int
+	inFence bool
+}
+
+// next returns the next chunk, or io.EOF once the document is exhausted
+func (c *chunkReader) next() (string, error) {
+	var chunk strings.Builder
+	for {
+		line, err := c.r.ReadString('\n')
+		chunk.WriteString(line)
+		if isFenceLine(line) {
+			c.inFence = !c.inFence
+		}
+		if err == io.EOF {
+			if chunk.Len() == 0 {
+				return "", io.EOF
+			}
+			return chunk.String(), nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if !c.inFence && strings.TrimSpace(line) == "" && chunk.Len() >= c.size {
+			return chunk.String(), nil
+		}
+	}
+}
+
+// canStream reports whether the file at path is large enough to be streamed
+// and encoded in UTF-8, which is the only encoding that can be decoded chunk by chunk
+func canStream(path string, threshold int64) bool {
+	info, err := os.Stat(path)
+	if err != nil || threshold <= 0 || info.Size() <= threshold {
+		return false
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(f, head); err != nil {
+		return false
+	}
+	return !bytes.Equal(head, utf16LEBOM) && !bytes.Equal(head, utf16BEBOM)
+}
+
+// refactorLargeFile refactors the file at inPath chunk by chunk, so that it
+// is never held in memory as a whole, and writes the result to outPath (or
+// stdout if empty) through a temporary file as the chunks come back
+func refactorLargeFile(inPath, outPath string, chunkSize int, policy outputPolicy, refactor func(chunk string) (string, error)) error {
+	in, err := os.Open(fsPath(inPath))
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", inPath, err)
+	}
+	defer in.Close()
+	r := bufio.NewReader(in)
+
+	source := sourceFile{}
+	if head, _ := r.Peek(len(utf8BOM)); bytes.Equal(head, utf8BOM) {
+		r.Discard(len(utf8BOM))
+		source.enc.bom = true
+	}
+
+	// A file refactored in place must not be overwritten if it was edited
+	// meanwhile; unlike whole files, a streamed one cannot be merged
+	var inPlace os.FileInfo
+	if outPath != "" {
+		if info, err := in.Stat(); err == nil && sameFile(info, outPath) {
+			inPlace = info
+		}
+	}
+
+	var out io.Writer = os.Stdout
+	var tmp *os.File
+	if outPath != "" {
+		if tmp, err = createTempFor(outPath, 0644); err != nil {
+			return fmt.Errorf("failed to create output file for %s: %w", outPath, err)
+		}
+		defer func() {
+			if tmp != nil {
+				tmp.Close()
+				os.Remove(tmp.Name())
+			}
+		}()
+		out = tmp
+	}
+
+	chunks := &chunkReader{r: r, size: chunkSize}
+	for i := 0; ; i++ {
+		chunk, err := chunks.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", inPath, err)
+		}
+		if !utf8.ValidString(chunk) {
+			return fmt.Errorf("%s is not valid UTF-8 and too large to be converted in memory", inPath)
+		}
+		if i == 0 {
+			source.eol = detectEOL(chunk)
+		} else {
+			// Only the first chunk carries the byte order mark
+			source.enc.bom = false
+		}
+
+		fmt.Fprintf(os.Stderr, "Refactoring chunk %d (%d bytes)...\n", i+1, len(chunk))
+		refactored, err := refactor(normalizeEOL(chunk))
+		if err != nil {
+			return fmt.Errorf("failed to refactor chunk %d: %w", i+1, err)
+		}
+		if i > 0 {
+			refactored = "\n" + refactored
+		}
+		data, err := source.encode(strings.TrimRight(refactored, "\n")+"\n", policy)
+		if err != nil {
+			return err
+		}
+		if _, err := out.Write(data); err != nil {
+			return fmt.Errorf("failed to write refactored content: %w", err)
+		}
+	}
+
+	if inPlace != nil {
+		if info, err := os.Stat(fsPath(inPath)); err != nil || !info.ModTime().Equal(inPlace.ModTime()) || info.Size() != inPlace.Size() {
+			return fmt.Errorf("%s changed on disk while it was being refactored, left it alone; refactor it again once the edits are done", inPath)
+		}
+	}
+	if tmp != nil {
+		f := tmp
+		tmp = nil
+		if err := commitTemp(f, outPath); err != nil {
+			return fmt.Errorf("failed to write output file %s: %w", outPath, err)
+		}
+	}
+	return nil
+}
+
+// sameFile reports whether path is the file described by info
+func sameFile(info os.FileInfo, path string) bool {
+	other, err := os.Stat(fsPath(path))
+	return err == nil && os.SameFile(info, other)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// contextAround returns up to n lines before and after the 1-based, inclusive
+// line range start..end of the file at path
+func contextAround(path string, start, end, n int) (string, string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read context file %s: %w", path, err)
+	}
+	lines := strings.Split(decodeSource(data).text, "\n")
+	if start > len(lines) {
+		return "", "", fmt.Errorf("line range starts at %d but %s only has %d lines", start, path, len(lines))
+	}
+	end = min(end, len(lines))
+
+	before := lines[max(0, start-1-n) : start-1]
+	after := lines[end:min(len(lines), end+n)]
+	return strings.Join(before, "\n"), strings.Join(after, "\n"), nil
+}
+
+// filterPrompt tells the model that it is refactoring an excerpt and shows it
+// the text around the excerpt, which must not be repeated in the reply
+func filterPrompt(systemPrompt, before, after string) string {
+	if strings.TrimSpace(before) == "" && strings.TrimSpace(after) == "" {
+		return systemPrompt + "\n\nThe content is an excerpt of a larger document. Reply with the replacement for the excerpt only."
+	}
+	return fmt.Sprintf("%s\n\nThe content is an excerpt of a larger document. Keep it consistent with the surrounding text shown below, "+
+		"but reply with the replacement for the excerpt only and do not repeat the surrounding text.\n\n"+
+		"Text before the excerpt:\n<<<\n%s\n>>>\n\nText after the excerpt:\n<<<\n%s\n>>>", systemPrompt, before, after)
+}
+
+// runFilter reads a selection from r, refactors it and writes nothing but the
+// replacement to w, ending it with a newline if the selection ended with one,
+// so it can replace the selection of an editor filter command
+func runFilter(r io.Reader, w io.Writer, systemPrompt string, refactor refactorFunc) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("failed to read selection from stdin: %w", err)
+	}
+	source := decodeSource(data)
+	if strings.TrimSpace(source.text) == "" {
+		// Nothing to refactor; hand the selection back unchanged
+		_, err := w.Write(data)
+		return err
+	}
+
+	refactored, err := refactor(systemPrompt, source.text)
+	if err != nil {
+		return err
+	}
+	refactored = strings.TrimRight(refactored, "\n")
+	if strings.HasSuffix(source.text, "\n") {
+		refactored += "\n"
+	}
+	out, err := source.encode(refactored, outputPolicy{eol: "preserve", encoding: "preserve"})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(out)
+	return err
+}
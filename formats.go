@@ -0,0 +1,335 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackmbuda/go-mdrefactor/mdrefactor"
+)
+
+// formatStyle is how dates, numbers and units are written across a docs
+// tree, the formats section of the config file
+type formatStyle struct {
+	Dates     string  `json:"dates"`     // iso rewrites dates as YYYY-MM-DD, empty leaves them alone
+	Locale    string  `json:"locale"`    // Language the docs are written in, deciding how 03/04/2024 and 1.000,5 are read
+	Thousands *string `json:"thousands"` // Thousands separator, e.g. "," or " ", "" for none
+	Decimal   string  `json:"decimal"`   // Decimal mark, "." or ","
+	Units     string  `json:"units"`     // space puts a space between a number and its unit (10 MB), empty leaves them alone
+}
+
+// Style applied by -normalize-formats, set from the config file
+var configFormatStyle formatStyle
+
+// applyFormatConfig applies the formats section of the config file
+func applyFormatConfig(cfg formatStyle) error {
+	if cfg.Dates != "" && cfg.Dates != "iso" {
+		return fmt.Errorf("invalid formats.dates %q, expected iso", cfg.Dates)
+	}
+	if cfg.Decimal != "" && cfg.Decimal != "." && cfg.Decimal != "," {
+		return fmt.Errorf("invalid formats.decimal %q, expected . or ,", cfg.Decimal)
+	}
+	if cfg.Units != "" && cfg.Units != "space" {
+		return fmt.Errorf("invalid formats.units %q, expected space", cfg.Units)
+	}
+	configFormatStyle = cfg
+	return nil
+}
+
+// withDefaults fills in the parts of the style the config leaves open,
+// with separators following the locale
+func (s formatStyle) withDefaults() formatStyle {
+	if s.Dates == "" {
+		s.Dates = "iso"
+	}
+	if s.Locale == "" {
+		s.Locale = "en-US"
+	}
+	thousands, decimal := ",", "."
+	if s.decimalComma() {
+		thousands, decimal = ".", ","
+	}
+	if s.Thousands == nil {
+		s.Thousands = &thousands
+	}
+	if s.Decimal == "" {
+		s.Decimal = decimal
+	}
+	if s.Units == "" {
+		s.Units = "space"
+	}
+	return s
+}
+
+// monthFirst reports whether the locale writes numeric dates month first, as in the US
+func (s formatStyle) monthFirst() bool {
+	return s.Locale == "en-US" || s.Locale == "en"
+}
+
+// decimalComma reports whether the locale writes 1.000,5 rather than 1,000.5
+func (s formatStyle) decimalComma() bool {
+	switch strings.ToLower(strings.SplitN(strings.ReplaceAll(s.Locale, "_", "-"), "-", 2)[0]) {
+	case "de", "fr", "es", "it", "pt", "nl", "da", "nb", "no", "sv", "fi", "pl", "cs", "ru", "uk", "tr":
+		return true
+	}
+	return false
+}
+
+var (
+	monthNames = map[string]int{
+		"jan": 1, "january": 1, "feb": 2, "february": 2, "mar": 3, "march": 3, "apr": 4, "april": 4, "may": 5,
+		"jun": 6, "june": 6, "jul": 7, "july": 7, "aug": 8, "august": 8, "sep": 9, "sept": 9, "september": 9,
+		"oct": 10, "october": 10, "nov": 11, "november": 11, "dec": 12, "december": 12,
+	}
+	unitPattern  = `(KiB|MiB|GiB|TiB|kB|KB|MB|GB|TB|PB|ms|µs|ns|kHz|MHz|GHz|Hz|km|cm|mm|kg|mg|Mbps|Gbps|px|pt|em|rem)`
+	monthPattern = `(Jan(?:uary)?|Feb(?:ruary)?|Mar(?:ch)?|Apr(?:il)?|May|June?|July?|Aug(?:ust)?|Sept?(?:ember)?|Oct(?:ober)?|Nov(?:ember)?|Dec(?:ember)?)\.?`
+	// March 5, 2024 and Mar 5th 2024
+	monthDayYearRe = regexp.MustCompile(`\b` + monthPattern + ` (\d{1,2})(?:st|nd|rd|th)?,? (\d{4})\b`)
+	// 5 March 2024 and 5th of March, 2024
+	dayMonthYearRe = regexp.MustCompile(`\b(\d{1,2})(?:st|nd|rd|th)?(?: of)? ` + monthPattern + `,? (\d{4})\b`)
+	// 03/05/2024, 03-05-2024 and 05.03.2024
+	numericDateRe = regexp.MustCompile(`\b(\d{1,2})([/.-])(\d{1,2})([/.-])(\d{4})\b`)
+	// 2024/3/5 and 2024.03.05
+	yearFirstDateRe = regexp.MustCompile(`\b(\d{4})[/.](\d{1,2})[/.](\d{1,2})\b`)
+	// ISO dates, which the pass produces
+	isoDateRe = regexp.MustCompile(`\b\d{4}-\d{2}-\d{2}\b`)
+	// Dates with a two-digit year, which cannot be normalized safely
+	shortYearDateRe = regexp.MustCompile(`\b\d{1,2}/\d{1,2}/\d{2}\b`)
+	// Numbers grouped by thousands in either convention, with decimals. Plain
+	// spaces are not taken as separators, they too often separate two numbers.
+	groupedNumberRe = regexp.MustCompile(`\b\d{1,3}(?:([,.'\x{00A0}\x{202F}])\d{3})+(?:([.,])\d+)?\b`)
+	// IPv4 addresses, which look like numbers grouped by dots
+	ipAddressRe = regexp.MustCompile(`^\d{1,3}(?:\.\d{1,3}){3}$`)
+	// A number directly followed by a unit
+	unitRe = regexp.MustCompile(`\b(\d+(?:[.,]\d+)?)` + unitPattern + `\b`)
+	// A quantity as the pass writes it
+	quantityRe = regexp.MustCompile(`\b\d+(?:[.,]\d+)? ` + unitPattern + `\b`)
+	// URLs and link targets, which are never rewritten
+	linkTargetRe = regexp.MustCompile(`\]\([^)]*\)|<[a-z]+://[^>]*>|[a-z][a-z0-9+.-]*://\S+`)
+)
+
+// isoDate formats a date as YYYY-MM-DD, or returns false if it does not exist
+func isoDate(year, month, day int) (string, bool) {
+	t := time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
+	if month < 1 || month > 12 || t.Day() != day {
+		return "", false
+	}
+	return t.Format("2006-01-02"), true
+}
+
+// normalizeDates rewrites the dates of text as ISO 8601
+func (s formatStyle) normalizeDates(text string) string {
+	text = monthDayYearRe.ReplaceAllStringFunc(text, func(m string) string {
+		sub := monthDayYearRe.FindStringSubmatch(m)
+		day, _ := strconv.Atoi(sub[2])
+		year, _ := strconv.Atoi(sub[3])
+		if iso, ok := isoDate(year, monthNames[strings.ToLower(sub[1])], day); ok {
+			return iso
+		}
+		return m
+	})
+	text = dayMonthYearRe.ReplaceAllStringFunc(text, func(m string) string {
+		sub := dayMonthYearRe.FindStringSubmatch(m)
+		day, _ := strconv.Atoi(sub[1])
+		year, _ := strconv.Atoi(sub[3])
+		if iso, ok := isoDate(year, monthNames[strings.ToLower(sub[2])], day); ok {
+			return iso
+		}
+		return m
+	})
+	text = yearFirstDateRe.ReplaceAllStringFunc(text, func(m string) string {
+		sub := yearFirstDateRe.FindStringSubmatch(m)
+		year, _ := strconv.Atoi(sub[1])
+		month, _ := strconv.Atoi(sub[2])
+		day, _ := strconv.Atoi(sub[3])
+		if iso, ok := isoDate(year, month, day); ok {
+			return iso
+		}
+		return m
+	})
+	return numericDateRe.ReplaceAllStringFunc(text, func(m string) string {
+		sub := numericDateRe.FindStringSubmatch(m)
+		if sub[2] != sub[4] {
+			return m
+		}
+		a, _ := strconv.Atoi(sub[1])
+		b, _ := strconv.Atoi(sub[3])
+		year, _ := strconv.Atoi(sub[5])
+		// Dotted dates are always day first, otherwise a part above 12 is the
+		// day and the locale settles the rest
+		month, day := b, a
+		if sub[2] != "." && a <= 12 && (b > 12 || s.monthFirst()) {
+			month, day = a, b
+		}
+		if iso, ok := isoDate(year, month, day); ok {
+			return iso
+		}
+		return m
+	})
+}
+
+// normalizeNumbers rewrites numbers grouped by thousands with the style's
+// separators. Which convention a number is written in is taken from the
+// locale, unless its separators make it unambiguous.
+func (s formatStyle) normalizeNumbers(text string) string {
+	return groupedNumberRe.ReplaceAllStringFunc(text, func(m string) string {
+		sub := groupedNumberRe.FindStringSubmatch(m)
+		group, decimal := sub[1], sub[2]
+		if group == decimal || ipAddressRe.MatchString(m) {
+			return m
+		}
+		// 1,234 alone could be a decimal in a locale with decimal commas
+		if decimal == "" && (group == "," && s.decimalComma() || group == "." && !s.decimalComma()) {
+			return m
+		}
+		integer, fraction, _ := strings.Cut(m, decimal)
+		if decimal == "" {
+			integer, fraction = m, ""
+		}
+		digits := strings.ReplaceAll(integer, group, "")
+		var b strings.Builder
+		for i, d := range digits {
+			if i > 0 && (len(digits)-i)%3 == 0 {
+				b.WriteString(*s.Thousands)
+			}
+			b.WriteRune(d)
+		}
+		if fraction != "" {
+			b.WriteString(s.Decimal + fraction)
+		}
+		return b.String()
+	})
+}
+
+// normalizeUnits puts a space between numbers and their units
+func (s formatStyle) normalizeUnits(text string) string {
+	return unitRe.ReplaceAllString(text, "$1 $2")
+}
+
+// normalize applies the style to the prose of a line
+func (s formatStyle) normalize(line string) string {
+	return mapOutsideInlineCode(line, func(text string) string {
+		return mapOutside(text, linkTargetRe, func(text string) string {
+			if s.Dates == "iso" {
+				text = s.normalizeDates(text)
+			}
+			text = s.normalizeNumbers(text)
+			if s.Units == "space" {
+				text = s.normalizeUnits(text)
+			}
+			return text
+		})
+	})
+}
+
+// mapOutside applies f to the parts of text that re does not match
+func mapOutside(text string, re *regexp.Regexp, f func(string) string) string {
+	var b strings.Builder
+	last := 0
+	for _, loc := range re.FindAllStringIndex(text, -1) {
+		b.WriteString(f(text[last:loc[0]]))
+		b.WriteString(text[loc[0]:loc[1]])
+		last = loc[1]
+	}
+	b.WriteString(f(text[last:]))
+	return b.String()
+}
+
+// instruction returns the system prompt addition describing the style
+func (s formatStyle) instruction() string {
+	var rules []string
+	if s.Dates == "iso" {
+		rules = append(rules, "Write dates in ISO 8601 format (YYYY-MM-DD).")
+	}
+	switch {
+	case *s.Thousands == "":
+		rules = append(rules, fmt.Sprintf("Do not group the digits of numbers and use %q as the decimal mark.", s.Decimal))
+	default:
+		rules = append(rules, fmt.Sprintf("Group the thousands of numbers with %q and use %q as the decimal mark.", *s.Thousands, s.Decimal))
+	}
+	if s.Units == "space" {
+		rules = append(rules, "Separate numbers from their units with a space, as in 10 MB or 250 ms.")
+	}
+	rules = append(rules, "Never change the value of a date, number or quantity, only how it is written.")
+	return strings.Join(rules, " ")
+}
+
+// formattedValues returns the dates and numbers of the prose of content in
+// the style, to compare the values of two versions of a document
+func (s formatStyle) formattedValues(content string) map[string]int {
+	_, body := mdrefactor.SplitFrontMatter(content)
+	values := make(map[string]int)
+	code := codeLines(body)
+	for i, line := range strings.Split(body, "\n") {
+		if code[i] {
+			continue
+		}
+		mapOutsideInlineCode(s.normalize(line), func(text string) string {
+			for _, d := range isoDateRe.FindAllString(text, -1) {
+				values[d]++
+			}
+			for _, n := range groupedNumberRe.FindAllString(text, -1) {
+				values[n]++
+			}
+			for _, q := range quantityRe.FindAllString(text, -1) {
+				values[q]++
+			}
+			return text
+		})
+	}
+	return values
+}
+
+// withFormatStyle wraps refactor so that dates, numbers and units in the
+// output follow the style. The model is asked to follow it, and its output
+// is normalized and checked deterministically afterwards: dates that
+// cannot be normalized and values of the input missing from the output are
+// reported.
+func withFormatStyle(style formatStyle, refactor refactorFunc) refactorFunc {
+	return func(systemPrompt, content string) (string, error) {
+		refactored, err := refactor(systemPrompt+"\n\n"+style.instruction(), content)
+		if err != nil {
+			return "", err
+		}
+
+		frontMatter, body := mdrefactor.SplitFrontMatter(refactored)
+		lines := strings.Split(body, "\n")
+		code := codeLines(body)
+		var ambiguous []string
+		for i, line := range lines {
+			if code[i] {
+				continue
+			}
+			lines[i] = style.normalize(line)
+			if style.Dates == "iso" {
+				mapOutsideInlineCode(lines[i], func(text string) string {
+					prose := linkTargetRe.ReplaceAllString(text, " ")
+					ambiguous = append(ambiguous, shortYearDateRe.FindAllString(prose, -1)...)
+					ambiguous = append(ambiguous, numericDateRe.FindAllString(prose, -1)...)
+					return text
+				})
+			}
+		}
+		refactored = frontMatter + strings.Join(lines, "\n")
+
+		if len(ambiguous) > 0 {
+			fmt.Fprintf(os.Stderr, "Warning: dates that could not be normalized to ISO 8601: %s\n", strings.Join(ambiguous, ", "))
+		}
+		before, after := style.formattedValues(content), style.formattedValues(refactored)
+		var lost []string
+		for value, n := range before {
+			if after[value] < n {
+				lost = append(lost, value)
+			}
+		}
+		if len(lost) > 0 {
+			sort.Strings(lost)
+			fmt.Fprintf(os.Stderr, "Warning: dates or numbers of the input are missing from the output, check that no value was changed: %s\n", strings.Join(lost, ", "))
+		}
+		return refactored, nil
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"unicode"
+
+	"github.com/jackmbuda/go-mdrefactor/mdrefactor"
+)
+
+// withFrontMatterPreserved wraps refactor so that only the document body is
+// sent to the model and the original front matter is restored verbatim
+func withFrontMatterPreserved(refactor refactorFunc) refactorFunc {
+	return func(systemPrompt, content string) (string, error) {
+		frontMatter, body := mdrefactor.SplitFrontMatter(content)
+		if frontMatter == "" {
+			return refactor(systemPrompt, content)
+		}
+
+		refactored, err := refactor(systemPrompt, body)
+		if err != nil {
+			return "", err
+		}
+		return frontMatter + strings.TrimLeft(refactored, "\n"), nil
+	}
+}
+
+// frontMatterValue returns the value of a top-level key in YAML or TOML front
+// matter, with surrounding quotes removed, or "" if the key is not present
+func frontMatterValue(frontMatter, key string) string {
+	for _, line := range strings.Split(frontMatter, "\n") {
+		line = strings.TrimRight(line, "\r")
+		for _, sep := range []string{":", "=", " ="} {
+			if value, ok := strings.CutPrefix(line, key+sep); ok {
+				return strings.Trim(strings.TrimSpace(value), `"'`)
+			}
+		}
+	}
+	return ""
+}
+
+// frontMatterField is a key/value pair to be written into front matter
+type frontMatterField struct {
+	key   string
+	value any // Encoded as JSON, which is valid YAML and TOML for strings and string lists
+}
+
+// frontMatterKeyPrefixes returns the line prefixes a key may be written with
+func frontMatterKeyPrefixes(key string) []string {
+	return []string{key + ":", `"` + key + `":`, key + " =", key + "=", `"` + key + `" =`}
+}
+
+// hasFrontMatterKey reports whether front matter contains a top-level key
+func hasFrontMatterKey(frontMatter, key string) bool {
+	for _, line := range strings.Split(frontMatter, "\n") {
+		for _, prefix := range frontMatterKeyPrefixes(key) {
+			if strings.HasPrefix(line, prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// encodeFrontMatterKey quotes keys that are not plain identifiers, such as og:title
+func encodeFrontMatterKey(key string) string {
+	for _, r := range key {
+		if !(r == '_' || r == '-' || unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			quoted, _ := json.Marshal(key)
+			return string(quoted)
+		}
+	}
+	return key
+}
+
+// setFrontMatterFields writes fields into the front matter of content, creating
+// YAML front matter if there is none. Existing keys are replaced only when
+// overwrite is set. It returns the new content and the keys that were written.
+func setFrontMatterFields(content string, fields []frontMatterField, overwrite bool) (string, []string) {
+	frontMatter, body := mdrefactor.SplitFrontMatter(content)
+	delim, sep := "---", ": "
+	if strings.HasPrefix(frontMatter, "+++") {
+		delim, sep = "+++", " = "
+	}
+
+	var lines []string
+	if frontMatter != "" {
+		inner := strings.TrimSuffix(strings.TrimRight(frontMatter, "\r\n"), delim)
+		inner = strings.TrimPrefix(inner, delim)
+		lines = strings.Split(strings.Trim(inner, "\r\n"), "\n")
+		if len(lines) == 1 && lines[0] == "" {
+			lines = nil
+		}
+	}
+
+	var written []string
+	for _, f := range fields {
+		value, err := json.Marshal(f.value)
+		if err != nil {
+			continue
+		}
+		line := encodeFrontMatterKey(f.key) + sep + string(value)
+
+		replaced := false
+		for i, existing := range lines {
+			for _, prefix := range frontMatterKeyPrefixes(f.key) {
+				if strings.HasPrefix(existing, prefix) {
+					if overwrite {
+						// Drop the continuation lines of block-style values
+						end := i + 1
+						for end < len(lines) && (strings.HasPrefix(lines[end], " ") || strings.HasPrefix(lines[end], "\t") || strings.HasPrefix(lines[end], "- ")) {
+							end++
+						}
+						lines = append(append(lines[:i:i], line), lines[end:]...)
+						written = append(written, f.key)
+					}
+					replaced = true
+					break
+				}
+			}
+			if replaced {
+				break
+			}
+		}
+		if !replaced {
+			lines = append(lines, line)
+			written = append(written, f.key)
+		}
+	}
+
+	if len(lines) == 0 {
+		return content, nil
+	}
+	return delim + "\n" + strings.Join(lines, "\n") + "\n" + delim + "\n" + body, written
+}
+
+// frontMatterList returns the values of a top-level list key, written either
+// as a flow sequence (key: [a, b]) or as a block sequence of "- " lines
+func frontMatterList(frontMatter, key string) []string {
+	lines := strings.Split(frontMatter, "\n")
+	for i, line := range lines {
+		line = strings.TrimRight(line, "\r")
+		var value string
+		found := false
+		for _, prefix := range frontMatterKeyPrefixes(key) {
+			if v, ok := strings.CutPrefix(line, prefix); ok {
+				value, found = strings.TrimSpace(v), true
+				break
+			}
+		}
+		if !found {
+			continue
+		}
+
+		var values []string
+		if strings.HasPrefix(value, "[") {
+			for _, item := range strings.Split(strings.Trim(value, "[]"), ",") {
+				if item = strings.Trim(strings.TrimSpace(item), `"'`); item != "" {
+					values = append(values, item)
+				}
+			}
+			return values
+		}
+		if value != "" {
+			return []string{strings.Trim(value, `"'`)}
+		}
+		for _, item := range lines[i+1:] {
+			item = strings.TrimSpace(strings.TrimRight(item, "\r"))
+			rest, ok := strings.CutPrefix(item, "- ")
+			if !ok {
+				break
+			}
+			values = append(values, strings.Trim(strings.TrimSpace(rest), `"'`))
+		}
+		return values
+	}
+	return nil
+}
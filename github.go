@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// Default endpoint of the GitHub REST API, GITHUB_API_URL points elsewhere
+// for GitHub Enterprise
+const defaultGitHubAPIURL = "https://api.github.com"
+
+// owner/name of a repository in a GitHub URL, SSH remote or plain "owner/name"
+var githubRepoRe = regexp.MustCompile(`^(?:(?:https?://|ssh://git@|git@)[^/:]+[/:])?([\w.-]+)/([\w.-]+?)(?:\.git)?/?$`)
+
+// githubClient calls the GitHub REST API on behalf of one repository
+type githubClient struct {
+	baseURL string
+	token   string
+	owner   string
+	repo    string
+}
+
+// parseGitHubRepo returns the owner and name of a repository given as
+// owner/name or as a GitHub URL
+func parseGitHubRepo(s string) (string, string, error) {
+	m := githubRepoRe.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return "", "", fmt.Errorf("invalid GitHub repository %q, expected owner/name or a GitHub URL", s)
+	}
+	return m[1], m[2], nil
+}
+
+// newGitHubClient returns a client for repo, which defaults to the origin
+// remote of the current directory. The token defaults to GITHUB_TOKEN or GH_TOKEN.
+func newGitHubClient(repo, token string) (*githubClient, error) {
+	if repo == "" {
+		out, err := exec.Command("git", "remote", "get-url", "origin").Output()
+		if err != nil {
+			return nil, fmt.Errorf("no repository given and the current directory has no origin remote")
+		}
+		repo = strings.TrimSpace(string(out))
+	}
+	owner, name, err := parseGitHubRepo(repo)
+	if err != nil {
+		return nil, err
+	}
+	if token == "" {
+		token = os.Getenv("GITHUB_TOKEN")
+	}
+	if token == "" {
+		token = os.Getenv("GH_TOKEN")
+	}
+	baseURL := os.Getenv("GITHUB_API_URL")
+	if baseURL == "" {
+		baseURL = defaultGitHubAPIURL
+	}
+	return &githubClient{baseURL: strings.TrimSuffix(baseURL, "/"), token: token, owner: owner, repo: name}, nil
+}
+
+// do sends a request to path below the repository, e.g. "/pulls/12", with
+// body encoded as JSON if not nil, and decodes the response into out if not nil
+func (c *githubClient) do(method, path string, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	url := fmt.Sprintf("%s/repos/%s/%s%s", c.baseURL, c.owner, c.repo, path)
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		return fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("GitHub request %s %s failed: %w", method, path, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read GitHub response: %w", err)
+	}
+	if resp.StatusCode >= 300 {
+		var apiErr struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(data, &apiErr) != nil || apiErr.Message == "" {
+			apiErr.Message = strings.TrimSpace(string(data))
+		}
+		hint := ""
+		if (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusForbidden) && c.token == "" {
+			hint = " (set GITHUB_TOKEN for private repositories and higher rate limits)"
+		}
+		return fmt.Errorf("GitHub request %s %s failed with status %d: %s%s", method, path, resp.StatusCode, apiErr.Message, hint)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("failed to decode GitHub response: %w", err)
+	}
+	return nil
+}
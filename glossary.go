@@ -0,0 +1,196 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/jackmbuda/go-mdrefactor/mdrefactor"
+)
+
+const (
+	// Maximum number of context snippets sent to the model per term
+	maxGlossaryContexts = 3
+	// System prompt used to synthesize glossary definitions
+	glossarySystemPrompt = "You are a technical writer compiling a project glossary. Write concise, accurate definitions based only on the provided context."
+)
+
+var (
+	// **Term**: definition, **Term** - definition, **Term** — definition
+	boldDefinitionRe = regexp.MustCompile(`^\s*(?:[-*+]\s+)?\*\*([^*]{2,60})\*\*\s*(?::|-|–|—)\s*(.+)$`)
+	// Full Name (ABBR)
+	acronymDefinitionRe = regexp.MustCompile(`((?:[A-Z][\w-]*\s+){1,5}[A-Z][\w-]*)\s+\(([A-Z][A-Z0-9]{1,9})\)`)
+	sentenceSplitRe     = regexp.MustCompile(`(?:[.!?])\s+`)
+)
+
+// glossaryTerm is a candidate glossary entry with the places it was found
+type glossaryTerm struct {
+	term     string
+	contexts []string // "file: sentence" snippets describing the term
+}
+
+// addContext records a context snippet for the term, up to the configured limit
+func (t *glossaryTerm) addContext(file, snippet string) {
+	if len(t.contexts) < maxGlossaryContexts {
+		t.contexts = append(t.contexts, fmt.Sprintf("%s: %s", file, strings.TrimSpace(snippet)))
+	}
+}
+
+// extractGlossaryTerms finds domain terms in a document: bold terms that are
+// followed by a definition, definition-list entries and spelled-out acronyms
+func extractGlossaryTerms(file, content string, terms map[string]*glossaryTerm) {
+	add := func(term, snippet string) {
+		term = strings.TrimSpace(term)
+		key := strings.ToLower(term)
+		if terms[key] == nil {
+			terms[key] = &glossaryTerm{term: term}
+		}
+		terms[key].addContext(file, snippet)
+	}
+
+	_, body := mdrefactor.SplitFrontMatter(content)
+	lines := strings.Split(body, "\n")
+	code := codeLines(body)
+	for i, line := range lines {
+		if code[i] || strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		if m := boldDefinitionRe.FindStringSubmatch(line); m != nil {
+			add(m[1], m[1]+": "+m[2])
+		}
+
+		// Definition lists: a term line followed by ": definition"
+		if i+1 < len(lines) && strings.HasPrefix(lines[i+1], ": ") && !strings.HasPrefix(strings.TrimSpace(line), "#") {
+			add(strings.TrimSpace(line), strings.TrimSpace(line)+": "+strings.TrimPrefix(lines[i+1], ": "))
+		}
+
+		for _, m := range acronymDefinitionRe.FindAllStringSubmatch(line, -1) {
+			add(m[2], m[0])
+		}
+	}
+}
+
+// collectUsageContexts adds sentences that mention a term to its contexts,
+// for terms that were requested explicitly and not defined anywhere
+func collectUsageContexts(file, content string, terms map[string]*glossaryTerm) {
+	for _, unit := range proseUnits(content) {
+		for _, sentence := range sentenceSplitRe.Split(unit, -1) {
+			lower := strings.ToLower(sentence)
+			for key, t := range terms {
+				if strings.Contains(lower, key) {
+					t.addContext(file, sentence)
+				}
+			}
+		}
+	}
+}
+
+// buildGlossaryPrompt builds the user message asking the model to write the glossary
+func buildGlossaryPrompt(terms []*glossaryTerm) string {
+	var b strings.Builder
+	b.WriteString("Write a consolidated GLOSSARY.md for the following terms, extracted from the project documentation. ")
+	b.WriteString("Start with a \"# Glossary\" heading, list the terms alphabetically as \"**Term**: definition\" entries, ")
+	b.WriteString("merge synonyms and duplicates, and output only the Markdown document.\n\n")
+	for _, t := range terms {
+		fmt.Fprintf(&b, "Term: %s\n", t.term)
+		for _, c := range t.contexts {
+			fmt.Fprintf(&b, "  Context (%s)\n", c)
+		}
+	}
+	return b.String()
+}
+
+// runGlossaryCommand implements the glossary subcommand
+func runGlossaryCommand(args []string) error {
+	fs := flag.NewFlagSet("glossary", flag.ExitOnError)
+	apiKey := fs.String("apikey", os.Getenv("OPENAI_API_KEY"), "OpenAI API key (can also be set via OPENAI_API_KEY environment variable)")
+	addAPIFlags(fs)
+	model := fs.String("model", defaultModel, "OpenAI model to use for definition synthesis")
+	output := fs.String("o", "", "Path of the generated glossary (defaults to <docs-dir>/GLOSSARY.md)")
+	extraTerms := fs.String("terms", "", "Comma-separated list of additional terms to define")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: mdrefactor glossary [flags] <docs-dir>")
+		fs.PrintDefaults()
+	}
+	positional := parseArgs(fs, args)
+	if len(positional) != 1 {
+		fs.Usage()
+		return fmt.Errorf("a docs directory is required")
+	}
+	dir := positional[0]
+	if *output == "" {
+		*output = filepath.Join(dir, "GLOSSARY.md")
+	}
+
+	files, err := findMarkdownFiles(dir)
+	if err != nil {
+		return err
+	}
+
+	contents := make(map[string]string)
+	terms := make(map[string]*glossaryTerm)
+	for _, rel := range files {
+		if mustAbs(filepath.Join(dir, rel)) == mustAbs(*output) {
+			// Do not feed the previous glossary back into itself
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(dir, rel))
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", rel, err)
+		}
+		contents[rel] = string(content)
+		extractGlossaryTerms(rel, string(content), terms)
+	}
+
+	requested := make(map[string]*glossaryTerm)
+	for _, term := range strings.Split(*extraTerms, ",") {
+		if term = strings.TrimSpace(term); term != "" && terms[strings.ToLower(term)] == nil {
+			requested[strings.ToLower(term)] = &glossaryTerm{term: term}
+		}
+	}
+	if len(requested) > 0 {
+		for _, rel := range sortedKeys(contents) {
+			collectUsageContexts(rel, contents[rel], requested)
+		}
+		for key, t := range requested {
+			terms[key] = t
+		}
+	}
+
+	if len(terms) == 0 {
+		return fmt.Errorf("no glossary terms found in %s, use -terms to name them explicitly", dir)
+	}
+
+	// Terms are keyed by their lowercase form, so this sorts them alphabetically
+	sorted := make([]*glossaryTerm, 0, len(terms))
+	for _, key := range sortedKeys(terms) {
+		sorted = append(sorted, terms[key])
+	}
+
+	fmt.Printf("Synthesizing definitions for %d terms...\n", len(sorted))
+	glossary, err := chatCompletion(*apiKey, *model, []Message{
+		{Role: "system", Content: glossarySystemPrompt},
+		{Role: "user", Content: buildGlossaryPrompt(sorted)},
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(*output, []byte(strings.TrimSpace(glossary)+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to write glossary %s: %w", *output, err)
+	}
+	fmt.Printf("Glossary with %d terms written to %s\n", len(sorted), *output)
+	return nil
+}
+
+// mustAbs returns the absolute form of path, or path itself if it cannot be determined
+func mustAbs(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
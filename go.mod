@@ -1,3 +1,5 @@
 module github.com/jackmbuda/go-mdrefactor
 
 go 1.22.2
+
+require github.com/yuin/goldmark v1.7.8
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// goldenTransform is a deterministic, offline transform whose output on the
+// corpus is compared against a golden file
+type goldenTransform func(file, content string) (string, error)
+
+// goldenTransforms are the deterministic passes covered by verify-goldens, by
+// the name of their golden directory
+var goldenTransforms = map[string]goldenTransform{
+	"toc": func(_, content string) (string, error) {
+		return generateTOC(content), nil
+	},
+	"shift-headings": func(_, content string) (string, error) {
+		return shiftHeadings(content, 1), nil
+	},
+	"structure": func(_, content string) (string, error) {
+		s := analyzeStructure(content)
+		tables := "none"
+		if len(s.tables) > 0 {
+			tables = strings.Join(s.tables, ", ")
+		}
+		return fmt.Sprintf("headings: %d\ncode blocks: %d\ntables: %s\n", s.headings, len(s.codeBlocks), tables), nil
+	},
+	"lint": func(_, content string) (string, error) {
+		problems := lintMarkdown(content)
+		if len(problems) == 0 {
+			return "", nil
+		}
+		return strings.Join(problems, "\n") + "\n", nil
+	},
+	"split": func(_, content string) (string, error) {
+		intro, chunks := splitDocument(content, 2, "index.md", ".", ".")
+		var b strings.Builder
+		fmt.Fprintf(&b, "<!-- index.md -->\n%s\n", intro)
+		for _, c := range chunks {
+			fmt.Fprintf(&b, "<!-- %s -->\n%s\n", c.file, c.content)
+		}
+		return b.String(), nil
+	},
+	"broken-links": func(file, _ string) (string, error) {
+		g, err := buildLinkGraph(filepath.Dir(file))
+		if err != nil {
+			return "", err
+		}
+		broken := brokenLinks(g, filepath.Base(file))
+		if len(broken) == 0 {
+			return "", nil
+		}
+		return strings.Join(broken, "\n") + "\n", nil
+	},
+	// Chunks are kept tiny so every document is split several times; each
+	// chunk is marked so the golden shows where the boundaries fell
+	"chunks": func(file, _ string) (string, error) {
+		out, err := os.CreateTemp("", "mdrefactor-golden-*.md")
+		if err != nil {
+			return "", err
+		}
+		out.Close()
+		defer os.Remove(out.Name())
+		err = refactorLargeFile(file, out.Name(), 64, outputPolicy{eol: "preserve", encoding: "preserve"}, func(chunk string) (string, error) {
+			return "<!-- chunk -->\n" + chunk, nil
+		})
+		if err != nil {
+			return "", err
+		}
+		data, err := os.ReadFile(out.Name())
+		return string(data), err
+	},
+	"slugs": func(_, content string) (string, error) {
+		defer func(style, locale string) { slugStyle, slugLocale = style, locale }(slugStyle, slugLocale)
+		var b strings.Builder
+		for _, style := range []string{slugStyleGitHub, slugStyleASCII} {
+			slugStyle, slugLocale = style, "de"
+			for _, anchor := range headingAnchors(parseHeadings(content)) {
+				fmt.Fprintf(&b, "%s: #%s\n", style, anchor)
+			}
+		}
+		return b.String(), nil
+	},
+	// The passes wrapping a model call repair its output deterministically;
+	// here they get the input back unchanged
+	"script": func(_, content string) (string, error) {
+		return withScriptRules(scriptOptions{script: scriptAuto, unwrap: true, punctuation: true}, unchangedRefactor)("", content)
+	},
+	"formats": func(_, content string) (string, error) {
+		return withFormatStyle(formatStyle{Units: "space"}.withDefaults(), unchangedRefactor)("", content)
+	},
+	"acronyms": func(_, content string) (string, error) {
+		expanded, unknown := expandAcronyms(content, map[string]string{"SLO": "service level objective"})
+		return withReport(expanded, "unknown acronyms", unknown), nil
+	},
+	"terms": func(_, content string) (string, error) {
+		updated, _, violations := compileTerminology(defaultTerminology).apply(content, true)
+		var left []string
+		for _, v := range violations {
+			left = append(left, v.String())
+		}
+		return withReport(updated, "left", left), nil
+	},
+	"numbering": func(_, content string) (string, error) {
+		numbered, _ := numberHeadings(content, numberingInsert)
+		stripped, _ := numberHeadings(numbered, numberingStrip)
+		return numbered + "<!-- stripped again -->\n" + stripped, nil
+	},
+	"url-rewrites": func(_, content string) (string, error) {
+		return newURLRewriter(urlRewriteConfig{
+			HTTPS:       true,
+			Domains:     map[string]string{"docs.old-example.org": "docs.example.org/v2"},
+			StripParams: []string{"utm_*"},
+		}).apply(content), nil
+	},
+	"citations": func(_, content string) (string, error) {
+		converted, _ := convertCitations(content, citationFootnote, "References")
+		return converted, nil
+	},
+	"heading-case": func(_, content string) (string, error) {
+		recased, _ := newHeadingCaser(headingCaseSentence, nil).recaseHeadings(content)
+		return recased, nil
+	},
+}
+
+// unchangedRefactor stands in for the model in golden transforms
+func unchangedRefactor(_, content string) (string, error) {
+	return content, nil
+}
+
+// withReport appends the findings of a pass to its output as a comment, so
+// the golden covers them too
+func withReport(content, label string, findings []string) string {
+	if len(findings) == 0 {
+		return content
+	}
+	return content + fmt.Sprintf("<!-- %s: %s -->\n", label, strings.Join(findings, "; "))
+}
+
+// firstDifference returns the 1-based line at which got and want differ and both lines
+func firstDifference(got, want string) (int, string, string) {
+	gotLines, wantLines := strings.Split(got, "\n"), strings.Split(want, "\n")
+	for i := 0; i < max(len(gotLines), len(wantLines)); i++ {
+		var g, w string
+		if i < len(gotLines) {
+			g = gotLines[i]
+		}
+		if i < len(wantLines) {
+			w = wantLines[i]
+		}
+		if g != w || i >= len(gotLines) || i >= len(wantLines) {
+			return i + 1, g, w
+		}
+	}
+	return 0, "", ""
+}
+
+// runVerifyGoldensCommand implements the verify-goldens subcommand
+func runVerifyGoldensCommand(args []string) error {
+	fs := flag.NewFlagSet("verify-goldens", flag.ExitOnError)
+	corpus := fs.String("corpus", filepath.Join("testdata", "corpus"), "Directory of input documents")
+	goldens := fs.String("goldens", filepath.Join("testdata", "goldens"), "Directory with one subdirectory of golden outputs per transform")
+	only := fs.String("transform", "", "Only verify this transform")
+	update := fs.Bool("update", false, "Rewrite the golden files with the current outputs instead of comparing")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: mdrefactor verify-goldens [flags]")
+		fmt.Fprintln(fs.Output(), "Runs the deterministic structural passes over the corpus and compares their output against golden files. No API calls are made.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *only != "" && goldenTransforms[*only] == nil {
+		return fmt.Errorf("unknown transform %q, expected one of %s", *only, strings.Join(sortedKeys(goldenTransforms), ", "))
+	}
+	files, err := findMarkdownFiles(*corpus)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no Markdown files found in %s", *corpus)
+	}
+
+	checked, failed := 0, 0
+	for _, name := range sortedKeys(goldenTransforms) {
+		if *only != "" && name != *only {
+			continue
+		}
+		for _, rel := range files {
+			checked++
+			input := filepath.Join(*corpus, rel)
+			data, err := os.ReadFile(input)
+			if err != nil {
+				return fmt.Errorf("failed to read %s: %w", input, err)
+			}
+			got, err := goldenTransforms[name](input, decodeSource(data).text)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "FAIL %s %s: %v\n", name, rel, err)
+				failed++
+				continue
+			}
+
+			golden := filepath.Join(*goldens, name, rel)
+			if *update {
+				if err := os.MkdirAll(filepath.Dir(golden), 0755); err != nil {
+					return err
+				}
+				if err := writeFileAtomic(golden, []byte(got), 0644); err != nil {
+					return fmt.Errorf("failed to write golden %s: %w", golden, err)
+				}
+				continue
+			}
+
+			want, err := os.ReadFile(golden)
+			if errors.Is(err, os.ErrNotExist) {
+				fmt.Fprintf(os.Stderr, "FAIL %s %s: golden %s is missing, run with -update to create it\n", name, rel, golden)
+				failed++
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("failed to read golden %s: %w", golden, err)
+			}
+			if got != string(want) {
+				line, g, w := firstDifference(got, string(want))
+				fmt.Fprintf(os.Stderr, "FAIL %s %s: line %d differs\n  got:  %q\n  want: %q\n", name, rel, line, g, w)
+				failed++
+			}
+		}
+	}
+
+	if *update {
+		fmt.Printf("Updated %d golden files in %s\n", checked-failed, *goldens)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d golden checks failed", failed, checked)
+	}
+	if *update {
+		return nil
+	}
+	fmt.Printf("All %d golden checks passed\n", checked)
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// graphNode is a document in an exported link graph
+type graphNode struct {
+	ID     string `json:"id"`
+	Title  string `json:"title"`
+	Broken bool   `json:"broken,omitempty"` // Linked to, but missing from the tree
+}
+
+// graphEdge is a link between two documents in an exported link graph
+type graphEdge struct {
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Count int    `json:"count"`
+}
+
+// exportedGraph is the JSON representation of a link graph
+type exportedGraph struct {
+	Nodes []graphNode `json:"nodes"`
+	Edges []graphEdge `json:"edges"`
+}
+
+// export converts the link graph into nodes and deduplicated, counted edges
+func (g *linkGraph) export() exportedGraph {
+	out := exportedGraph{Nodes: []graphNode{}, Edges: []graphEdge{}}
+	for _, file := range g.files {
+		out.Nodes = append(out.Nodes, graphNode{ID: file, Title: documentTitle(g.contents[file], file)})
+	}
+
+	broken := make(map[string]bool)
+	for _, from := range g.files {
+		counts := make(map[string]int)
+		var order []string
+		for _, l := range g.links[from] {
+			if l.file == from {
+				continue
+			}
+			if counts[l.file] == 0 {
+				order = append(order, l.file)
+			}
+			counts[l.file]++
+			if _, ok := g.contents[l.file]; !ok && !broken[l.file] {
+				broken[l.file] = true
+				out.Nodes = append(out.Nodes, graphNode{ID: l.file, Title: l.file, Broken: true})
+			}
+		}
+		for _, to := range order {
+			out.Edges = append(out.Edges, graphEdge{From: from, To: to, Count: counts[to]})
+		}
+	}
+	return out
+}
+
+// renderDot renders the graph in Graphviz DOT format
+func renderDot(graph exportedGraph) string {
+	var b strings.Builder
+	b.WriteString("digraph docs {\n")
+	b.WriteString("  node [shape=box];\n")
+	for _, n := range graph.Nodes {
+		attrs := "label=" + strconv.Quote(n.Title)
+		if n.Broken {
+			attrs += ", style=dashed, color=red"
+		}
+		fmt.Fprintf(&b, "  %s [%s];\n", strconv.Quote(n.ID), attrs)
+	}
+	for _, e := range graph.Edges {
+		if e.Count > 1 {
+			fmt.Fprintf(&b, "  %s -> %s [label=%q];\n", strconv.Quote(e.From), strconv.Quote(e.To), strconv.Itoa(e.Count))
+			continue
+		}
+		fmt.Fprintf(&b, "  %s -> %s;\n", strconv.Quote(e.From), strconv.Quote(e.To))
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// runGraphCommand implements the graph subcommand
+func runGraphCommand(args []string) error {
+	fs := flag.NewFlagSet("graph", flag.ExitOnError)
+	format := fs.String("format", "dot", "Output format (dot, json)")
+	output := fs.String("o", "", "Path to write the graph to (prints to stdout if not provided)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: mdrefactor graph [flags] <docs-dir>")
+		fs.PrintDefaults()
+	}
+	positional := parseArgs(fs, args)
+	if len(positional) != 1 {
+		fs.Usage()
+		return fmt.Errorf("a docs directory is required")
+	}
+
+	g, err := buildLinkGraph(positional[0])
+	if err != nil {
+		return err
+	}
+
+	var out string
+	switch *format {
+	case "dot":
+		out = renderDot(g.export())
+	case "json":
+		data, err := json.MarshalIndent(g.export(), "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal graph: %w", err)
+		}
+		out = string(data) + "\n"
+	default:
+		return fmt.Errorf("unknown graph format %q, expected dot or json", *format)
+	}
+
+	if *output == "" {
+		fmt.Print(out)
+		return nil
+	}
+	if err := writeFileAtomic(*output, []byte(out), 0644); err != nil {
+		return fmt.Errorf("failed to write graph %s: %w", *output, err)
+	}
+	fmt.Printf("Link graph written to %s\n", *output)
+	return nil
+}
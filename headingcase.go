@@ -0,0 +1,286 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/jackmbuda/go-mdrefactor/mdrefactor"
+)
+
+const (
+	// Major words capitalized: Getting Started with the API
+	headingCaseTitle = "title"
+	// Only the first word capitalized: Getting started with the API
+	headingCaseSentence = "sentence"
+)
+
+// Words kept in their own spelling whatever the heading case. Words written
+// in capitals (API) or with inner capitals are kept anyway; the list covers
+// those a case change would break and restores lowercased ones (github, api).
+// Ambiguous words like Go, Windows or May are left to the heading_case
+// section of the config file.
+var defaultProtectedWords = []string{
+	"Android", "Apache", "AWS", "Azure", "Bash", "Docker", "English", "Git", "GitHub", "GitLab", "Google", "Helm",
+	"iOS", "Java", "JavaScript", "Kafka", "Kubernetes", "Linux", "macOS", "Markdown", "Node.js", "npm", "OpenAI",
+	"PostgreSQL", "PowerShell", "Python", "React", "Redis", "Ruby", "Rust", "Slack", "Terraform", "TypeScript", "Ubuntu", "Unicode",
+	"API", "CLI", "CPU", "CSS", "CSV", "DNS", "FAQ", "GPU", "HTML", "HTTP", "HTTPS", "JSON", "PDF", "SDK", "SQL", "SSH",
+	"TCP", "TLS", "UDP", "URI", "URL", "XML", "YAML",
+	"Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday", "Sunday",
+	"January", "February", "March", "April", "June", "July", "August", "September", "October", "November", "December",
+}
+
+// Words lowercase in title case unless they start or end the heading
+var minorWords = map[string]bool{
+	"a": true, "an": true, "the": true, "and": true, "but": true, "or": true, "nor": true, "for": true, "so": true, "yet": true,
+	"as": true, "at": true, "by": true, "if": true, "in": true, "of": true, "off": true, "on": true, "per": true, "to": true,
+	"up": true, "via": true, "vs": true, "v": true, "en": true, "from": true, "into": true, "with": true,
+}
+
+// headingCaseConfig is the heading_case section of the config file
+type headingCaseConfig struct {
+	Style     string   `json:"style"`     // Case headings are written in, unchanged if empty
+	Protected []string `json:"protected"` // Words and phrases kept as spelled, in addition to the defaults
+}
+
+// Heading case of the project, set from the heading_case section of the config file
+var configHeadingCase headingCaseConfig
+
+// applyHeadingCaseConfig applies the heading_case section of the config file
+func applyHeadingCaseConfig(cfg headingCaseConfig) error {
+	if _, err := parseHeadingCase(cfg.Style); err != nil {
+		return fmt.Errorf("heading_case: %w", err)
+	}
+	configHeadingCase = cfg
+	return nil
+}
+
+// parseHeadingCase validates a heading case style
+func parseHeadingCase(s string) (string, error) {
+	switch s {
+	case "", headingCaseTitle, headingCaseSentence:
+		return s, nil
+	}
+	return "", fmt.Errorf("invalid heading case %q, expected title or sentence", s)
+}
+
+var (
+	// A word of heading text; hyphenated words are one word per part
+	headingWordRe = regexp.MustCompile(`\p{L}[\p{L}\p{N}'’]*`)
+	// Parts of heading text never recased: code, link targets, tags, URLs,
+	// attribute lists such as {#custom-id} and emoji shortcodes
+	headingCaseSkipRe = regexp.MustCompile(nonProseRe.String() + `|\{[#.][^}]*\}|:[a-z0-9_+-]+:`)
+)
+
+// headingCaser recases heading text to a style, keeping protected words
+type headingCaser struct {
+	style     string
+	protected *regexp.Regexp    // Matches the protected words and phrases
+	spelling  map[string]string // Protected spelling by lowercase word or phrase
+}
+
+// newHeadingCaser returns a caser for style, protecting the default words,
+// the acronyms of the config file and protected
+func newHeadingCaser(style string, protected []string) *headingCaser {
+	c := &headingCaser{style: style, spelling: make(map[string]string)}
+	words := append(append([]string{}, defaultProtectedWords...), protected...)
+	for acronym := range configAcronyms {
+		words = append(words, acronym)
+	}
+	var patterns []string
+	for _, w := range words {
+		w = strings.TrimSpace(w)
+		key := strings.ToLower(w)
+		if w == "" || c.spelling[key] != "" {
+			continue
+		}
+		c.spelling[key] = w
+		patterns = append(patterns, regexp.QuoteMeta(w))
+	}
+	// Longer phrases first, so Visual Studio Code wins over Code
+	sort.Slice(patterns, func(i, j int) bool {
+		if len(patterns[i]) != len(patterns[j]) {
+			return len(patterns[i]) > len(patterns[j])
+		}
+		return patterns[i] < patterns[j]
+	})
+	c.protected = regexp.MustCompile(`(?i)\b(?:` + strings.Join(patterns, "|") + `)\b`)
+	return c
+}
+
+// keepsCase reports whether a word is written as it is whatever the style:
+// acronyms, words with inner capitals (GitHub, iOS) and the pronoun I
+func keepsCase(word string) bool {
+	for i, r := range word {
+		if i > 0 && unicode.IsUpper(r) {
+			return true
+		}
+	}
+	return word == "I"
+}
+
+// capitalize returns word with its first letter in upper case
+func capitalize(word string) string {
+	r, size := utf8.DecodeRuneInString(word)
+	return string(unicode.ToUpper(r)) + word[size:]
+}
+
+// apply recases heading text
+func (c *headingCaser) apply(text string) string {
+	// Words are counted first, as title case treats the last one specially
+	total := 0
+	mapOutside(text, headingCaseSkipRe, func(s string) string {
+		total += len(headingWordRe.FindAllString(s, -1))
+		return s
+	})
+
+	index := 0
+	recased := mapOutside(text, headingCaseSkipRe, func(s string) string {
+		var b strings.Builder
+		last := 0
+		for _, loc := range headingWordRe.FindAllStringIndex(s, -1) {
+			before, word := s[last:loc[0]], s[loc[0]:loc[1]]
+			b.WriteString(before)
+			last = loc[1]
+			// Words after a colon start a new phrase
+			first := index == 0 || strings.Contains(before, ":")
+			index++
+			switch {
+			case keepsCase(word):
+				b.WriteString(word)
+			case c.style == headingCaseTitle && minorWords[strings.ToLower(word)] && !first && index != total && !strings.HasSuffix(before, "-"):
+				b.WriteString(strings.ToLower(word))
+			case c.style == headingCaseTitle || first:
+				b.WriteString(capitalize(strings.ToLower(word)))
+			default:
+				b.WriteString(strings.ToLower(word))
+			}
+		}
+		b.WriteString(s[last:])
+		return b.String()
+	})
+
+	// Protected words get their own spelling back, but not in code or links
+	return mapOutside(recased, headingCaseSkipRe, func(s string) string {
+		return c.protected.ReplaceAllStringFunc(s, func(m string) string {
+			if spelling := c.spelling[strings.ToLower(m)]; spelling != "" {
+				return spelling
+			}
+			return m
+		})
+	})
+}
+
+// headingCaseChange is a heading whose text changed case
+type headingCaseChange struct {
+	line     int // 1-based line of the document
+	old, new string
+}
+
+// recaseHeadings writes the headings of content in the caser's style. Anchors
+// are lowercase, so links to the headings keep working.
+func (c *headingCaser) recaseHeadings(content string) (string, []headingCaseChange) {
+	frontMatter, body := mdrefactor.SplitFrontMatter(content)
+	offset := strings.Count(frontMatter, "\n")
+	lines := strings.Split(body, "\n")
+	var changes []headingCaseChange
+	for _, h := range parseHeadings(body) {
+		line := lines[h.line]
+		marker := atxMarkerRe.FindString(line)
+		if marker == "" {
+			// The text line of a setext heading, with its indentation
+			marker = line[:len(line)-len(strings.TrimLeft(line, " "))]
+		}
+		recased := marker + c.apply(line[len(marker):])
+		if recased != line {
+			lines[h.line] = recased
+			changes = append(changes, headingCaseChange{line: offset + h.line + 1, old: strings.TrimSpace(line[len(marker):]), new: strings.TrimSpace(recased[len(marker):])})
+		}
+	}
+	return frontMatter + strings.Join(lines, "\n"), changes
+}
+
+// instruction returns the system prompt addition describing the style
+func (c *headingCaser) instruction() string {
+	if c.style == headingCaseTitle {
+		return "Write headings in title case, capitalizing every word except articles, conjunctions and short prepositions."
+	}
+	return "Write headings in sentence case, capitalizing only the first word, acronyms and proper nouns."
+}
+
+// withHeadingCase wraps refactor so that the headings of the output are
+// written in the caser's style, whatever case the model chose
+func withHeadingCase(c *headingCaser, refactor refactorFunc) refactorFunc {
+	return func(systemPrompt, content string) (string, error) {
+		refactored, err := refactor(systemPrompt+"\n\n"+c.instruction(), content)
+		if err != nil {
+			return "", err
+		}
+		refactored, _ = c.recaseHeadings(refactored)
+		return refactored, nil
+	}
+}
+
+// runHeadingCaseCommand implements the heading-case subcommand
+func runHeadingCaseCommand(args []string) error {
+	fs := flag.NewFlagSet("heading-case", flag.ExitOnError)
+	style := fs.String("style", configHeadingCase.Style, "Case to write headings in: title or sentence (defaults to the heading_case section of the config file)")
+	protect := fs.String("protect", "", "Comma-separated words and phrases to keep as spelled, in addition to the config file's")
+	dryRun := fs.Bool("dry-run", false, "Only list the headings that would change")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: mdrefactor heading-case [flags] <file-or-dir>...")
+		fmt.Fprintln(fs.Output(), "Writes the headings of documents in title or sentence case. No API calls are made.")
+		fs.PrintDefaults()
+	}
+	positional := parseArgs(fs, args)
+	if len(positional) == 0 {
+		fs.Usage()
+		return fmt.Errorf("at least one file or directory is required")
+	}
+	if s, err := parseHeadingCase(*style); err != nil || s == "" {
+		return fmt.Errorf("-style title or sentence is required")
+	}
+	files, err := expandMarkdownArgs(positional)
+	if err != nil {
+		return err
+	}
+
+	protected := configHeadingCase.Protected
+	if *protect != "" {
+		protected = append(protected, strings.Split(*protect, ",")...)
+	}
+	caser := newHeadingCaser(*style, protected)
+	total, changed := 0, 0
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", file, err)
+		}
+		source := decodeSource(data)
+		updated, changes := caser.recaseHeadings(source.text)
+		for _, c := range changes {
+			fmt.Printf("%s:%d: %s -> %s\n", file, c.line, c.old, c.new)
+		}
+		if len(changes) == 0 {
+			continue
+		}
+		total, changed = total+len(changes), changed+1
+		if *dryRun {
+			continue
+		}
+		out, err := source.encode(updated, outputPolicy{eol: "preserve", encoding: "preserve"})
+		if err != nil {
+			return fmt.Errorf("failed to encode %s: %w", file, err)
+		}
+		if err := writeFileAtomic(file, out, 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %w", file, err)
+		}
+	}
+	fmt.Printf("Recased %d headings in %d of %d files.\n", total, changed, len(files))
+	return nil
+}
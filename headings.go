@@ -0,0 +1,92 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/jackmbuda/go-mdrefactor/mdrefactor"
+)
+
+// heading is a single ATX or setext heading found in a Markdown document
+type heading struct {
+	level   int    // Heading level, 1-6
+	text    string // Heading text without the leading #s or underline
+	anchor  string // Anchor in the configured slug style, duplicates suffixed with -1, -2, ...
+	line    int    // 0-based line index in the document
+	endLine int    // 0-based index of the last line, the underline of setext headings
+}
+
+// document returns content as a document of the mdrefactor package, with
+// anchors in the configured slug style
+func document(content string) *mdrefactor.Document {
+	return &mdrefactor.Document{Content: content, Slugify: slugify}
+}
+
+// parseHeadings returns the top-level headings of content. Headings nested in
+// lists or block quotes and anything inside code blocks are not included.
+func parseHeadings(content string) []heading {
+	var headings []heading
+	for _, h := range document(content).Headings() {
+		headings = append(headings, heading{level: h.Level, text: h.Text, anchor: h.Anchor, line: h.Line, endLine: h.EndLine})
+	}
+	return headings
+}
+
+// slugify converts heading text into an anchor the way GitHub does. With the
+// ascii slug style, letters are transliterated to ASCII first and the others
+// dropped.
+func slugify(text string) string {
+	if slugStyle == slugStyleASCII {
+		text = strings.Map(func(r rune) rune {
+			if r >= unicode.MaxASCII {
+				return -1
+			}
+			return r
+		}, transliterate(strings.ToLower(text), slugLocale))
+	}
+	return mdrefactor.Slugify(text)
+}
+
+// headingAnchors returns the anchor of every heading
+func headingAnchors(headings []heading) []string {
+	anchors := make([]string, len(headings))
+	for i, h := range headings {
+		anchors[i] = h.anchor
+	}
+	return anchors
+}
+
+// shiftHeadings changes the level of every top-level heading by delta,
+// clamping the result to levels 1-6. Setext headings are rewritten as ATX
+// headings, since they cannot express levels beyond 2.
+func shiftHeadings(content string, delta int) string {
+	if delta == 0 {
+		return content
+	}
+	lines := strings.Split(content, "\n")
+	headings := parseHeadings(content)
+	for i := len(headings) - 1; i >= 0; i-- {
+		h := headings[i]
+		level := h.level + delta
+		if level < 1 {
+			level = 1
+		}
+		if level > 6 {
+			level = 6
+		}
+		lines[h.line] = strings.Repeat("#", level) + " " + h.text
+		lines = append(lines[:h.line+1], lines[h.endLine+1:]...)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// minHeadingLevel returns the smallest heading level in content, or 0 if it has no headings
+func minHeadingLevel(content string) int {
+	min := 0
+	for _, h := range parseHeadings(content) {
+		if min == 0 || h.level < min {
+			min = h.level
+		}
+	}
+	return min
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackmbuda/go-mdrefactor/mdrefactor"
+)
+
+// Defaults of the http section of the config file
+const (
+	defaultRequestTimeout      = 60 * time.Second
+	defaultStreamTimeout       = 10 * time.Minute
+	defaultDialTimeout         = 30 * time.Second
+	defaultTLSHandshakeTimeout = 10 * time.Second
+	defaultIdleConnTimeout     = 90 * time.Second
+	defaultKeepAlive           = 30 * time.Second
+	defaultMaxIdleConnsPerHost = 10
+	defaultMaxRequestSize      = 4 << 20
+)
+
+// ErrRequestTooLarge marks requests refused because their body exceeds the maximum request size
+var ErrRequestTooLarge = errors.New("request too large")
+
+// Transport shared by every API request, tuned by the http section of the config file
+var apiTransport = http.DefaultTransport.(*http.Transport).Clone()
+
+// Global HTTP clients for reuse. Streamed responses get their own overall
+// timeout, since they stay open for as long as the model generates. Both
+// refuse hosts that are not on the -allow-hosts list.
+var (
+	httpClient   = &http.Client{Transport: egressTransport{apiTransport}, Timeout: defaultRequestTimeout}
+	streamClient = &http.Client{Transport: egressTransport{apiTransport}, Timeout: defaultStreamTimeout}
+)
+
+// configDuration is a duration written as a string such as "30s" or "2m" in the config file
+type configDuration time.Duration
+
+func (d *configDuration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("invalid duration %s, expected a string such as \"30s\"", data)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil || v < 0 {
+		return fmt.Errorf("invalid duration %q, expected a value such as \"30s\"", s)
+	}
+	*d = configDuration(v)
+	return nil
+}
+
+// httpConfig holds the timeouts and connection settings of API requests.
+// Zero values select the defaults.
+type httpConfig struct {
+	Timeout               configDuration `json:"timeout"`                 // Whole request and response, unless streamed
+	StreamTimeout         configDuration `json:"stream_timeout"`          // Whole streamed request and response
+	DialTimeout           configDuration `json:"dial_timeout"`            // Establishing the TCP connection
+	TLSHandshakeTimeout   configDuration `json:"tls_handshake_timeout"`   // TLS handshake
+	ResponseHeaderTimeout configDuration `json:"response_header_timeout"` // Waiting for the response headers, no limit by default
+	IdleConnTimeout       configDuration `json:"idle_conn_timeout"`       // Keeping unused connections open for reuse
+	KeepAlive             configDuration `json:"keep_alive"`              // Interval of TCP keep-alive probes
+	MaxIdleConnsPerHost   int            `json:"max_idle_conns_per_host"`
+	MaxRequestSize        int64          `json:"max_request_size"` // Largest request body in bytes that is sent
+}
+
+// orDefault returns d, or def if d is zero
+func (d configDuration) orDefault(def time.Duration) time.Duration {
+	if d == 0 {
+		return def
+	}
+	return time.Duration(d)
+}
+
+// applyHTTPConfig configures the shared transport and clients
+func applyHTTPConfig(cfg httpConfig) {
+	dialer := &net.Dialer{
+		Timeout:   cfg.DialTimeout.orDefault(defaultDialTimeout),
+		KeepAlive: cfg.KeepAlive.orDefault(defaultKeepAlive),
+	}
+	apiTransport.DialContext = dialer.DialContext
+	apiTransport.TLSHandshakeTimeout = cfg.TLSHandshakeTimeout.orDefault(defaultTLSHandshakeTimeout)
+	apiTransport.ResponseHeaderTimeout = time.Duration(cfg.ResponseHeaderTimeout)
+	apiTransport.IdleConnTimeout = cfg.IdleConnTimeout.orDefault(defaultIdleConnTimeout)
+	apiTransport.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	if cfg.MaxIdleConnsPerHost > 0 {
+		apiTransport.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	}
+	httpClient.Timeout = cfg.Timeout.orDefault(defaultRequestTimeout)
+	streamClient.Timeout = cfg.StreamTimeout.orDefault(defaultStreamTimeout)
+	maxRequestSize = defaultMaxRequestSize
+	if cfg.MaxRequestSize > 0 {
+		maxRequestSize = cfg.MaxRequestSize
+	}
+}
+
+// Largest request body in bytes sent to the API, 0 for no limit
+var maxRequestSize int64 = defaultMaxRequestSize
+
+func init() {
+	applyHTTPConfig(httpConfig{})
+}
+
+// Extra headers sent with every API request. Headers given with -header take
+// precedence over the ones from the config file.
+var (
+	configHeaders = http.Header{}
+	flagHeaders   = http.Header{}
+)
+
+// headerFlag is a repeatable flag adding a "Name: value" header to flagHeaders
+type headerFlag struct{}
+
+func (headerFlag) String() string { return "" }
+
+func (headerFlag) Set(s string) error {
+	name, value, ok := strings.Cut(s, ":")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" {
+		return fmt.Errorf("invalid header %q, expected \"Name: value\"", s)
+	}
+	flagHeaders.Add(name, strings.TrimSpace(value))
+	return nil
+}
+
+// newAPIRequest creates a JSON POST request to the API with the
+// authorization and any extra headers set
+func newAPIRequest(url, apiKey string, body []byte) (*http.Request, error) {
+	if err := checkRequestSize(int64(len(body))); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	setAPIHeaders(req, apiKey)
+	return req, nil
+}
+
+// checkRequestSize refuses request bodies larger than -max-request-size, as
+// the provider would reject them with an opaque 400
+func checkRequestSize(size int64) error {
+	if maxRequestSize > 0 && size > maxRequestSize {
+		return fmt.Errorf("%w: the request body is %d bytes, more than the maximum of %d; split the content into smaller parts, "+
+			"e.g. refactor large files in chunks with -stream-threshold and -chunk-size or a part at a time with -lines, or raise -max-request-size",
+			ErrRequestTooLarge, size, maxRequestSize)
+	}
+	return nil
+}
+
+// chatClient returns the client sending the chat completions of the run to
+// chatTransport, checked against the organization policy and with personal
+// data scrubbed if -scrub-pii is set
+func chatClient(apiKey string) *mdrefactor.Client {
+	client := &mdrefactor.Client{APIKey: apiKey, Transport: chatTransport(apiKey)}
+	client.Use(policyInterceptor, piiInterceptor)
+	return client
+}
+
+// chatTransport returns the transport sending chat completions to the API
+// with the extra headers, seed and token limit of the run, through the
+// circuit breaker
+func chatTransport(apiKey string) *mdrefactor.OpenAI {
+	return &mdrefactor.OpenAI{
+		APIKey:    apiKey,
+		URL:       openaiAPIURL,
+		Seed:      requestSeed,
+		MaxTokens: requestMaxTokens,
+		Do: func(req *http.Request) (*http.Response, error) {
+			if err := checkRequestSize(req.ContentLength); err != nil {
+				return nil, err
+			}
+			setAPIHeaders(req, apiKey)
+			return doAPIRequest(req)
+		},
+	}
+}
+
+// setAPIHeaders sets the authorization and any extra headers of a request
+// to the API
+func setAPIHeaders(req *http.Request, apiKey string) {
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	for name, values := range configHeaders {
+		req.Header[name] = values
+	}
+	for name, values := range flagHeaders {
+		req.Header[name] = values
+	}
+}
+
+// addAPIFlags registers the flags shared by every command that calls the API
+func addAPIFlags(fs *flag.FlagSet) {
+	fs.Var(headerFlag{}, "header", "Extra HTTP header sent with API requests, as \"Name: value\" (repeatable)")
+	fs.IntVar(&requestMaxTokens, "max-tokens", 0, "Maximum number of tokens generated per request (0 for the model's limit); truncated replies are continued and stitched together")
+	fs.Var(seedFlag{}, "seed", "Seed sent with completion requests so that repeated runs at temperature 0 are reproducible")
+	fs.BoolVar(&scrubPII, "scrub-pii", false, "Replace email addresses, phone, card and social security numbers and IP addresses with placeholders before sending content to the API, restoring them in the replies")
+	fs.Int64Var(&maxRequestSize, "max-request-size", maxRequestSize, "Largest request body in bytes sent to the API (0 for no limit); larger requests fail before they are sent")
+	fs.Var(allowHostsFlag{}, "allow-hosts", "Comma-separated hosts (host, host:port or *.domain) outgoing requests may go to; requests to any other host fail")
+	fs.Var(debugHTTPFlag{}, "debug-http", "Directory to write every raw HTTP request and response to, with credentials stripped")
+	fs.Var(diagnosticsFlag{}, "diagnostics", "If the run fails, write a diagnostic bundle (redacted flags and config, environment, model, request sizes, response statuses and timing, but no content or credentials) to this file")
+	addBreakerFlags(fs)
+}
+
+// Seed sent with every completion request, nil if none was given
+var requestSeed *int64
+
+// Output token cap sent with every completion request, 0 if none was given
+var requestMaxTokens int
+
+// seedFlag is a flag setting requestSeed
+type seedFlag struct{}
+
+func (seedFlag) String() string {
+	if requestSeed == nil {
+		return ""
+	}
+	return strconv.FormatInt(*requestSeed, 10)
+}
+
+func (seedFlag) Set(s string) error {
+	seed, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid seed %q, expected an integer", s)
+	}
+	requestSeed = &seed
+	return nil
+}
+
+// debugHTTPFlag is a flag that enables dumping HTTP traffic to a directory
+type debugHTTPFlag struct{}
+
+func (debugHTTPFlag) String() string { return "" }
+
+func (debugHTTPFlag) Set(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create debug directory %s: %w", dir, err)
+	}
+	debug := &debugTransport{dir: dir, next: egressTransport{apiTransport}}
+	httpClient.Transport = debug
+	streamClient.Transport = debug
+	return nil
+}
+
+// debugTransport writes each request and its raw response to timestamped
+// files in dir, the response body as the caller reads it
+type debugTransport struct {
+	dir  string
+	next http.RoundTripper
+	seq  atomic.Int64
+}
+
+// isSecretHeader reports whether a header carries credentials that must not be written to disk
+func isSecretHeader(name string) bool {
+	name = strings.ToLower(name)
+	return strings.Contains(name, "authorization") || strings.Contains(name, "api-key") || strings.Contains(name, "token")
+}
+
+// writeHTTPHead writes the start line and headers of a request or response
+func writeHTTPHead(w io.Writer, startLine string, header http.Header) {
+	fmt.Fprintf(w, "%s\n", startLine)
+	for _, name := range sortedKeys(header) {
+		if isSecretHeader(name) {
+			continue
+		}
+		for _, value := range header[name] {
+			fmt.Fprintf(w, "%s: %s\n", name, value)
+		}
+	}
+	fmt.Fprint(w, "\n")
+}
+
+// dumpHTTP writes the start line, headers and body of a request or response
+func dumpHTTP(path, startLine string, header http.Header, body []byte) {
+	var b bytes.Buffer
+	writeHTTPHead(&b, startLine, header)
+	b.Write(body)
+	if err := os.WriteFile(path, b.Bytes(), 0600); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to write HTTP debug file %s: %v\n", path, err)
+	}
+}
+
+// dumpBody is a response body that writes what is read from it to a debug
+// file, so streamed responses reach the caller as they arrive
+type dumpBody struct {
+	io.ReadCloser
+	file *os.File
+}
+
+func (b *dumpBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.file.Write(p[:n])
+	return n, err
+}
+
+func (b *dumpBody) Close() error {
+	b.file.Close()
+	return b.ReadCloser.Close()
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *debugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	prefix := filepath.Join(t.dir, fmt.Sprintf("%s-%03d", time.Now().Format("20060102-150405.000"), t.seq.Add(1)))
+
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	dumpHTTP(prefix+"-request.txt", req.Method+" "+req.URL.String(), req.Header, body)
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		dumpHTTP(prefix+"-response.txt", "error: "+err.Error(), nil, nil)
+		return nil, err
+	}
+	path := prefix + "-response.txt"
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to write HTTP debug file %s: %v\n", path, err)
+		return resp, nil
+	}
+	writeHTTPHead(file, resp.Proto+" "+resp.Status, resp.Header)
+	resp.Body = &dumpBody{ReadCloser: resp.Body, file: file}
+	return resp, nil
+}
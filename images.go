@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	markdownImageRe = regexp.MustCompile(`!\[([^\]]*)\]\(\s*<?([^)\s>]+)>?(?:\s+["'(][^)]*)?\)`)
+	htmlImageRe     = regexp.MustCompile(`(?i)<img\s[^>]*?src\s*=\s*["']([^"']+)["'][^>]*>`)
+	htmlAltRe       = regexp.MustCompile(`(?i)\salt\s*=\s*["']([^"']*)["']`)
+)
+
+// imageRef is an image referenced from a Markdown document
+type imageRef struct {
+	alt    string
+	target string
+}
+
+// parseImages returns the Markdown and HTML images referenced by content, ignoring code blocks
+func parseImages(content string) []imageRef {
+	var images []imageRef
+	code := codeLines(content)
+	for i, line := range strings.Split(content, "\n") {
+		if code[i] {
+			continue
+		}
+		line = inlineCodeRe.ReplaceAllString(line, "")
+		for _, m := range markdownImageRe.FindAllStringSubmatch(line, -1) {
+			images = append(images, imageRef{alt: m[1], target: m[2]})
+		}
+		for _, m := range htmlImageRe.FindAllStringSubmatch(line, -1) {
+			alt := ""
+			if a := htmlAltRe.FindStringSubmatch(m[0]); a != nil {
+				alt = a[1]
+			}
+			images = append(images, imageRef{alt: alt, target: m[1]})
+		}
+	}
+	return images
+}
+
+// isRemoteURL reports whether target points to a web resource
+func isRemoteURL(target string) bool {
+	return strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") || strings.HasPrefix(target, "//")
+}
+
+// checkRemoteImage reports an error if the image URL cannot be fetched
+func checkRemoteImage(target string) error {
+	if strings.HasPrefix(target, "//") {
+		target = "https:" + target
+	}
+	resp, err := httpClient.Head(target)
+	if err == nil && resp.StatusCode == http.StatusMethodNotAllowed {
+		// Some servers only answer GET requests
+		resp.Body.Close()
+		resp, err = httpClient.Get(target)
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// resolveLocalPath resolves a local link target relative to the directory of
+// the document. Root-relative targets (/img/a.png) resolve against rootDir.
+func resolveLocalPath(target, docDir, rootDir string) string {
+	if isDrivePath(target) {
+		return filepath.Clean(target)
+	}
+	target = slashLinkPath(target)
+	if u, err := url.Parse(target); err == nil {
+		target = u.Path
+	}
+	if unescaped, err := url.PathUnescape(target); err == nil {
+		target = unescaped
+	}
+	if strings.HasPrefix(target, "/") {
+		return filepath.Join(rootDir, filepath.FromSlash(target))
+	}
+	return filepath.Join(docDir, filepath.FromSlash(target))
+}
+
+// checkImages verifies that every image of the refactored document resolves
+// and reports images that the model dropped or whose paths it rewrote, as well
+// as images larger than maxSize (unless 0) and hotlinked ones.
+// docDir is the directory the refactored document is written to.
+func checkImages(original, refactored, docDir, rootDir string, checkRemote bool, maxSize int64) []string {
+	problems := auditImages(refactored, docDir, rootDir, maxSize)
+
+	after := parseImages(refactored)
+	kept := make(map[string]bool)
+	for _, img := range after {
+		kept[img.target] = true
+		if checkRemote && isRemoteURL(img.target) {
+			if err := checkRemoteImage(img.target); err != nil {
+				problems = append(problems, fmt.Sprintf("unreachable image %s: %v", img.target, err))
+			}
+		}
+	}
+
+	for _, img := range parseImages(original) {
+		if kept[img.target] {
+			continue
+		}
+		// Moved to a copy of the same image, such as by -assets-dir
+		moved := false
+		for _, candidate := range after {
+			if !isRemoteURL(img.target) && !isRemoteURL(candidate.target) && sameFileContent(resolveLocalPath(img.target, docDir, rootDir), resolveLocalPath(candidate.target, docDir, rootDir)) {
+				moved = true
+				break
+			}
+		}
+		if moved {
+			continue
+		}
+		// An image with the same alt text but a new target was rewritten, not dropped
+		rewritten := ""
+		for _, candidate := range after {
+			if img.alt != "" && candidate.alt == img.alt {
+				rewritten = candidate.target
+				break
+			}
+		}
+		if rewritten != "" {
+			problems = append(problems, fmt.Sprintf("image path rewritten: %s -> %s", img.target, rewritten))
+		} else {
+			problems = append(problems, fmt.Sprintf("image dropped by the model: %s", img.target))
+		}
+	}
+	return problems
+}
+
+// reportImageProblems prints the image problems found in a file to stderr
+func reportImageProblems(file string, problems []string) {
+	for _, p := range problems {
+		fmt.Fprintf(os.Stderr, "Warning: %s: %s\n", file, p)
+	}
+}
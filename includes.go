@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Directive pulling a source file, line range or region into the document as
+// the code block below it, e.g. <!-- include: ../examples/client.go#connect -->
+var includeDirectiveRe = regexp.MustCompile(`^\s*<!--\s*include:\s*(\S+?)\s*-->\s*$`)
+
+// Info strings of included code blocks by file extension, the extension itself otherwise
+var includeLanguages = map[string]string{
+	".go": "go", ".py": "python", ".js": "javascript", ".mjs": "javascript", ".ts": "typescript", ".tsx": "tsx",
+	".sh": "bash", ".bash": "bash", ".ps1": "powershell", ".rb": "ruby", ".rs": "rust", ".java": "java", ".kt": "kotlin",
+	".c": "c", ".h": "c", ".cc": "cpp", ".cpp": "cpp", ".cs": "csharp", ".yml": "yaml", ".yaml": "yaml",
+	".json": "json", ".toml": "toml", ".sql": "sql", ".proto": "protobuf", ".tf": "hcl",
+}
+
+// includeLanguage returns the info string of a code block holding file
+func includeLanguage(file string) string {
+	ext := strings.ToLower(path.Ext(file))
+	if lang, ok := includeLanguages[ext]; ok {
+		return lang
+	}
+	if strings.ToLower(path.Base(file)) == "dockerfile" {
+		return "dockerfile"
+	}
+	return strings.TrimPrefix(ext, ".")
+}
+
+// includeFence returns a fence longer than any run of backticks in lines
+func includeFence(lines []string) string {
+	fence := "```"
+	for _, line := range lines {
+		for strings.Contains(line, fence) {
+			fence += "`"
+		}
+	}
+	return fence
+}
+
+// expandIncludes fills the code block below every include directive of the
+// document at path with the current source, adding the block if there is
+// none yet. Running it again keeps the blocks in sync with their sources.
+// It returns the new content and the number of directives.
+func expandIncludes(path, content string) (string, int, error) {
+	lines := strings.Split(content, "\n")
+	code := codeLines(content)
+	blocks := make(map[int]annotatedSnippet)
+	for _, s := range findAnnotatedSnippets(content, includeDirectiveRe) {
+		blocks[s.directive] = s
+	}
+
+	count := 0
+	docDir := filepath.Dir(path)
+	// Expand from the end so earlier line numbers stay valid
+	for i := len(lines) - 1; i >= 0; i-- {
+		m := includeDirectiveRe.FindStringSubmatch(lines[i])
+		if m == nil || code[i] {
+			continue
+		}
+		count++
+		ref, err := parseSnippetRef(m[1])
+		if err != nil {
+			return "", 0, fmt.Errorf("%s:%d: %w", path, i+1, err)
+		}
+		source, err := loadSnippet(docDir, ref)
+		if err != nil {
+			return "", 0, fmt.Errorf("%s:%d: cannot include %w", path, i+1, err)
+		}
+
+		indent := lines[i][:len(lines[i])-len(strings.TrimLeft(lines[i], " \t"))]
+		if s, ok := blocks[i]; ok {
+			indent = lines[s.open][:len(lines[s.open])-len(strings.TrimLeft(lines[s.open], " \t"))]
+		}
+		body := make([]string, len(source))
+		for j, line := range source {
+			if line != "" {
+				line = indent + line
+			}
+			body[j] = line
+		}
+
+		if s, ok := blocks[i]; ok {
+			lines = append(lines[:s.open+1], append(body, lines[s.close:]...)...)
+			continue
+		}
+		fence := includeFence(source)
+		block := append(append([]string{indent + fence + includeLanguage(ref.file)}, body...), indent+fence)
+		lines = append(lines[:i+1], append(block, lines[i+1:]...)...)
+	}
+	return strings.Join(lines, "\n"), count, nil
+}
+
+// syncIncludes expands the include directives of the refactored version of
+// the document at path, so included code is taken from its source rather
+// than from the model, and warns about directives the model dropped
+func syncIncludes(path, original, refactored string) (string, error) {
+	_, before, err := expandIncludes(path, original)
+	if err != nil || before == 0 {
+		return refactored, err
+	}
+	refactored, after, err := expandIncludes(path, refactored)
+	if err != nil {
+		return "", err
+	}
+	if after < before {
+		fmt.Fprintf(os.Stderr, "Warning: %s: %d of %d include directives were lost in refactoring\n", path, before-after, before)
+	}
+	return refactored, nil
+}
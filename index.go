@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jackmbuda/go-mdrefactor/mdrefactor"
+)
+
+const (
+	// Embedding index of a docs tree, below the docs directory
+	defaultIndexFile = ".mdrefactor/index.json"
+	// Length of the excerpt shown for a section
+	searchExcerptChars = 160
+)
+
+// indexedSection is one section of a docs tree in the embedding index
+type indexedSection struct {
+	File    string    `json:"file"` // Slash-separated path relative to the docs directory
+	Title   string    `json:"title"`
+	Heading string    `json:"heading,omitempty"`
+	Anchor  string    `json:"anchor,omitempty"`
+	Line    int       `json:"line"` // 1-based line of the heading
+	Excerpt string    `json:"excerpt"`
+	Vector  []float64 `json:"vector"`
+}
+
+// location returns the file#anchor location of the section
+func (s indexedSection) location() string {
+	if s.Anchor == "" {
+		return s.File
+	}
+	return s.File + "#" + s.Anchor
+}
+
+// name returns the title of the section's document and its heading
+func (s indexedSection) name() string {
+	if s.Heading != "" && s.Heading != s.Title {
+		return s.Title + " > " + s.Heading
+	}
+	return s.Title
+}
+
+// indexedFile is one document of a docs tree in the embedding index
+type indexedFile struct {
+	Hash     string           `json:"hash"`   // Hash of the content the entry was computed from
+	Vector   []float64        `json:"vector"` // Embedding of the whole document
+	Sections []indexedSection `json:"sections"`
+}
+
+// docIndex is an embedding index of the documents and sections of a docs
+// tree. It is kept on disk and only documents whose content changed are
+// embedded again.
+type docIndex struct {
+	Model string                  `json:"model"`
+	Files map[string]*indexedFile `json:"files"` // By slash-separated path relative to the docs directory
+}
+
+// sections returns the sections of all documents, in path order
+func (idx *docIndex) sections() []indexedSection {
+	var all []indexedSection
+	for _, p := range sortedKeys(idx.Files) {
+		all = append(all, idx.Files[p].Sections...)
+	}
+	return all
+}
+
+// indexPathFor returns the index file of the docs tree in dir, unless one is given
+func indexPathFor(dir, file string) string {
+	if file != "" {
+		return file
+	}
+	return filepath.Join(dir, filepath.FromSlash(defaultIndexFile))
+}
+
+// contentHash returns the hash identifying a version of a document
+func contentHash(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// indexDocument splits a document into its entry of the index, without
+// vectors, and returns the embedding inputs of the document and its sections
+func indexDocument(p, content string) (*indexedFile, []string) {
+	entry := &indexedFile{Hash: contentHash(content)}
+	title := documentTitle(content, p)
+	inputs := []string{title + "\n" + strings.Join(proseUnits(content), "\n")}
+
+	frontMatter, body := mdrefactor.SplitFrontMatter(content)
+	offset := strings.Count(frontMatter, "\n")
+	for _, s := range splitSections(body) {
+		units := proseUnits(s.Text)
+		if len(units) == 0 || s.Heading != "" && len(units) == 1 {
+			// Nothing but a heading
+			continue
+		}
+		excerpt := strings.Join(units, " ")
+		if s.Heading != "" {
+			// The heading line is the first unit, the excerpt shows what follows it
+			excerpt = strings.Join(units[1:], " ")
+		}
+		if len([]rune(excerpt)) > searchExcerptChars {
+			excerpt = string([]rune(excerpt)[:searchExcerptChars]) + "..."
+		}
+		entry.Sections = append(entry.Sections, indexedSection{
+			File: p, Title: title, Heading: s.Heading, Anchor: s.Anchor, Line: offset + s.StartLine + 1, Excerpt: excerpt,
+		})
+		// The document title gives sections such as "Configuration" their context
+		inputs = append(inputs, title+"\n"+strings.Join(units, "\n"))
+	}
+	return entry, inputs
+}
+
+// updateIndex returns the embedding index of the docs tree in dir, kept in
+// indexFile. Documents whose content hash matches their entry are taken from
+// the file; new and changed documents are embedded, and removed ones dropped.
+func updateIndex(embedder embeddingProvider, dir, indexFile string) (*docIndex, error) {
+	files, err := findMarkdownFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	model := embedder.id()
+	index := &docIndex{Model: model, Files: make(map[string]*indexedFile)}
+	var previous docIndex
+	if data, err := os.ReadFile(indexFile); err == nil {
+		if err := json.Unmarshal(data, &previous); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: ignoring unreadable index %s: %v\n", indexFile, err)
+		} else if previous.Model != model && len(previous.Files) > 0 {
+			fmt.Fprintf(os.Stderr, "The index was built with %s, rebuilding it with %s\n", previous.Model, model)
+			previous.Files = nil
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read index %s: %w", indexFile, err)
+	}
+
+	var changed []string
+	var inputs []string
+	pending := make(map[string]*indexedFile)
+	for _, rel := range files {
+		data, err := os.ReadFile(filepath.Join(dir, rel))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", rel, err)
+		}
+		p := filepath.ToSlash(rel)
+		content := decodeSource(data).text
+		if old, ok := previous.Files[p]; ok && old.Hash == contentHash(content) {
+			index.Files[p] = old
+			continue
+		}
+		entry, entryInputs := indexDocument(p, content)
+		changed = append(changed, p)
+		pending[p] = entry
+		inputs = append(inputs, entryInputs...)
+	}
+	removed := 0
+	for p := range previous.Files {
+		if index.Files[p] == nil && pending[p] == nil {
+			removed++
+		}
+	}
+	if len(changed) == 0 && removed == 0 {
+		return index, nil
+	}
+
+	if len(changed) > 0 {
+		fmt.Fprintf(os.Stderr, "Indexing %d new or changed documents (%d unchanged)...\n", len(changed), len(index.Files))
+		vectors, err := createEmbeddings(embedder, inputs)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range changed {
+			entry := pending[p]
+			entry.Vector, vectors = vectors[0], vectors[1:]
+			for i := range entry.Sections {
+				entry.Sections[i].Vector, vectors = vectors[0], vectors[1:]
+			}
+			index.Files[p] = entry
+		}
+	}
+
+	data, err := json.Marshal(index)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(indexFile), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create index directory: %w", err)
+	}
+	if err := writeFileAtomic(indexFile, data, 0644); err != nil {
+		return nil, fmt.Errorf("failed to write index %s: %w", indexFile, err)
+	}
+	return index, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Number of extra attempts made when a refactored document violates the length policy
+const lengthRetries = 2
+
+// Tolerance used by -target-length same when -max-growth is not given
+const defaultSameLengthTolerance = 0.10
+
+// refactorFunc refactors content using the given system prompt
+type refactorFunc func(systemPrompt, content string) (string, error)
+
+// lengthPolicy describes how much the refactored document may differ in length from the original
+type lengthPolicy struct {
+	maxGrowth float64 // Maximum allowed growth as a fraction, negative if unset
+	target    string  // Target length ("same" or "shorter"), empty if unset
+}
+
+// parseGrowth parses a growth limit such as "10%" or "0.1" into a fraction
+func parseGrowth(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	percent := strings.HasSuffix(s, "%")
+	value, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid growth limit %q, expected a percentage such as 10%%", s)
+	}
+	if percent {
+		value /= 100
+	}
+	return value, nil
+}
+
+// newLengthPolicy builds a lengthPolicy from the -max-growth and -target-length flag values
+func newLengthPolicy(maxGrowth, target string) (lengthPolicy, error) {
+	policy := lengthPolicy{maxGrowth: -1, target: target}
+	if maxGrowth != "" {
+		growth, err := parseGrowth(maxGrowth)
+		if err != nil {
+			return policy, err
+		}
+		policy.maxGrowth = growth
+	}
+	switch target {
+	case "", "same", "shorter":
+	default:
+		return policy, fmt.Errorf("invalid target length %q, expected same or shorter", target)
+	}
+	return policy, nil
+}
+
+// enabled reports whether the policy constrains the output at all
+func (p lengthPolicy) enabled() bool {
+	return p.maxGrowth >= 0 || p.target != ""
+}
+
+// bounds returns the allowed word-count range for a document of the given length
+func (p lengthPolicy) bounds(words int) (int, int) {
+	min, max := 0, -1
+	switch p.target {
+	case "same":
+		tolerance := defaultSameLengthTolerance
+		if p.maxGrowth >= 0 {
+			tolerance = p.maxGrowth
+		}
+		min = int(float64(words) * (1 - tolerance))
+		max = int(float64(words)*(1+tolerance) + 0.5)
+	case "shorter":
+		max = words
+	}
+	if p.maxGrowth >= 0 {
+		limit := int(float64(words)*(1+p.maxGrowth) + 0.5)
+		if max < 0 || limit < max {
+			max = limit
+		}
+	}
+	return min, max
+}
+
+// instruction returns the prompt text describing the policy for a document of the given length
+func (p lengthPolicy) instruction(words int) string {
+	min, max := p.bounds(words)
+	switch {
+	case p.target == "same":
+		return fmt.Sprintf("The original document is %d words long. Keep the refactored document about the same length: between %d and %d words.", words, min, max)
+	case p.target == "shorter":
+		return fmt.Sprintf("The original document is %d words long. The refactored document must be shorter, at most %d words.", words, max)
+	default:
+		return fmt.Sprintf("The original document is %d words long. The refactored document must not exceed %d words.", words, max)
+	}
+}
+
+// countWords returns the number of whitespace-separated words in s
+func countWords(s string) int {
+	return len(strings.Fields(s))
+}
+
+// withLengthPolicy wraps refactor so that the length policy is added to the
+// prompt and verified afterwards, retrying when the output is out of bounds
+func withLengthPolicy(policy lengthPolicy, refactor refactorFunc) refactorFunc {
+	if !policy.enabled() {
+		return refactor
+	}
+	return func(systemPrompt, content string) (string, error) {
+		words := countWords(content)
+		min, max := policy.bounds(words)
+		prompt := systemPrompt + "\n\n" + policy.instruction(words)
+
+		for attempt := 0; ; attempt++ {
+			refactored, err := refactor(prompt, content)
+			if err != nil {
+				return "", err
+			}
+
+			got := countWords(refactored)
+			if got >= min && (max < 0 || got <= max) {
+				return refactored, nil
+			}
+			if attempt == lengthRetries {
+				return "", fmt.Errorf("refactored content is %d words, outside the allowed range of %d-%d words after %d attempts", got, min, max, attempt+1)
+			}
+
+			fmt.Printf("Refactored content is %d words (allowed %d-%d), retrying...\n", got, min, max)
+			prompt = fmt.Sprintf("%s\n\n%s\nYour previous attempt was %d words, which violates this limit. Respect the limit strictly.", systemPrompt, policy.instruction(words), got)
+		}
+	}
+}
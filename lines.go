@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jackmbuda/go-mdrefactor/mdrefactor"
+)
+
+// parseLineRange parses a range such as "120-180" into 1-based, inclusive line numbers
+func parseLineRange(s string) (int, int, error) {
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid line range %q, expected START-END (e.g. 120-180)", s)
+	}
+
+	start, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid start line in range %q: %w", s, err)
+	}
+	end, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid end line in range %q: %w", s, err)
+	}
+
+	if start < 1 || end < start {
+		return 0, 0, fmt.Errorf("invalid line range %q, START must be >= 1 and END >= START", s)
+	}
+	return start, end, nil
+}
+
+// isFenceLine reports whether a line opens or closes a fenced code block
+func isFenceLine(line string) bool {
+	trimmed := strings.TrimSpace(line)
+	return strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~")
+}
+
+// blockIDs assigns every line the index of the top-level Markdown block it
+// belongs to. Lines between blocks get -1, since they separate blocks.
+func blockIDs(lines []string) []int {
+	content := strings.Join(lines, "\n")
+	d := parseMarkdown(content)
+	ids := make([]int, len(lines))
+	for i := range ids {
+		ids[i] = -1
+	}
+	id := 0
+
+	// Front matter is a single block of its own
+	if frontMatter, _ := mdrefactor.SplitFrontMatter(content); frontMatter != "" {
+		for i := 0; i < strings.Count(frontMatter, "\n"); i++ {
+			ids[i] = id
+		}
+		id++
+	}
+	for n := d.root.FirstChild(); n != nil; n = n.NextSibling() {
+		first, last, ok := d.span(n)
+		if !ok {
+			continue
+		}
+		for i := first; i <= last && i < len(ids); i++ {
+			ids[i] = id
+		}
+		id++
+	}
+	return ids
+}
+
+// snapToBlocks widens the 0-based, inclusive range [start, end] so that it
+// never cuts through a paragraph, list or fenced code block
+func snapToBlocks(lines []string, start, end int) (int, int) {
+	ids := blockIDs(lines)
+
+	// Skip separating blank lines at the edges of the selection
+	for start < end && ids[start] == -1 {
+		start++
+	}
+	for end > start && ids[end] == -1 {
+		end--
+	}
+
+	if id := ids[start]; id != -1 {
+		for start > 0 && ids[start-1] == id {
+			start--
+		}
+	}
+	if id := ids[end]; id != -1 {
+		for end < len(lines)-1 && ids[end+1] == id {
+			end++
+		}
+	}
+	return start, end
+}
+
+// refactorLineRange refactors only lines start..end (1-based, inclusive) of
+// content, snapped to block boundaries, and merges the result back in place
+func refactorLineRange(content string, start, end int, refactor func(string) (string, error)) (string, error) {
+	lines := strings.Split(content, "\n")
+	// A trailing newline produces an empty last element that is not a real line
+	trailingNewline := strings.HasSuffix(content, "\n")
+	if trailingNewline {
+		lines = lines[:len(lines)-1]
+	}
+
+	if start > len(lines) {
+		return "", fmt.Errorf("line range starts at %d but the file only has %d lines", start, len(lines))
+	}
+	if end > len(lines) {
+		end = len(lines)
+	}
+
+	first, last := snapToBlocks(lines, start-1, end-1)
+	if first != start-1 || last != end-1 {
+		fmt.Printf("Line range snapped to block boundaries: %d-%d\n", first+1, last+1)
+	}
+
+	selection := strings.Join(lines[first:last+1], "\n")
+	refactored, err := refactor(selection)
+	if err != nil {
+		return "", err
+	}
+
+	// Splice the refactored selection back between the untouched lines
+	var merged []string
+	merged = append(merged, lines[:first]...)
+	merged = append(merged, strings.TrimRight(refactored, "\n"))
+	merged = append(merged, lines[last+1:]...)
+
+	result := strings.Join(merged, "\n")
+	if trailingNewline {
+		result += "\n"
+	}
+	return result, nil
+}
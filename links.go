@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	inlineLinkRe       = regexp.MustCompile(`(!?)\[([^\]]*)\]\(\s*<?([^)\s>]*)>?(?:\s+["'(][^)]*)?\)`)
+	referenceDefRe     = regexp.MustCompile(`^ {0,3}\[([^\]]+)\]:\s*<?(\S+?)>?(?:\s+.*)?$`)
+	htmlAnchorRe       = regexp.MustCompile(`(?i)<a\s[^>]*?href\s*=\s*["']([^"']+)["']`)
+	uriSchemeRe        = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+.-]*:`)
+	markdownExtensions = []string{".md", ".markdown"}
+)
+
+// link is a link found in a Markdown document
+type link struct {
+	text   string
+	target string
+	line   int // 0-based line index
+}
+
+// parseLinks returns the links of content (inline links, reference
+// definitions and HTML anchors), ignoring images and code blocks
+func parseLinks(content string) []link {
+	var links []link
+	code := codeLines(content)
+	for i, line := range strings.Split(content, "\n") {
+		if code[i] {
+			continue
+		}
+		line = inlineCodeRe.ReplaceAllString(line, "")
+
+		if m := referenceDefRe.FindStringSubmatch(line); m != nil {
+			links = append(links, link{text: m[1], target: m[2], line: i})
+			continue
+		}
+		for _, m := range inlineLinkRe.FindAllStringSubmatch(line, -1) {
+			if m[1] == "!" {
+				continue
+			}
+			links = append(links, link{text: m[2], target: m[3], line: i})
+		}
+		for _, m := range htmlAnchorRe.FindAllStringSubmatch(line, -1) {
+			links = append(links, link{target: m[1], line: i})
+		}
+	}
+	return links
+}
+
+// isExternalLink reports whether target leaves the docs tree (a URL, mailto:, etc.)
+func isExternalLink(target string) bool {
+	return uriSchemeRe.MatchString(target) || strings.HasPrefix(target, "//")
+}
+
+// resolveDocLink resolves a link target found in the document at from (a
+// slash-separated path relative to the docs root) to the linked document and
+// anchor. It returns ok=false for external links and links outside the tree.
+func resolveDocLink(from, target string, exists func(string) bool) (file, anchor string, ok bool) {
+	if target == "" || isExternalLink(target) {
+		return "", "", false
+	}
+
+	pathPart, anchor, _ := strings.Cut(target, "#")
+	if i := strings.Index(pathPart, "?"); i >= 0 {
+		pathPart = pathPart[:i]
+	}
+	if unescaped, err := url.PathUnescape(pathPart); err == nil {
+		pathPart = slashLinkPath(unescaped)
+	}
+	if pathPart == "" {
+		return from, anchor, true
+	}
+
+	var p string
+	if strings.HasPrefix(pathPart, "/") {
+		p = path.Clean(strings.TrimPrefix(pathPart, "/"))
+	} else {
+		p = path.Join(path.Dir(from), pathPart)
+	}
+	if strings.HasPrefix(p, "../") || p == ".." {
+		return "", "", false
+	}
+
+	// Links may point at the file, at a directory's index page, or omit the extension
+	candidates := []string{p}
+	for _, ext := range markdownExtensions {
+		candidates = append(candidates, p+ext)
+	}
+	for _, index := range []string{"index.md", "README.md", "readme.md"} {
+		candidates = append(candidates, path.Join(p, index))
+	}
+	for _, c := range candidates {
+		if exists(c) {
+			return c, anchor, true
+		}
+	}
+	return p, anchor, true
+}
+
+// linkGraph is the graph of links between the documents of a docs tree
+type linkGraph struct {
+	files    []string                   // Slash-separated paths of all documents
+	contents map[string]string          // Document contents by path
+	links    map[string][]resolvedLink  // Outgoing links by source document
+	inbound  map[string]map[string]bool // Linking documents by target document
+	anchors  map[string]map[string]bool // Referenced anchors by target document
+}
+
+// resolvedLink is a link between two documents of the tree
+type resolvedLink struct {
+	link
+	file   string // Target document, may not exist if the link is broken
+	anchor string
+}
+
+// buildLinkGraph reads every Markdown file below dir and resolves the links between them
+func buildLinkGraph(dir string) (*linkGraph, error) {
+	files, err := findMarkdownFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &linkGraph{
+		contents: make(map[string]string),
+		links:    make(map[string][]resolvedLink),
+		inbound:  make(map[string]map[string]bool),
+		anchors:  make(map[string]map[string]bool),
+	}
+	for _, rel := range files {
+		content, err := os.ReadFile(filepath.Join(dir, rel))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", rel, err)
+		}
+		p := filepath.ToSlash(rel)
+		g.files = append(g.files, p)
+		g.contents[p] = string(content)
+	}
+
+	exists := func(p string) bool {
+		_, ok := g.contents[p]
+		return ok
+	}
+	for _, from := range g.files {
+		for _, l := range parseLinks(g.contents[from]) {
+			file, anchor, ok := resolveDocLink(from, l.target, exists)
+			if !ok {
+				continue
+			}
+			g.links[from] = append(g.links[from], resolvedLink{link: l, file: file, anchor: anchor})
+			if file != from {
+				if g.inbound[file] == nil {
+					g.inbound[file] = make(map[string]bool)
+				}
+				g.inbound[file][from] = true
+			}
+			if anchor != "" {
+				if g.anchors[file] == nil {
+					g.anchors[file] = make(map[string]bool)
+				}
+				g.anchors[file][anchor] = true
+			}
+		}
+	}
+	return g, nil
+}
+
+// replaceGroup replaces the given capture group of every match of re in line
+func replaceGroup(line string, re *regexp.Regexp, group int, fn func(match []string) string) string {
+	matches := re.FindAllStringSubmatchIndex(line, -1)
+	for i := len(matches) - 1; i >= 0; i-- {
+		m := matches[i]
+		start, end := m[2*group], m[2*group+1]
+		if start < 0 {
+			continue
+		}
+		groups := make([]string, len(m)/2)
+		for g := range groups {
+			if m[2*g] >= 0 {
+				groups[g] = line[m[2*g]:m[2*g+1]]
+			}
+		}
+		line = line[:start] + fn(groups) + line[end:]
+	}
+	return line
+}
+
+// rewriteLinks calls rewrite for the target of every link and image in
+// content outside of code, replacing the target with the returned value
+func rewriteLinks(content string, rewrite func(target string, image bool) string) string {
+	lines := strings.Split(content, "\n")
+	code := codeLines(content)
+	for i, line := range lines {
+		if code[i] {
+			continue
+		}
+
+		if referenceDefRe.MatchString(line) {
+			lines[i] = replaceGroup(line, referenceDefRe, 2, func(m []string) string { return rewrite(m[2], false) })
+			continue
+		}
+		line = replaceGroup(line, inlineLinkRe, 3, func(m []string) string { return rewrite(m[3], m[1] == "!") })
+		line = replaceGroup(line, htmlAnchorRe, 1, func(m []string) string { return rewrite(m[1], false) })
+		line = replaceGroup(line, htmlImageRe, 1, func(m []string) string { return rewrite(m[1], true) })
+		lines[i] = line
+	}
+	return strings.Join(lines, "\n")
+}
+
+// rebaseLink rewrites a relative link target written in a document in fromDir
+// so that it resolves to the same file from a document in toDir
+func rebaseLink(target, fromDir, toDir string) string {
+	pathPart, suffix := target, ""
+	if i := strings.IndexAny(target, "#?"); i >= 0 {
+		pathPart, suffix = target[:i], target[i:]
+	}
+	if pathPart == "" || isDrivePath(pathPart) {
+		return target
+	}
+	rel, err := filepath.Rel(toDir, filepath.Join(fromDir, filepath.FromSlash(slashLinkPath(pathPart))))
+	if err != nil {
+		return target
+	}
+	return filepath.ToSlash(rel) + suffix
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// Lock file of a tree, below its root
+	treeLockFile = ".mdrefactor/lock"
+	// How often a waiting run checks whether the lock was released
+	lockPollInterval = 500 * time.Millisecond
+	// Default of -lock-timeout
+	defaultLockTimeout = 10 * time.Minute
+)
+
+// lockHolder identifies the run holding a tree lock
+type lockHolder struct {
+	PID     int       `json:"pid"`
+	Host    string    `json:"host"`
+	Started time.Time `json:"started"`
+	Command string    `json:"command"`
+}
+
+// treeRoot returns the root of the tree containing dir: the closest
+// directory with a .git entry, or dir itself outside of repositories
+func treeRoot(dir string) string {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return dir
+	}
+	for d := abs; ; d = filepath.Dir(d) {
+		if _, err := os.Stat(filepath.Join(d, ".git")); err == nil {
+			return d
+		}
+		if filepath.Dir(d) == d {
+			return abs
+		}
+	}
+}
+
+// stale reports whether the holder of a lock is a process of this host that
+// no longer runs, e.g. after a crash
+func (h lockHolder) stale() bool {
+	host, _ := os.Hostname()
+	return h.Host == host && h.PID != os.Getpid() && !processAlive(h.PID)
+}
+
+// lockTree takes the lock of the tree containing dir, so that runs in the
+// same tree (CI matrix jobs, watch mode and manual runs) write their outputs
+// one after another. It waits up to timeout for another run to finish and
+// takes over locks of crashed runs. The returned function releases the lock.
+func lockTree(dir string, timeout time.Duration) (func(), error) {
+	path := filepath.Join(treeRoot(dir), filepath.FromSlash(treeLockFile))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create lock directory: %w", err)
+	}
+	host, _ := os.Hostname()
+	data, err := json.Marshal(lockHolder{PID: os.Getpid(), Host: host, Started: time.Now(), Command: strings.Join(os.Args, " ")})
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	waiting := false
+	for {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			_, err = f.Write(data)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(path)
+				return nil, fmt.Errorf("failed to write lock file %s: %w", path, err)
+			}
+			return func() {
+				// Only remove the lock if it is still ours
+				if current, err := os.ReadFile(path); err == nil && string(current) == string(data) {
+					os.Remove(path)
+				}
+			}, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("failed to create lock file %s: %w", path, err)
+		}
+
+		var holder lockHolder
+		current, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue // Released in the meantime
+		}
+		if err == nil && json.Unmarshal(current, &holder) == nil && holder.stale() {
+			fmt.Fprintf(os.Stderr, "Removing stale lock %s of process %d, which no longer runs\n", path, holder.PID)
+			os.Remove(path)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("the tree is locked by another mdrefactor run (process %d on %s since %s: %s); "+
+				"wait for it to finish, raise -lock-timeout or remove %s if that run is gone",
+				holder.PID, holder.Host, holder.Started.Format(time.RFC3339), holder.Command, path)
+		}
+		if !waiting {
+			fmt.Fprintf(os.Stderr, "Waiting for another mdrefactor run in the tree (process %d) to finish...\n", holder.PID)
+			waiting = true
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+const (
+	// Access right enough to read the exit code of a process
+	processQueryLimitedInformation = 0x1000
+	// Exit code of a process that has not exited yet
+	stillActive = 259
+	// Error opening the ID of a process that no longer exists
+	errorInvalidParameter syscall.Errno = 87
+)
+
+// processAlive reports whether a process with the given ID is running on
+// this host. Signals cannot tell on Windows, so the process is opened
+// instead; a process that cannot be checked counts as running.
+func processAlive(pid int) bool {
+	h, err := syscall.OpenProcess(processQueryLimitedInformation, false, uint32(pid))
+	if err != nil {
+		return !errors.Is(err, errorInvalidParameter)
+	}
+	defer syscall.CloseHandle(h)
+	var code uint32
+	if err := syscall.GetExitCodeProcess(h, &code); err != nil {
+		return true
+	}
+	return code == stillActive
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"unicode/utf16"
+)
+
+// System prompt used to proofread a selection
+const proofreadSystemPrompt = "You are a careful copy editor. Fix spelling, grammar and punctuation in the Markdown content without changing its meaning, structure or formatting. Reply with the corrected Markdown only."
+
+// Commands offered as code actions
+const (
+	lspRefactorSection = "mdrefactor.refactorSection"
+	lspGenerateTOC     = "mdrefactor.generateToc"
+	lspProofread       = "mdrefactor.proofreadSelection"
+)
+
+// lspPosition is a position in a document, with the character offset counted in UTF-16 code units
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+// lspRange is a range in a document
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+// lspTextEdit replaces a range of a document
+type lspTextEdit struct {
+	Range   lspRange `json:"range"`
+	NewText string   `json:"newText"`
+}
+
+// lspCommand is a command the client asks the server to execute
+type lspCommand struct {
+	Title     string            `json:"title"`
+	Command   string            `json:"command"`
+	Arguments []json.RawMessage `json:"arguments,omitempty"`
+}
+
+// lspSettings is the workspace configuration of the server, sent by the
+// client as initializationOptions or in the "mdrefactor" settings section
+type lspSettings struct {
+	APIKey string `json:"apiKey"`
+	Model  string `json:"model"`
+	Prompt string `json:"prompt"`
+}
+
+// lspServer is a minimal Language Server offering refactoring code actions for Markdown
+type lspServer struct {
+	conn *rpcConn
+
+	mu       sync.Mutex
+	docs     map[string]string // Open documents by URI
+	settings lspSettings
+	nextID   int
+}
+
+// applySettings merges the non-empty fields of raw settings into the server settings
+func (s *lspServer) applySettings(raw json.RawMessage) {
+	var wrapped struct {
+		Mdrefactor *lspSettings `json:"mdrefactor"`
+	}
+	var settings lspSettings
+	if json.Unmarshal(raw, &wrapped) == nil && wrapped.Mdrefactor != nil {
+		settings = *wrapped.Mdrefactor
+	} else if json.Unmarshal(raw, &settings) != nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if settings.APIKey != "" {
+		s.settings.APIKey = settings.APIKey
+	}
+	if settings.Model != "" {
+		s.settings.Model = settings.Model
+	}
+	if settings.Prompt != "" {
+		s.settings.Prompt = settings.Prompt
+	}
+}
+
+// document returns the text of an open document
+func (s *lspServer) document(uri string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	text, ok := s.docs[uri]
+	if !ok {
+		return "", &rpcError{Code: rpcInvalidParams, Message: "document is not open: " + uri}
+	}
+	return text, nil
+}
+
+// utf16Len returns the length of s in UTF-16 code units
+func utf16Len(s string) int {
+	return len(utf16.Encode([]rune(s)))
+}
+
+// lineRange returns the range covering the 0-based lines start up to (but
+// excluding) end of a document, ending at the end of the last line if end is
+// past it
+func lineRange(lines []string, start, end int) lspRange {
+	if end >= len(lines) {
+		last := len(lines) - 1
+		return lspRange{Start: lspPosition{Line: start}, End: lspPosition{Line: last, Character: utf16Len(lines[last])}}
+	}
+	return lspRange{Start: lspPosition{Line: start}, End: lspPosition{Line: end}}
+}
+
+// generateTOC returns a nested Markdown list linking to every heading of
+// content below the document title
+func generateTOC(content string) string {
+	headings := parseHeadings(content)
+	anchors := headingAnchors(headings)
+	base := 0
+	for _, h := range headings {
+		if h.level > 1 && (base == 0 || h.level < base) {
+			base = h.level
+		}
+	}
+
+	var b strings.Builder
+	for i, h := range headings {
+		if h.level == 1 {
+			continue
+		}
+		fmt.Fprintf(&b, "%s- [%s](#%s)\n", strings.Repeat("  ", h.level-base), linkRe.ReplaceAllString(h.text, "$1"), anchors[i])
+	}
+	return b.String()
+}
+
+// codeActions returns the commands available for a range of a document
+func (s *lspServer) codeActions(params json.RawMessage) (any, error) {
+	var p struct {
+		TextDocument struct {
+			URI string `json:"uri"`
+		} `json:"textDocument"`
+		Range lspRange `json:"range"`
+	}
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, &rpcError{Code: rpcInvalidParams, Message: err.Error()}
+	}
+	uri, _ := json.Marshal(p.TextDocument.URI)
+	rng, _ := json.Marshal(p.Range)
+
+	actions := []lspCommand{
+		{Title: "Refactor section", Command: lspRefactorSection, Arguments: []json.RawMessage{uri, rng}},
+		{Title: "Generate TOC", Command: lspGenerateTOC, Arguments: []json.RawMessage{uri, rng}},
+	}
+	if p.Range.Start != p.Range.End {
+		actions = append(actions, lspCommand{Title: "Proofread selection", Command: lspProofread, Arguments: []json.RawMessage{uri, rng}})
+	}
+	return actions, nil
+}
+
+// executeCommand runs a code action and asks the client to apply its edit
+func (s *lspServer) executeCommand(params json.RawMessage) (any, error) {
+	var p struct {
+		Command   string            `json:"command"`
+		Arguments []json.RawMessage `json:"arguments"`
+	}
+	if err := json.Unmarshal(params, &p); err != nil {
+		return nil, &rpcError{Code: rpcInvalidParams, Message: err.Error()}
+	}
+	var uri string
+	var rng lspRange
+	if len(p.Arguments) != 2 || json.Unmarshal(p.Arguments[0], &uri) != nil || json.Unmarshal(p.Arguments[1], &rng) != nil {
+		return nil, &rpcError{Code: rpcInvalidParams, Message: "expected document URI and range arguments"}
+	}
+
+	text, err := s.document(uri)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	settings := s.settings
+	s.mu.Unlock()
+	lines := strings.Split(text, "\n")
+	if rng.Start.Line < 0 || rng.Start.Line >= len(lines) || rng.End.Line < rng.Start.Line {
+		return nil, &rpcError{Code: rpcInvalidParams, Message: "range is outside the document"}
+	}
+
+	var edit lspTextEdit
+	switch p.Command {
+	case lspRefactorSection:
+		var target *section
+		for _, sec := range splitSections(text) {
+			if rng.Start.Line >= sec.StartLine && rng.Start.Line < sec.EndLine {
+				target = &sec
+				break
+			}
+		}
+		if target == nil {
+			return nil, &rpcError{Code: rpcInvalidParams, Message: "no section at the cursor"}
+		}
+		refactored, err := refactorMarkdown(settings.APIKey, settings.Model, settings.Prompt, target.Text)
+		if err != nil {
+			return nil, err
+		}
+		edit = lspTextEdit{Range: lineRange(lines, target.StartLine, target.EndLine), NewText: strings.TrimRight(refactored, "\n") + "\n"}
+		if target.EndLine >= len(lines) {
+			edit.NewText = strings.TrimRight(edit.NewText, "\n")
+		}
+	case lspGenerateTOC:
+		edit = lspTextEdit{Range: lspRange{Start: lspPosition{Line: rng.Start.Line}, End: lspPosition{Line: rng.Start.Line}}, NewText: generateTOC(text) + "\n"}
+	case lspProofread:
+		// The selection is widened to whole lines
+		end := rng.End.Line
+		if rng.End.Character > 0 || end == rng.Start.Line {
+			end++
+		}
+		end = min(end, len(lines))
+		selection := strings.Join(lines[rng.Start.Line:end], "\n")
+		proofread, err := chatCompletion(settings.APIKey, settings.Model, []Message{
+			{Role: "system", Content: proofreadSystemPrompt},
+			{Role: "user", Content: selection},
+		})
+		if err != nil {
+			return nil, err
+		}
+		edit = lspTextEdit{Range: lineRange(lines, rng.Start.Line, end), NewText: strings.TrimRight(proofread, "\n") + "\n"}
+		if end >= len(lines) {
+			edit.NewText = strings.TrimRight(edit.NewText, "\n")
+		}
+	default:
+		return nil, &rpcError{Code: rpcInvalidParams, Message: "unknown command " + p.Command}
+	}
+
+	s.mu.Lock()
+	s.nextID++
+	id := json.RawMessage(fmt.Sprintf("%d", s.nextID))
+	s.mu.Unlock()
+	editParams, _ := json.Marshal(map[string]any{
+		"label": "mdrefactor",
+		"edit":  map[string]any{"changes": map[string][]lspTextEdit{uri: {edit}}},
+	})
+	return nil, s.conn.write(&rpcMessage{ID: &id, Method: "workspace/applyEdit", Params: editParams})
+}
+
+// handle processes one message from the client and returns false once the client has exited
+func (s *lspServer) handle(msg *rpcMessage) bool {
+	var result any
+	var err error
+	switch msg.Method {
+	case "":
+		// Responses to our workspace/applyEdit requests need no handling
+		return true
+	case "initialize":
+		var p struct {
+			InitializationOptions json.RawMessage `json:"initializationOptions"`
+		}
+		if json.Unmarshal(msg.Params, &p) == nil && len(p.InitializationOptions) > 0 {
+			s.applySettings(p.InitializationOptions)
+		}
+		result = map[string]any{
+			"capabilities": map[string]any{
+				"textDocumentSync":       1, // Full document sync
+				"codeActionProvider":     true,
+				"executeCommandProvider": map[string]any{"commands": []string{lspRefactorSection, lspGenerateTOC, lspProofread}},
+			},
+			"serverInfo": map[string]string{"name": "mdrefactor"},
+		}
+	case "initialized", "$/cancelRequest", "$/setTrace":
+	case "shutdown":
+	case "exit":
+		return false
+	case "workspace/didChangeConfiguration":
+		var p struct {
+			Settings json.RawMessage `json:"settings"`
+		}
+		if json.Unmarshal(msg.Params, &p) == nil {
+			s.applySettings(p.Settings)
+		}
+	case "textDocument/didOpen":
+		var p struct {
+			TextDocument struct {
+				URI  string `json:"uri"`
+				Text string `json:"text"`
+			} `json:"textDocument"`
+		}
+		if json.Unmarshal(msg.Params, &p) == nil {
+			s.mu.Lock()
+			s.docs[p.TextDocument.URI] = p.TextDocument.Text
+			s.mu.Unlock()
+		}
+	case "textDocument/didChange":
+		var p struct {
+			TextDocument struct {
+				URI string `json:"uri"`
+			} `json:"textDocument"`
+			ContentChanges []struct {
+				Text string `json:"text"`
+			} `json:"contentChanges"`
+		}
+		if json.Unmarshal(msg.Params, &p) == nil && len(p.ContentChanges) > 0 {
+			s.mu.Lock()
+			s.docs[p.TextDocument.URI] = p.ContentChanges[len(p.ContentChanges)-1].Text
+			s.mu.Unlock()
+		}
+	case "textDocument/didClose":
+		var p struct {
+			TextDocument struct {
+				URI string `json:"uri"`
+			} `json:"textDocument"`
+		}
+		if json.Unmarshal(msg.Params, &p) == nil {
+			s.mu.Lock()
+			delete(s.docs, p.TextDocument.URI)
+			s.mu.Unlock()
+		}
+	case "textDocument/codeAction":
+		result, err = s.codeActions(msg.Params)
+	case "workspace/executeCommand":
+		// Commands call the API, so they must not block other messages
+		go func() {
+			result, err := s.executeCommand(msg.Params)
+			if err := s.conn.reply(msg.ID, result, err); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			}
+		}()
+		return true
+	default:
+		err = &rpcError{Code: rpcMethodNotFound, Message: "method not supported: " + msg.Method}
+	}
+	if err := s.conn.reply(msg.ID, result, err); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	}
+	return true
+}
+
+// runLSPCommand implements the lsp subcommand
+func runLSPCommand(args []string) error {
+	fs := flag.NewFlagSet("lsp", flag.ExitOnError)
+	apiKey := fs.String("apikey", os.Getenv("OPENAI_API_KEY"), "OpenAI API key (can also be set via OPENAI_API_KEY environment variable or the apiKey setting)")
+	addAPIFlags(fs)
+	model := fs.String("model", defaultModel, "OpenAI model to use unless the model setting overrides it")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: mdrefactor lsp [flags]")
+		fmt.Fprintln(fs.Output(), "Speaks the Language Server Protocol on stdin and stdout.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	// stdout belongs to the protocol; progress messages go to stderr
+	conn := newRPCConn(os.Stdin, os.Stdout)
+	os.Stdout = os.Stderr
+
+	s := &lspServer{
+		conn:     conn,
+		docs:     make(map[string]string),
+		settings: lspSettings{APIKey: *apiKey, Model: *model, Prompt: defaultSystemPrompt},
+	}
+	for {
+		msg, err := conn.read()
+		if err == io.EOF {
+			return nil
+		}
+		if rerr, ok := err.(*rpcError); ok {
+			id := json.RawMessage("null")
+			conn.write(&rpcMessage{ID: &id, Error: rerr})
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !s.handle(msg) {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/jackmbuda/go-mdrefactor/mdrefactor"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/text"
+)
+
+// markdownParser parses documents the way GitHub renders them, including tables
+var markdownParser = goldmark.New(goldmark.WithExtensions(extension.GFM)).Parser()
+
+// markdownDoc is a parsed Markdown document. Structure-aware operations work
+// on its AST and map nodes back to lines of the source.
+type markdownDoc struct {
+	source     []byte
+	root       ast.Node
+	lines      []string // Source split at "\n"
+	lineStarts []int    // Byte offset of the start of every line
+}
+
+// parseMarkdown parses content into a markdownDoc
+func parseMarkdown(content string) *markdownDoc {
+	source := []byte(content)
+	// Front matter is not Markdown; blank it out so its delimiters are not
+	// taken for a thematic break and a setext heading, keeping offsets intact
+	frontMatter, _ := mdrefactor.SplitFrontMatter(content)
+	parsed := []byte(content)
+	for i := 0; i < len(frontMatter); i++ {
+		if parsed[i] != '\n' {
+			parsed[i] = ' '
+		}
+	}
+	d := &markdownDoc{
+		source: source,
+		root:   markdownParser.Parse(text.NewReader(parsed)),
+		lines:  strings.Split(content, "\n"),
+	}
+	offset := 0
+	for _, line := range d.lines {
+		d.lineStarts = append(d.lineStarts, offset)
+		offset += len(line) + 1
+	}
+	return d
+}
+
+// lineOf returns the 0-based line containing the byte offset
+func (d *markdownDoc) lineOf(offset int) int {
+	return sort.Search(len(d.lineStarts), func(i int) bool { return d.lineStarts[i] > offset }) - 1
+}
+
+// span returns the 0-based, inclusive range of lines covered by a block node,
+// including the fences of fenced code and the underline of setext headings.
+// ok is false for nodes that carry no source lines, such as thematic breaks.
+func (d *markdownDoc) span(n ast.Node) (first, last int, ok bool) {
+	first, last = -1, -1
+	extend := func(line int) {
+		if first == -1 || line < first {
+			first = line
+		}
+		if line > last {
+			last = line
+		}
+	}
+
+	ast.Walk(n, func(c ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering || c.Type() != ast.TypeBlock {
+			return ast.WalkContinue, nil
+		}
+		lines := c.Lines()
+		for i := 0; i < lines.Len(); i++ {
+			seg := lines.At(i)
+			extend(d.lineOf(seg.Start))
+			if seg.Stop > seg.Start {
+				extend(d.lineOf(seg.Stop - 1))
+			}
+		}
+
+		switch c := c.(type) {
+		case *ast.FencedCodeBlock:
+			if c.Info != nil {
+				extend(d.lineOf(c.Info.Segment.Start))
+			} else if lines.Len() > 0 {
+				extend(d.lineOf(lines.At(0).Start) - 1)
+			}
+			// The closing fence follows the last content line, if the block is closed
+			if lines.Len() > 0 {
+				if next := d.lineOf(lines.At(lines.Len()-1).Start) + 1; next < len(d.lines) && isFenceLine(d.lines[next]) {
+					extend(next)
+				}
+			}
+		case *ast.Heading:
+			if lines.Len() > 0 && d.isSetext(c) {
+				extend(d.lineOf(lines.At(lines.Len()-1).Start) + 1)
+			}
+		}
+		return ast.WalkContinue, nil
+	})
+	return first, last, first >= 0
+}
+
+// isSetext reports whether a heading is underlined rather than prefixed with #s
+func (d *markdownDoc) isSetext(h *ast.Heading) bool {
+	if h.Lines().Len() == 0 {
+		return false
+	}
+	line := d.lines[d.lineOf(h.Lines().At(0).Start)]
+	return !strings.HasPrefix(strings.TrimLeft(line, " "), "#")
+}
+
+// codeLines reports for every line of the document whether it belongs to a
+// fenced or indented code block, fences included
+func (d *markdownDoc) codeLines() []bool {
+	code := make([]bool, len(d.lines))
+	ast.Walk(d.root, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		switch n.Kind() {
+		case ast.KindFencedCodeBlock, ast.KindCodeBlock:
+			if first, last, ok := d.span(n); ok {
+				for i := first; i <= last; i++ {
+					code[i] = true
+				}
+			}
+			return ast.WalkSkipChildren, nil
+		}
+		return ast.WalkContinue, nil
+	})
+	return code
+}
+
+// codeLines reports for every line of content whether it belongs to a code block
+func codeLines(content string) []bool {
+	return parseMarkdown(content).codeLines()
+}
@@ -2,55 +2,68 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
-	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
+	"text/template"
 	"time"
+
+	"github.com/jackmbuda/go-mdrefactor/mdrefactor"
 )
 
 // Configuration constants
 const (
-	// Replace with the actual OpenAI API endpoint for chat completions
-	openaiAPIURL = "https://api.openai.com/v1/chat/completions"
+	// OpenAI API endpoint for chat completions
+	openaiAPIURL = mdrefactor.OpenAIURL
 	// Default model to use. You can change this to gpt-4, etc.
-	defaultModel = "gpt-3.5-turbo"
+	defaultModel = mdrefactor.DefaultModel
 	// Default system prompt for the AI
-	defaultSystemPrompt = "You are a helpful assistant that refactors Markdown content. Please improve its structure, clarity, and formatting while preserving the original meaning."
+	defaultSystemPrompt = mdrefactor.DefaultSystemPrompt
+	// Number of follow-up requests made to finish a reply cut off at the token limit
+	maxContinuations = 5
+	// Sent after a truncated reply to have the model finish it
+	continuationPrompt = "Your reply was cut off. Continue exactly where it ended, without repeating anything and without any preamble."
 	// GitHub system prompt for the AI
 	githubSystemPrompt = "You are a helpful assiatant that reads a github repo and writes a Markdown READ.me file. Please explain how to use the repo and what is important for a new user to know about this repository."
 )
 
-// APIRequest represents the request payload for the OpenAI API
-type APIRequest struct {
-	Model    string    `json:"model"`
-	Messages []Message `json:"messages"`
-	Stream   bool      `json:"stream"` // Set to false for simple refactoring
-}
+// verbose enables warnings about corrections made to the model's replies
+var verbose bool
 
-// Message represents a single message in the chat completion request
-type Message struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+// completionParams are optional parameters of a chat completion request
+// that most callers leave at the API defaults
+type completionParams struct {
+	temperature    *float64
+	responseFormat any
+	tools          []Tool
 }
 
+// Messages and tools of chat completion requests
+type (
+	Message      = mdrefactor.Message
+	ToolCall     = mdrefactor.ToolCall
+	Tool         = mdrefactor.Tool
+	ToolFunction = mdrefactor.ToolFunction
+)
+
 // APIResponse represents the expected response structure from the OpenAI API
 type APIResponse struct {
-	ID      string   `json:"id"`
-	Object  string   `json:"object"`
-	Created int64    `json:"created"`
-	Model   string   `json:"model"`
-	Choices []Choice `json:"choices"`
-	Usage   struct {
-		PromptTokens     int `json:"prompt_tokens"`
-		CompletionTokens int `json:"completion_tokens"`
-		TotalTokens      int `json:"total_tokens"`
-	} `json:"usage"`
-	Error *APIError `json:"error,omitempty"`
+	ID      string           `json:"id"`
+	Object  string           `json:"object"`
+	Created int64            `json:"created"`
+	Model   string           `json:"model"`
+	Choices []Choice         `json:"choices"`
+	Usage   mdrefactor.Usage `json:"usage"`
+	// Identifies the backend configuration; outputs for the same seed are
+	// only reproducible while it stays the same
+	SystemFingerprint string               `json:"system_fingerprint"`
+	Error             *mdrefactor.APIError `json:"error,omitempty"`
 }
 
 // Choice represents one of the completion choices from the API
@@ -60,116 +73,742 @@ type Choice struct {
 	FinishReason string  `json:"finish_reason"`
 }
 
-// APIError represents an error returned by the API
-type APIError struct {
-	Message string `json:"message"`
-	Type    string `json:"type"`
-	Param   string `json:"param"`
-	Code    string `json:"code"`
+// chatCompletion sends the messages to the OpenAI chat completions API and returns the content of the first choice
+func chatCompletion(apiKey, model string, messages []Message) (string, error) {
+	return chatCompletionContext(context.Background(), apiKey, model, messages)
 }
 
-// Global HTTP client for reuse
-var httpClient = &http.Client{Timeout: 60 * time.Second}
-
-// refactorMarkdown sends the markdown content to the OpenAI API for refactoring
-func refactorMarkdown(apiKey, model, systemPrompt, markdownContent string) (string, error) {
-	if apiKey == "" {
-		return "", fmt.Errorf("OpenAI API key is not set. Please set the OPENAI_API_KEY environment variable or use the -apikey flag")
-	}
+// chatCompletionContext is chatCompletion with a context controlling the request
+func chatCompletionContext(ctx context.Context, apiKey, model string, messages []Message) (string, error) {
+	return chatCompletionParams(ctx, apiKey, model, messages, completionParams{})
+}
 
-	// Construct the messages for the API request
-	messages := []Message{
-		{Role: "system", Content: systemPrompt},
-		{Role: "user", Content: fmt.Sprintf("Refactor the following Markdown content:\n\n%s", markdownContent)},
+// chatCompletionParams is chatCompletionContext with explicit request parameters
+func chatCompletionParams(ctx context.Context, apiKey, model string, messages []Message, params completionParams) (string, error) {
+	apiResponse, err := chatCompletionResponse(ctx, apiKey, model, messages, params)
+	if err != nil {
+		return "", err
 	}
+	return apiResponse.Choices[0].Message.Content, nil
+}
 
-	// Create the request payload
-	apiRequest := APIRequest{
-		Model:    model,
-		Messages: messages,
-		Stream:   false, // We want the full response, not a stream
-	}
+// chatCompletionResponse sends a chat completion request and returns the
+// whole response, including token usage. A reply cut off at the token limit
+// is continued with follow-up requests; the returned response then holds the
+// stitched reply and the usage of all requests.
+func chatCompletionResponse(ctx context.Context, apiKey, model string, messages []Message, params completionParams) (*APIResponse, error) {
+	var reply strings.Builder
+	request := messages
+	var total *APIResponse
+	for continuation := 0; ; continuation++ {
+		apiResponse, err := sendCompletion(ctx, apiKey, model, request, params)
+		if err != nil {
+			return nil, err
+		}
+		if total == nil {
+			total = apiResponse
+		} else {
+			total.Usage.PromptTokens += apiResponse.Usage.PromptTokens
+			total.Usage.CompletionTokens += apiResponse.Usage.CompletionTokens
+			total.Usage.TotalTokens += apiResponse.Usage.TotalTokens
+			total.Choices[0].FinishReason = apiResponse.Choices[0].FinishReason
+		}
+		choice := apiResponse.Choices[0]
+		reply.WriteString(choice.Message.Content)
+		if choice.FinishReason != "length" {
+			total.Choices[0].Message.Content = reply.String()
+			return total, nil
+		}
+		if continuation == maxContinuations {
+			return nil, fmt.Errorf("reply was still truncated at the token limit after %d continuations", maxContinuations)
+		}
 
-	// Marshal the request payload to JSON
-	requestBody, err := json.Marshal(apiRequest)
-	if err != nil {
-		return "", fmt.Errorf("failed to marshal API request: %w", err)
+		// The model sees everything it wrote so far as one assistant message
+		fmt.Fprintln(os.Stderr, "Reply was truncated at the token limit, continuing...")
+		request = append(messages[:len(messages):len(messages)],
+			Message{Role: "assistant", Content: reply.String()},
+			Message{Role: "user", Content: continuationPrompt})
 	}
+}
 
-	// Create the HTTP request
-	req, err := http.NewRequest("POST", openaiAPIURL, bytes.NewBuffer(requestBody))
+// sendCompletion sends a single chat completion request and returns the
+// whole response if it has at least one choice
+func sendCompletion(ctx context.Context, apiKey, model string, messages []Message, params completionParams) (*APIResponse, error) {
+	apiKey, err := resolveAPIKey(apiKey)
 	if err != nil {
-		return "", fmt.Errorf("failed to create HTTP request: %w", err)
+		return nil, err
 	}
 
-	// Set necessary headers
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+apiKey)
+	ctx, cancel := withBatchDeadline(ctx)
+	defer cancel()
+	completion, err := chatClient(apiKey).Complete(ctx, &mdrefactor.CompletionRequest{
+		Model:    model,
+		Messages: messages,
 
-	// Send the request
-	fmt.Println("Sending content to API for refactoring...")
-	resp, err := httpClient.Do(req)
+		Temperature:    params.temperature,
+		ResponseFormat: params.responseFormat,
+		Tools:          params.tools,
+	})
 	if err != nil {
-		return "", fmt.Errorf("failed to send HTTP request: %w", err)
+		return nil, err
 	}
-	defer resp.Body.Close()
+	return &APIResponse{
+		Model:             model,
+		Choices:           []Choice{{Message: completion.Message, FinishReason: completion.FinishReason}},
+		Usage:             completion.Usage,
+		SystemFingerprint: completion.SystemFingerprint,
+	}, nil
+}
 
-	// Read the response body
-	responseBody, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", fmt.Errorf("failed to read API response body: %w", err)
+// decodeJSONReply decodes a JSON object from a model reply, tolerating a
+// surrounding Markdown code fence and text before or after the object
+func decodeJSONReply(reply string, v any) error {
+	start := strings.Index(reply, "{")
+	end := strings.LastIndex(reply, "}")
+	if start < 0 || end < start {
+		// The reply is left out, errors end up in diagnostic bundles
+		return fmt.Errorf("no JSON object found in the model reply of %d bytes", len(reply))
+	}
+	if err := json.Unmarshal([]byte(reply[start:end+1]), v); err != nil {
+		return fmt.Errorf("failed to decode JSON model reply: %w", err)
 	}
+	return nil
+}
 
-	// Unmarshal the API response
-	var apiResponse APIResponse
-	if err := json.Unmarshal(responseBody, &apiResponse); err != nil {
-		// Try to print the raw response body if JSON unmarshalling fails for debugging
-		fmt.Fprintf(os.Stderr, "Raw API response: %s\n", string(responseBody))
-		return "", fmt.Errorf("failed to unmarshal API response: %w", err)
+// refactorMarkdown sends the markdown content to the OpenAI API for refactoring
+func refactorMarkdown(apiKey, model, systemPrompt, markdownContent string) (string, error) {
+	// Construct the messages for the API request
+	messages := []Message{
+		{Role: "system", Content: systemPrompt},
+		{Role: "user", Content: fmt.Sprintf("Refactor the following Markdown content:\n\n%s", markdownContent)},
 	}
 
-	// Check for API errors
-	if apiResponse.Error != nil {
-		return "", fmt.Errorf("API error: %s (Type: %s, Code: %s)", apiResponse.Error.Message, apiResponse.Error.Type, apiResponse.Error.Code)
+	if err := preflight(model, messages); err != nil {
+		return "", err
 	}
 
-	// Check if choices are available
-	if len(apiResponse.Choices) == 0 {
-		return "", fmt.Errorf("no refactored content received from API. Raw response: %s", string(responseBody))
+	if activeProviderBatch != nil {
+		reply, err := activeProviderBatch.reply(model, messages)
+		if !errors.Is(err, errNotInBatch) {
+			return reply, err
+		}
 	}
 
-	// Extract the refactored content
-	refactoredContent := apiResponse.Choices[0].Message.Content
+	fmt.Println("Sending content to API for refactoring...")
+	resp, err := chatCompletionResponse(context.Background(), apiKey, model, messages, completionParams{})
+	if err != nil {
+		return "", err
+	}
 	fmt.Println("Refactoring successful.")
-	return refactoredContent, nil
+	if requestSeed != nil && resp.SystemFingerprint != "" {
+		// Runs with the same seed only match while the fingerprint does
+		fmt.Printf("System fingerprint: %s\n", resp.SystemFingerprint)
+	}
+	return resp.Choices[0].Message.Content, nil
+}
+
+// subcommands maps the name of each subcommand to its entry point
+var subcommands = map[string]func(args []string) error{
+	"adr":             runADRCommand,
+	"archive":         runArchiveCommand,
+	"ask":             runAskCommand,
+	"bench":           runBenchCommand,
+	"citations":       runCitationsCommand,
+	"compile":         runCompileCommand,
+	"coverage":        runCoverageCommand,
+	"duplicates":      runDuplicatesCommand,
+	"eval":            runEvalCommand,
+	"experiment":      runExperimentCommand,
+	"faq":             runFAQCommand,
+	"glossary":        runGlossaryCommand,
+	"graph":           runGraphCommand,
+	"heading-case":    runHeadingCaseCommand,
+	"images":          runImagesCommand,
+	"lsp":             runLSPCommand,
+	"merge":           runMergeCommand,
+	"metadata":        runMetadataCommand,
+	"new":             runNewCommand,
+	"number-headings": runNumberHeadingsCommand,
+	"orphans":         runOrphansCommand,
+	"policy":          runPolicyCommand,
+	"pr-description":  runPRDescriptionCommand,
+	"related":         runRelatedCommand,
+	"release-notes":   runReleaseNotesCommand,
+	"report":          runReportCommand,
+	"review":          runReviewCommand,
+	"review-comments": runReviewCommentsCommand,
+	"rollback":        runRollbackCommand,
+	"rpc":             runRPCCommand,
+	"scaffold":        runScaffoldCommand,
+	"search":          runSearchCommand,
+	"seo":             runSEOCommand,
+	"snippets":        runSnippetsCommand,
+	"split":           runSplitCommand,
+	"stale":           runStaleCommand,
+	"terms":           runTermsCommand,
+	"titles":          runTitlesCommand,
+	"verify-goldens":  runVerifyGoldensCommand,
+}
+
+// parseArgs parses subcommand flags that may appear before, between or after
+// the positional arguments, and returns the positional arguments
+func parseArgs(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		fs.Parse(args)
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
 }
 
 func main() {
+	// Pass on what -diagnostics captured of stderr before the program ends
+	defer restoreStderr()
+
+	// Settings from the config file apply to every command
+	if err := loadConfig(configPath(), false); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		exit(1)
+	}
+	// So does the organization policy
+	if err := loadPolicy(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		exit(1)
+	}
+
+	// Dispatch to a subcommand if one is given
+	if len(os.Args) > 1 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			if err := cmd(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				writeDiagnostics(err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	//var markdownContent []byte
+	var source sourceFile
 	var responseContent string
 
 	// Define command-line flags
 	inputFile := flag.String("input", "", "Path to the input Markdown file (required)")
 	outputFile := flag.String("output", "", "Path to the output Markdown file (optional, prints to stdout if not provided)")
+	outputPatternFlag := flag.String("output-pattern", "", "Write each refactored file to a path built from its input path instead of in place, e.g. {{dir}}/{{name}}.refactored{{ext}} or out/{{dir}}/{{name}}{{ext}}")
 	apiKey := flag.String("apikey", os.Getenv("OPENAI_API_KEY"), "OpenAI API key (can also be set via OPENAI_API_KEY environment variable)")
 	model := flag.String("model", defaultModel, "OpenAI model to use (e.g., gpt-3.5-turbo, gpt-4)")
-	gitURL := flag.String("git", "", "GitHub URL to fetch raw content from")
+	cheapModel := flag.String("cheap-model", "", "Cheaper model that short and simple documents are sent to, leaving long ones and those dense with tables or code to -model (defaults to routing.cheap_model of the config file)")
+	gitURL := flag.String("git", "", "GitHub URL of a repository to generate a README for")
+	gitPaths := flag.String("git-paths", "", "With -git, comma-separated directories to check out with a sparse clone instead of the whole repository")
+	gitRef := flag.String("ref", "", "With -git, the branch, tag or commit to generate the README for instead of the default branch")
+	replaceReadme := flag.Bool("replace-readme", false, "With -git, replace the README the repository already has instead of merging into it")
+	readmeLangsFlag := flag.String("readme-langs", "", "With -git and -output, also write the README translated into these comma-separated languages (e.g. zh-CN,es) next to it, as README.zh-CN.md and so on, with a language switcher at the top of every variant")
+	monorepoDir := flag.String("monorepo", "", "With -git, write a README for every workspace package of the repository plus an index README.md to this directory")
 	// zipFile := flag.String("z", "", "Path to the input zip file (optional)")
 	systemPrompt := flag.String("prompt", defaultSystemPrompt, "System prompt to guide the AI refactoring")
 	githubPrompt := flag.String("gitprompt", githubSystemPrompt, "System prompt to guild the AI building the READ.me file")
+	lineRange := flag.String("lines", "", "Refactor only the given line range of the input file (e.g. 120-180), snapped to block boundaries; the file is edited in place unless -output is given")
+	maxGrowth := flag.String("max-growth", "", "Maximum allowed growth of the refactored content (e.g. 10%)")
+	targetLength := flag.String("target-length", "", "Target length of the refactored content relative to the input (same, shorter)")
+	tone := flag.String("tone", "", "Tone of the refactored content (formal, friendly, terse)")
+	audience := flag.String("audience", "", "Intended audience of the refactored content (beginner, expert)")
+	modeName := flag.String("mode", "", "Kind of document to restructure the content into (adr, minutes)")
+	lang := flag.String("lang", "", "Language to write the refactored content in (e.g. es, de, ja)")
+	readingLevel := flag.String("reading-level", "", "Target reading level of the refactored content (e.g. grade8)")
+	eol := flag.String("eol", "preserve", "Line endings of written files (lf, crlf, preserve)")
+	encoding := flag.String("encoding", "preserve", "Encoding of written files (utf8, preserve)")
+	streamThreshold := flag.Int64("stream-threshold", defaultStreamThreshold, "Input files larger than this many bytes are streamed through the model in chunks (0 disables streaming)")
+	chunkSize := flag.Int("chunk-size", 0, "Approximate size in bytes of the chunks a streamed file is split into (defaults to what fits the model)")
+	sanitizeFlag := flag.String("sanitize", "all", "Model artifacts to strip from the output (comma-separated: preamble, commentary, fence, all, none)")
+	flag.BoolVar(&verbose, "verbose", false, "Report corrections made to the model's replies, such as unwrapping a reply fenced as a whole")
+	reviewMode := flag.Bool("review", false, fmt.Sprintf("Hold uncertain or large-change outputs in the review queue instead of writing them (-auto-apply-threshold %.1f and -review-max-change %.1f unless set)", defaultReviewThreshold, defaultReviewMaxChange))
+	autoApplyThreshold := flag.Float64("auto-apply-threshold", 0, "Write only outputs whose confidence score (0-1, from structure, similarity and lint checks) reaches this, holding the others for review")
+	reviewMaxChange := flag.Float64("review-max-change", 0, "Write only outputs changing at most this share of lines (0-1), holding the others for review")
+	reviewDir := flag.String("review-dir", defaultReviewDir, "Directory of the review queue (see mdrefactor review)")
+	lockTimeout := flag.Duration("lock-timeout", defaultLockTimeout, "How long to wait for another run writing to the same tree to finish")
+	changeNotesFlag := flag.Bool("change-notes", false, "Ask the model which changes it made and why, print them in the run summary and save them to -change-notes-file for review-comments and pr-description")
+	changeNotesFile := flag.String("change-notes-file", defaultChangeNotesFile, "With -change-notes, the file the change notes are saved to")
+	guard := flag.Bool("guard", false, "Treat the input as untrusted: remove hidden characters, shield the prompt against instructions in the content and flag suspicious output")
+	invariants := flag.String("invariants", "", "Structure the refactored content must keep (comma-separated: headings, code, tables, all)")
+	anchorMap := flag.String("anchor-map", "", "Path to write an old -> new anchor map to when headings or file paths change")
+	anchorMapFormat := flag.String("anchor-map-format", "json", "Format of the anchor map (json, redirects)")
+	checkImagesFlag := flag.Bool("check-images", false, "Report images that are missing, dropped or rewritten after refactoring")
+	checkImageURLs := flag.Bool("check-image-urls", false, "With -check-images, also verify that remote image URLs are reachable")
+	maxImageSize := byteSize(defaultMaxImageSize)
+	flag.Var(&maxImageSize, "max-image-size", "With -check-images, report local images larger than this (e.g. 500KB, 2MiB; 0 disables the check)")
+	assetsDir := flag.String("assets-dir", "", "Copy the local images of refactored documents into this directory (relative to -dir if given) and point the documents at the copies")
+	extractMeta := flag.Bool("metadata", false, "Also extract the title, summary, tags, audience and action items of each refactored document to a .meta.json file next to it")
+	docsDir := flag.String("dir", "", "Path to a docs directory whose Markdown files are all refactored in place")
+	filterMode := flag.Bool("filter", false, "Editor filter mode: refactor the selection read from stdin and print only the replacement")
+	contextFile := flag.String("context-file", "", "In -filter mode, the file the selection was taken from")
+	contextLines := flag.String("context-lines", "", "In -filter mode, the line range of the selection in -context-file (e.g. 120-180)")
+	cursorContext := flag.Int("cursor-context", 0, "In -filter mode, number of lines around the selection shown to the model as context")
+	clipboard := flag.Bool("clipboard", false, "Refactor the Markdown on the system clipboard and copy the result back to it")
+	printChanged := flag.Bool("print-changed", false, "Print only the paths of files that were modified to stdout; progress goes to stderr")
+	nulSeparated := flag.Bool("0", false, "With -print-changed, terminate paths with NUL instead of newline (for xargs -0)")
+	filesFrom := flag.String("files-from", "", "Refactor in place the Markdown files listed (newline- or NUL-separated) in this file, or on stdin if -")
+	sample := flag.String("sample", "", "With -dir, refactor only a random sample of the files (e.g. 5% or 20), drawn from every directory, to try a prompt or model cheaply")
+	sampleSeed := flag.Int64("sample-seed", 0, "Seed of -sample, to draw the same files again (random by default)")
+	useProviderBatch := flag.Bool("provider-batch", false, "With -dir, send the refactoring requests as OpenAI Batch API jobs at about half the price, waiting up to 24 hours for them; an interrupted run resumes waiting when run again with the same flags")
+	deadline := flag.Duration("deadline", 0, "With -dir or -files-from, start no new file after this much time (e.g. 5m), taking the files in -deadline-order and reporting those left for the next run")
+	deadlineOrder := flag.String("deadline-order", "smallest", "With -deadline, the files taken first: smallest, or changed for the most recently changed")
+	remainingFile := flag.String("remaining-file", "", "With -deadline, write the paths of the files left at the deadline to this file, to continue with -files-from")
+	duplicateContext := flag.Bool("duplicate-context", false, "In -dir mode, tell the model which sections are duplicated in other files")
+	duplicateThreshold := flag.Float64("duplicate-threshold", defaultDuplicateThreshold, "Minimum similarity (0-1) for sections to count as duplicates")
+	suggestNames := flag.Bool("suggest-names", false, "In -dir mode, suggest kebab-case file names derived from each document's final title")
+	renameFiles := flag.Bool("rename", false, "In -dir mode, rename files to their suggested names and rewrite links to them")
+	renameStubs := flag.String("rename-stubs", "", "With -rename, keep old paths working with stub pages (stub) or front matter aliases (aliases)")
+	renameMap := flag.String("rename-map", "", "Path to write the old -> new file name map to as JSON")
+	navFormat := flag.String("nav", "", "Navigation file to generate after a -dir run (mkdocs, docusaurus, summary)")
+	navFile := flag.String("nav-file", "", "Path of the navigation file (defaults to mkdocs.yml, sidebars.js or <dir>/SUMMARY.md)")
+	configFile := flag.String("config", "", "Path to a JSON config file (defaults to "+defaultConfigFile+" if present)")
+	script := flag.String("script", scriptAuto, "Script whose typography rules apply to the output: latin, cjk, rtl or auto to detect it per document")
+	unwrap := flag.Bool("unwrap", false, "Join hard-wrapped paragraph lines into one line each, without inserting spaces between Chinese or Japanese characters")
+	normalizePunct := flag.Bool("normalize-punctuation", false, "Convert ASCII punctuation in CJK and Arabic text to the script's own forms, e.g. , to ， or ،")
+	normalizeFormats := flag.Bool("normalize-formats", false, "Normalize dates to ISO 8601, number separators and units per the formats section of the config file, checking the model changed no value")
+	formatLocale := flag.String("format-locale", "", "Locale the docs are written in, deciding how dates like 03/04/2024 and numbers like 1.000,5 are read (default en-US, or formats.locale of the config file)")
+	expandAcronymsFlag := flag.Bool("expand-acronyms", false, "Spell out every acronym on its first use, with the expansions of the acronyms section of the config file")
+	useTerminology := flag.Bool("terminology", false, "Replace terms to avoid, such as whitelist, per the terminology map of the config file, and report uses that need a writer's choice")
+	headingCase := flag.String("heading-case", "", "Write the headings of the refactored content in title or sentence case, keeping protected words (defaults to the heading_case section of the config file)")
+	citationStyle := flag.String("citation-style", "", "Convert the citations of the refactored content to inline citations, footnotes or a references section (inline, footnote, references; defaults to the citations section of the config file)")
+	archiveLinks := flag.String("archive-links", "", "Link the external links of the refactored content to their Wayback Machine snapshots, after each link (inline) or in footnotes (footnote)")
+	archiveSave := flag.Bool("archive-save", false, "With -archive-links, ask the Wayback Machine to archive pages it has no snapshot of")
+	numberHeadingsFlag := flag.String("number-headings", "", "Insert hierarchical section numbers into headings (insert) or remove them (strip), updating links to their anchors")
+	flag.Var(slugStyleFlag{}, "slug-style", "Style of generated heading anchors: github keeps non-ASCII letters like GitHub, ascii transliterates them")
+	flag.StringVar(&slugLocale, "slug-locale", slugLocale, "Language whose transliteration rules apply to ASCII anchors and file names, e.g. de for ä -> ae")
+	addAPIFlags(flag.CommandLine)
+	outputTemplate := flag.String("output-template", "", "Path to a Go text/template that wraps the refactored content of every file")
 	flag.Parse()
 
+	if *configFile != "" {
+		if err := loadConfig(*configFile, true); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exit(1)
+		}
+	}
+
+	// Routing is off when the cheap model is the one every document goes to anyway
+	if *cheapModel == "" {
+		*cheapModel = configRouting.CheapModel
+	}
+	if *cheapModel == *model {
+		*cheapModel = ""
+	}
+
+	// Refuse runs the organization policy does not allow before doing any work
+	for _, m := range []string{*model, *cheapModel} {
+		if m == "" {
+			continue
+		}
+		if err := activePolicy.check(openaiProvider, m); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exit(1)
+		}
+	}
+
 	// Check if API key is provided
-	if *apiKey == "" {
-		fmt.Fprintln(os.Stderr, "Error: OpenAI API key is missing. Please provide it using the -apikey flag or set the OPENAI_API_KEY environment variable.")
-		os.Exit(1)
+	var err error
+	if *apiKey, err = resolveAPIKey(*apiKey); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		exit(1)
+	}
+
+	// Outputs named by pattern go next to or away from their inputs
+	pattern, err := parseOutputPattern(*outputPatternFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		exit(1)
+	}
+	if pattern != "" {
+		switch {
+		case *outputFile != "":
+			fmt.Fprintln(os.Stderr, "Error: -output-pattern cannot be combined with -output.")
+			exit(1)
+		case *renameFiles:
+			fmt.Fprintln(os.Stderr, "Error: -output-pattern cannot be combined with -rename, which renames the inputs.")
+			exit(1)
+		case *inputFile != "":
+			*outputFile = pattern.path(*inputFile)
+			if err := os.MkdirAll(filepath.Dir(*outputFile), 0755); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+		case *docsDir == "" && *filesFrom == "":
+			fmt.Fprintln(os.Stderr, "Error: -output-pattern requires -input, -dir or -files-from.")
+			exit(1)
+		}
+	}
+
+	if *lineRange != "" && *outputFile == "" {
+		// The range is merged back into the document, which is edited in place
+		*outputFile = *inputFile
 	}
 
 	// Validate input file
-	if *inputFile == "" && *gitURL == "" {
-		fmt.Fprintln(os.Stderr, "Error: Input file path or GitHub url is required.")
+	// With -print-changed or -filter, stdout carries nothing but the list of
+	// changed files or the replacement text
+	changedOut := os.Stdout
+	if *filterMode {
+		os.Stdout = os.Stderr
+	}
+	if *printChanged {
+		if *outputFile == "" && *docsDir == "" && *filesFrom == "" {
+			fmt.Fprintln(os.Stderr, "Error: -print-changed requires -output, -dir or -files-from.")
+			exit(1)
+		}
+		os.Stdout = os.Stderr
+	}
+
+	if *filesFrom != "" && *docsDir == "" {
+		// Listed paths are taken relative to the working directory
+		*docsDir = "."
+	}
+
+	if !*filterMode && !*clipboard && *inputFile == "" && *docsDir == "" && *gitURL == "" {
+		fmt.Fprintln(os.Stderr, "Error: Input file path, docs directory, file list, clipboard or GitHub url is required.")
 		flag.Usage()
-		os.Exit(1)
+		exit(1)
+	}
+
+	readmeLangs, err := parseReadmeLangs(*readmeLangsFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		exit(1)
+	}
+	if len(readmeLangs) > 0 && (*gitURL == "" || *outputFile == "" || *monorepoDir != "") {
+		fmt.Fprintln(os.Stderr, "Error: -readme-langs requires -git and -output, and cannot be combined with -monorepo.")
+		exit(1)
+	}
+
+	if *lineRange != "" && *inputFile == "" {
+		fmt.Fprintln(os.Stderr, "Error: -lines can only be used with -input.")
+		exit(1)
+	}
+
+	if err := validateEOL(*eol); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		exit(1)
+	}
+	if err := validateEncoding(*encoding); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		exit(1)
+	}
+	output := outputPolicy{eol: *eol, encoding: *encoding}
+
+	switch *renameStubs {
+	case "", "stub", "aliases":
+	default:
+		fmt.Fprintf(os.Stderr, "Error: unknown rename stub style %q, expected stub or aliases\n", *renameStubs)
+		exit(1)
+	}
+
+	switch *navFormat {
+	case "", "mkdocs", "docusaurus", "summary":
+	default:
+		fmt.Fprintf(os.Stderr, "Error: unknown navigation format %q, expected mkdocs, docusaurus or summary\n", *navFormat)
+		exit(1)
+	}
+
+	if *useProviderBatch {
+		if *docsDir == "" {
+			fmt.Fprintln(os.Stderr, "Error: -provider-batch requires -dir or -files-from.")
+			exit(1)
+		}
+		// The placeholders of scrubbed requests could not be restored in a later run
+		if scrubPII {
+			fmt.Fprintln(os.Stderr, "Error: -provider-batch cannot be used with -scrub-pii.")
+			exit(1)
+		}
+		if activeProviderBatch, err = openProviderBatch(*docsDir); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exit(1)
+		}
+	}
+
+	if *deadline < 0 {
+		fmt.Fprintln(os.Stderr, "Error: -deadline must not be negative.")
+		exit(1)
+	}
+	if *deadline > 0 {
+		switch {
+		case *docsDir == "":
+			fmt.Fprintln(os.Stderr, "Error: -deadline requires -dir or -files-from.")
+			exit(1)
+		case *useProviderBatch:
+			fmt.Fprintln(os.Stderr, "Error: -deadline cannot be used with -provider-batch, whose jobs take up to 24 hours.")
+			exit(1)
+		case *deadlineOrder != "smallest" && *deadlineOrder != "changed":
+			fmt.Fprintf(os.Stderr, "Error: unknown deadline order %q, expected smallest or changed\n", *deadlineOrder)
+			exit(1)
+		}
+		// The deadline counts from the start of the run
+		batchDeadline = time.Now().Add(*deadline)
+	}
+
+	var sampled sampleSize
+	if *sample != "" {
+		if sampled, err = parseSample(*sample); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exit(1)
+		}
+		if *navFormat != "" {
+			fmt.Fprintln(os.Stderr, "Error: -nav needs every file of the tree and cannot be used with -sample.")
+			exit(1)
+		}
+	}
+
+	// Compose the tone and audience presets into both system prompts
+	promptOpts := promptOptions{tone: *tone, audience: *audience, lang: *lang}
+	if *systemPrompt, err = composePrompt(*systemPrompt, promptOpts); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		exit(1)
+	}
+	if *githubPrompt, err = composePrompt(*githubPrompt, promptOpts); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		exit(1)
+	}
+	var mode refactorMode
+	if *modeName != "" {
+		var ok bool
+		if mode, ok = refactorModes[*modeName]; !ok {
+			fmt.Fprintf(os.Stderr, "Error: unknown mode %q, expected one of: %s\n", *modeName, modeNames())
+			exit(1)
+		}
+		*systemPrompt += "\n\n" + mode.instruction
+	}
+
+	// Build the refactoring pipeline shared by single-file and batch mode
+	policy, err := newLengthPolicy(*maxGrowth, *targetLength)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		exit(1)
+	}
+
+	inv, err := parseInvariants(*invariants)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		exit(1)
+	}
+
+	refactor := refactorFunc(func(prompt, content string) (string, error) {
+		return refactorMarkdown(*apiKey, *model, prompt, content)
+	})
+	var router *modelRouter
+	if *cheapModel != "" {
+		router = newModelRouter(*cheapModel, *model, configRouting)
+		refactor = routedRefactor(*apiKey, router)
+	}
+	// The notes are taken out of the reply before any check sees it
+	var notes *changeNotes
+	if *changeNotesFlag {
+		notes = newChangeNotes()
+		refactor = withChangeNotes(notes, refactor)
+	}
+	if *guard {
+		refactor = withInjectionGuard(refactor)
+	}
+	sanitizeOpts, err := parseSanitize(*sanitizeFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		exit(1)
+	}
+	refactor = withOutputSanitizer(sanitizeOpts, refactor)
+	scriptName, err := parseScript(*script)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		exit(1)
+	}
+	refactor = withScriptRules(scriptOptions{script: scriptName, unwrap: *unwrap, punctuation: *normalizePunct}, refactor)
+	if *normalizeFormats {
+		style := configFormatStyle
+		if *formatLocale != "" {
+			style.Locale = *formatLocale
+		}
+		refactor = withFormatStyle(style.withDefaults(), refactor)
+	}
+	if *expandAcronymsFlag {
+		refactor = withAcronymExpansion(refactor)
+	}
+	if *useTerminology {
+		refactor = withTerminology(compileTerminology(terminology), refactor)
+	}
+	if *autoApplyThreshold < 0 || *autoApplyThreshold > 1 || *reviewMaxChange < 0 || *reviewMaxChange > 1 {
+		fmt.Fprintln(os.Stderr, "Error: -auto-apply-threshold and -review-max-change must be between 0 and 1.")
+		exit(1)
+	}
+	gate := autoApply{threshold: *autoApplyThreshold, maxChange: *reviewMaxChange, reviewDir: *reviewDir}
+	if *reviewMode {
+		if gate.threshold == 0 {
+			gate.threshold = defaultReviewThreshold
+		}
+		if gate.maxChange == 0 {
+			gate.maxChange = defaultReviewMaxChange
+		}
+	}
+	if *readingLevel != "" {
+		level, err := parseReadingLevel(*readingLevel)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exit(1)
+		}
+		refactor = withReadingLevel(level, refactor)
+	}
+	refactor = withLengthPolicy(policy, refactor)
+	refactor = withStructureInvariants(inv, refactor)
+	refactor = withRequiredSections(mode, refactor)
+	if *headingCase == "" {
+		*headingCase = configHeadingCase.Style
+	}
+	if _, err := parseHeadingCase(*headingCase); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		exit(1)
+	}
+	if *headingCase != "" {
+		refactor = withHeadingCase(newHeadingCaser(*headingCase, configHeadingCase.Protected), refactor)
+	}
+	if *citationStyle == "" {
+		*citationStyle = configCitations.Style
+	}
+	if _, err := parseCitationStyle(*citationStyle); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		exit(1)
+	}
+	if *citationStyle != "" {
+		refactor = withCitationStyle(*citationStyle, configCitations.Heading, refactor)
+	}
+	// Numbering comes last, so the checks above see the headings as the model wrote them
+	numbering, err := parseNumbering(*numberHeadingsFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		exit(1)
+	}
+	if numbering != "" {
+		refactor = withHeadingNumbers(numbering, refactor)
+	}
+	// Links are rewritten before they are archived, so the canonical URLs are
+	var rewriter *urlRewriter
+	if urlRewrites.enabled() {
+		rewriter = newURLRewriter(urlRewrites)
+		refactor = withURLRewrites(rewriter, refactor)
+	}
+	archiveStyle, err := parseArchiveStyle(*archiveLinks)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		exit(1)
+	}
+	if archiveStyle != "" {
+		refactor = withLinkArchive(newLinkArchiver(archiveStyle, *archiveSave), refactor)
+	}
+	if *lang != "" {
+		// Front matter keys and values must survive translation untouched
+		refactor = withFrontMatterPreserved(refactor)
+	}
+	if notes != nil {
+		refactor = notes.collect(refactor)
+	}
+
+	// The output template is applied after refactoring, so it never reaches the model
+	var tmpl *template.Template
+	if *outputTemplate != "" {
+		if tmpl, err = loadOutputTemplate(*outputTemplate); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exit(1)
+		}
+	}
+
+	if *filterMode {
+		prompt := *systemPrompt
+		if *contextFile != "" && *contextLines != "" && *cursorContext > 0 {
+			start, end, err := parseLineRange(*contextLines)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			before, after, err := contextAround(*contextFile, start, end, *cursorContext)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			prompt = filterPrompt(prompt, before, after)
+		} else {
+			prompt = filterPrompt(prompt, "", "")
+		}
+		if err := runFilter(os.Stdin, changedOut, prompt, refactor); err != nil {
+			fmt.Fprintf(os.Stderr, "Error refactoring Markdown: %v\n", err)
+			exit(1)
+		}
+		return
+	}
+
+	if *clipboard {
+		if err := runClipboard(*systemPrompt, refactor); err != nil {
+			fmt.Fprintf(os.Stderr, "Error refactoring clipboard: %v\n", err)
+			exit(1)
+		}
+		fmt.Println("Refactored content copied to the clipboard")
+		return
+	}
+
+	// Runs writing to the same tree take turns
+	lockDir := *docsDir
+	switch {
+	case lockDir != "":
+	case *monorepoDir != "":
+		lockDir = *monorepoDir
+	case *outputFile != "":
+		lockDir = filepath.Dir(*outputFile)
+	}
+	// A run exiting with an error leaves the lock behind, the next run in
+	// the tree removes it once the process is gone
+	unlock := func() {}
+	if lockDir != "" {
+		if unlock, err = lockTree(lockDir, *lockTimeout); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exit(1)
+		}
+		defer unlock()
+	}
+
+	// Files too large for the context window of the model are chunked as well
+	if *chunkSize <= 0 {
+		*chunkSize = chunkSizeFor(*model)
+	}
+	threshold := *streamThreshold
+	if info, ok := lookupModel(*model); ok && threshold > 0 {
+		threshold = min(threshold, int64(info.inputTokens()*bytesPerToken))
+	}
+	if *inputFile != "" && *lineRange == "" && *anchorMap == "" && !*checkImagesFlag && *assetsDir == "" && !*extractMeta && tmpl == nil && canStream(*inputFile, threshold) {
+		if gate.threshold > 0 || gate.maxChange > 0 {
+			// Scoring and the review queue need the whole file and its result
+			fmt.Fprintf(os.Stderr, "Error: %s is larger than -stream-threshold and is refactored chunk by chunk, which -review, "+
+				"-auto-apply-threshold and -review-max-change cannot gate; raise -stream-threshold to refactor it whole\n", *inputFile)
+			exit(1)
+		}
+		// Very large files are never loaded whole but refactored chunk by chunk
+		err := refactorLargeFile(*inputFile, *outputFile, *chunkSize, output, func(chunk string) (string, error) {
+			return refactor(*systemPrompt, chunk)
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error refactoring Markdown: %v\n", err)
+			exit(1)
+		}
+		if *outputFile != "" {
+			fmt.Printf("Refactored content successfully written to %s\n", *outputFile)
+			if *printChanged {
+				printChangedFiles(changedOut, []string{*outputFile}, *nulSeparated)
+			}
+		}
+		notes.record(*inputFile)
+		rewriter.printSummary()
+		router.printSummary()
+		notes.printSummary()
+		notes.save(*changeNotesFile)
+		return
 	}
 
 	if *inputFile != "" {
@@ -177,40 +816,412 @@ func main() {
 		markdownBytes, err := os.ReadFile(*inputFile)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error reading input file %s: %v\n", *inputFile, err)
-			os.Exit(1)
+			exit(1)
+		}
+		// The model only ever sees UTF-8 with LF line endings; the original
+		// encoding and line endings are restored on output
+		source = decodeSource(markdownBytes)
+		if source.enc != (textEncoding{}) {
+			fmt.Printf("Input encoding: %s\n", source.enc)
 		}
-		markdownContent := string(markdownBytes)
+		markdownContent := source.text
 
-		responseContent, err = refactorMarkdown(*apiKey, *model, *systemPrompt, markdownContent)
+		if *lineRange != "" {
+			// Refactor only the selected lines and merge them back into the file
+			var start, end int
+			if start, end, err = parseLineRange(*lineRange); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			responseContent, err = refactorLineRange(markdownContent, start, end, func(selection string) (string, error) {
+				return refactor(*systemPrompt, selection)
+			})
+		} else {
+			responseContent, err = refactor(*systemPrompt, markdownContent)
+		}
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error refactoring Markdown: %v\n", err)
-			os.Exit(1)
+			exit(1)
+		}
+		notes.record(*inputFile)
+		// Included code comes from its source, not from the model
+		if responseContent, err = syncIncludes(*inputFile, markdownContent, responseContent); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exit(1)
+		}
+
+		if responseContent, err = applyOutputTemplate(tmpl, *inputFile, *model, responseContent); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exit(1)
+		}
+
+		newFile := *inputFile
+		if *outputFile != "" {
+			newFile = *outputFile
+		}
+		if *assetsDir != "" {
+			if responseContent, err = newImageRelocator(".", *assetsDir).relocate(responseContent, filepath.Dir(newFile)); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+		}
+		if *checkImagesFlag {
+			reportImageProblems(*inputFile, checkImages(markdownContent, responseContent, filepath.Dir(newFile), ".", *checkImageURLs, int64(maxImageSize)))
+		}
+
+		if *anchorMap != "" {
+			// Record moved anchors so site owners can install redirects
+			redirects := buildRedirects(*inputFile, newFile, mapAnchors(markdownContent, responseContent))
+			if err := writeAnchorMap(*anchorMap, *anchorMapFormat, redirects); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			fmt.Printf("Anchor map with %d entries written to %s\n", len(redirects), *anchorMap)
+		}
+
+		if *extractMeta {
+			newFile := *inputFile
+			if *outputFile != "" {
+				newFile = *outputFile
+			}
+			meta, err := extractMetadata(*apiKey, *model, responseContent)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error extracting metadata: %v\n", err)
+				exit(1)
+			}
+			if err := writeMetadata(metadataPath(newFile), meta); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			fmt.Printf("Metadata written to %s\n", metadataPath(newFile))
+		}
+	} else if *docsDir != "" {
+		promptFor := func(string) string { return *systemPrompt }
+		if *duplicateContext {
+			// Tell the model which sections are duplicated elsewhere in the tree
+			duplicates, err := findDuplicates(*docsDir, *duplicateThreshold)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			notes := duplicateNotes(duplicates)
+			promptFor = func(rel string) string {
+				if len(notes[rel]) == 0 {
+					return *systemPrompt
+				}
+				return *systemPrompt + "\n\n" + strings.Join(notes[rel], "\n")
+			}
+		}
+
+		var relocator *imageRelocator
+		if *assetsDir != "" {
+			relocator = newImageRelocator(*docsDir, *assetsDir)
+		}
+
+		// Refactor every Markdown file of the directory in place, or write
+		// it where the output pattern says
+		targetFor := func(rel string) string { return filepath.Join(*docsDir, rel) }
+		finish := func(rel, original, content string) (string, error) {
+			notes.record(filepath.Join(*docsDir, rel))
+			content, err := syncIncludes(filepath.Join(*docsDir, rel), original, content)
+			if err != nil {
+				return "", err
+			}
+			if content, err = applyOutputTemplate(tmpl, filepath.ToSlash(rel), *model, content); err != nil {
+				return "", err
+			}
+			if relocator != nil {
+				if content, err = relocator.relocate(content, filepath.Join(*docsDir, filepath.Dir(rel))); err != nil {
+					return "", err
+				}
+			}
+			if content, err = gate.gate(targetFor(rel), original, content); err != nil {
+				return "", err
+			}
+			// Keep edits made to the file while it was being refactored
+			return mergeConcurrentEdits(filepath.Join(*docsDir, rel), original, content, *reviewDir)
+		}
+		files, err := batchFiles(*docsDir, *filesFrom)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exit(1)
+		}
+		if *sample != "" {
+			seed := *sampleSeed
+			if seed == 0 {
+				seed = newSampleSeed()
+			}
+			total := len(files)
+			files = sampleFiles(files, sampled, seed)
+			fmt.Printf("Sampled %d of %d files (-sample-seed %d draws the same files again)\n", len(files), total, seed)
+		}
+		if pattern != "" {
+			targets, err := pattern.outputTargets(*docsDir, files)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			targetFor = func(rel string) string { return targets[rel] }
+		}
+		if *deadline > 0 {
+			if files, err = prioritizeFiles(*docsDir, files, *deadlineOrder); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+		}
+		if activeProviderBatch != nil {
+			// A first pass queues the requests of the files, a second one
+			// applies the replies once the batch jobs are done
+			if !activeProviderBatch.submitted() {
+				fmt.Println("Preparing batch requests...")
+				runBatch(*docsDir, files, refactor, promptFor, finish, targetFor, output)
+				if err := activeProviderBatch.submit(*apiKey); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+				router.reset()
+			}
+			if !activeProviderBatch.submitted() {
+				// Nothing was queued, the files failed before any request
+				activeProviderBatch = nil
+			} else if err := activeProviderBatch.wait(*apiKey); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+		}
+
+		// Keep the originals so the run can be rolled back without version control
+		snapshot, err := takeSnapshot(*docsDir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to snapshot %s: %v\n", *docsDir, err)
+			exit(1)
+		}
+		results := runBatch(*docsDir, files, refactor, promptFor, finish, targetFor, output)
+		if activeProviderBatch != nil {
+			if err := activeProviderBatch.finish(); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+			}
 		}
+
+		// Rename files after their final titles and keep inbound links working
+		newPaths := make(map[string]string)
+		if *suggestNames || *renameFiles {
+			renames := suggestRenames(results)
+			for _, r := range renames {
+				fmt.Printf("Suggested name: %s -> %s\n", r.From, r.To)
+			}
+			if *renameFiles {
+				if err := applyRenames(*docsDir, renames); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+				for _, r := range renames {
+					newPaths[filepath.FromSlash(r.From)] = filepath.FromSlash(r.To)
+				}
+				if *renameStubs != "" {
+					if err := writeRenameStubs(*docsDir, *renameStubs, renames); err != nil {
+						fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+						exit(1)
+					}
+				}
+			}
+			if *renameMap != "" {
+				if err := writeRenameMap(*renameMap, renames); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+				fmt.Printf("Rename map with %d entries written to %s\n", len(renames), *renameMap)
+			}
+		}
+		if err := snapshot.finish(); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		}
+
+		oldPaths := make(map[string]string)
+		for i, r := range results {
+			oldPaths[r.path] = r.path
+			if to, ok := newPaths[r.path]; ok {
+				results[i].path = to
+				results[i].changed = true
+				oldPaths[to] = r.path
+			}
+		}
+
+		if *checkImagesFlag {
+			for _, r := range results {
+				if r.err == nil {
+					docDir := filepath.Join(*docsDir, filepath.Dir(r.path))
+					reportImageProblems(filepath.Join(*docsDir, r.path), checkImages(r.original, r.refactored, docDir, *docsDir, *checkImageURLs, int64(maxImageSize)))
+				}
+			}
+		}
+
+		if *anchorMap != "" {
+			redirects := []redirect{}
+			for _, r := range results {
+				if r.err == nil {
+					redirects = append(redirects, buildRedirects(oldPaths[r.path], r.path, mapAnchors(r.original, r.refactored))...)
+				}
+			}
+			if err := writeAnchorMap(*anchorMap, *anchorMapFormat, redirects); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			fmt.Printf("Anchor map with %d entries written to %s\n", len(redirects), *anchorMap)
+		}
+
+		if *extractMeta {
+			for _, r := range results {
+				if r.err != nil {
+					continue
+				}
+				file := filepath.Join(*docsDir, r.path)
+				meta, err := extractMetadata(*apiKey, *model, r.refactored)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error extracting metadata of %s: %v\n", file, err)
+					continue
+				}
+				if err := writeMetadata(metadataPath(file), meta); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					continue
+				}
+				fmt.Printf("Metadata written to %s\n", metadataPath(file))
+			}
+		}
+
+		if *navFormat != "" {
+			if err := writeNav(*navFormat, *navFile, *docsDir, results); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+		}
+
+		if *printChanged {
+			var changed []string
+			for _, r := range results {
+				switch {
+				case r.changed && pattern != "":
+					changed = append(changed, r.target)
+				case r.changed:
+					changed = append(changed, filepath.Join(*docsDir, r.path))
+				}
+			}
+			printChangedFiles(changedOut, changed, *nulSeparated)
+		}
+
+		failed, held, remaining := countFailures(results), countHeld(results), countRemaining(results)
+		fmt.Printf("Refactored %d of %d files in %s\n", len(results)-failed-held-remaining, len(results), *docsDir)
+		rewriter.printSummary()
+		router.printSummary()
+		notes.printSummary()
+		notes.save(*changeNotesFile)
+		if held > 0 {
+			fmt.Printf("%d files held for review in %s\n", held, *reviewDir)
+		}
+		if err := reportRemaining(*docsDir, results, *remainingFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			unlock()
+			exit(1)
+		}
+		if failed > 0 {
+			unlock()
+			exit(1)
+		}
+		return
 	} else if *gitURL != "" {
 		parsedURL, err := url.Parse(*gitURL)
 		if err != nil || !strings.Contains(parsedURL.Host, "github.com") {
 			fmt.Println("Error: Invalid GitHub URL")
-			os.Exit(1)
+			exit(1)
 		}
 
-		responseContent, err = refactorMarkdown(*apiKey, *model, *githubPrompt, *gitURL)
+		opts := cloneOptions{ref: strings.TrimSpace(*gitRef)}
+		for _, p := range strings.Split(*gitPaths, ",") {
+			if p = strings.Trim(strings.TrimSpace(p), "/"); p != "" {
+				opts.paths = append(opts.paths, p)
+			}
+		}
+		if *monorepoDir != "" {
+			if err := generateMonorepoReadmes(*apiKey, *model, *githubPrompt, *gitURL, opts, !*replaceReadme, *monorepoDir); err != nil {
+				fmt.Fprintf(os.Stderr, "Error generating READMEs: %v\n", err)
+				exit(1)
+			}
+			return
+		}
+		responseContent, err = generateReadme(*apiKey, *model, *githubPrompt, *gitURL, opts, !*replaceReadme)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error refactoring Markdown: %v\n", err)
-			os.Exit(1)
+			fmt.Fprintf(os.Stderr, "Error generating README: %v\n", err)
+			exit(1)
+		}
+		if len(readmeLangs) > 0 {
+			// The translations reuse the README instead of exploring the repository again
+			variants, err := localizeReadme(*apiKey, *model, responseContent, *outputFile, readmeLangs)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			for _, file := range sortedKeys(variants) {
+				if file == *outputFile {
+					continue
+				}
+				if err := writeFileAtomic(file, []byte(variants[file]), 0644); err != nil {
+					fmt.Fprintf(os.Stderr, "Error writing output file %s: %v\n", file, err)
+					exit(1)
+				}
+				fmt.Printf("Localized README written to %s\n", file)
+			}
+			responseContent = variants[*outputFile]
+		}
+		if responseContent, err = applyOutputTemplate(tmpl, *gitURL, *model, responseContent); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exit(1)
 		}
 	}
 
 	// Output the refactored content
 	if *outputFile != "" {
-		err := os.WriteFile(*outputFile, []byte(responseContent), 0644)
+		if *inputFile != "" {
+			if responseContent, err = gate.gate(*outputFile, source.text, responseContent); errors.Is(err, errHeldForReview) {
+				return
+			} else if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+			if filepath.Clean(*outputFile) == filepath.Clean(*inputFile) {
+				// Keep edits made to the file while it was being refactored
+				if responseContent, err = mergeConcurrentEdits(*outputFile, source.text, responseContent, *reviewDir); errors.Is(err, errHeldForReview) {
+					return
+				} else if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					exit(1)
+				}
+			}
+		}
+		data, err := source.encode(responseContent, output)
 		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exit(1)
+		}
+		existing, readErr := os.ReadFile(*outputFile)
+		if readErr == nil && bytes.Equal(existing, data) {
+			fmt.Printf("%s is already up to date\n", *outputFile)
+			return
+		}
+		if err := writeFileAtomic(*outputFile, data, 0644); err != nil {
 			fmt.Fprintf(os.Stderr, "Error writing output file %s: %v\n", *outputFile, err)
-			os.Exit(1)
+			exit(1)
 		}
 		fmt.Printf("Refactored content successfully written to %s\n", *outputFile)
+		if *printChanged {
+			printChangedFiles(changedOut, []string{*outputFile}, *nulSeparated)
+		}
 	} else {
 		// Print to stdout if no output file is specified
 		fmt.Println("\n--- Refactored Markdown ---")
 		fmt.Println(responseContent)
 	}
+	rewriter.printSummary()
+	router.printSummary()
+	notes.printSummary()
+	notes.save(*changeNotesFile)
 }
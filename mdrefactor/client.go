@@ -0,0 +1,120 @@
+package mdrefactor
+
+import (
+	"context"
+	"fmt"
+)
+
+const (
+	// Model used when a Client names none
+	DefaultModel = "gpt-3.5-turbo"
+	// System prompt used when a Client has none
+	DefaultSystemPrompt = "You are a helpful assistant that refactors Markdown content. Please improve its structure, clarity, and formatting while preserving the original meaning."
+)
+
+// Client refactors Markdown through the API with a fixed key, model and
+// system prompt, for programs embedding the refactoring engine
+type Client struct {
+	APIKey       string
+	Model        string    // Defaults to DefaultModel
+	SystemPrompt string    // Defaults to DefaultSystemPrompt
+	Transport    Completer // Sends the requests to the API, the OpenAI API with APIKey if nil
+
+	interceptors []Interceptor
+}
+
+// CompletionRequest is a chat completion on its way to the API. Interceptors
+// may inspect or rewrite it before passing it on.
+type CompletionRequest struct {
+	Model    string
+	Messages []Message
+
+	Temperature    *float64 // Sampling temperature, the API default if nil
+	ResponseFormat any      // Structured output format, free text if nil
+	Tools          []Tool   // Tools the model may call instead of replying
+
+	// OnChunk receives the reply piece by piece when the request is streamed, nil otherwise
+	OnChunk func(chunk string) error
+}
+
+// Completion is the reply to a CompletionRequest
+type Completion struct {
+	Message      Message // The reply, with the tools the model asks to have called
+	FinishReason string  // "length" if the reply was cut off at the token limit
+	Usage        Usage   // Zero for streamed replies
+	// Identifies the backend configuration; outputs for the same seed are
+	// only reproducible while it stays the same
+	SystemFingerprint string
+}
+
+// Completer sends a chat completion request and returns the full reply
+type Completer interface {
+	Complete(ctx context.Context, req *CompletionRequest) (*Completion, error)
+}
+
+// CompleterFunc adapts a function to the Completer interface
+type CompleterFunc func(ctx context.Context, req *CompletionRequest) (*Completion, error)
+
+// Complete implements Completer
+func (f CompleterFunc) Complete(ctx context.Context, req *CompletionRequest) (*Completion, error) {
+	return f(ctx, req)
+}
+
+// Interceptor wraps the next Completer of the chain, e.g. for logging,
+// metrics, prompt rewriting or caching. It may return without calling next.
+type Interceptor func(next Completer) Completer
+
+// Use registers interceptors on the client. The first interceptor registered
+// is the outermost one and sees every request first.
+func (c *Client) Use(interceptors ...Interceptor) {
+	c.interceptors = append(c.interceptors, interceptors...)
+}
+
+// Complete sends req through the registered interceptors to the transport
+func (c *Client) Complete(ctx context.Context, req *CompletionRequest) (*Completion, error) {
+	next := c.Transport
+	if next == nil {
+		next = &OpenAI{APIKey: c.APIKey}
+	}
+	for i := len(c.interceptors) - 1; i >= 0; i-- {
+		next = c.interceptors[i](next)
+	}
+	return next.Complete(ctx, req)
+}
+
+// request returns the completion request asking the model to refactor content
+func (c *Client) request(content string, onChunk func(chunk string) error) *CompletionRequest {
+	model := c.Model
+	if model == "" {
+		model = DefaultModel
+	}
+	systemPrompt := c.SystemPrompt
+	if systemPrompt == "" {
+		systemPrompt = DefaultSystemPrompt
+	}
+	return &CompletionRequest{
+		Model: model,
+		Messages: []Message{
+			{Role: "system", Content: systemPrompt},
+			{Role: "user", Content: fmt.Sprintf("Refactor the following Markdown content:\n\n%s", content)},
+		},
+		OnChunk: onChunk,
+	}
+}
+
+// Refactor refactors content and returns the result
+func (c *Client) Refactor(ctx context.Context, content string) (string, error) {
+	completion, err := c.Complete(ctx, c.request(content, nil))
+	if err != nil {
+		return "", err
+	}
+	return completion.Message.Content, nil
+}
+
+// RefactorStream refactors content and passes the output to fn chunk by chunk
+// as the model generates it. An error returned by fn stops the stream and is
+// returned as is.
+func (c *Client) RefactorStream(ctx context.Context, content string, fn func(chunk string) error) error {
+	_, err := c.Complete(ctx, c.request(content, fn))
+	return err
+}
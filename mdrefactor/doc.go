@@ -0,0 +1,4 @@
+// Package mdrefactor is the refactoring engine of the mdrefactor command, for
+// programs that refactor Markdown through the API themselves. The command is
+// built on it, so both send requests and report errors the same way.
+package mdrefactor
@@ -0,0 +1,53 @@
+package mdrefactor
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Sentinel errors the errors returned by the API calls can be matched against with errors.Is
+var (
+	ErrRateLimited    = errors.New("rate limited")
+	ErrContextTooLong = errors.New("context too long")
+	ErrAuth           = errors.New("authentication failed")
+)
+
+// APIError represents an error returned by the API. It unwraps to
+// ErrRateLimited, ErrContextTooLong or ErrAuth when it is one of those.
+type APIError struct {
+	StatusCode int    `json:"-"` // HTTP status of the response carrying the error
+	Message    string `json:"message"`
+	Type       string `json:"type"`
+	Param      string `json:"param"`
+	Code       string `json:"code"`
+}
+
+// Error implements the error interface
+func (e *APIError) Error() string {
+	return fmt.Sprintf("API error: %s (Type: %s, Code: %s)", e.Message, e.Type, e.Code)
+}
+
+// Unwrap returns the sentinel error matching the kind of API error, if any
+func (e *APIError) Unwrap() error {
+	switch {
+	case e.Code == "context_length_exceeded":
+		return ErrContextTooLong
+	case e.StatusCode == http.StatusTooManyRequests || e.Code == "rate_limit_exceeded":
+		return ErrRateLimited
+	case e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden || e.Code == "invalid_api_key":
+		return ErrAuth
+	}
+	return nil
+}
+
+// ResponseError returns the error carried by the body of an API response
+// that could not be decoded, or nil if the response was successful
+func ResponseError(resp *http.Response, body []byte) error {
+	if resp.StatusCode < 300 {
+		return nil
+	}
+	return &APIError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(body)), Type: "http_error", Code: strconv.Itoa(resp.StatusCode)}
+}
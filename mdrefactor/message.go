@@ -0,0 +1,40 @@
+package mdrefactor
+
+// Message represents a single message in the chat completion request
+type Message struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+
+	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`   // Tools the assistant asks to have called
+	ToolCallID string     `json:"tool_call_id,omitempty"` // Call a "tool" message answers
+}
+
+// ToolCall is a request of the model to call one of the tools it was offered
+type ToolCall struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"` // JSON-encoded arguments
+	} `json:"function"`
+}
+
+// Tool describes a function the model may call instead of replying
+type Tool struct {
+	Type     string       `json:"type"`
+	Function ToolFunction `json:"function"`
+}
+
+// ToolFunction is the name, purpose and JSON schema of the parameters of a tool
+type ToolFunction struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Parameters  any    `json:"parameters"`
+}
+
+// Usage is the number of tokens a completion took
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
@@ -0,0 +1,188 @@
+package mdrefactor
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// OpenAI API endpoint for chat completions
+const OpenAIURL = "https://api.openai.com/v1/chat/completions"
+
+// OpenAI is the transport sending completion requests to the OpenAI chat
+// completions API, or a server compatible with it
+type OpenAI struct {
+	APIKey    string
+	URL       string // Defaults to OpenAIURL
+	Seed      *int64 // Makes sampling deterministic on a best-effort basis
+	MaxTokens int    // Cap on the generated tokens, the model's limit if 0
+	// Do sends the HTTP requests, http.DefaultClient.Do if nil. Programs set
+	// it to add headers, retries or logging.
+	Do func(req *http.Request) (*http.Response, error)
+}
+
+// ChatRequest is the payload of a request to the OpenAI chat completions API
+type ChatRequest struct {
+	Model    string    `json:"model"`
+	Messages []Message `json:"messages"`
+	Stream   bool      `json:"stream"`
+
+	Temperature *float64 `json:"temperature,omitempty"`
+	Seed        *int64   `json:"seed,omitempty"`
+	MaxTokens   int      `json:"max_tokens,omitempty"`
+
+	ResponseFormat any    `json:"response_format,omitempty"`
+	Tools          []Tool `json:"tools,omitempty"`
+}
+
+// chatResponse represents the expected response structure from the OpenAI API
+type chatResponse struct {
+	Choices []struct {
+		Message      Message `json:"message"`
+		FinishReason string  `json:"finish_reason"`
+	} `json:"choices"`
+	Usage             Usage     `json:"usage"`
+	SystemFingerprint string    `json:"system_fingerprint"`
+	Error             *APIError `json:"error,omitempty"`
+}
+
+// streamChunk represents one server-sent event of a streamed chat completion
+type streamChunk struct {
+	Choices []struct {
+		Delta        Message `json:"delta"`
+		FinishReason string  `json:"finish_reason"`
+	} `json:"choices"`
+	Error *APIError `json:"error,omitempty"`
+}
+
+// NewChatRequest returns the payload Complete sends for req, for programs
+// that send it another way, such as through the Batch API
+func (o *OpenAI) NewChatRequest(req *CompletionRequest) *ChatRequest {
+	return &ChatRequest{
+		Model:    req.Model,
+		Messages: req.Messages,
+		Stream:   req.OnChunk != nil,
+
+		Temperature: req.Temperature,
+		Seed:        o.Seed,
+		MaxTokens:   o.MaxTokens,
+
+		ResponseFormat: req.ResponseFormat,
+		Tools:          req.Tools,
+	}
+}
+
+// Complete implements Completer. Streamed requests pass each content delta
+// of the first choice to req.OnChunk.
+func (o *OpenAI) Complete(ctx context.Context, req *CompletionRequest) (*Completion, error) {
+	requestBody, err := json.Marshal(o.NewChatRequest(req))
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal API request: %w", err)
+	}
+	url := o.URL
+	if url == "" {
+		url = OpenAIURL
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(requestBody))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Authorization", "Bearer "+o.APIKey)
+	if req.OnChunk != nil {
+		httpReq.Header.Set("Accept", "text/event-stream")
+	}
+
+	do := o.Do
+	if do == nil {
+		do = http.DefaultClient.Do
+	}
+	resp, err := do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if req.OnChunk != nil && resp.StatusCode < 300 {
+		return readStream(resp, req.OnChunk)
+	}
+
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read API response body: %w", err)
+	}
+	var apiResponse chatResponse
+	if err := json.Unmarshal(responseBody, &apiResponse); err != nil {
+		if err := ResponseError(resp, responseBody); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to unmarshal API response: %w", err)
+	}
+	if apiResponse.Error != nil {
+		apiResponse.Error.StatusCode = resp.StatusCode
+		return nil, apiResponse.Error
+	}
+	// Errors of streamed requests are reported as a plain JSON body too
+	if err := ResponseError(resp, responseBody); err != nil {
+		return nil, err
+	}
+	if len(apiResponse.Choices) == 0 {
+		return nil, fmt.Errorf("no content received from API. Raw response: %s", string(responseBody))
+	}
+	return &Completion{
+		Message:           apiResponse.Choices[0].Message,
+		FinishReason:      apiResponse.Choices[0].FinishReason,
+		Usage:             apiResponse.Usage,
+		SystemFingerprint: apiResponse.SystemFingerprint,
+	}, nil
+}
+
+// readStream reads the server-sent events of a streamed completion, passing
+// each content delta of the first choice to fn
+func readStream(resp *http.Response, fn func(chunk string) error) (*Completion, error) {
+	var reply strings.Builder
+	finishReason := ""
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue
+		}
+		data = strings.TrimSpace(data)
+		if data == "[DONE]" {
+			return &Completion{Message: Message{Role: "assistant", Content: reply.String()}, FinishReason: finishReason}, nil
+		}
+
+		var chunk streamChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal API stream event: %w", err)
+		}
+		if chunk.Error != nil {
+			chunk.Error.StatusCode = resp.StatusCode
+			return nil, chunk.Error
+		}
+		if len(chunk.Choices) == 0 {
+			continue
+		}
+		if reason := chunk.Choices[0].FinishReason; reason != "" {
+			finishReason = reason
+		}
+		if chunk.Choices[0].Delta.Content == "" {
+			continue
+		}
+		reply.WriteString(chunk.Choices[0].Delta.Content)
+		if err := fn(chunk.Choices[0].Delta.Content); err != nil {
+			return nil, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read API response stream: %w", err)
+	}
+	return nil, fmt.Errorf("API response stream ended before completion")
+}
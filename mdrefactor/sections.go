@@ -0,0 +1,229 @@
+package mdrefactor
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/text"
+)
+
+// Section is the part of a document from one heading up to the next
+type Section struct {
+	Heading   string // Heading text, empty for content before the first heading
+	Anchor    string // Anchor of the heading, empty for content before the first heading
+	Level     int    // Heading level, 0 for content before the first heading
+	StartLine int    // 0-based index of the heading line
+	EndLine   int    // 0-based index one past the last line of the section
+	Start     int    // Byte offset of the section in the content
+	End       int    // Byte offset one past the end of the section, including its newlines
+	Text      string // Section content including the heading line
+}
+
+// Heading is a top-level heading of a document, one that starts a section
+type Heading struct {
+	Level   int    // Heading level, 1-6
+	Text    string // Heading text without the leading #s or underline
+	Anchor  string // Anchor of the heading, duplicates suffixed with -1, -2, ...
+	Line    int    // 0-based index of the first line of the heading
+	EndLine int    // 0-based index of the last line, the underline of setext headings
+}
+
+// Document is a Markdown document to be worked on section by section
+type Document struct {
+	Content string
+	// Slugify turns heading text into an anchor, Slugify if nil. Programs
+	// whose documents are rendered by other generators than GitHub set it.
+	Slugify func(text string) string
+}
+
+var (
+	markdownParser = goldmark.New(goldmark.WithExtensions(extension.GFM)).Parser()
+	inlineCodeRe   = regexp.MustCompile("`[^`]*`")
+	linkRe         = regexp.MustCompile(`\[([^\]]*)\]\([^)]*\)`)
+	htmlTagRe      = regexp.MustCompile(`<[^>]+>`)
+)
+
+// ParseSections splits content into sections at every heading, with
+// anchors generated the way GitHub does
+func ParseSections(content string) []Section {
+	return (&Document{Content: content}).Sections()
+}
+
+// ReplaceSection returns content with the section with the given anchor,
+// from its heading up to the next heading, replaced by text. The empty
+// anchor names the part before the first heading.
+func ReplaceSection(content, anchor, text string) (string, error) {
+	return (&Document{Content: content}).ReplaceSection(anchor, text)
+}
+
+// Headings returns the top-level headings of the document. Headings nested
+// in lists or block quotes and anything inside code blocks are not included.
+func (d *Document) Headings() []Heading {
+	slugify := d.Slugify
+	if slugify == nil {
+		slugify = Slugify
+	}
+	// Front matter is not Markdown; blank it out so its delimiters are not
+	// taken for a thematic break and a setext heading, keeping offsets intact
+	frontMatter, _ := SplitFrontMatter(d.Content)
+	parsed := []byte(d.Content)
+	for i := 0; i < len(frontMatter); i++ {
+		if parsed[i] != '\n' {
+			parsed[i] = ' '
+		}
+	}
+	root := markdownParser.Parse(text.NewReader(parsed))
+
+	var headings []Heading
+	seen := make(map[string]int)
+	for n := root.FirstChild(); n != nil; n = n.NextSibling() {
+		h, ok := n.(*ast.Heading)
+		if !ok || h.Lines().Len() == 0 {
+			continue
+		}
+		var parts []string
+		for i := 0; i < h.Lines().Len(); i++ {
+			seg := h.Lines().At(i)
+			parts = append(parts, strings.TrimSpace(string(seg.Value(parsed))))
+		}
+		heading := Heading{Level: h.Level, Text: strings.Join(parts, " ")}
+		heading.Line = strings.Count(d.Content[:h.Lines().At(0).Start], "\n")
+		heading.EndLine = strings.Count(d.Content[:h.Lines().At(h.Lines().Len()-1).Start], "\n")
+		// Setext headings are underlined rather than prefixed with #s
+		lineStart := strings.LastIndex(d.Content[:h.Lines().At(0).Start], "\n") + 1
+		if !strings.HasPrefix(strings.TrimLeft(d.Content[lineStart:], " "), "#") {
+			heading.EndLine++
+		}
+
+		slug := slugify(heading.Text)
+		heading.Anchor = slug
+		if n := seen[slug]; n > 0 {
+			heading.Anchor = fmt.Sprintf("%s-%d", slug, n)
+		}
+		seen[slug]++
+		headings = append(headings, heading)
+	}
+	return headings
+}
+
+// Sections splits the document into sections at every heading, in document
+// order. Content before the first heading, if any, is the first section.
+func (d *Document) Sections() []Section {
+	headings := d.Headings()
+	lines := strings.Split(d.Content, "\n")
+	// offsets[i] is the byte offset of line i, offsets[len(lines)] the length of the content
+	offsets := make([]int, len(lines)+1)
+	for i, line := range lines {
+		offsets[i+1] = min(offsets[i]+len(line)+1, len(d.Content))
+	}
+
+	var sections []Section
+	if len(headings) == 0 || headings[0].Line > 0 {
+		end := len(lines)
+		if len(headings) > 0 {
+			end = headings[0].Line
+		}
+		sections = append(sections, Section{StartLine: 0, EndLine: end, Start: 0, End: offsets[end], Text: strings.Join(lines[:end], "\n")})
+	}
+
+	for i, h := range headings {
+		end := len(lines)
+		if i+1 < len(headings) {
+			end = headings[i+1].Line
+		}
+		sections = append(sections, Section{
+			Heading:   h.Text,
+			Anchor:    h.Anchor,
+			Level:     h.Level,
+			StartLine: h.Line,
+			EndLine:   end,
+			Start:     offsets[h.Line],
+			End:       offsets[end],
+			Text:      strings.Join(lines[h.Line:end], "\n"),
+		})
+	}
+	return sections
+}
+
+// ReplaceSection returns the content of the document with the section with
+// the given anchor replaced by text, keeping the blank lines that separated
+// it from the next one. The empty anchor names the part before the first
+// heading. Anchors that more than one section has, such as the empty anchor
+// of a heading without text, are an error.
+func (d *Document) ReplaceSection(anchor, text string) (string, error) {
+	var match *Section
+	sections := d.Sections()
+	for i, s := range sections {
+		if s.Anchor != anchor {
+			continue
+		}
+		if match != nil {
+			return "", fmt.Errorf("more than one section has the anchor %q", anchor)
+		}
+		match = &sections[i]
+	}
+	if match == nil {
+		if anchor == "" {
+			return "", fmt.Errorf("the document has no content before its first heading")
+		}
+		return "", fmt.Errorf("no section with the anchor %q", anchor)
+	}
+	old := d.Content[match.Start:match.End]
+	text = strings.TrimRight(text, "\n") + old[len(strings.TrimRight(old, "\n")):]
+	return d.Content[:match.Start] + text + d.Content[match.End:], nil
+}
+
+// SplitFrontMatter separates a leading YAML (---) or TOML (+++) front matter
+// block from the document body. The returned front matter includes its
+// delimiters and trailing newline, so frontMatter+body == content.
+func SplitFrontMatter(content string) (frontMatter, body string) {
+	for _, delim := range []string{"---", "+++"} {
+		if !strings.HasPrefix(content, delim+"\n") && !strings.HasPrefix(content, delim+"\r\n") {
+			continue
+		}
+
+		// Find the closing delimiter on a line of its own
+		offset := strings.Index(content, "\n") + 1
+		for offset < len(content) {
+			end := strings.Index(content[offset:], "\n")
+			line := content[offset:]
+			next := len(content)
+			if end >= 0 {
+				line = content[offset : offset+end]
+				next = offset + end + 1
+			}
+			if strings.TrimRight(line, "\r") == delim {
+				return content[:next], content[next:]
+			}
+			offset = next
+		}
+	}
+	return "", content
+}
+
+// Slugify converts heading text into an anchor the way GitHub does:
+// lowercase, punctuation removed and spaces replaced by hyphens
+func Slugify(heading string) string {
+	// Inline Markdown does not end up in the rendered anchor
+	heading = inlineCodeRe.ReplaceAllStringFunc(heading, func(code string) string { return strings.Trim(code, "`") })
+	heading = linkRe.ReplaceAllString(heading, "$1")
+	heading = htmlTagRe.ReplaceAllString(heading, "")
+
+	var b strings.Builder
+	for _, r := range strings.ToLower(heading) {
+		switch {
+		// Like GitHub, keep letters, combining marks (which e.g. Devanagari
+		// vowel signs are), numbers, connector punctuation such as _ and hyphens
+		case unicode.IsLetter(r) || unicode.Is(unicode.M, r) || unicode.IsNumber(r) || unicode.Is(unicode.Pc, r) || r == '-':
+			b.WriteRune(r)
+		case r == ' ':
+			b.WriteRune('-')
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jackmbuda/go-mdrefactor/mdrefactor"
+)
+
+const (
+	// Similarity above which a section is considered a repeat of an earlier one
+	mergeDuplicateThreshold = 0.9
+	// System prompt used to smooth the transitions between merged documents
+	mergeSmoothPrompt = "You are a technical editor. The following document was assembled from several separate files. " +
+		"Add short transition sentences where one part ends and the next begins so that it reads as one coherent document. " +
+		"Do not change headings, links, code or any other content."
+)
+
+// mergePart is one input document of a merge
+type mergePart struct {
+	file     string   // Absolute, slash-separated path of the input file
+	content  string   // Content with front matter removed and headings shifted
+	anchors  []string // Anchors of the part's own headings, in order
+	offset   int      // Index of the part's first heading among all merged headings
+	headings int
+	before   string // Inserted before the part
+}
+
+// dedupeSections removes sections of at least minWords words that repeat a
+// section already kept in an earlier part (or earlier in the same part),
+// returning the remaining content
+func dedupeSections(file, content string, minWords int, seen *[]docSection) string {
+	var kept []string
+	for _, s := range splitSections(content) {
+		set, words := shingles(s.Text)
+		duplicate := false
+		if words >= max(minWords, shingleSize) {
+			for _, prev := range *seen {
+				if shingleSimilarity(set, prev.shingles) >= mergeDuplicateThreshold {
+					fmt.Printf("Dropped repeated section %q from %s (same as %s)\n", s.Heading, file, prev.location())
+					duplicate = true
+					break
+				}
+			}
+			if !duplicate {
+				*seen = append(*seen, docSection{file: file, section: s, shingles: set, words: words})
+			}
+		}
+		if !duplicate {
+			kept = append(kept, s.Text)
+		}
+	}
+	return strings.Join(kept, "\n")
+}
+
+// mergeInput is a document to merge
+type mergeInput struct {
+	file    string // Path of the document, empty for text added between documents
+	content string
+	level   int    // Level the document's top headings are shifted to
+	before  string // Inserted before the document, such as a page break
+}
+
+// mergeDocuments concatenates the files into one document written to output.
+// Headings are shifted below the optional title, repeated sections are
+// dropped, and links between the files become links to internal anchors.
+func mergeDocuments(files []string, output, title string, minWords int) (string, error) {
+	target := 1
+	if title != "" {
+		target = 2
+	}
+	inputs := make([]mergeInput, len(files))
+	for i, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s: %w", file, err)
+		}
+		inputs[i] = mergeInput{file: file, content: string(content), level: target}
+	}
+	return assembleDocuments(inputs, output, title, true, minWords)
+}
+
+// assembleDocuments joins the inputs into one document written to output,
+// below the optional title. The headings of each input are shifted to its
+// level, repeated sections of at least minWords words are dropped if dedupe
+// is set, and links between the inputs become links to internal anchors.
+// Inputs given more than once are linked to as their first copy.
+func assembleDocuments(inputs []mergeInput, output, title string, dedupe bool, minWords int) (string, error) {
+	var parts []*mergePart
+	var seen []docSection
+	byFile := make(map[string]*mergePart)
+	for _, in := range inputs {
+		_, body := mdrefactor.SplitFrontMatter(in.content)
+		body = strings.TrimSpace(body)
+		if min := minHeadingLevel(body); min > 0 {
+			body = shiftHeadings(body, in.level-min)
+		}
+		if dedupe {
+			body = dedupeSections(in.file, body, minWords, &seen)
+		}
+
+		part := &mergePart{content: strings.TrimSpace(body), before: in.before}
+		parts = append(parts, part)
+		if in.file != "" {
+			part.file = filepath.ToSlash(filepath.Clean(mustAbs(in.file)))
+			if _, ok := byFile[part.file]; !ok {
+				byFile[part.file] = part
+			}
+		}
+	}
+
+	// Anchors are computed over the whole document, since duplicates get suffixes
+	var all []string
+	offset := 0
+	if title != "" {
+		all, offset = []string{"# " + title}, 1
+	}
+	for _, p := range parts {
+		all = append(all, p.content)
+	}
+	mergedAnchors := headingAnchors(parseHeadings(strings.Join(all, "\n\n")))
+	for _, p := range parts {
+		p.anchors = headingAnchors(parseHeadings(p.content))
+		p.offset = offset
+		p.headings = len(p.anchors)
+		offset += p.headings
+	}
+
+	// mergedAnchor maps an anchor of a part to its anchor in the merged document
+	mergedAnchor := func(p *mergePart, anchor string) string {
+		if p.headings == 0 {
+			return ""
+		}
+		if anchor == "" {
+			return mergedAnchors[p.offset]
+		}
+		for i, a := range p.anchors {
+			if a == anchor {
+				return mergedAnchors[p.offset+i]
+			}
+		}
+		return anchor
+	}
+
+	outDir := filepath.Dir(mustAbs(output))
+	exists := func(p string) bool { _, ok := byFile[p]; return ok }
+
+	var b strings.Builder
+	if title != "" {
+		fmt.Fprintf(&b, "# %s\n\n", title)
+	}
+	for i, p := range parts {
+		content := rewriteLinks(p.content, func(target string, image bool) string {
+			if p.file == "" || target == "" || isExternalLink(target) || strings.HasPrefix(target, "/") {
+				return target
+			}
+			if !image {
+				if file, anchor, ok := resolveDocLink(p.file, target, exists); ok {
+					if other, merged := byFile[file]; merged {
+						if a := mergedAnchor(other, anchor); a != "" {
+							return "#" + a
+						}
+					}
+				}
+			}
+			if strings.HasPrefix(target, "#") {
+				return target
+			}
+
+			// Other relative links must still resolve from the output location
+			return rebaseLink(target, filepath.Dir(filepath.FromSlash(p.file)), outDir)
+		})
+
+		b.WriteString(p.before + content)
+		if i < len(parts)-1 {
+			b.WriteString("\n\n")
+		}
+	}
+	b.WriteString("\n")
+	return b.String(), nil
+}
+
+// runMergeCommand implements the merge subcommand
+func runMergeCommand(args []string) error {
+	fs := flag.NewFlagSet("merge", flag.ExitOnError)
+	output := fs.String("o", "", "Path of the merged document (required)")
+	title := fs.String("title", "", "Title of the merged document; headings of the inputs are nested below it")
+	smooth := fs.Bool("smooth", false, "Have the model add transitions between the merged parts")
+	minWords := fs.Int("min-words", shingleSize, fmt.Sprintf("Sections with fewer words are never dropped as repeats; repeats are found by runs of %d words, so it cannot be lower", shingleSize))
+	apiKey := fs.String("apikey", os.Getenv("OPENAI_API_KEY"), "OpenAI API key, used with -smooth")
+	addAPIFlags(fs)
+	model := fs.String("model", defaultModel, "OpenAI model to use with -smooth")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: mdrefactor merge [flags] <file>... -o <output>")
+		fs.PrintDefaults()
+	}
+	positional := parseArgs(fs, args)
+	if len(positional) < 2 || *output == "" {
+		fs.Usage()
+		return fmt.Errorf("at least two input files and -o are required")
+	}
+
+	merged, err := mergeDocuments(positional, *output, *title, *minWords)
+	if err != nil {
+		return err
+	}
+
+	if *smooth {
+		fmt.Println("Sending merged document to API for smoothing...")
+		merged, err = chatCompletion(*apiKey, *model, []Message{
+			{Role: "system", Content: mergeSmoothPrompt},
+			{Role: "user", Content: merged},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := writeFileAtomic(*output, []byte(merged), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", *output, err)
+	}
+	fmt.Printf("Merged %d files into %s\n", len(positional), *output)
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// merge3 merges the changes from base to ours and from base to theirs,
+// line by line like diff3. Hunks changed on one side only take that side;
+// hunks changed differently on both sides are conflicts and take theirs.
+// It returns the merged text and the number of conflicting hunks.
+func merge3(base, ours, theirs string) (string, int) {
+	b, o, t := strings.Split(base, "\n"), strings.Split(ours, "\n"), strings.Split(theirs, "\n")
+	mo, mt := lcsMatches(b, o), lcsMatches(b, t)
+
+	var merged []string
+	conflicts := 0
+	// resolve adds the hunk between the last stable line and base line i
+	bi, oi, ti := 0, 0, 0
+	resolve := func(bEnd, oEnd, tEnd int) {
+		bh, oh, th := b[bi:bEnd], o[oi:oEnd], t[ti:tEnd]
+		switch {
+		case equalLines(oh, bh):
+			merged = append(merged, th...)
+		case equalLines(th, bh), equalLines(oh, th):
+			merged = append(merged, oh...)
+		default:
+			conflicts++
+			merged = append(merged, th...)
+		}
+	}
+	for i := range b {
+		// Lines kept by both sides are stable and separate the hunks
+		if mo[i] < 0 || mt[i] < 0 {
+			continue
+		}
+		resolve(i, mo[i], mt[i])
+		merged = append(merged, b[i])
+		bi, oi, ti = i+1, mo[i]+1, mt[i]+1
+	}
+	resolve(len(b), len(o), len(t))
+	return strings.Join(merged, "\n"), conflicts
+}
+
+// equalLines reports whether two slices of lines are equal
+func equalLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeConcurrentEdits returns refactored, the result of refactoring the
+// content base read from path, adjusted to edits made to path since it was
+// read, e.g. in an editor that is still open or by another CI job. Edits that
+// do not overlap the refactoring are merged in. If they conflict, the file is
+// left alone and the result is added to the review queue in reviewDir instead.
+func mergeConcurrentEdits(path, base, refactored, reviewDir string) (string, error) {
+	data, err := os.ReadFile(fsPath(path))
+	if err != nil {
+		// Removed or unreadable: nothing to merge with
+		return refactored, nil
+	}
+	current := decodeSource(data).text
+	if current == base {
+		return refactored, nil
+	}
+
+	merged, conflicts := merge3(base, refactored, current)
+	if conflicts == 0 {
+		fmt.Printf("%s changed on disk during the run, merged the refactored result with those edits\n", path)
+		return merged, nil
+	}
+	entry := reviewEntry{
+		Target:   path,
+		Changed:  changedFraction(current, refactored),
+		Problems: []string{fmt.Sprintf("%d hunks of the refactored result conflict with edits made to the file during the run", conflicts)},
+	}
+	entryDir, err := saveForReview(reviewDir, entry, current, refactored)
+	if err != nil {
+		return "", err
+	}
+	fmt.Printf("Held %s for review in %s: it changed on disk during the run and %d hunks conflict with the refactored result\n", path, entryDir, conflicts)
+	return "", fmt.Errorf("%s %w (conflicts with edits made during the run)", path, errHeldForReview)
+}
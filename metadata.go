@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// System prompt used to extract document metadata
+const metadataSystemPrompt = "You are a technical writer cataloguing documentation. Describe the document accurately, based only on its content."
+
+// documentMetadata is the metadata extracted from a document
+type documentMetadata struct {
+	Title       string   `json:"title"`
+	Summary     string   `json:"summary"`
+	Tags        []string `json:"tags"`
+	Audience    string   `json:"audience"`
+	ActionItems []string `json:"action_items"`
+}
+
+// metadataResponseFormat makes the API return documentMetadata as JSON that
+// conforms to its schema instead of free text
+var metadataResponseFormat = map[string]any{
+	"type": "json_schema",
+	"json_schema": map[string]any{
+		"name":   "document_metadata",
+		"strict": true,
+		"schema": map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"title":        map[string]any{"type": "string", "description": "Title of the document"},
+				"summary":      map[string]any{"type": "string", "description": "One or two sentence summary"},
+				"tags":         map[string]any{"type": "array", "items": map[string]any{"type": "string"}, "description": "3 to 8 lowercase topic tags"},
+				"audience":     map[string]any{"type": "string", "description": "Intended audience, e.g. beginner, expert, operator, contributor"},
+				"action_items": map[string]any{"type": "array", "items": map[string]any{"type": "string"}, "description": "Tasks, TODOs or follow-ups the document asks the reader or its authors to do"},
+			},
+			"required":             []string{"title", "summary", "tags", "audience", "action_items"},
+			"additionalProperties": false,
+		},
+	},
+}
+
+// extractMetadata asks the model for the metadata of a document using structured output
+func extractMetadata(apiKey, model, content string) (documentMetadata, error) {
+	var meta documentMetadata
+	reply, err := chatCompletionParams(context.Background(), apiKey, model, []Message{
+		{Role: "system", Content: metadataSystemPrompt},
+		{Role: "user", Content: "Extract the metadata of the following Markdown document.\n\n" + content},
+	}, completionParams{responseFormat: metadataResponseFormat})
+	if err != nil {
+		return meta, err
+	}
+	if err := decodeJSONReply(reply, &meta); err != nil {
+		return meta, err
+	}
+	return meta, nil
+}
+
+// metadataPath returns the path of the metadata file written next to a document
+func metadataPath(file string) string {
+	return strings.TrimSuffix(file, filepath.Ext(file)) + ".meta.json"
+}
+
+// writeMetadata writes metadata as indented JSON to path
+func writeMetadata(path string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write metadata %s: %w", path, err)
+	}
+	return nil
+}
+
+// runMetadataCommand implements the metadata subcommand
+func runMetadataCommand(args []string) error {
+	fs := flag.NewFlagSet("metadata", flag.ExitOnError)
+	apiKey := fs.String("apikey", os.Getenv("OPENAI_API_KEY"), "OpenAI API key (can also be set via OPENAI_API_KEY environment variable)")
+	addAPIFlags(fs)
+	model := fs.String("model", defaultModel, "OpenAI model to use (must support structured outputs)")
+	output := fs.String("o", "", "Write the metadata of all files to this JSON file, keyed by path (- for stdout), instead of a .meta.json file next to each document")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: mdrefactor metadata [flags] <file-or-dir>...")
+		fmt.Fprintln(fs.Output(), "Extracts the title, summary, tags, audience and action items of each document as JSON.")
+		fs.PrintDefaults()
+	}
+	positional := parseArgs(fs, args)
+	if len(positional) == 0 {
+		fs.Usage()
+		return fmt.Errorf("at least one file or directory is required")
+	}
+
+	files, err := expandMarkdownArgs(positional)
+	if err != nil {
+		return err
+	}
+
+	all := make(map[string]documentMetadata)
+	failed := 0
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", file, err)
+		}
+		if *output == "-" {
+			fmt.Fprintf(os.Stderr, "Extracting metadata of %s...\n", file)
+		} else {
+			fmt.Printf("Extracting metadata of %s...\n", file)
+		}
+		meta, err := extractMetadata(*apiKey, *model, decodeSource(content).text)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error extracting metadata of %s: %v\n", file, err)
+			failed++
+			continue
+		}
+		if *output != "" {
+			all[filepath.ToSlash(file)] = meta
+			continue
+		}
+		if err := writeMetadata(metadataPath(file), meta); err != nil {
+			return err
+		}
+		fmt.Printf("Metadata written to %s\n", metadataPath(file))
+	}
+
+	switch *output {
+	case "":
+	case "-":
+		data, err := json.MarshalIndent(all, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+	default:
+		if err := writeMetadata(*output, all); err != nil {
+			return err
+		}
+		fmt.Printf("Metadata of %d files written to %s\n", len(all), *output)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("failed to extract metadata of %d of %d files", failed, len(files))
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Number of extra attempts made when a refactored document lacks a section its mode requires
+const sectionRetries = 1
+
+// refactorMode is a -mode preset for a kind of document: instructions added
+// to the system prompt and the sections the refactored document must have
+type refactorMode struct {
+	instruction string
+	sections    []string // Heading texts the output must contain, in this order
+}
+
+// Presets of the -mode flag
+var refactorModes = map[string]refactorMode{
+	"adr": {
+		instruction: "The document is an architecture decision record. Restructure it into the standard form: a # title " +
+			"naming the decision, followed by the sections ## Status (Proposed, Accepted, Deprecated or Superseded, with a " +
+			"link to the superseding record if any), ## Context (the forces and the problem), ## Decision (what was decided, " +
+			"in active voice) and ## Consequences (what becomes easier or harder), in this order. Move the existing content " +
+			"into the matching section, keep dates and links to other records, and do not invent decisions or rationale.",
+		sections: []string{"Status", "Context", "Decision", "Consequences"},
+	},
+	"minutes": {
+		instruction: "The content is raw meeting notes. Turn them into structured minutes: a # title with the name and date " +
+			"of the meeting if the notes give them, followed by the sections ## Attendees (a list of names), ## Summary (the " +
+			"main points discussed, briefly), ## Decisions (a list; \"None recorded.\" if there are none) and ## Action items " +
+			"(a task list of the form \"- [ ] **Owner**: task (due date)\", with Unassigned as the owner when none is named " +
+			"and the due date left out when none is given), in this order. Do not invent attendees, decisions, owners or dates.",
+		sections: []string{"Attendees", "Summary", "Decisions", "Action items"},
+	},
+}
+
+// modeNames returns the names of the -mode presets for use in messages
+func modeNames() string {
+	return strings.Join(sortedKeys(refactorModes), ", ")
+}
+
+// missingSections returns the required sections that content lacks or has
+// out of order, matching heading texts case-insensitively
+func missingSections(content string, required []string) []string {
+	var missing []string
+	next := 0
+	headings := parseHeadings(content)
+	for _, want := range required {
+		found := false
+		for i := next; i < len(headings); i++ {
+			if strings.EqualFold(strings.TrimSpace(headings[i].text), want) {
+				found = true
+				next = i + 1
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, want)
+		}
+	}
+	return missing
+}
+
+// withRequiredSections wraps refactor so that output lacking one of the
+// sections of the mode is retried and finally rejected
+func withRequiredSections(mode refactorMode, refactor refactorFunc) refactorFunc {
+	if len(mode.sections) == 0 {
+		return refactor
+	}
+	return func(systemPrompt, content string) (string, error) {
+		prompt := systemPrompt
+		for attempt := 0; ; attempt++ {
+			refactored, err := refactor(prompt, content)
+			if err != nil {
+				return "", err
+			}
+			missing := missingSections(refactored, mode.sections)
+			if len(missing) == 0 {
+				return refactored, nil
+			}
+			if attempt == sectionRetries {
+				return "", fmt.Errorf("refactored content lacks the required sections %s after %d attempts", strings.Join(missing, ", "), attempt+1)
+			}
+			fmt.Printf("Refactored content lacks the sections %s, retrying...\n", strings.Join(missing, ", "))
+			prompt = fmt.Sprintf("%s\n\nYour previous attempt lacked these sections or had them out of order: %s. The document must have the headings %s, in this order.",
+				systemPrompt, strings.Join(missing, ", "), strings.Join(mode.sections, ", "))
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/jackmbuda/go-mdrefactor/mdrefactor"
+)
+
+var (
+	// use ./tools or a line of a use ( ... ) block of go.work
+	goWorkUseRe = regexp.MustCompile(`^\s*(?:use\s+)?(\.[^\s)]*)\s*$`)
+	// members = ["a", "crates/*"] of a Cargo workspace, possibly spanning several lines
+	cargoMembersRe = regexp.MustCompile(`(?s)\[workspace\].*?members\s*=\s*\[(.*?)\]`)
+	// - 'packages/*' items of pnpm-workspace.yaml
+	pnpmPackageRe = regexp.MustCompile(`^\s*-\s*['"]?([^'"#]+?)['"]?\s*$`)
+	quotedRe      = regexp.MustCompile(`"([^"]+)"`)
+)
+
+// workspacePatterns returns the package directories or glob patterns
+// declared by the go.work, Cargo.toml, package.json or pnpm-workspace.yaml of
+// the repository root
+func workspacePatterns(root string) []string {
+	var patterns []string
+
+	if data, err := os.ReadFile(filepath.Join(root, "go.work")); err == nil {
+		inUse := false
+		for _, line := range strings.Split(string(data), "\n") {
+			trimmed := strings.TrimSpace(line)
+			switch {
+			case strings.HasPrefix(trimmed, "use ("):
+				inUse = true
+			case inUse && trimmed == ")":
+				inUse = false
+			case inUse || strings.HasPrefix(trimmed, "use "):
+				if m := goWorkUseRe.FindStringSubmatch(trimmed); m != nil {
+					patterns = append(patterns, m[1])
+				}
+			}
+		}
+	}
+
+	if data, err := os.ReadFile(filepath.Join(root, "Cargo.toml")); err == nil {
+		if m := cargoMembersRe.FindStringSubmatch(string(data)); m != nil {
+			for _, q := range quotedRe.FindAllStringSubmatch(m[1], -1) {
+				patterns = append(patterns, q[1])
+			}
+		}
+	}
+
+	if data, err := os.ReadFile(filepath.Join(root, "package.json")); err == nil {
+		var pkg struct {
+			Workspaces json.RawMessage `json:"workspaces"`
+		}
+		if json.Unmarshal(data, &pkg) == nil && len(pkg.Workspaces) > 0 {
+			var list []string
+			var object struct {
+				Packages []string `json:"packages"`
+			}
+			if json.Unmarshal(pkg.Workspaces, &list) == nil {
+				patterns = append(patterns, list...)
+			} else if json.Unmarshal(pkg.Workspaces, &object) == nil {
+				patterns = append(patterns, object.Packages...)
+			}
+		}
+	}
+
+	if f, err := os.Open(filepath.Join(root, "pnpm-workspace.yaml")); err == nil {
+		scanner := bufio.NewScanner(f)
+		inPackages := false
+		for scanner.Scan() {
+			line := scanner.Text()
+			if !strings.HasPrefix(line, " ") && !strings.HasPrefix(line, "-") {
+				inPackages = strings.HasPrefix(line, "packages:")
+				continue
+			}
+			if m := pnpmPackageRe.FindStringSubmatch(line); inPackages && m != nil && !strings.HasPrefix(m[1], "!") {
+				patterns = append(patterns, m[1])
+			}
+		}
+		f.Close()
+	}
+	return patterns
+}
+
+// detectPackages returns the package directories of a monorepo relative to
+// its root, sorted. Without workspace files, every directory below packages/
+// is taken as a package.
+func detectPackages(root string) []string {
+	patterns := workspacePatterns(root)
+	if len(patterns) == 0 {
+		patterns = []string{"packages/*"}
+	}
+
+	seen := make(map[string]bool)
+	var packages []string
+	for _, pattern := range patterns {
+		pattern = path.Clean(strings.TrimPrefix(filepath.ToSlash(pattern), "./"))
+		if pattern == "." || strings.HasPrefix(pattern, "..") {
+			continue
+		}
+		matches, _ := filepath.Glob(filepath.Join(root, filepath.FromSlash(pattern)))
+		for _, m := range matches {
+			if info, err := os.Stat(m); err != nil || !info.IsDir() {
+				continue
+			}
+			rel, err := filepath.Rel(root, m)
+			if err != nil || seen[rel] {
+				continue
+			}
+			seen[rel] = true
+			packages = append(packages, filepath.ToSlash(rel))
+		}
+	}
+	sort.Strings(packages)
+	return packages
+}
+
+// firstParagraph returns the first paragraph of prose of a Markdown document
+// on one line, skipping headings, badges, HTML and code
+func firstParagraph(content string) string {
+	_, body := mdrefactor.SplitFrontMatter(content)
+	code := codeLines(body)
+	var paragraph []string
+	for i, line := range strings.Split(body, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if code[i] || trimmed == "" {
+			if len(paragraph) > 0 {
+				break
+			}
+			continue
+		}
+		if len(paragraph) == 0 && strings.ContainsAny(trimmed[:1], "#=-!<|[>`") {
+			continue
+		}
+		paragraph = append(paragraph, trimmed)
+	}
+	return strings.Join(paragraph, " ")
+}
+
+// renderPackageIndex returns the top-level README linking to the README of every package
+func renderPackageIndex(name string, packages []string, readmes map[string]string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n\nThis repository contains the following packages. Each has its own README.\n\n", name)
+	b.WriteString("| Package | Description |\n| --- | --- |\n")
+	for _, pkg := range packages {
+		readme, ok := readmes[pkg]
+		if !ok {
+			continue
+		}
+		description := strings.ReplaceAll(firstParagraph(readme), "|", `\|`)
+		fmt.Fprintf(&b, "| [%s](%s/README.md) | %s |\n", pkg, pkg, description)
+	}
+	return b.String()
+}
+
+// generateMonorepoReadmes writes a README for every package of the repository
+// at url to outDir, mirroring the package paths, plus an index README.md. With
+// merge, each README is merged into the one the package already has.
+func generateMonorepoReadmes(apiKey, model, systemPrompt, url string, opts cloneOptions, merge bool, outDir string) error {
+	fmt.Printf("Cloning %s...\n", url)
+	dir, err := cloneRepository(url, opts)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	packages := detectPackages(dir)
+	if len(packages) == 0 {
+		return fmt.Errorf("no packages found in %s: no go.work, Cargo workspace, package.json workspaces, pnpm-workspace.yaml or packages/ directory", url)
+	}
+	fmt.Printf("Found %d packages: %s\n", len(packages), strings.Join(packages, ", "))
+
+	readmes := make(map[string]string)
+	failed := 0
+	for _, pkg := range packages {
+		fmt.Printf("Exploring %s...\n", pkg)
+		task := fmt.Sprintf("Write a README for the package %s of the repository %s. Describe only this package.", pkg, url)
+		if opts.ref != "" {
+			task += fmt.Sprintf(" The checked out version is %s.", opts.ref)
+		}
+		pkgDir := filepath.Join(dir, filepath.FromSlash(pkg))
+		if merge {
+			task += existingReadmeHint(pkgDir)
+		}
+		readme, err := exploreAndWrite(apiKey, model, systemPrompt, &repoExplorer{root: pkgDir}, task)
+		if err == nil && merge {
+			readme, err = mergeWithExistingReadme(pkgDir, readme)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error generating README for %s: %v\n", pkg, err)
+			failed++
+			continue
+		}
+		file := filepath.Join(outDir, filepath.FromSlash(pkg), "README.md")
+		if err := os.MkdirAll(fsPath(filepath.Dir(file)), 0755); err != nil {
+			return err
+		}
+		if err := writeFileAtomic(file, []byte(strings.TrimSpace(readme)+"\n"), 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %w", file, err)
+		}
+		readmes[pkg] = readme
+		fmt.Printf("README for %s written to %s\n", pkg, file)
+	}
+
+	name := strings.TrimSuffix(path.Base(strings.TrimSuffix(url, "/")), ".git")
+	index := filepath.Join(outDir, "README.md")
+	if err := writeFileAtomic(index, []byte(renderPackageIndex(name, packages, readmes)), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", index, err)
+	}
+	fmt.Printf("Index of %d packages written to %s\n", len(readmes), index)
+	if failed > 0 {
+		return fmt.Errorf("failed to generate the README of %d of %d packages", failed, len(packages))
+	}
+	return nil
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/jackmbuda/go-mdrefactor/mdrefactor"
+)
+
+var mkdocsTopLevelKeyRe = regexp.MustCompile(`^[^\s#-]`)
+
+// navNode is a page or section of a generated navigation tree
+type navNode struct {
+	title    string
+	path     string // Slash-separated path relative to the docs directory, empty for sections
+	children []*navNode
+}
+
+// humanize turns a file or directory name into a title, e.g. getting-started -> Getting started
+func humanize(name string) string {
+	name = strings.TrimSuffix(name, path.Ext(name))
+	name = strings.TrimSpace(strings.NewReplacer("-", " ", "_", " ").Replace(name))
+	if name == "" {
+		return name
+	}
+	runes := []rune(name)
+	runes[0] = unicode.ToUpper(runes[0])
+	return string(runes)
+}
+
+// documentTitle returns the title of a document: its front matter title,
+// its first level-1 heading, or a title derived from its file name
+func documentTitle(content, file string) string {
+	frontMatter, body := mdrefactor.SplitFrontMatter(content)
+	if title := frontMatterValue(frontMatter, "title"); title != "" {
+		return title
+	}
+	for _, h := range parseHeadings(body) {
+		if h.level == 1 && h.text != "" {
+			return h.text
+		}
+	}
+	return humanize(filepath.Base(file))
+}
+
+// isIndexPage reports whether a slash-separated path is the index page of its directory
+func isIndexPage(p string) bool {
+	base := strings.ToLower(strings.TrimSuffix(path.Base(p), path.Ext(p)))
+	return base == "index" || base == "readme"
+}
+
+// buildNavTree arranges pages (slash-separated path -> title) into sections
+// mirroring the directory layout, with index pages first in each section
+func buildNavTree(paths []string, titles map[string]string) *navNode {
+	root := &navNode{}
+	sections := map[string]*navNode{"": root}
+
+	var section func(dir string) *navNode
+	section = func(dir string) *navNode {
+		if dir == "." {
+			dir = ""
+		}
+		if node, ok := sections[dir]; ok {
+			return node
+		}
+		parent := section(path.Dir(dir))
+		node := &navNode{title: humanize(path.Base(dir))}
+		parent.children = append(parent.children, node)
+		sections[dir] = node
+		return node
+	}
+
+	for _, p := range paths {
+		parent := section(path.Dir(p))
+		page := &navNode{title: titles[p], path: p}
+		if isIndexPage(p) {
+			// Index pages lead their section and lend it their title
+			parent.children = append([]*navNode{page}, parent.children...)
+			if parent != root {
+				parent.title = page.title
+			}
+			continue
+		}
+		parent.children = append(parent.children, page)
+	}
+	return root
+}
+
+// yamlString quotes s if it cannot be written as a plain YAML scalar
+func yamlString(s string) string {
+	if s == "" || strings.ContainsAny(s, ":#{}[],&*?|<>=!%@`'\"\\") || strings.HasPrefix(s, "-") {
+		quoted, _ := json.Marshal(s)
+		return string(quoted)
+	}
+	return s
+}
+
+// renderMkDocsNav renders the tree as the value of an mkdocs.yml nav key
+func renderMkDocsNav(root *navNode) string {
+	var b strings.Builder
+	b.WriteString("nav:\n")
+	var walk func(nodes []*navNode, indent string)
+	walk = func(nodes []*navNode, indent string) {
+		for _, n := range nodes {
+			if n.path != "" {
+				fmt.Fprintf(&b, "%s- %s: %s\n", indent, yamlString(n.title), yamlString(n.path))
+				continue
+			}
+			fmt.Fprintf(&b, "%s- %s:\n", indent, yamlString(n.title))
+			walk(n.children, indent+"    ")
+		}
+	}
+	walk(root.children, "  ")
+	return b.String()
+}
+
+// updateMkDocsConfig replaces the nav key of an existing mkdocs.yml, or
+// appends one if the file has none
+func updateMkDocsConfig(existing, nav string) string {
+	lines := strings.Split(existing, "\n")
+	start := -1
+	for i, line := range lines {
+		if strings.HasPrefix(line, "nav:") {
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		if existing != "" && !strings.HasSuffix(existing, "\n") {
+			existing += "\n"
+		}
+		return existing + nav
+	}
+
+	end := start + 1
+	for end < len(lines) && !mkdocsTopLevelKeyRe.MatchString(lines[end]) {
+		end++
+	}
+	// Keep blank lines that separated nav from the next key
+	for end > start+1 && strings.TrimSpace(lines[end-1]) == "" {
+		end--
+	}
+
+	before := strings.Join(lines[:start], "\n")
+	if start > 0 {
+		before += "\n"
+	}
+	return before + nav + strings.Join(lines[end:], "\n")
+}
+
+// renderDocusaurusSidebar renders the tree as a Docusaurus sidebars.js file
+func renderDocusaurusSidebar(root *navNode) string {
+	var b strings.Builder
+	b.WriteString("// Generated by mdrefactor\n")
+	b.WriteString("module.exports = {\n  docs: [\n")
+	var walk func(nodes []*navNode, indent string)
+	walk = func(nodes []*navNode, indent string) {
+		for _, n := range nodes {
+			label, _ := json.Marshal(n.title)
+			if n.path != "" {
+				id, _ := json.Marshal(strings.TrimSuffix(n.path, path.Ext(n.path)))
+				fmt.Fprintf(&b, "%s{type: \"doc\", id: %s, label: %s},\n", indent, id, label)
+				continue
+			}
+			fmt.Fprintf(&b, "%s{\n%s  type: \"category\",\n%s  label: %s,\n%s  items: [\n", indent, indent, indent, label, indent)
+			walk(n.children, indent+"    ")
+			fmt.Fprintf(&b, "%s  ],\n%s},\n", indent, indent)
+		}
+	}
+	walk(root.children, "    ")
+	b.WriteString("  ],\n};\n")
+	return b.String()
+}
+
+// renderSummary renders the tree as a GitBook/mdBook SUMMARY.md file
+func renderSummary(root *navNode) string {
+	var b strings.Builder
+	b.WriteString("# Summary\n\n")
+	var walk func(nodes []*navNode, indent string)
+	walk = func(nodes []*navNode, indent string) {
+		for _, n := range nodes {
+			if n.path != "" {
+				fmt.Fprintf(&b, "%s- [%s](%s)\n", indent, n.title, n.path)
+				continue
+			}
+			// Sections link to their index page when they have one
+			children := n.children
+			link := ""
+			if len(children) > 0 && children[0].path != "" && isIndexPage(children[0].path) {
+				link = children[0].path
+				children = children[1:]
+			}
+			fmt.Fprintf(&b, "%s- [%s](%s)\n", indent, n.title, link)
+			walk(children, indent+"  ")
+		}
+	}
+	walk(root.children, "")
+	return b.String()
+}
+
+// defaultNavFile returns the conventional location of the navigation file for a format
+func defaultNavFile(format, dir string) string {
+	switch format {
+	case "mkdocs":
+		return "mkdocs.yml"
+	case "docusaurus":
+		return "sidebars.js"
+	default:
+		return filepath.Join(dir, "SUMMARY.md")
+	}
+}
+
+// writeNav generates the navigation file for the batch results in the given format
+func writeNav(format, navFile, dir string, results []batchResult) error {
+	if navFile == "" {
+		navFile = defaultNavFile(format, dir)
+	}
+	absNav, _ := filepath.Abs(navFile)
+
+	var paths []string
+	titles := make(map[string]string)
+	for _, r := range results {
+		if abs, _ := filepath.Abs(filepath.Join(dir, r.path)); abs == absNav {
+			// The navigation file is never an entry of itself
+			continue
+		}
+		p := filepath.ToSlash(r.path)
+		paths = append(paths, p)
+		titles[p] = documentTitle(r.finalContent(), r.path)
+	}
+	root := buildNavTree(paths, titles)
+
+	var out string
+	switch format {
+	case "mkdocs":
+		existing, err := os.ReadFile(navFile)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to read %s: %w", navFile, err)
+		}
+		out = updateMkDocsConfig(string(existing), renderMkDocsNav(root))
+	case "docusaurus":
+		out = renderDocusaurusSidebar(root)
+	case "summary":
+		out = renderSummary(root)
+	default:
+		return fmt.Errorf("unknown navigation format %q, expected mkdocs, docusaurus or summary", format)
+	}
+
+	if err := writeFileAtomic(navFile, []byte(out), 0644); err != nil {
+		return fmt.Errorf("failed to write navigation file %s: %w", navFile, err)
+	}
+	fmt.Printf("Navigation written to %s\n", navFile)
+	return nil
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// System prompt used to fill the sections of a new document
+const newDocSystemPrompt = "You are a technical writer starting a new document from a team template. Replace every " +
+	"<!-- fill: ... --> comment with content for that section following its instructions, based on the title and the " +
+	"notes provided. Keep every heading of the template, in the same order and at the same level, and keep the rest of " +
+	"the template as it is; you may add subheadings inside a section. Where a section needs specifics the notes do not " +
+	"give, such as host names, commands, thresholds or contacts, write a TODO placeholder for the author instead of " +
+	"inventing them. Reply with the complete Markdown document only."
+
+// Custom templates of a tree, below its root, one <name>.md file per template
+const docTemplateDir = ".mdrefactor/templates"
+
+// fillMarkerRe matches the comments marking the parts of a template the model writes
+var fillMarkerRe = regexp.MustCompile(`<!--\s*fill:\s*(.*?)\s*-->`)
+
+// docTemplate is a named skeleton for new documents. The body is a Go
+// text/template executed with newDocData; <!-- fill: ... --> comments in it
+// mark the sections the model writes and tell it what they should contain.
+type docTemplate struct {
+	description string
+	body        string
+}
+
+// newDocData is the data a document template is executed with
+type newDocData struct {
+	Title    string // Title of the new document
+	Date     string // Current date as YYYY-MM-DD
+	Template string // Name of the template
+}
+
+// Built-in document templates, by name
+var docTemplates = map[string]docTemplate{
+	"how-to": {
+		description: "Task-oriented guide to reach one goal",
+		body: `# {{.Title}}
+
+<!-- fill: One or two sentences on what the reader achieves and when they need to. -->
+
+## Before you begin
+
+<!-- fill: Prerequisites as a list: access, tools and versions, prior setup. -->
+
+## Steps
+
+<!-- fill: Numbered steps, one action each, with the commands or settings involved in code blocks. -->
+
+## Verify
+
+<!-- fill: How the reader checks that it worked, with the expected output. -->
+
+## Troubleshooting
+
+<!-- fill: Likely problems with their symptoms and fixes. -->
+`,
+	},
+	"postmortem": {
+		description: "Blameless incident review",
+		body: `# {{.Title}}
+
+Date: {{.Date}}
+Status: Draft
+
+## Summary
+
+<!-- fill: What happened, its impact and how it was resolved, in a short paragraph. -->
+
+## Impact
+
+<!-- fill: Who and what was affected, for how long, and by how much. -->
+
+## Timeline
+
+<!-- fill: Time-stamped list of detection, escalation, mitigation and resolution, with TODO times where unknown. -->
+
+## Root cause
+
+<!-- fill: The chain of causes that led to the incident, without blaming people. -->
+
+## What went well
+
+<!-- fill: Practices and tools that limited the impact. -->
+
+## What went wrong
+
+<!-- fill: Gaps in detection, response or tooling. -->
+
+## Action items
+
+| Action | Owner | Due |
+| --- | --- | --- |
+| TODO | TODO | TODO |
+`,
+	},
+	"reference": {
+		description: "Reference page for an API, command or configuration",
+		body: `# {{.Title}}
+
+<!-- fill: One paragraph on what this is and where it is used. -->
+
+## Synopsis
+
+<!-- fill: The signature, command line or minimal configuration in a code block. -->
+
+## Options
+
+<!-- fill: Table of the parameters, flags or fields with their type, default and description. -->
+
+## Examples
+
+<!-- fill: Two or three short examples for common cases, each with a sentence of explanation. -->
+
+## See also
+
+<!-- fill: Related pages as a list of TODO links. -->
+`,
+	},
+	"runbook": {
+		description: "Operational procedure for on-call engineers",
+		body: `# {{.Title}}
+
+Last reviewed: {{.Date}}
+Owner: TODO
+
+## Overview
+
+<!-- fill: What the procedure is for and the outcome it leads to, in two or three sentences. -->
+
+## When to use
+
+<!-- fill: The alerts, symptoms or requests that call for this runbook, as a list. -->
+
+## Prerequisites
+
+<!-- fill: Access, tools and approvals needed before starting, as a checklist. -->
+
+## Procedure
+
+<!-- fill: Numbered steps with the exact commands in code blocks and what to expect after each one. -->
+
+## Verification
+
+<!-- fill: How to confirm the system is healthy afterwards. -->
+
+## Rollback
+
+<!-- fill: How to undo the procedure if it makes things worse. -->
+
+## Escalation
+
+<!-- fill: Who to contact when the procedure does not help, with TODO contacts. -->
+`,
+	},
+	"tutorial": {
+		description: "Learning-oriented walkthrough for newcomers",
+		body: `# {{.Title}}
+
+<!-- fill: What the reader builds or learns and roughly how long it takes. -->
+
+## What you need
+
+<!-- fill: Prerequisites as a list. -->
+
+## Steps
+
+<!-- fill: A sequence of ### subsections, each doing one thing and explaining why, with code blocks. -->
+
+## Next steps
+
+<!-- fill: Where to go from here, as a list of TODO links. -->
+`,
+	},
+}
+
+// loadDocTemplate returns the template called name, looking in the custom
+// templates of the tree containing dir before the built-in ones
+func loadDocTemplate(dir, name string) (docTemplate, error) {
+	path := filepath.Join(treeRoot(dir), filepath.FromSlash(docTemplateDir), name+".md")
+	data, err := os.ReadFile(path)
+	if err == nil {
+		return docTemplate{description: "Custom template " + path, body: decodeSource(data).text}, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return docTemplate{}, fmt.Errorf("failed to read template %s: %w", path, err)
+	}
+	if t, ok := docTemplates[name]; ok {
+		return t, nil
+	}
+	return docTemplate{}, fmt.Errorf("unknown template %q, run mdrefactor new -list for the available ones", name)
+}
+
+// customDocTemplates returns the names of the custom templates of the tree containing dir
+func customDocTemplates(dir string) []string {
+	entries, err := os.ReadDir(filepath.Join(treeRoot(dir), filepath.FromSlash(docTemplateDir)))
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".md") {
+			names = append(names, strings.TrimSuffix(e.Name(), ".md"))
+		}
+	}
+	return names
+}
+
+// renderDocTemplate executes the template for a document titled title
+func renderDocTemplate(name string, t docTemplate, title string) (string, error) {
+	tmpl, err := template.New(name).Parse(t.body)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse template %s: %w", name, err)
+	}
+	var b strings.Builder
+	data := newDocData{Title: title, Date: time.Now().Format("2006-01-02"), Template: name}
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("failed to apply template %s: %w", name, err)
+	}
+	return b.String(), nil
+}
+
+// unfilledGuidance turns the fill markers left in a document into plain
+// comments, so they read as guidance for the author
+func unfilledGuidance(content string) string {
+	return fillMarkerRe.ReplaceAllString(content, "<!-- $1 -->")
+}
+
+// keepsHeadings reports whether the headings of skeleton appear in filled in
+// the same order and at the same level. Headings added in between are fine.
+func keepsHeadings(skeleton, filled string) bool {
+	want := parseHeadings(skeleton)
+	have := parseHeadings(filled)
+	i := 0
+	for _, h := range have {
+		if i < len(want) && h.level == want[i].level && h.text == want[i].text {
+			i++
+		}
+	}
+	return i == len(want)
+}
+
+// fillDocTemplate has the model write the marked sections of skeleton, using
+// notes as the facts to build on. If the reply drops headings of the
+// template, the skeleton is returned with a warning.
+func fillDocTemplate(apiKey, model, name, title, skeleton, notes string) (string, error) {
+	if !fillMarkerRe.MatchString(skeleton) {
+		return skeleton, nil
+	}
+	if notes == "" {
+		notes = "None, leave TODO placeholders for every specific."
+	}
+	reply, err := chatCompletion(apiKey, model, []Message{
+		{Role: "system", Content: newDocSystemPrompt},
+		{Role: "user", Content: fmt.Sprintf("Template: %s\nTitle: %s\n\nNotes:\n\n%s\n\nTemplate to fill:\n\n%s", name, title, notes, skeleton)},
+	})
+	if err != nil {
+		return "", err
+	}
+	filled := strings.TrimSpace(reply) + "\n"
+	if !keepsHeadings(skeleton, filled) {
+		fmt.Fprintf(os.Stderr, "Warning: the filled document does not keep the headings of the %s template, writing the empty skeleton instead\n", name)
+		return skeleton, nil
+	}
+	return filled, nil
+}
+
+// runNewCommand implements the new subcommand
+func runNewCommand(args []string) error {
+	fs := flag.NewFlagSet("new", flag.ExitOnError)
+	apiKey := fs.String("apikey", os.Getenv("OPENAI_API_KEY"), "OpenAI API key (can also be set via OPENAI_API_KEY environment variable)")
+	addAPIFlags(fs)
+	model := fs.String("model", defaultModel, "OpenAI model to use")
+	dir := fs.String("dir", ".", "Directory to create the document in")
+	output := fs.String("o", "", "Path of the new document (default: <dir>/<kebab-case title>.md)")
+	contextFiles := fs.String("context", "", "Comma-separated files with notes the sections are written from, e.g. an incident ticket or design notes")
+	noFill := fs.Bool("no-fill", false, "Only write the skeleton of the template, without API calls")
+	list := fs.Bool("list", false, "List the available templates")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: mdrefactor new [flags] <template> <title>")
+		fmt.Fprintln(fs.Output(), "Creates a document from a named template, with its sections drafted by the model.")
+		fmt.Fprintf(fs.Output(), "Custom templates are read from %s/<name>.md at the root of the tree.\n", docTemplateDir)
+		fs.PrintDefaults()
+	}
+	positional := parseArgs(fs, args)
+
+	if *list {
+		for _, name := range sortedKeys(docTemplates) {
+			fmt.Printf("%-12s %s\n", name, docTemplates[name].description)
+		}
+		for _, name := range customDocTemplates(*dir) {
+			fmt.Printf("%-12s custom\n", name)
+		}
+		return nil
+	}
+	if len(positional) < 2 {
+		fs.Usage()
+		return fmt.Errorf("a template and a title are required")
+	}
+	name := positional[0]
+	title := strings.TrimSpace(strings.Join(positional[1:], " "))
+
+	t, err := loadDocTemplate(*dir, name)
+	if err != nil {
+		return err
+	}
+	path := *output
+	if path == "" {
+		stem := safeFileStem(kebabCase(title))
+		if stem == "" {
+			return fmt.Errorf("cannot derive a file name from %q, use -o", title)
+		}
+		path = filepath.Join(*dir, stem+".md")
+	}
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%s already exists", path)
+	}
+
+	content, err := renderDocTemplate(name, t, title)
+	if err != nil {
+		return err
+	}
+	if !*noFill {
+		var notes []string
+		if *contextFiles != "" {
+			for _, f := range strings.Split(*contextFiles, ",") {
+				data, err := os.ReadFile(strings.TrimSpace(f))
+				if err != nil {
+					return fmt.Errorf("failed to read context: %w", err)
+				}
+				notes = append(notes, strings.TrimSpace(decodeSource(data).text))
+			}
+		}
+		fmt.Fprintf(os.Stderr, "Drafting the sections of the %s template...\n", name)
+		if content, err = fillDocTemplate(*apiKey, *model, name, title, content, strings.Join(notes, "\n\n")); err != nil {
+			return err
+		}
+	}
+	content = unfilledGuidance(content)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, []byte(content), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	fmt.Println(path)
+	return nil
+}
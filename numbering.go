@@ -0,0 +1,239 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/jackmbuda/go-mdrefactor/mdrefactor"
+)
+
+const (
+	// Section numbers are added to headings, replacing any they have
+	numberingInsert = "insert"
+	// Section numbers are removed from headings
+	numberingStrip = "strip"
+)
+
+var (
+	// A section number leading heading text: 1. or 1.2 or 1.2.3.
+	sectionNumberRe = regexp.MustCompile(`^(?:\d+\.(?:\d+\.?)*)\s+`)
+	// The marker of an ATX heading line, with its indentation
+	atxMarkerRe = regexp.MustCompile(`^ {0,3}#{1,6}[ \t]+`)
+)
+
+// parseNumbering validates the value of -number-headings
+func parseNumbering(s string) (string, error) {
+	switch s {
+	case "", numberingInsert, numberingStrip:
+		return s, nil
+	}
+	return "", fmt.Errorf("invalid heading numbering %q, expected insert or strip", s)
+}
+
+// stripSectionNumber returns heading text without its section number
+func stripSectionNumber(text string) string {
+	return sectionNumberRe.ReplaceAllString(text, "")
+}
+
+// sectionNumbers returns the hierarchical number of every heading, 1. for
+// the first section and 1.1 for its first subsection. Like generateTOC,
+// level 1 headings are titles and get none.
+func sectionNumbers(headings []heading) []string {
+	base := 0
+	for _, h := range headings {
+		if h.level > 1 && (base == 0 || h.level < base) {
+			base = h.level
+		}
+	}
+	numbers := make([]string, len(headings))
+	var counters [7]int
+	for i, h := range headings {
+		if h.level == 1 {
+			continue
+		}
+		counters[h.level]++
+		for l := h.level + 1; l < len(counters); l++ {
+			counters[l] = 0
+		}
+		parts := make([]string, 0, h.level-base+1)
+		for l := base; l <= h.level; l++ {
+			parts = append(parts, strconv.Itoa(counters[l]))
+		}
+		numbers[i] = strings.Join(parts, ".")
+		if len(parts) == 1 {
+			numbers[i] += "."
+		}
+	}
+	return numbers
+}
+
+// numberHeadings inserts section numbers into the headings of content, or
+// removes them with mode strip. Links within the document, such as a TOC,
+// follow the changed anchors, and TOC entries take the new heading text. It
+// returns the new content and an old -> new map of the changed anchors.
+func numberHeadings(content, mode string) (string, map[string]string) {
+	frontMatter, body := mdrefactor.SplitFrontMatter(content)
+	headings := parseHeadings(body)
+	numbers := sectionNumbers(headings)
+	oldAnchors := headingAnchors(headings)
+
+	lines := strings.Split(body, "\n")
+	renumbered := make([]heading, len(headings))
+	// From the end, so removing setext underlines keeps earlier lines in place
+	for i := len(headings) - 1; i >= 0; i-- {
+		h := headings[i]
+		renumbered[i] = h
+		renumbered[i].text = stripSectionNumber(h.text)
+		if mode == numberingInsert && numbers[i] != "" {
+			renumbered[i].text = numbers[i] + " " + renumbered[i].text
+		}
+		if renumbered[i].text == h.text {
+			continue
+		}
+		marker := atxMarkerRe.FindString(lines[h.line])
+		if marker == "" {
+			// A numbered setext heading would read as a list item, so it
+			// becomes an ATX heading
+			lines[h.line] = strings.Repeat("#", h.level) + " " + renumbered[i].text
+			lines = append(lines[:h.line+1], lines[h.endLine+1:]...)
+			continue
+		}
+		// The number leads the heading text, the rest of the line stays as written
+		rest := stripSectionNumber(lines[h.line][len(marker):])
+		if mode == numberingInsert && numbers[i] != "" {
+			rest = numbers[i] + " " + rest
+		}
+		lines[h.line] = marker + rest
+	}
+	newAnchors := headingAnchors(renumbered)
+
+	changes := make(map[string]string)
+	for i := range headings {
+		if oldAnchors[i] != newAnchors[i] {
+			changes[oldAnchors[i]] = newAnchors[i]
+		}
+	}
+	body = strings.Join(lines, "\n")
+	if len(changes) == 0 {
+		return frontMatter + body, changes
+	}
+
+	body = rewriteLinks(body, func(target string, image bool) string {
+		if to, ok := changes[strings.TrimPrefix(target, "#")]; ok && strings.HasPrefix(target, "#") && !image {
+			return "#" + to
+		}
+		return target
+	})
+	// TOC entries repeat the heading text as generateTOC writes it, keep them in step
+	for i, h := range headings {
+		if renumbered[i].text != h.text {
+			old := "[" + linkRe.ReplaceAllString(h.text, "$1") + "](#" + newAnchors[i] + ")"
+			body = strings.ReplaceAll(body, old, "["+linkRe.ReplaceAllString(renumbered[i].text, "$1")+"](#"+newAnchors[i]+")")
+		}
+	}
+	return frontMatter + body, changes
+}
+
+// withHeadingNumbers wraps refactor so that the output's headings are
+// numbered, or not, by mode. Numbers are removed before the model sees the
+// content, so it cannot renumber sections itself, and set afterwards.
+func withHeadingNumbers(mode string, refactor refactorFunc) refactorFunc {
+	return func(systemPrompt, content string) (string, error) {
+		content, _ = numberHeadings(content, numberingStrip)
+		refactored, err := refactor(systemPrompt+"\n\nDo not number headings; section numbers are managed separately.", content)
+		if err != nil {
+			return "", err
+		}
+		refactored, _ = numberHeadings(refactored, mode)
+		return refactored, nil
+	}
+}
+
+// runNumberHeadingsCommand implements the number-headings subcommand
+func runNumberHeadingsCommand(args []string) error {
+	fs := flag.NewFlagSet("number-headings", flag.ExitOnError)
+	strip := fs.Bool("strip", false, "Remove section numbers instead of inserting them")
+	dryRun := fs.Bool("dry-run", false, "Only list the anchors that would change")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: mdrefactor number-headings [flags] <file-or-docs-dir>")
+		fmt.Fprintln(fs.Output(), "Numbers the sections of documents (1., 1.1, 1.1.1) and updates the links to their anchors across the tree.")
+		fs.PrintDefaults()
+	}
+	positional := parseArgs(fs, args)
+	if len(positional) != 1 {
+		fs.Usage()
+		return fmt.Errorf("a file or docs directory is required")
+	}
+	mode := numberingInsert
+	if *strip {
+		mode = numberingStrip
+	}
+
+	root, files := positional[0], []string{}
+	if info, err := os.Stat(fsPath(root)); err == nil && info.IsDir() {
+		found, err := findMarkdownFiles(root)
+		if err != nil {
+			return err
+		}
+		for _, f := range found {
+			files = append(files, filepath.ToSlash(f))
+		}
+	} else {
+		root, files = filepath.Dir(root), []string{filepath.Base(root)}
+	}
+
+	contents := make(map[string]string)
+	sources := make(map[string]sourceFile)
+	changes := make(map[string]map[string]string)
+	for _, file := range files {
+		data, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(file)))
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", file, err)
+		}
+		sources[file] = decodeSource(data)
+		numbered, anchors := numberHeadings(sources[file].text, mode)
+		contents[file] = numbered
+		if len(anchors) > 0 {
+			changes[file] = anchors
+		}
+		for _, old := range sortedKeys(anchors) {
+			fmt.Printf("%s: #%s -> #%s\n", file, old, anchors[old])
+		}
+	}
+
+	// Links between documents follow the changed anchors too
+	exists := func(p string) bool { _, ok := contents[p]; return ok }
+	written := 0
+	for _, file := range files {
+		updated := rewriteLinks(contents[file], func(target string, image bool) string {
+			if image || strings.HasPrefix(target, "#") {
+				return target
+			}
+			to, anchor, ok := resolveDocLink(file, target, exists)
+			if !ok || changes[to][anchor] == "" {
+				return target
+			}
+			return strings.TrimSuffix(target, anchor) + changes[to][anchor]
+		})
+		if updated == sources[file].text || *dryRun {
+			continue
+		}
+		out, err := sources[file].encode(updated, outputPolicy{eol: "preserve", encoding: "preserve"})
+		if err != nil {
+			return fmt.Errorf("failed to encode %s: %w", file, err)
+		}
+		if err := writeFileAtomic(filepath.Join(root, filepath.FromSlash(file)), out, 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %w", file, err)
+		}
+		written++
+	}
+	if !*dryRun {
+		fmt.Printf("Updated %d of %d documents.\n", written, len(files))
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path"
+
+	"github.com/jackmbuda/go-mdrefactor/mdrefactor"
+)
+
+// orphanReport lists pages nothing links to and headings no link references
+type orphanReport struct {
+	pages    []string
+	sections map[string][]string // Unreferenced heading anchors by document
+}
+
+// findOrphans analyzes the link graph for orphan pages and dead sections.
+// Headings above minLevel (e.g. the page title) are not reported.
+func findOrphans(g *linkGraph, minLevel int) orphanReport {
+	report := orphanReport{sections: make(map[string][]string)}
+	for _, file := range g.files {
+		// The root index page is the entry point of the tree, not an orphan
+		if len(g.inbound[file]) == 0 && !(isIndexPage(file) && path.Dir(file) == ".") {
+			report.pages = append(report.pages, file)
+		}
+
+		_, body := mdrefactor.SplitFrontMatter(g.contents[file])
+		headings := parseHeadings(body)
+		for i, anchor := range headingAnchors(headings) {
+			if headings[i].level < minLevel || g.anchors[file][anchor] {
+				continue
+			}
+			report.sections[file] = append(report.sections[file], anchor)
+		}
+	}
+	return report
+}
+
+// runOrphansCommand implements the orphans subcommand
+func runOrphansCommand(args []string) error {
+	fs := flag.NewFlagSet("orphans", flag.ExitOnError)
+	minLevel := fs.Int("min-level", 2, "Only report unreferenced headings of this level or deeper")
+	pagesOnly := fs.Bool("pages-only", false, "Only report orphan pages, not unreferenced headings")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: mdrefactor orphans [flags] <docs-dir>")
+		fs.PrintDefaults()
+	}
+	positional := parseArgs(fs, args)
+	if len(positional) != 1 {
+		fs.Usage()
+		return fmt.Errorf("a docs directory is required")
+	}
+
+	g, err := buildLinkGraph(positional[0])
+	if err != nil {
+		return err
+	}
+	report := findOrphans(g, *minLevel)
+
+	fmt.Printf("Orphan pages (%d):\n", len(report.pages))
+	for _, p := range report.pages {
+		fmt.Printf("  %s\n", p)
+	}
+
+	if !*pagesOnly {
+		total := 0
+		for _, anchors := range report.sections {
+			total += len(anchors)
+		}
+		fmt.Printf("\nUnreferenced headings (%d):\n", total)
+		for _, file := range g.files {
+			for _, anchor := range report.sections[file] {
+				fmt.Printf("  %s#%s\n", file, anchor)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Placeholder of an output pattern, such as {{name}}
+var patternPlaceholderRe = regexp.MustCompile(`\{\{\s*(\w*)\s*\}\}`)
+
+// outputPattern names the output file of an input file, such as
+// "{{dir}}/{{name}}.refactored{{ext}}" for docs/intro.md ->
+// docs/intro.refactored.md
+type outputPattern string
+
+// parseOutputPattern checks that s only uses the known placeholders
+func parseOutputPattern(s string) (outputPattern, error) {
+	for _, m := range patternPlaceholderRe.FindAllStringSubmatch(s, -1) {
+		switch m[1] {
+		case "dir", "name", "ext":
+		default:
+			return "", fmt.Errorf("unknown placeholder %s in output pattern, expected {{dir}}, {{name}} or {{ext}}", m[0])
+		}
+	}
+	return outputPattern(s), nil
+}
+
+// path returns the output path of input: {{dir}} is its directory, {{name}}
+// its file name without extension and {{ext}} the extension with its dot
+func (p outputPattern) path(input string) string {
+	ext := filepath.Ext(input)
+	out := patternPlaceholderRe.ReplaceAllStringFunc(string(p), func(placeholder string) string {
+		switch patternPlaceholderRe.FindStringSubmatch(placeholder)[1] {
+		case "dir":
+			return filepath.Dir(input)
+		case "name":
+			return strings.TrimSuffix(filepath.Base(input), ext)
+		default:
+			return ext
+		}
+	})
+	return filepath.Clean(filepath.FromSlash(out))
+}
+
+// outputTargets returns the output path of every file below dir, refusing
+// patterns that give two files the same output or overwrite another input
+func (p outputPattern) outputTargets(dir string, files []string) (map[string]string, error) {
+	targets := make(map[string]string, len(files))
+	inputs := make(map[string]string, len(files))
+	for _, rel := range files {
+		inputs[filepath.Clean(filepath.Join(dir, rel))] = rel
+	}
+	owners := make(map[string]string, len(files))
+	for _, rel := range files {
+		target := p.path(filepath.Join(dir, rel))
+		if other, ok := owners[target]; ok {
+			return nil, fmt.Errorf("output pattern writes both %s and %s to %s", other, rel, target)
+		}
+		if input, ok := inputs[target]; ok && input != rel {
+			return nil, fmt.Errorf("output pattern writes %s over the input %s", rel, input)
+		}
+		owners[target] = rel
+		targets[rel] = target
+	}
+	return targets, nil
+}
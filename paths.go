@@ -0,0 +1,49 @@
+package main
+
+import (
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+var (
+	// Windows paths with a drive letter, such as C:\docs or C:/docs
+	drivePathRe = regexp.MustCompile(`^[A-Za-z]:[\\/]`)
+	// File names Windows reserves for devices, with or without an extension
+	reservedNameRe = regexp.MustCompile(`(?i)^(?:con|prn|aux|nul|com[0-9]|lpt[0-9])$`)
+)
+
+// fsPath returns the form of p to hand to the file system. Windows only
+// accepts paths beyond MAX_PATH (260 characters) in absolute form, which Go
+// then extends with the \\?\ prefix, so relative paths are made absolute
+// there. Elsewhere p is returned unchanged.
+func fsPath(p string) string {
+	if runtime.GOOS != "windows" {
+		return p
+	}
+	if abs, err := filepath.Abs(p); err == nil {
+		return abs
+	}
+	return p
+}
+
+// isDrivePath reports whether a link target is a Windows path with a drive letter
+func isDrivePath(target string) bool {
+	return drivePathRe.MatchString(target)
+}
+
+// slashLinkPath returns the path of a link target with the backslashes of
+// Windows-authored links turned into the slashes URLs use
+func slashLinkPath(p string) string {
+	return strings.ReplaceAll(p, `\`, "/")
+}
+
+// safeFileStem returns stem, or stem with a suffix if Windows reserves it
+// as a device name, since files named e.g. con.md cannot be created there
+func safeFileStem(stem string) string {
+	if reservedNameRe.MatchString(stem) {
+		return stem + "-page"
+	}
+	return stem
+}
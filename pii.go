@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/jackmbuda/go-mdrefactor/mdrefactor"
+)
+
+// scrubPII replaces personal data in every request with placeholders that
+// are restored in the replies, set by -scrub-pii
+var scrubPII bool
+
+// Kinds of personal data that are scrubbed, in the order they are matched
+var piiPatterns = []struct {
+	kind string
+	re   *regexp.Regexp
+}{
+	{"EMAIL", regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)},
+	{"CARD", regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`)},
+	{"SSN", regexp.MustCompile(`\b\d{3}-\d{2}-\d{4}\b`)},
+	{"PHONE", regexp.MustCompile(`(?:\+\d{1,3}[ .-]?(?:\(\d{1,4}\)|\d{1,4})|\(\d{3}\))(?:[ .-]?\d{2,4}){2,4}\b`)},
+	{"IP", regexp.MustCompile(`\b(?:(?:25[0-5]|2[0-4]\d|1?\d?\d)\.){3}(?:25[0-5]|2[0-4]\d|1?\d?\d)\b`)},
+}
+
+// Placeholders standing in for scrubbed values
+var piiPlaceholderRe = regexp.MustCompile(`\[PII_[A-Z]+_\d+\]`)
+
+// luhnValid reports whether the digits of s pass the Luhn checksum of card numbers
+func luhnValid(s string) bool {
+	sum, double := 0, false
+	for i := len(s) - 1; i >= 0; i-- {
+		if s[i] < '0' || s[i] > '9' {
+			continue
+		}
+		d := int(s[i] - '0')
+		if double {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// piiScrubber replaces personal data with numbered placeholders, the same
+// value always with the same placeholder, and puts the values back
+type piiScrubber struct {
+	values map[string]string // Placeholder -> value
+	tokens map[string]string // Value -> placeholder
+	counts map[string]int    // Placeholders per kind
+}
+
+// newPIIScrubber returns an empty piiScrubber
+func newPIIScrubber() *piiScrubber {
+	return &piiScrubber{values: make(map[string]string), tokens: make(map[string]string), counts: make(map[string]int)}
+}
+
+// scrub returns text with its personal data replaced by placeholders
+func (s *piiScrubber) scrub(text string) string {
+	for _, p := range piiPatterns {
+		text = p.re.ReplaceAllStringFunc(text, func(value string) string {
+			if p.kind == "CARD" && !luhnValid(value) {
+				return value
+			}
+			if token, ok := s.tokens[value]; ok {
+				return token
+			}
+			s.counts[p.kind]++
+			token := fmt.Sprintf("[PII_%s_%d]", p.kind, s.counts[p.kind])
+			s.tokens[value], s.values[token] = token, value
+			return token
+		})
+	}
+	return text
+}
+
+// restore returns text with the placeholders replaced by their values
+func (s *piiScrubber) restore(text string) string {
+	return piiPlaceholderRe.ReplaceAllStringFunc(text, func(token string) string {
+		if value, ok := s.values[token]; ok {
+			return value
+		}
+		return token
+	})
+}
+
+// scrubMessages returns copies of messages with their personal data scrubbed
+func (s *piiScrubber) scrubMessages(messages []Message) []Message {
+	scrubbed := make([]Message, len(messages))
+	for i, m := range messages {
+		m.Content = s.scrub(m.Content)
+		scrubbed[i] = m
+	}
+	return scrubbed
+}
+
+// restoreStream returns a function passing the chunks of a streamed reply on
+// to fn with placeholders restored, and a function flushing what is left.
+// Text from a "[" that may begin a placeholder is held back until it is complete.
+func (s *piiScrubber) restoreStream(fn func(chunk string) error) (func(chunk string) error, func() error) {
+	var pending string
+	write := func(chunk string) error {
+		pending += chunk
+		keep := strings.LastIndex(pending, "[")
+		if keep < 0 || strings.Contains(pending[keep:], "]") || len(pending)-keep > len("[PII_EMAIL_]")+10 {
+			keep = len(pending)
+		}
+		out := s.restore(pending[:keep])
+		pending = pending[keep:]
+		if out == "" {
+			return nil
+		}
+		return fn(out)
+	}
+	flush := func() error {
+		out := s.restore(pending)
+		pending = ""
+		if out == "" {
+			return nil
+		}
+		return fn(out)
+	}
+	return write, flush
+}
+
+// piiInterceptor scrubs the personal data of chat completion requests with
+// -scrub-pii and restores it in the replies, streamed or not
+func piiInterceptor(next mdrefactor.Completer) mdrefactor.Completer {
+	return mdrefactor.CompleterFunc(func(ctx context.Context, req *mdrefactor.CompletionRequest) (*mdrefactor.Completion, error) {
+		if !scrubPII {
+			return next.Complete(ctx, req)
+		}
+		scrubber := newPIIScrubber()
+		scrubbed := *req
+		scrubbed.Messages = scrubber.scrubMessages(req.Messages)
+		flush := func() error { return nil }
+		if req.OnChunk != nil {
+			scrubbed.OnChunk, flush = scrubber.restoreStream(req.OnChunk)
+		}
+		completion, err := next.Complete(ctx, &scrubbed)
+		if err != nil {
+			return nil, err
+		}
+		if err := flush(); err != nil {
+			return nil, err
+		}
+		msg := &completion.Message
+		msg.Content = scrubber.restore(msg.Content)
+		for j := range msg.ToolCalls {
+			msg.ToolCalls[j].Function.Arguments = scrubber.restore(msg.ToolCalls[j].Function.Arguments)
+		}
+		return completion, nil
+	})
+}
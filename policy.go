@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/jackmbuda/go-mdrefactor/mdrefactor"
+)
+
+// Provider of the chat API, and the default embeddings provider
+const openaiProvider = "openai"
+
+// ErrPolicy marks runs refused because they violate the organization policy
+var ErrPolicy = errors.New("refused by organization policy")
+
+// Data-handling options a policy can require or forbid, with the flag setting each
+var policyOptions = map[string]struct {
+	flag    string
+	enabled func() bool
+}{
+	"scrub_pii": {"-scrub-pii", func() bool { return scrubPII }},
+	"debug_http": {"-debug-http", func() bool {
+		_, ok := httpClient.Transport.(*debugTransport)
+		return ok
+	}},
+}
+
+// orgPolicy restricts the providers, models and data-handling options that
+// users of an organization may use
+type orgPolicy struct {
+	Providers []string          `json:"providers,omitempty"` // Allowed providers, all if empty
+	Models    []string          `json:"models,omitempty"`    // Allowed models as glob patterns such as gpt-4o*, all if empty
+	Options   map[string]string `json:"options,omitempty"`   // Data-handling option -> required, forbidden or allowed
+
+	path string
+}
+
+// Policy loaded at startup, nil if the organization has none
+var activePolicy *orgPolicy
+
+// policyDir returns the administrator-owned directory of the central policy
+func policyDir() string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("ProgramData"), "mdrefactor")
+	}
+	return "/etc/mdrefactor"
+}
+
+// policyPath returns the policy file to enforce: the central one if it
+// exists, else the one named by MDREFACTOR_POLICY, e.g. on a network share
+func policyPath() string {
+	central := filepath.Join(policyDir(), "policy.json")
+	if _, err := os.Stat(central); err == nil {
+		return central
+	}
+	return os.Getenv("MDREFACTOR_POLICY")
+}
+
+// loadPolicy reads and verifies the organization policy, if there is one.
+// When the central directory holds a public key (policy.pub), the policy
+// must come with a valid signature in <policy>.sig.
+func loadPolicy() error {
+	file := policyPath()
+	if file == "" {
+		return nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("failed to read policy file %s: %w", file, err)
+	}
+	if key, err := os.ReadFile(filepath.Join(policyDir(), "policy.pub")); err == nil {
+		if err := verifyPolicy(file, data, key); err != nil {
+			return err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read policy key: %w", err)
+	}
+
+	p := &orgPolicy{path: file}
+	if err := json.Unmarshal(data, p); err != nil {
+		return fmt.Errorf("failed to parse policy file %s: %w", file, err)
+	}
+	for name, rule := range p.Options {
+		if _, ok := policyOptions[name]; !ok {
+			return fmt.Errorf("policy file %s: unknown option %q, expected one of %s", file, name, strings.Join(sortedKeys(policyOptions), ", "))
+		}
+		switch rule {
+		case "required", "forbidden", "allowed":
+		default:
+			return fmt.Errorf("policy file %s: invalid rule %q for %s, expected required, forbidden or allowed", file, rule, name)
+		}
+	}
+	activePolicy = p
+	return nil
+}
+
+// verifyPolicy checks the detached signature of a policy file against a
+// base64 ed25519 public key
+func verifyPolicy(file string, data, key []byte) error {
+	publicKey, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(key)))
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid policy key in %s, expected a base64 ed25519 public key", policyDir())
+	}
+	sig, err := os.ReadFile(file + ".sig")
+	if err != nil {
+		return fmt.Errorf("%w: policy file %s is not signed: %v", ErrPolicy, file, err)
+	}
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+	if err != nil || !ed25519.Verify(publicKey, data, signature) {
+		return fmt.Errorf("%w: the signature of policy file %s is invalid", ErrPolicy, file)
+	}
+	return nil
+}
+
+// policyInterceptor refuses chat completion requests for models the policy
+// does not allow
+func policyInterceptor(next mdrefactor.Completer) mdrefactor.Completer {
+	return mdrefactor.CompleterFunc(func(ctx context.Context, req *mdrefactor.CompletionRequest) (*mdrefactor.Completion, error) {
+		if err := activePolicy.check(openaiProvider, req.Model); err != nil {
+			return nil, err
+		}
+		return next.Complete(ctx, req)
+	})
+}
+
+// check returns an error wrapping ErrPolicy if a request to model at
+// provider, with the current data-handling options, violates the policy
+func (p *orgPolicy) check(provider, model string) error {
+	if p == nil {
+		return nil
+	}
+	if len(p.Providers) > 0 && !containsFold(p.Providers, provider) {
+		return fmt.Errorf("%w %s: provider %s is not allowed (allowed: %s)", ErrPolicy, p.path, provider, strings.Join(p.Providers, ", "))
+	}
+	if len(p.Models) > 0 {
+		allowed := false
+		for _, pattern := range p.Models {
+			if ok, _ := path.Match(pattern, model); ok {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("%w %s: model %s is not allowed (allowed: %s)", ErrPolicy, p.path, model, strings.Join(p.Models, ", "))
+		}
+	}
+	for _, name := range sortedKeys(p.Options) {
+		option := policyOptions[name]
+		switch enabled := option.enabled(); {
+		case p.Options[name] == "required" && !enabled:
+			return fmt.Errorf("%w %s: %s is required, run with %s", ErrPolicy, p.path, name, option.flag)
+		case p.Options[name] == "forbidden" && enabled:
+			return fmt.Errorf("%w %s: %s is forbidden, run without %s", ErrPolicy, p.path, name, option.flag)
+		}
+	}
+	return nil
+}
+
+// containsFold reports whether list contains s, ignoring case
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// runPolicyCommand implements the policy subcommand
+func runPolicyCommand(args []string) error {
+	fs := flag.NewFlagSet("policy", flag.ExitOnError)
+	keyFile := fs.String("key", "policy.key", "With keygen, the private key file to create; with sign, the private key to sign with")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: mdrefactor policy show")
+		fmt.Fprintln(fs.Output(), "       mdrefactor policy keygen [-key policy.key]")
+		fmt.Fprintln(fs.Output(), "       mdrefactor policy sign [-key policy.key] <policy.json>")
+		fmt.Fprintln(fs.Output(), "Shows the organization policy in effect, or creates a signing key pair and signs policy files for administrators.")
+		fs.PrintDefaults()
+	}
+	positional := parseArgs(fs, args)
+	if len(positional) == 0 {
+		fs.Usage()
+		return fmt.Errorf("a policy command is required")
+	}
+
+	switch positional[0] {
+	case "show":
+		if activePolicy == nil {
+			fmt.Println("No organization policy in effect")
+			return nil
+		}
+		data, err := json.MarshalIndent(activePolicy, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Policy %s:\n%s\n", activePolicy.path, data)
+		return nil
+	case "keygen":
+		publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(*keyFile, []byte(base64.StdEncoding.EncodeToString(privateKey)+"\n"), 0600); err != nil {
+			return fmt.Errorf("failed to write %s: %w", *keyFile, err)
+		}
+		pub := strings.TrimSuffix(*keyFile, filepath.Ext(*keyFile)) + ".pub"
+		if err := writeFileAtomic(pub, []byte(base64.StdEncoding.EncodeToString(publicKey)+"\n"), 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %w", pub, err)
+		}
+		fmt.Printf("Private key written to %s, keep it secret\nPublic key written to %s, install it as %s\n", *keyFile, pub, filepath.Join(policyDir(), "policy.pub"))
+		return nil
+	case "sign":
+		if len(positional) != 2 {
+			fs.Usage()
+			return fmt.Errorf("a policy file is required")
+		}
+		file := positional[1]
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &orgPolicy{}); err != nil {
+			return fmt.Errorf("failed to parse policy file %s: %w", file, err)
+		}
+		key, err := os.ReadFile(*keyFile)
+		if err != nil {
+			return err
+		}
+		privateKey, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(key)))
+		if err != nil || len(privateKey) != ed25519.PrivateKeySize {
+			return fmt.Errorf("invalid private key in %s", *keyFile)
+		}
+		signature := ed25519.Sign(ed25519.PrivateKey(privateKey), data)
+		if err := writeFileAtomic(file+".sig", []byte(base64.StdEncoding.EncodeToString(signature)+"\n"), 0644); err != nil {
+			return fmt.Errorf("failed to write %s.sig: %w", file, err)
+		}
+		fmt.Printf("Signature written to %s.sig\n", file)
+		return nil
+	}
+	fs.Usage()
+	return fmt.Errorf("unknown policy command %q", positional[0])
+}
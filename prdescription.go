@@ -0,0 +1,144 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// System prompt used to rewrite pull request descriptions
+const prDescriptionSystemPrompt = "You are a senior engineer editing a pull request description for its reviewers. " +
+	"Rewrite it into exactly these Markdown sections: ## Summary (what the change does and why, in two or three " +
+	"sentences), ## Changes (a bullet list grouped by area, based on the changed files), ## Testing (how the change " +
+	"was verified; write \"Not described.\" if the description does not say) and ## Risks (what could break and what " +
+	"reviewers should check). Keep issue references, links and checklists of the original. Do not invent facts " +
+	"that neither the description nor the changed files support. Reply with the Markdown description only."
+
+// Maximum number of changed files listed in the prompt
+const maxPRFiles = 300
+
+// pullRequest is the part of a GitHub pull request the rewrite needs
+type pullRequest struct {
+	Number       int    `json:"number"`
+	Title        string `json:"title"`
+	Body         string `json:"body"`
+	Additions    int    `json:"additions"`
+	Deletions    int    `json:"deletions"`
+	ChangedFiles int    `json:"changed_files"`
+}
+
+// pullFile is a file changed by a pull request
+type pullFile struct {
+	Filename  string `json:"filename"`
+	Status    string `json:"status"`
+	Additions int    `json:"additions"`
+	Deletions int    `json:"deletions"`
+}
+
+// pullDiffstat returns the changed files of a pull request as a diffstat
+func pullDiffstat(gh *githubClient, pr pullRequest) (string, error) {
+	var b strings.Builder
+	listed := 0
+	for page := 1; listed < maxPRFiles; page++ {
+		var files []pullFile
+		if err := gh.do("GET", fmt.Sprintf("/pulls/%d/files?per_page=%d&page=%d", pr.Number, githubPageSize, page), nil, &files); err != nil {
+			return "", err
+		}
+		for _, f := range files {
+			if listed == maxPRFiles {
+				break
+			}
+			fmt.Fprintf(&b, "%s | +%d -%d (%s)\n", f.Filename, f.Additions, f.Deletions, f.Status)
+			listed++
+		}
+		if len(files) < githubPageSize {
+			break
+		}
+	}
+	if pr.ChangedFiles > listed {
+		fmt.Fprintf(&b, "[%d more files not listed]\n", pr.ChangedFiles-listed)
+	}
+	fmt.Fprintf(&b, "%d files changed, %d insertions(+), %d deletions(-)\n", pr.ChangedFiles, pr.Additions, pr.Deletions)
+	return b.String(), nil
+}
+
+// rewritePRDescription asks the model for a structured description of the
+// pull request, explaining documentation changes with the change notes of
+// the run that made them, if any
+func rewritePRDescription(apiKey, model string, pr pullRequest, diffstat, changeNotes string) (string, error) {
+	body := strings.TrimSpace(pr.Body)
+	if body == "" {
+		body = "(empty)"
+	}
+	prompt := fmt.Sprintf("Pull request #%d: %s\n\nCurrent description:\n\n%s\n\nChanged files:\n\n%s", pr.Number, pr.Title, body, diffstat)
+	if changeNotes != "" {
+		prompt += "\nNotes on why the documents were changed, to explain them in the Changes section:\n\n" + changeNotes
+	}
+	return chatCompletion(apiKey, model, []Message{
+		{Role: "system", Content: prDescriptionSystemPrompt},
+		{Role: "user", Content: prompt},
+	})
+}
+
+// runPRDescriptionCommand implements the pr-description subcommand
+func runPRDescriptionCommand(args []string) error {
+	fs := flag.NewFlagSet("pr-description", flag.ExitOnError)
+	apiKey := fs.String("apikey", os.Getenv("OPENAI_API_KEY"), "OpenAI API key (can also be set via OPENAI_API_KEY environment variable)")
+	addAPIFlags(fs)
+	model := fs.String("model", defaultModel, "OpenAI model to use")
+	repo := fs.String("repo", "", "GitHub repository as owner/name or URL, the origin remote of the current directory by default")
+	token := fs.String("github-token", "", "GitHub token, GITHUB_TOKEN or GH_TOKEN by default")
+	update := fs.Bool("update", false, "Replace the description of the pull request on GitHub instead of printing it")
+	changeNotesFile := fs.String("change-notes", defaultChangeNotesFile, "Change notes saved by a run with -change-notes, explaining why documents changed (ignored if missing)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: mdrefactor pr-description [flags] <number>")
+		fmt.Fprintln(fs.Output(), "Rewrites the description of a pull request into Summary, Changes, Testing and Risks sections.")
+		fs.PrintDefaults()
+	}
+	positional := parseArgs(fs, args)
+	if len(positional) != 1 {
+		fs.Usage()
+		return fmt.Errorf("a pull request number is required")
+	}
+	number, err := strconv.Atoi(strings.TrimPrefix(positional[0], "#"))
+	if err != nil || number <= 0 {
+		return fmt.Errorf("invalid pull request number %q", positional[0])
+	}
+
+	gh, err := newGitHubClient(*repo, *token)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Fetching pull request #%d of %s/%s...\n", number, gh.owner, gh.repo)
+	var pr pullRequest
+	if err := gh.do("GET", fmt.Sprintf("/pulls/%d", number), nil, &pr); err != nil {
+		return err
+	}
+	diffstat, err := pullDiffstat(gh, pr)
+	if err != nil {
+		return err
+	}
+	notes, err := loadChangeNotes(*changeNotesFile)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(os.Stderr, "Rewriting the description...")
+	description, err := rewritePRDescription(*apiKey, *model, pr, diffstat, formatChangeNotes(notes))
+	if err != nil {
+		return err
+	}
+	description = strings.TrimSpace(description) + "\n"
+
+	if !*update {
+		fmt.Print(description)
+		return nil
+	}
+	if err := gh.do("PATCH", fmt.Sprintf("/pulls/%d", number), map[string]string{"body": description}, nil); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Updated the description of #%d\n", number)
+	return nil
+}
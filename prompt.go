@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Prompt fragments for the -tone presets
+var toneInstructions = map[string]string{
+	"formal":   "Write in a formal, professional tone. Avoid contractions, slang and exclamation marks.",
+	"friendly": "Write in a warm, friendly and approachable tone. Address the reader directly and keep the language inviting.",
+	"terse":    "Write tersely. Use short sentences and bullet points, drop filler words and marketing language.",
+}
+
+// Prompt fragments for the -audience presets
+var audienceInstructions = map[string]string{
+	"beginner": "The readers are beginners. Explain jargon on first use, spell out steps explicitly and do not assume prior knowledge.",
+	"expert":   "The readers are experts. Skip basic explanations and focus on precise, technical details.",
+}
+
+// Display names for common -lang codes, other codes are passed to the model as-is
+var languageNames = map[string]string{
+	"de":    "German",
+	"en":    "English",
+	"es":    "Spanish",
+	"fr":    "French",
+	"it":    "Italian",
+	"ja":    "Japanese",
+	"ko":    "Korean",
+	"nl":    "Dutch",
+	"pl":    "Polish",
+	"pt":    "Portuguese",
+	"pt-br": "Brazilian Portuguese",
+	"ru":    "Russian",
+	"sv":    "Swedish",
+	"tr":    "Turkish",
+	"uk":    "Ukrainian",
+	"zh":    "Simplified Chinese",
+	"zh-cn": "Simplified Chinese",
+	"zh-tw": "Traditional Chinese",
+}
+
+// languageName returns a human-readable name for a language code
+func languageName(code string) string {
+	if name, ok := languageNames[strings.ToLower(code)]; ok {
+		return name
+	}
+	return code
+}
+
+// promptOptions holds the settings that are composed into the system prompt
+type promptOptions struct {
+	tone     string
+	audience string
+	lang     string
+}
+
+// presetNames returns the sorted keys of a preset map for use in error messages
+func presetNames(presets map[string]string) string {
+	names := make([]string, 0, len(presets))
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// composePrompt appends the instructions selected by opts to the base system prompt
+func composePrompt(base string, opts promptOptions) (string, error) {
+	parts := []string{base}
+
+	if opts.tone != "" {
+		instruction, ok := toneInstructions[opts.tone]
+		if !ok {
+			return "", fmt.Errorf("unknown tone %q, expected one of: %s", opts.tone, presetNames(toneInstructions))
+		}
+		parts = append(parts, instruction)
+	}
+
+	if opts.audience != "" {
+		instruction, ok := audienceInstructions[opts.audience]
+		if !ok {
+			return "", fmt.Errorf("unknown audience %q, expected one of: %s", opts.audience, presetNames(audienceInstructions))
+		}
+		parts = append(parts, instruction)
+	}
+
+	if opts.lang != "" {
+		parts = append(parts, fmt.Sprintf("Write the refactored document in %s, restructuring and translating it in a single pass. "+
+			"Keep code blocks, inline code, URLs, link targets and HTML tags exactly as they are.", languageName(opts.lang)))
+	}
+
+	return strings.Join(parts, "\n\n"), nil
+}
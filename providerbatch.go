@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jackmbuda/go-mdrefactor/mdrefactor"
+)
+
+const (
+	// OpenAI API endpoints of the Batch API and the files it reads and writes
+	openaiBatchesURL = "https://api.openai.com/v1/batches"
+	openaiFilesURL   = "https://api.openai.com/v1/files"
+	// State of the batch jobs of a -provider-batch run, kept in the docs directory
+	providerBatchStateFile = ".mdrefactor-batch.json"
+	// How often the status of a submitted batch job is checked
+	providerBatchPollInterval = 30 * time.Second
+	// Limits of a single batch job
+	maxBatchRequests  = 50000
+	maxBatchFileBytes = 200 << 20
+)
+
+// errQueuedInBatch marks documents whose request was queued for a batch job
+// instead of being sent
+var errQueuedInBatch = errors.New("queued in batch job")
+
+// errNotInBatch is returned for requests the batch job has no reply to,
+// which are then sent directly
+var errNotInBatch = errors.New("no reply in batch job")
+
+// batchRequest is one line of the input file of a batch job
+type batchRequest struct {
+	CustomID string                  `json:"custom_id"`
+	Method   string                  `json:"method"`
+	URL      string                  `json:"url"`
+	Body     *mdrefactor.ChatRequest `json:"body"`
+}
+
+// batchOutput is one line of the output or error file of a batch job
+type batchOutput struct {
+	CustomID string `json:"custom_id"`
+	Response *struct {
+		StatusCode int         `json:"status_code"`
+		Body       APIResponse `json:"body"`
+	} `json:"response"`
+	Error *mdrefactor.APIError `json:"error"`
+}
+
+// batchJob is the state of a batch job as returned by the Batch API
+type batchJob struct {
+	ID            string `json:"id"`
+	Status        string `json:"status"`
+	OutputFileID  string `json:"output_file_id"`
+	ErrorFileID   string `json:"error_file_id"`
+	RequestCounts struct {
+		Total     int `json:"total"`
+		Completed int `json:"completed"`
+		Failed    int `json:"failed"`
+	} `json:"request_counts"`
+	Errors *struct {
+		Data []mdrefactor.APIError `json:"data"`
+	} `json:"errors"`
+}
+
+// providerBatchState is what a run keeps on disk about its batch jobs, so
+// that an interrupted run resumes waiting for the same jobs
+type providerBatchState struct {
+	Jobs      []string  `json:"jobs"` // Batch IDs, one job per model
+	Requests  int       `json:"requests"`
+	Submitted time.Time `json:"submitted"`
+}
+
+// providerBatch sends the refactoring requests of a -dir run as batch jobs,
+// one per model since a job takes requests to a single model. A first pass
+// over the files queues the requests instead of sending them, the jobs are
+// submitted and waited for, and a second pass takes the replies from their
+// output.
+type providerBatch struct {
+	path     string // State file
+	state    providerBatchState
+	queued   []batchRequest
+	seen     map[string]bool
+	replies  map[string]APIResponse // Replies of the finished jobs by custom ID
+	received bool                   // Whether the output of the jobs was downloaded
+}
+
+// Batch job of the run, nil unless -provider-batch is given
+var activeProviderBatch *providerBatch
+
+// openProviderBatch returns the batch of a -dir run of dir, resuming the
+// jobs recorded in its state file if there is one
+func openProviderBatch(dir string) (*providerBatch, error) {
+	b := &providerBatch{path: filepath.Join(dir, providerBatchStateFile), seen: make(map[string]bool)}
+	data, err := os.ReadFile(b.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read batch state %s: %w", b.path, err)
+	}
+	if err := json.Unmarshal(data, &b.state); err != nil || len(b.state.Jobs) == 0 {
+		return nil, fmt.Errorf("invalid batch state %s, remove it to submit new batch jobs", b.path)
+	}
+	return b, nil
+}
+
+// submitted reports whether the batch jobs were submitted
+func (b *providerBatch) submitted() bool {
+	return len(b.state.Jobs) > 0
+}
+
+// batchRequestFor returns the batch request of a refactoring request. Its
+// custom ID is a hash of the request, so both passes over the files arrive
+// at the same ID for the same document and prompt.
+func batchRequestFor(model string, messages []Message) (batchRequest, error) {
+	transport := &mdrefactor.OpenAI{Seed: requestSeed, MaxTokens: requestMaxTokens}
+	body := transport.NewChatRequest(&mdrefactor.CompletionRequest{Model: model, Messages: messages})
+	data, err := json.Marshal(body)
+	if err != nil {
+		return batchRequest{}, fmt.Errorf("failed to marshal API request: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	return batchRequest{CustomID: hex.EncodeToString(sum[:16]), Method: "POST", URL: "/v1/chat/completions", Body: body}, nil
+}
+
+// reply queues a request before the jobs are submitted and returns the
+// reply of its job afterwards. It returns errNotInBatch if there is no
+// reply, such as for retries the checks of the pipeline ask for.
+func (b *providerBatch) reply(model string, messages []Message) (string, error) {
+	request, err := batchRequestFor(model, messages)
+	if err != nil {
+		return "", err
+	}
+	if !b.submitted() {
+		if !b.seen[request.CustomID] {
+			b.seen[request.CustomID] = true
+			b.queued = append(b.queued, request)
+		}
+		return "", errQueuedInBatch
+	}
+	resp, ok := b.replies[request.CustomID]
+	if !ok || len(resp.Choices) == 0 || resp.Choices[0].FinishReason == "length" {
+		// Truncated replies are redone directly, where they can be continued
+		return "", errNotInBatch
+	}
+	return resp.Choices[0].Message.Content, nil
+}
+
+// submit uploads the queued requests and creates a batch job per model
+func (b *providerBatch) submit(apiKey string) error {
+	if len(b.queued) == 0 {
+		return nil
+	}
+	inputs := make(map[string]*bytes.Buffer)
+	counts := make(map[string]int)
+	for _, request := range b.queued {
+		input := inputs[request.Body.Model]
+		if input == nil {
+			input = new(bytes.Buffer)
+			inputs[request.Body.Model] = input
+		}
+		if counts[request.Body.Model]++; counts[request.Body.Model] > maxBatchRequests {
+			return fmt.Errorf("the requests to %s are more than the %d a batch job takes, refactor the tree in parts with -files-from", request.Body.Model, maxBatchRequests)
+		}
+		if err := json.NewEncoder(input).Encode(request); err != nil {
+			return fmt.Errorf("failed to marshal batch request: %w", err)
+		}
+		if input.Len() > maxBatchFileBytes {
+			return fmt.Errorf("the batch requests to %s are more than the %d bytes a batch job takes, refactor the tree in parts with -files-from", request.Body.Model, maxBatchFileBytes)
+		}
+	}
+
+	state := providerBatchState{Requests: len(b.queued), Submitted: time.Now().UTC().Truncate(time.Second)}
+	for _, model := range sortedKeys(inputs) {
+		fileID, err := uploadBatchFile(apiKey, inputs[model].Bytes())
+		if err != nil {
+			return err
+		}
+		body, err := json.Marshal(map[string]string{"input_file_id": fileID, "endpoint": "/v1/chat/completions", "completion_window": "24h"})
+		if err != nil {
+			return fmt.Errorf("failed to marshal batch job: %w", err)
+		}
+		req, err := newAPIRequest(openaiBatchesURL, apiKey, body)
+		if err != nil {
+			return err
+		}
+		var job batchJob
+		if err := doBatchAPIRequest(req, &job); err != nil {
+			return fmt.Errorf("failed to create batch job: %w", err)
+		}
+		fmt.Printf("Submitted batch job %s for %s\n", job.ID, model)
+		state.Jobs = append(state.Jobs, job.ID)
+	}
+
+	b.state = state
+	data, err := json.MarshalIndent(b.state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal batch state: %w", err)
+	}
+	if err := writeFileAtomic(b.path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write batch state %s: %w", b.path, err)
+	}
+	fmt.Printf("Submitted %d requests, state saved to %s\n", len(b.queued), b.path)
+	return nil
+}
+
+// uploadBatchFile uploads the input file of a batch job and returns its ID.
+// The file is far larger than a single request, so it is not subject to
+// -max-request-size.
+func uploadBatchFile(apiKey string, data []byte) (string, error) {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	if err := w.WriteField("purpose", "batch"); err != nil {
+		return "", fmt.Errorf("failed to build batch file upload: %w", err)
+	}
+	part, err := w.CreateFormFile("file", "mdrefactor-batch.jsonl")
+	if err != nil {
+		return "", fmt.Errorf("failed to build batch file upload: %w", err)
+	}
+	if _, err := part.Write(data); err != nil {
+		return "", fmt.Errorf("failed to build batch file upload: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return "", fmt.Errorf("failed to build batch file upload: %w", err)
+	}
+
+	req, err := http.NewRequest("POST", openaiFilesURL, bytes.NewReader(body.Bytes()))
+	if err != nil {
+		return "", fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	setAPIHeaders(req, apiKey)
+	var file struct {
+		ID string `json:"id"`
+	}
+	if err := doBatchAPIRequest(req, &file); err != nil {
+		return "", fmt.Errorf("failed to upload batch file: %w", err)
+	}
+	return file.ID, nil
+}
+
+// newAPIGetRequest creates a GET request to the API
+func newAPIGetRequest(url, apiKey string) (*http.Request, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	setAPIHeaders(req, apiKey)
+	return req, nil
+}
+
+// doBatchAPIRequest sends a request to the Batch or Files API and decodes
+// the JSON response into v
+func doBatchAPIRequest(req *http.Request, v any) error {
+	body, err := readAPIResponse(req)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("failed to unmarshal API response: %w", err)
+	}
+	return nil
+}
+
+// readAPIResponse sends a request to the API and returns the body of a
+// successful response
+func readAPIResponse(req *http.Request) ([]byte, error) {
+	resp, err := doAPIRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read API response body: %w", err)
+	}
+	if err := mdrefactor.ResponseError(resp, body); err != nil {
+		var apiErr struct {
+			Error *mdrefactor.APIError `json:"error"`
+		}
+		if json.Unmarshal(body, &apiErr) == nil && apiErr.Error != nil {
+			apiErr.Error.StatusCode = resp.StatusCode
+			return nil, apiErr.Error
+		}
+		return nil, err
+	}
+	return body, nil
+}
+
+// wait polls the batch jobs until they end and downloads their replies. An
+// interrupted wait is resumed by running again with the same flags.
+func (b *providerBatch) wait(apiKey string) error {
+	if !b.submitted() || b.received {
+		return nil
+	}
+	b.replies = make(map[string]APIResponse)
+	for _, id := range b.state.Jobs {
+		job, err := waitForBatchJob(apiKey, id)
+		if err != nil {
+			return err
+		}
+		if job.Status == "failed" {
+			// Nothing was processed, the next run submits new jobs
+			os.Remove(b.path)
+			var reasons []string
+			if job.Errors != nil {
+				for _, e := range job.Errors.Data {
+					reasons = append(reasons, e.Message)
+				}
+			}
+			return fmt.Errorf("batch job %s failed: %s", job.ID, strings.Join(reasons, "; "))
+		}
+		if err := b.download(apiKey, job); err != nil {
+			return err
+		}
+	}
+	b.received = true
+	if missing := b.state.Requests - len(b.replies); missing > 0 {
+		fmt.Printf("The batch jobs have no reply to %d of %d requests, they are sent directly\n", missing, b.state.Requests)
+	}
+	return nil
+}
+
+// waitForBatchJob polls a batch job until it ends, printing its progress
+func waitForBatchJob(apiKey, id string) (batchJob, error) {
+	last := ""
+	for {
+		var job batchJob
+		req, err := newAPIGetRequest(openaiBatchesURL+"/"+id, apiKey)
+		if err != nil {
+			return job, err
+		}
+		if err := doBatchAPIRequest(req, &job); err != nil {
+			return job, fmt.Errorf("failed to check batch job %s: %w", id, err)
+		}
+		status := fmt.Sprintf("Batch job %s is %s", id, job.Status)
+		if job.RequestCounts.Total > 0 {
+			status += fmt.Sprintf(", %d of %d requests done", job.RequestCounts.Completed+job.RequestCounts.Failed, job.RequestCounts.Total)
+		}
+		if status != last {
+			fmt.Println(status)
+			last = status
+		}
+		switch job.Status {
+		case "completed", "expired", "cancelled", "failed":
+			return job, nil
+		}
+		time.Sleep(providerBatchPollInterval)
+	}
+}
+
+// download reads the replies of a finished batch job. Jobs that expired or
+// were cancelled have replies to part of their requests; the others are
+// then sent directly.
+func (b *providerBatch) download(apiKey string, job batchJob) error {
+	for _, fileID := range []string{job.OutputFileID, job.ErrorFileID} {
+		if fileID == "" {
+			continue
+		}
+		req, err := newAPIGetRequest(openaiFilesURL+"/"+fileID+"/content", apiKey)
+		if err != nil {
+			return err
+		}
+		body, err := readAPIResponse(req)
+		if err != nil {
+			return fmt.Errorf("failed to download the output of batch job %s: %w", job.ID, err)
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(body))
+		scanner.Buffer(nil, maxBatchFileBytes)
+		for scanner.Scan() {
+			var out batchOutput
+			if err := json.Unmarshal(scanner.Bytes(), &out); err != nil {
+				return fmt.Errorf("failed to parse the output of batch job %s: %w", job.ID, err)
+			}
+			switch {
+			case out.Error != nil:
+				fmt.Fprintf(os.Stderr, "Warning: batch request %s failed: %s\n", out.CustomID, out.Error.Message)
+			case out.Response != nil && out.Response.StatusCode == http.StatusOK:
+				b.replies[out.CustomID] = out.Response.Body
+			case out.Response != nil && out.Response.Body.Error != nil:
+				fmt.Fprintf(os.Stderr, "Warning: batch request %s failed: %s\n", out.CustomID, out.Response.Body.Error.Message)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("failed to read the output of batch job %s: %w", job.ID, err)
+		}
+	}
+	return nil
+}
+
+// finish removes the state file once the replies of the jobs are applied
+func (b *providerBatch) finish() error {
+	if !b.received {
+		return nil
+	}
+	if err := os.Remove(b.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove batch state %s: %w", b.path, err)
+	}
+	return nil
+}
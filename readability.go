@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// How far (in grade levels) the output may miss the -reading-level target before it is retried
+const readingLevelTolerance = 2.0
+
+var (
+	inlineCodeRe   = regexp.MustCompile("`[^`]*`")
+	imageRe        = regexp.MustCompile(`!\[[^\]]*\]\([^)]*\)`)
+	linkRe         = regexp.MustCompile(`\[([^\]]*)\]\([^)]*\)`)
+	htmlTagRe      = regexp.MustCompile(`<[^>]+>`)
+	listMarkerRe   = regexp.MustCompile(`^\s*([-*+]|\d+[.)])\s+`)
+	sentenceEndRe  = regexp.MustCompile(`[.!?]+(\s|$)`)
+	markupCharsRe  = regexp.MustCompile("[#*_>|~]")
+	vowelGroupRe   = regexp.MustCompile(`[aeiouy]+`)
+	readingLevelRe = regexp.MustCompile(`^(?:grade)?\s*(\d+(?:\.\d+)?)$`)
+)
+
+// parseReadingLevel parses a reading level such as "grade8" or "8" into a US grade level
+func parseReadingLevel(s string) (float64, error) {
+	m := readingLevelRe.FindStringSubmatch(strings.ToLower(strings.TrimSpace(s)))
+	if m == nil {
+		return 0, fmt.Errorf("invalid reading level %q, expected a grade such as grade8", s)
+	}
+	return strconv.ParseFloat(m[1], 64)
+}
+
+// proseUnits strips code and Markdown syntax from content and returns its
+// prose split into units: paragraphs, headings and list items
+func proseUnits(content string) []string {
+	var units []string
+	var paragraph []string
+	flush := func() {
+		if len(paragraph) > 0 {
+			units = append(units, strings.Join(paragraph, " "))
+			paragraph = nil
+		}
+	}
+
+	code := codeLines(content)
+	for i, line := range strings.Split(content, "\n") {
+		if code[i] {
+			flush()
+			continue
+		}
+
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" {
+			flush()
+			continue
+		}
+
+		// Headings and list items are complete units on their own
+		standalone := strings.HasPrefix(trimmed, "#") || listMarkerRe.MatchString(line)
+
+		text := listMarkerRe.ReplaceAllString(line, "")
+		text = inlineCodeRe.ReplaceAllString(text, "")
+		text = imageRe.ReplaceAllString(text, "")
+		text = linkRe.ReplaceAllString(text, "$1")
+		text = htmlTagRe.ReplaceAllString(text, "")
+		text = strings.TrimSpace(markupCharsRe.ReplaceAllString(text, ""))
+		if text == "" {
+			continue
+		}
+
+		if standalone {
+			flush()
+			units = append(units, text)
+			continue
+		}
+		paragraph = append(paragraph, text)
+	}
+	flush()
+	return units
+}
+
+// countSyllables estimates the number of syllables in an English word
+func countSyllables(word string) int {
+	word = strings.ToLower(strings.TrimFunc(word, func(r rune) bool { return !unicode.IsLetter(r) }))
+	if word == "" {
+		return 0
+	}
+	count := len(vowelGroupRe.FindAllString(word, -1))
+	// A trailing silent "e" does not form its own syllable
+	if strings.HasSuffix(word, "e") && !strings.HasSuffix(word, "le") && count > 1 {
+		count--
+	}
+	if count == 0 {
+		count = 1
+	}
+	return count
+}
+
+// gradeLevel computes the Flesch-Kincaid grade level of the prose in content
+func gradeLevel(content string) float64 {
+	var sentences, words, syllables int
+	for _, unit := range proseUnits(content) {
+		n := len(sentenceEndRe.FindAllString(unit, -1))
+		if !sentenceEndRe.MatchString(unit[len(unit)-1:]) {
+			// Headings, list items and unpunctuated paragraphs still end a sentence
+			n++
+		}
+		sentences += n
+
+		for _, word := range strings.Fields(unit) {
+			if s := countSyllables(word); s > 0 {
+				words++
+				syllables += s
+			}
+		}
+	}
+
+	if words == 0 || sentences == 0 {
+		return 0
+	}
+	return 0.39*float64(words)/float64(sentences) + 11.8*float64(syllables)/float64(words) - 15.59
+}
+
+// withReadingLevel wraps refactor so that the model is asked to write at the
+// target grade level, retrying once if the output badly misses the target
+func withReadingLevel(target float64, refactor refactorFunc) refactorFunc {
+	return func(systemPrompt, content string) (string, error) {
+		instruction := fmt.Sprintf("Write at a US grade %g reading level: prefer short sentences and common words.", target)
+		refactored, err := refactor(systemPrompt+"\n\n"+instruction, content)
+		if err != nil {
+			return "", err
+		}
+
+		score := gradeLevel(refactored)
+		if math.Abs(score-target) <= readingLevelTolerance {
+			fmt.Printf("Reading level: grade %.1f (target %g)\n", score, target)
+			return refactored, nil
+		}
+
+		fmt.Printf("Reading level is grade %.1f, target is %g, retrying...\n", score, target)
+		direction := "simpler"
+		if score < target {
+			direction = "less simplified"
+		}
+		retryPrompt := fmt.Sprintf("%s\n\n%s\nYour previous attempt scored grade %.1f on the Flesch-Kincaid scale; make the writing %s.", systemPrompt, instruction, score, direction)
+		refactored, err = refactor(retryPrompt, content)
+		if err != nil {
+			return "", err
+		}
+
+		score = gradeLevel(refactored)
+		if math.Abs(score-target) > readingLevelTolerance {
+			fmt.Fprintf(os.Stderr, "Warning: reading level is still grade %.1f, target is %g\n", score, target)
+		} else {
+			fmt.Printf("Reading level: grade %.1f (target %g)\n", score, target)
+		}
+		return refactored, nil
+	}
+}
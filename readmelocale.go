@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Language generated READMEs are written in before they are localized
+const readmeBaseLang = "en"
+
+// Marks the language switcher line of a localized README, so it is replaced
+// rather than repeated when the README is generated again
+const languageSwitcherMarker = "<!-- mdrefactor:languages -->"
+
+// System prompt used to translate a generated README
+const readmeTranslateSystemPrompt = "You translate the README of a software project into %s. Translate the prose, " +
+	"headings, table contents and link texts, keeping the Markdown structure as it is. Keep code blocks, inline code, " +
+	"commands, URLs, link targets, HTML tags and the names of products and projects exactly as they are. Reply with " +
+	"the translated README only."
+
+// Names of languages in the languages themselves, shown in the language
+// switcher; other codes are shown by their English name
+var nativeLanguageNames = map[string]string{
+	"de":    "Deutsch",
+	"en":    "English",
+	"es":    "Español",
+	"fr":    "Français",
+	"it":    "Italiano",
+	"ja":    "日本語",
+	"ko":    "한국어",
+	"nl":    "Nederlands",
+	"pl":    "Polski",
+	"pt":    "Português",
+	"pt-br": "Português (Brasil)",
+	"ru":    "Русский",
+	"sv":    "Svenska",
+	"tr":    "Türkçe",
+	"uk":    "Українська",
+	"zh":    "简体中文",
+	"zh-cn": "简体中文",
+	"zh-tw": "繁體中文",
+}
+
+// Shape of a language code such as es or zh-CN
+var langCodeRe = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+
+// parseReadmeLangs parses a comma-separated list of language codes such as
+// "zh-CN,es" into the languages to localize a README into
+func parseReadmeLangs(s string) ([]string, error) {
+	var langs []string
+	seen := map[string]bool{readmeBaseLang: true}
+	for _, code := range strings.Split(s, ",") {
+		code = strings.TrimSpace(code)
+		if code == "" {
+			continue
+		}
+		if !langCodeRe.MatchString(code) {
+			return nil, fmt.Errorf("invalid language code %q, expected a code such as es or zh-CN", code)
+		}
+		if !seen[strings.ToLower(code)] {
+			seen[strings.ToLower(code)] = true
+			langs = append(langs, code)
+		}
+	}
+	return langs, nil
+}
+
+// nativeLanguageName returns the name of a language in the language itself
+func nativeLanguageName(code string) string {
+	if name, ok := nativeLanguageNames[strings.ToLower(code)]; ok {
+		return name
+	}
+	return languageName(code)
+}
+
+// localizedReadmePath returns the path of the variant of readme in lang, such
+// as README.zh-CN.md for README.md
+func localizedReadmePath(readme, lang string) string {
+	ext := filepath.Ext(readme)
+	return strings.TrimSuffix(readme, ext) + "." + lang + ext
+}
+
+// withLanguageSwitcher returns content headed by a line linking the variants
+// of the README, the one in current in bold. paths holds the path of every
+// variant by language, all in the same directory.
+func withLanguageSwitcher(content, current string, langs []string, paths map[string]string) string {
+	links := make([]string, 0, len(langs))
+	for _, lang := range langs {
+		if lang == current {
+			links = append(links, "**"+nativeLanguageName(lang)+"**")
+		} else {
+			links = append(links, fmt.Sprintf("[%s](%s)", nativeLanguageName(lang), filepath.Base(paths[lang])))
+		}
+	}
+	return languageSwitcherMarker + strings.Join(links, " | ") + "\n\n" + stripLanguageSwitcher(content)
+}
+
+// stripLanguageSwitcher removes the language switcher of an earlier run
+func stripLanguageSwitcher(content string) string {
+	lines := strings.Split(content, "\n")
+	kept := lines[:0]
+	for i := 0; i < len(lines); i++ {
+		if strings.HasPrefix(lines[i], languageSwitcherMarker) {
+			if i+1 < len(lines) && strings.TrimSpace(lines[i+1]) == "" {
+				i++
+			}
+			continue
+		}
+		kept = append(kept, lines[i])
+	}
+	return strings.TrimLeft(strings.Join(kept, "\n"), "\n")
+}
+
+// localizeReadme translates readme, generated in the base language, into
+// every language of langs and returns the content of every variant by path,
+// each headed by a language switcher. readmePath is where the README in the
+// base language is written.
+func localizeReadme(apiKey, model, readme, readmePath string, langs []string) (map[string]string, error) {
+	readme = stripLanguageSwitcher(readme)
+	all := append([]string{readmeBaseLang}, langs...)
+	paths := map[string]string{readmeBaseLang: readmePath}
+	contents := map[string]string{readmeBaseLang: readme}
+	for _, lang := range langs {
+		fmt.Printf("Translating the README into %s...\n", languageName(lang))
+		translated, err := chatCompletion(apiKey, model, []Message{
+			{Role: "system", Content: fmt.Sprintf(readmeTranslateSystemPrompt, languageName(lang))},
+			{Role: "user", Content: readme},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to translate the README into %s: %w", languageName(lang), err)
+		}
+		paths[lang] = localizedReadmePath(readmePath, lang)
+		contents[lang] = strings.TrimSpace(translated) + "\n"
+	}
+
+	variants := make(map[string]string, len(all))
+	for _, lang := range all {
+		variants[paths[lang]] = withLanguageSwitcher(contents[lang], lang, all, paths)
+	}
+	return variants, nil
+}
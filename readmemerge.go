@@ -0,0 +1,364 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// Marks a README section as written by a person; merges never touch it
+	readmeKeepMarker = "<!-- mdrefactor:keep -->"
+	// Marks a README section as generated; merges replace it with the new version
+	readmeGeneratedMarker = "<!-- mdrefactor:generated -->"
+	// Lines of unchanged context around each hunk of a diff
+	diffContext = 3
+)
+
+// findExistingReadme returns the path of the README of dir, empty if it has none
+func findExistingReadme(dir string) string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+	for _, entry := range entries {
+		name := strings.ToLower(entry.Name())
+		if !entry.IsDir() && (name == "readme.md" || name == "readme.markdown") {
+			return filepath.Join(dir, entry.Name())
+		}
+	}
+	return ""
+}
+
+// existingReadmeHint tells the model about the README of dir, so the sections
+// it regenerates keep their headings and can be matched when merging
+func existingReadmeHint(dir string) string {
+	path := findExistingReadme(dir)
+	if path == "" {
+		return ""
+	}
+	return fmt.Sprintf(" It already has a %s; read it and keep its headings for the sections that still apply.", filepath.Base(path))
+}
+
+// sectionKey identifies a section across the existing and generated README:
+// its heading text, case-insensitively, or "" for the content before the first heading
+func sectionKey(s section) string {
+	return strings.ToLower(strings.TrimSpace(s.Heading))
+}
+
+// markGenerated adds the generated marker right below the heading of a section
+func markGenerated(s section) string {
+	if strings.Contains(s.Text, readmeGeneratedMarker) {
+		return s.Text
+	}
+	lines := strings.Split(s.Text, "\n")
+	after := 0
+	if headings := parseHeadings(s.Text); len(headings) > 0 && s.Level > 0 {
+		after = headings[0].endLine + 1
+	}
+	lines = append(lines[:after], append([]string{readmeGeneratedMarker}, lines[after:]...)...)
+	return strings.Join(lines, "\n")
+}
+
+// mergeReadme merges a newly generated README into an existing one. Sections
+// of the existing README marked as generated are replaced by the generated
+// section with the same heading, or dropped if there is none anymore. All
+// other sections, whether marked to keep or unmarked, were written by people
+// and are preserved. Generated sections without a counterpart are inserted
+// after the section that precedes them in the generated README.
+func mergeReadme(existing, generated string) string {
+	existing = strings.ReplaceAll(existing, "\r\n", "\n")
+	newSections := splitSections(strings.TrimSpace(generated))
+	byKey := make(map[string]section)
+	for _, s := range newSections {
+		if _, ok := byKey[sectionKey(s)]; !ok {
+			byKey[sectionKey(s)] = s
+		}
+	}
+
+	var merged []string
+	placed := make(map[string]int) // Index in merged of each placed key
+	for _, s := range splitSections(existing) {
+		key := sectionKey(s)
+		if _, done := placed[key]; done && key != "" {
+			continue
+		}
+		text := strings.TrimRight(s.Text, "\n")
+		if strings.Contains(s.Text, readmeGeneratedMarker) && !strings.Contains(s.Text, readmeKeepMarker) {
+			replacement, ok := byKey[key]
+			if !ok {
+				continue
+			}
+			text = markGenerated(replacement)
+		}
+		placed[key] = len(merged)
+		merged = append(merged, strings.TrimRight(text, "\n"))
+	}
+
+	for i, s := range newSections {
+		key := sectionKey(s)
+		if _, done := placed[key]; done {
+			continue
+		}
+		// Insert after the previous generated section, at the top if there is none
+		at := 0
+		if i > 0 {
+			if prev, ok := placed[sectionKey(newSections[i-1])]; ok {
+				at = prev + 1
+			}
+		}
+		merged = append(merged[:at], append([]string{strings.TrimRight(markGenerated(s), "\n")}, merged[at:]...)...)
+		for k, idx := range placed {
+			if idx >= at {
+				placed[k] = idx + 1
+			}
+		}
+		placed[key] = at
+	}
+	return strings.Join(merged, "\n\n") + "\n"
+}
+
+// markAllGenerated marks every section of a README as generated, so a later
+// merge knows it may replace them
+func markAllGenerated(content string) string {
+	var parts []string
+	for _, s := range splitSections(strings.TrimSpace(content)) {
+		parts = append(parts, strings.TrimRight(markGenerated(s), "\n"))
+	}
+	return strings.Join(parts, "\n\n") + "\n"
+}
+
+// mergeWithExistingReadme merges generated into the README of dir if there
+// is one and prints a diff of the changes. Without an existing README, the
+// sections of generated are marked so future runs can merge.
+func mergeWithExistingReadme(dir, generated string) (string, error) {
+	path := findExistingReadme(dir)
+	if path == "" {
+		return markAllGenerated(generated), nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	existing := decodeSource(data).text
+	merged := mergeReadme(existing, generated)
+
+	name := filepath.Base(path)
+	if diff := lineDiff(name+" (existing)", name+" (merged)", existing, merged); diff != "" {
+		fmt.Printf("Merged with the existing %s:\n%s", name, diff)
+	} else {
+		fmt.Printf("The existing %s is unchanged\n", name)
+	}
+	return merged, nil
+}
+
+// lcsMatches returns, for every line of x, the index of the line of y it is
+// matched with in a longest common subsequence of x and y, or -1. It uses
+// Myers' divide and conquer diff, so memory grows with the number of lines
+// rather than with their product.
+func lcsMatches(x, y []string) []int {
+	// Compare lines by number
+	ids := make(map[string]int)
+	intern := func(lines []string) []int {
+		n := make([]int, len(lines))
+		for i, line := range lines {
+			id, ok := ids[line]
+			if !ok {
+				id = len(ids)
+				ids[line] = id
+			}
+			n[i] = id
+		}
+		return n
+	}
+	a, b := intern(x), intern(y)
+
+	matches := make([]int, len(a))
+	for i := range matches {
+		matches[i] = -1
+	}
+	// match fills in the matches of a[a0:a1] in b[b0:b1]
+	var match func(a0, a1, b0, b1 int)
+	match = func(a0, a1, b0, b1 int) {
+		for a0 < a1 && b0 < b1 && a[a0] == b[b0] {
+			matches[a0] = b0
+			a0, b0 = a0+1, b0+1
+		}
+		for a0 < a1 && b0 < b1 && a[a1-1] == b[b1-1] {
+			a1, b1 = a1-1, b1-1
+			matches[a1] = b1
+		}
+		if a0 == a1 || b0 == b1 {
+			return
+		}
+		if i, j, ok := middleSnake(a[a0:a1], b[b0:b1]); ok {
+			match(a0, a0+i, b0, b0+j)
+			match(a0+i, a1, b0+j, b1)
+		}
+	}
+	match(0, len(a), 0, len(b))
+	return matches
+}
+
+// middleSnake returns the point where the forward and backward searches of
+// Myers' diff of a and b meet, which a shortest edit script passes through,
+// or false if a and b have nothing in common
+func middleSnake(a, b []int) (int, int, bool) {
+	n, m := len(a), len(b)
+	maxD := (n + m + 1) / 2
+	offset := maxD
+	// vf[offset+k] and vb[offset+k] are the furthest x reached on diagonal k
+	// from the start and from the end
+	vf, vb := make([]int, 2*maxD+2), make([]int, 2*maxD+2)
+	for i := range vf {
+		vf[i], vb[i] = -1, -1
+	}
+	vf[offset+1], vb[offset+1] = 0, 0
+	delta := n - m
+	// With an odd delta the forward search meets the backward one, else the
+	// backward search meets the forward one
+	front := delta%2 != 0
+	// Diagonals that ran off the edges of the grid are not searched again
+	fStart, fEnd, bStart, bEnd := 0, 0, 0, 0
+	for d := 0; d < maxD; d++ {
+		for k := -d + fStart; k <= d-fEnd; k += 2 {
+			var x int
+			if k == -d || (k != d && vf[offset+k-1] < vf[offset+k+1]) {
+				x = vf[offset+k+1]
+			} else {
+				x = vf[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x, y = x+1, y+1
+			}
+			vf[offset+k] = x
+			switch {
+			case x > n:
+				fEnd += 2
+			case y > m:
+				fStart += 2
+			case front:
+				if kb := offset + delta - k; kb >= 0 && kb < len(vb) && vb[kb] != -1 && x >= n-vb[kb] {
+					return x, y, true
+				}
+			}
+		}
+		for k := -d + bStart; k <= d-bEnd; k += 2 {
+			var x int
+			if k == -d || (k != d && vb[offset+k-1] < vb[offset+k+1]) {
+				x = vb[offset+k+1]
+			} else {
+				x = vb[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[n-x-1] == b[m-y-1] {
+				x, y = x+1, y+1
+			}
+			vb[offset+k] = x
+			switch {
+			case x > n:
+				bEnd += 2
+			case y > m:
+				bStart += 2
+			case !front:
+				if kf := offset + delta - k; kf >= 0 && kf < len(vf) && vf[kf] != -1 && vf[kf] >= n-x {
+					return vf[kf], offset + vf[kf] - kf, true
+				}
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// changedFraction returns the share of lines of a and b that the diff
+// between them removes or adds, from 0 for equal texts to 1 for disjoint ones
+func changedFraction(a, b string) float64 {
+	x, y := strings.Split(a, "\n"), strings.Split(b, "\n")
+	common := 0
+	for _, j := range lcsMatches(x, y) {
+		if j >= 0 {
+			common++
+		}
+	}
+	return float64(len(x)+len(y)-2*common) / float64(len(x)+len(y))
+}
+
+// lineEdit is one line of the edit script turning one text into another
+type lineEdit struct {
+	kind   byte // ' ', '-' or '+'
+	text   string
+	ai, bi int // 0-based line in a and b where the edit applies
+}
+
+// diffLines returns the shortest edit script turning the lines x into y
+func diffLines(x, y []string) []lineEdit {
+	matches := lcsMatches(x, y)
+	var edits []lineEdit
+	j := 0
+	for i := 0; i <= len(x); i++ {
+		next := len(y)
+		if i < len(x) {
+			if matches[i] < 0 {
+				edits = append(edits, lineEdit{'-', x[i], i, j})
+				continue
+			}
+			next = matches[i]
+		}
+		for ; j < next; j++ {
+			edits = append(edits, lineEdit{'+', y[j], i, j})
+		}
+		if i < len(x) {
+			edits = append(edits, lineEdit{' ', x[i], i, j})
+			j++
+		}
+	}
+	return edits
+}
+
+// lineDiff returns a unified diff between the lines of a and b, or "" if they
+// are equal
+func lineDiff(aName, bName, a, b string) string {
+	hunks := formatHunks(diffLines(strings.Split(a, "\n"), strings.Split(b, "\n")))
+	if hunks == "" {
+		return ""
+	}
+	return fmt.Sprintf("--- %s\n+++ %s\n", aName, bName) + hunks
+}
+
+// formatHunks returns the changes of an edit script as the hunks of a
+// unified diff, or "" if it has none
+func formatHunks(edits []lineEdit) string {
+	var changed []int
+	for k, e := range edits {
+		if e.kind != ' ' {
+			changed = append(changed, k)
+		}
+	}
+
+	var out strings.Builder
+	for k := 0; k < len(changed); {
+		// Group changes whose context would overlap into one hunk
+		last := k
+		for last+1 < len(changed) && changed[last+1]-changed[last] <= 2*diffContext {
+			last++
+		}
+		start, end := max(changed[k]-diffContext, 0), min(changed[last]+diffContext+1, len(edits))
+		aCount, bCount := 0, 0
+		for _, e := range edits[start:end] {
+			if e.kind != '+' {
+				aCount++
+			}
+			if e.kind != '-' {
+				bCount++
+			}
+		}
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", edits[start].ai+1, aCount, edits[start].bi+1, bCount)
+		for _, e := range edits[start:end] {
+			fmt.Fprintf(&out, "%c%s\n", e.kind, e.text)
+		}
+		k = last + 1
+	}
+	return out.String()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jackmbuda/go-mdrefactor/mdrefactor"
+)
+
+const (
+	// Tokens kept free in the context window for the system prompt and instructions
+	promptReserveTokens = 1000
+	// Rough number of bytes of English Markdown per token
+	bytesPerToken = 4
+)
+
+// modelInfo describes the limits and prices of a model
+type modelInfo struct {
+	ContextWindow   int     `json:"context_window"`    // Tokens of prompt and reply together
+	MaxOutputTokens int     `json:"max_output_tokens"` // Tokens the model generates at most per reply
+	InputPrice      float64 `json:"input_price"`       // USD per million prompt tokens
+	OutputPrice     float64 `json:"output_price"`      // USD per million generated tokens
+}
+
+// Built-in limits and published prices of common models, matched by the
+// longest model name prefix. The models section of the config file adds
+// models or overrides single values.
+var modelRegistry = map[string]modelInfo{
+	"gpt-3.5-turbo": {ContextWindow: 16385, MaxOutputTokens: 4096, InputPrice: 0.50, OutputPrice: 1.50},
+	"gpt-4":         {ContextWindow: 8192, MaxOutputTokens: 8192, InputPrice: 30, OutputPrice: 60},
+	"gpt-4-turbo":   {ContextWindow: 128000, MaxOutputTokens: 4096, InputPrice: 10, OutputPrice: 30},
+	"gpt-4o":        {ContextWindow: 128000, MaxOutputTokens: 16384, InputPrice: 2.50, OutputPrice: 10},
+	"gpt-4o-mini":   {ContextWindow: 128000, MaxOutputTokens: 16384, InputPrice: 0.15, OutputPrice: 0.60},
+	"gpt-4.1":       {ContextWindow: 1047576, MaxOutputTokens: 32768, InputPrice: 2, OutputPrice: 8},
+	"gpt-4.1-mini":  {ContextWindow: 1047576, MaxOutputTokens: 32768, InputPrice: 0.40, OutputPrice: 1.60},
+	"gpt-4.1-nano":  {ContextWindow: 1047576, MaxOutputTokens: 32768, InputPrice: 0.10, OutputPrice: 0.40},
+}
+
+// registerModels merges model entries from the config file into the
+// registry; zero values keep the built-in ones
+func registerModels(models map[string]modelInfo) {
+	for name, m := range models {
+		info := modelRegistry[name]
+		if m.ContextWindow > 0 {
+			info.ContextWindow = m.ContextWindow
+		}
+		if m.MaxOutputTokens > 0 {
+			info.MaxOutputTokens = m.MaxOutputTokens
+		}
+		if m.InputPrice > 0 {
+			info.InputPrice = m.InputPrice
+		}
+		if m.OutputPrice > 0 {
+			info.OutputPrice = m.OutputPrice
+		}
+		modelRegistry[name] = info
+	}
+}
+
+// lookupModel returns the registry entry with the longest name prefix of model
+func lookupModel(model string) (modelInfo, bool) {
+	best := ""
+	for name := range modelRegistry {
+		if strings.HasPrefix(model, name) && len(name) > len(best) {
+			best = name
+		}
+	}
+	info, ok := modelRegistry[best]
+	return info, ok && best != ""
+}
+
+// estimateTokens roughly estimates the number of tokens of s
+func estimateTokens(s string) int {
+	return (len(s) + bytesPerToken - 1) / bytesPerToken
+}
+
+// inputTokens returns how many tokens of content a single refactoring request
+// can take: its reply is about as long as the content, so both have to fit
+// into the context window and the reply into the output limit
+func (m modelInfo) inputTokens() int {
+	tokens := (m.ContextWindow - promptReserveTokens) / 2
+	if m.MaxOutputTokens > 0 && m.MaxOutputTokens < tokens {
+		tokens = m.MaxOutputTokens
+	}
+	return max(tokens, 0)
+}
+
+// chunkSizeFor returns the size in bytes of the chunks a large document is
+// split into for model, leaving a quarter of the budget as a safety margin
+func chunkSizeFor(model string) int {
+	info, ok := lookupModel(model)
+	if !ok || info.inputTokens() == 0 {
+		return defaultChunkSize
+	}
+	return info.inputTokens() * bytesPerToken * 3 / 4
+}
+
+// preflight checks before sending a request whether the prompt fits into the
+// context window of model, which saves a request that would fail anyway
+func preflight(model string, messages []Message) error {
+	info, ok := lookupModel(model)
+	if !ok || info.ContextWindow == 0 {
+		return nil
+	}
+	tokens := 0
+	for _, m := range messages {
+		tokens += estimateTokens(m.Content)
+	}
+	if tokens > info.ContextWindow {
+		return fmt.Errorf("%w: the prompt is about %d tokens but %s has a context window of %d tokens, use -lines or split the document",
+			mdrefactor.ErrContextTooLong, tokens, model, info.ContextWindow)
+	}
+	return nil
+}
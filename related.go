@@ -0,0 +1,157 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Default heading of the generated related-pages section
+const defaultSeeAlsoHeading = "See also"
+
+// relatedPage is a document suggested as related to another one
+type relatedPage struct {
+	file       string
+	title      string
+	similarity float64
+}
+
+// findRelated returns, for every document, the k most similar other documents
+// by cosine similarity of their embeddings, ignoring matches below minSimilarity
+func findRelated(files []string, vectors [][]float64, titles map[string]string, k int, minSimilarity float64) map[string][]relatedPage {
+	related := make(map[string][]relatedPage)
+	for i, file := range files {
+		var candidates []relatedPage
+		for j, other := range files {
+			if i == j {
+				continue
+			}
+			if sim := cosineSimilarity(vectors[i], vectors[j]); sim >= minSimilarity {
+				candidates = append(candidates, relatedPage{file: other, title: titles[other], similarity: sim})
+			}
+		}
+		sort.SliceStable(candidates, func(a, b int) bool { return candidates[a].similarity > candidates[b].similarity })
+		if len(candidates) > k {
+			candidates = candidates[:k]
+		}
+		related[file] = candidates
+	}
+	return related
+}
+
+// relativeLink returns the slash-separated link from the document at from to
+// the document at to, both relative to the docs root
+func relativeLink(from, to string) string {
+	rel, err := filepath.Rel(filepath.FromSlash(path.Dir(from)), filepath.FromSlash(to))
+	if err != nil {
+		return to
+	}
+	return filepath.ToSlash(rel)
+}
+
+// upsertSeeAlso replaces the body of the level-2 section with the given
+// heading, or appends the section if the document does not have it yet
+func upsertSeeAlso(content, headingText, body string) string {
+	content = strings.TrimRight(content, "\n")
+	lines := strings.Split(content, "\n")
+	sectionText := "## " + headingText + "\n\n" + body
+
+	headings := parseHeadings(content)
+	for i, h := range headings {
+		if h.level != 2 || !strings.EqualFold(h.text, headingText) {
+			continue
+		}
+		// The section runs until the next heading of the same or a higher level
+		rest := ""
+		for _, next := range headings[i+1:] {
+			if next.level <= 2 {
+				rest = "\n" + strings.Join(lines[next.line:], "\n") + "\n"
+				break
+			}
+		}
+		return strings.Join(append(lines[:h.line:h.line], sectionText), "\n") + rest
+	}
+	return content + "\n\n" + sectionText
+}
+
+// renderSeeAlso renders related pages as a Markdown list linked from file
+func renderSeeAlso(file string, pages []relatedPage) string {
+	var b strings.Builder
+	for _, p := range pages {
+		fmt.Fprintf(&b, "- [%s](%s)\n", p.title, relativeLink(file, p.file))
+	}
+	return b.String()
+}
+
+// runRelatedCommand implements the related subcommand
+func runRelatedCommand(args []string) error {
+	fs := flag.NewFlagSet("related", flag.ExitOnError)
+	apiKey := fs.String("apikey", os.Getenv("OPENAI_API_KEY"), "OpenAI API key (can also be set via OPENAI_API_KEY environment variable)")
+	addAPIFlags(fs)
+	embedding := addEmbeddingFlags(fs)
+	k := fs.Int("k", 3, "Number of related pages to suggest per document")
+	minSimilarity := fs.Float64("min-similarity", 0.3, "Minimum cosine similarity (0-1) for a page to be suggested")
+	write := fs.Bool("write", false, "Add or update a related-pages section in every document instead of printing a report")
+	headingText := fs.String("heading", defaultSeeAlsoHeading, "Heading of the related-pages section written by -write")
+	indexFile := fs.String("index", "", "Path of the embedding index (defaults to <docs-dir>/"+defaultIndexFile+")")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: mdrefactor related [flags] <docs-dir>")
+		fs.PrintDefaults()
+	}
+	positional := parseArgs(fs, args)
+	if len(positional) != 1 {
+		fs.Usage()
+		return fmt.Errorf("a docs directory is required")
+	}
+	dir := positional[0]
+
+	embedder, err := embedding.open(*apiKey)
+	if err != nil {
+		return err
+	}
+	// Only documents changed since the last run are embedded
+	index, err := updateIndex(embedder, dir, indexPathFor(dir, *indexFile))
+	if err != nil {
+		return err
+	}
+
+	paths := sortedKeys(index.Files)
+	var vectors [][]float64
+	contents := make(map[string]string)
+	titles := make(map[string]string)
+	for _, p := range paths {
+		content, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(p)))
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", p, err)
+		}
+		contents[p] = string(content)
+		titles[p] = documentTitle(string(content), p)
+		vectors = append(vectors, index.Files[p].Vector)
+	}
+	related := findRelated(paths, vectors, titles, *k, *minSimilarity)
+
+	for _, p := range paths {
+		pages := related[p]
+		if !*write {
+			fmt.Printf("%s:\n", p)
+			for _, r := range pages {
+				fmt.Printf("  %.2f  %s (%s)\n", r.similarity, r.file, r.title)
+			}
+			continue
+		}
+		if len(pages) == 0 {
+			continue
+		}
+
+		updated := upsertSeeAlso(contents[p], *headingText, renderSeeAlso(p, pages))
+		if err := writeFileAtomic(filepath.Join(dir, filepath.FromSlash(p)), []byte(updated), 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %w", p, err)
+		}
+		fmt.Printf("Updated %s with %d related pages\n", p, len(pages))
+	}
+	return nil
+}
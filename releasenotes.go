@@ -0,0 +1,149 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+// System prompt used to draft release notes
+const releaseNotesSystemPrompt = "You are a maintainer writing the release notes of a software release for its users. " +
+	"Group the merged pull requests into categories such as Breaking changes, Features, Fixes, Documentation and " +
+	"Maintenance, using their labels where they help, and leave out empty categories. Rewrite each title as a short, " +
+	"human-readable sentence in the past tense and keep its pull request number and author. Open with a one or two " +
+	"sentence overview of the release. Reply with the Markdown release notes only."
+
+// Number of items requested per page from the GitHub API
+const githubPageSize = 100
+
+// mergedPull is a merged pull request of a milestone
+type mergedPull struct {
+	Number int    `json:"number"`
+	Title  string `json:"title"`
+	User   struct {
+		Login string `json:"login"`
+	} `json:"user"`
+	Labels []struct {
+		Name string `json:"name"`
+	} `json:"labels"`
+	PullRequest *struct {
+		MergedAt *string `json:"merged_at"`
+	} `json:"pull_request"`
+}
+
+// milestonePulls returns the merged pull requests of the milestone with the given title
+func milestonePulls(gh *githubClient, title string) ([]mergedPull, error) {
+	var milestones []struct {
+		Number int    `json:"number"`
+		Title  string `json:"title"`
+	}
+	if err := gh.do("GET", fmt.Sprintf("/milestones?state=all&per_page=%d", githubPageSize), nil, &milestones); err != nil {
+		return nil, err
+	}
+	number := 0
+	var titles []string
+	for _, m := range milestones {
+		if m.Title == title {
+			number = m.Number
+		}
+		titles = append(titles, m.Title)
+	}
+	if number == 0 {
+		return nil, fmt.Errorf("milestone %q not found in %s/%s, it has %s", title, gh.owner, gh.repo, strings.Join(titles, ", "))
+	}
+
+	// Pull requests are listed as issues, which can be filtered by milestone
+	var pulls []mergedPull
+	for page := 1; ; page++ {
+		var items []mergedPull
+		query := url.Values{"milestone": {fmt.Sprint(number)}, "state": {"closed"}, "per_page": {fmt.Sprint(githubPageSize)}, "page": {fmt.Sprint(page)}}
+		if err := gh.do("GET", "/issues?"+query.Encode(), nil, &items); err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			if item.PullRequest != nil && item.PullRequest.MergedAt != nil {
+				pulls = append(pulls, item)
+			}
+		}
+		if len(items) < githubPageSize {
+			break
+		}
+	}
+	sort.Slice(pulls, func(i, j int) bool { return pulls[i].Number < pulls[j].Number })
+	return pulls, nil
+}
+
+// draftReleaseNotes asks the model to turn the pull requests into release notes
+func draftReleaseNotes(apiKey, model, release string, pulls []mergedPull) (string, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Write the release notes of %s from these merged pull requests:\n\n", release)
+	for _, p := range pulls {
+		var labels []string
+		for _, l := range p.Labels {
+			labels = append(labels, l.Name)
+		}
+		fmt.Fprintf(&b, "- #%d %s (@%s)", p.Number, p.Title, p.User.Login)
+		if len(labels) > 0 {
+			fmt.Fprintf(&b, " [labels: %s]", strings.Join(labels, ", "))
+		}
+		b.WriteString("\n")
+	}
+	return chatCompletion(apiKey, model, []Message{
+		{Role: "system", Content: releaseNotesSystemPrompt},
+		{Role: "user", Content: b.String()},
+	})
+}
+
+// runReleaseNotesCommand implements the release-notes subcommand
+func runReleaseNotesCommand(args []string) error {
+	fs := flag.NewFlagSet("release-notes", flag.ExitOnError)
+	apiKey := fs.String("apikey", os.Getenv("OPENAI_API_KEY"), "OpenAI API key (can also be set via OPENAI_API_KEY environment variable)")
+	addAPIFlags(fs)
+	model := fs.String("model", defaultModel, "OpenAI model to use")
+	milestone := fs.String("milestone", "", "Title of the GitHub milestone whose merged pull requests go into the notes (required)")
+	repo := fs.String("repo", "", "GitHub repository as owner/name or URL, the origin remote of the current directory by default")
+	token := fs.String("github-token", "", "GitHub token, GITHUB_TOKEN or GH_TOKEN by default")
+	output := fs.String("o", "", "Write the release notes to this file instead of stdout")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: mdrefactor release-notes -milestone <title> [flags]")
+		fmt.Fprintln(fs.Output(), "Drafts categorized release notes from the merged pull requests of a GitHub milestone.")
+		fs.PrintDefaults()
+	}
+	parseArgs(fs, args)
+	if *milestone == "" {
+		fs.Usage()
+		return fmt.Errorf("-milestone is required")
+	}
+
+	gh, err := newGitHubClient(*repo, *token)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Fetching merged pull requests of %s in %s/%s...\n", *milestone, gh.owner, gh.repo)
+	pulls, err := milestonePulls(gh, *milestone)
+	if err != nil {
+		return err
+	}
+	if len(pulls) == 0 {
+		return fmt.Errorf("milestone %s has no merged pull requests", *milestone)
+	}
+	fmt.Fprintf(os.Stderr, "Drafting release notes from %d pull requests...\n", len(pulls))
+	notes, err := draftReleaseNotes(*apiKey, *model, *milestone, pulls)
+	if err != nil {
+		return err
+	}
+	notes = strings.TrimSpace(notes) + "\n"
+
+	if *output == "" {
+		fmt.Print(notes)
+		return nil
+	}
+	if err := writeFileAtomic(*output, []byte(notes), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", *output, err)
+	}
+	fmt.Fprintf(os.Stderr, "Release notes written to %s\n", *output)
+	return nil
+}
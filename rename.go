@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/jackmbuda/go-mdrefactor/mdrefactor"
+)
+
+// fileRename maps an old document path to its new path, both slash-separated
+// relative to the docs directory. Renames never move files across directories.
+type fileRename struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// kebabCase converts a title into a kebab-case file name stem, e.g.
+// "Getting Started with X!" -> getting-started-with-x. Non-ASCII letters
+// are transliterated, so "Über uns" -> uber-uns.
+func kebabCase(title string) string {
+	var b strings.Builder
+	pendingDash := false
+	for _, r := range transliterate(strings.ToLower(title), slugLocale) {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			if pendingDash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			pendingDash = false
+			continue
+		}
+		pendingDash = true
+	}
+	return b.String()
+}
+
+// suggestRenames proposes a kebab-case file name derived from the final
+// title of every document whose name does not match it yet. Index pages keep
+// their names, and conflicting suggestions get a numeric suffix.
+func suggestRenames(results []batchResult) []fileRename {
+	taken := make(map[string]bool)
+	for _, r := range results {
+		taken[strings.ToLower(filepath.ToSlash(r.path))] = true
+	}
+
+	var renames []fileRename
+	for _, r := range results {
+		from := filepath.ToSlash(r.path)
+		if isIndexPage(from) {
+			continue
+		}
+		stem := safeFileStem(kebabCase(documentTitle(r.finalContent(), r.path)))
+		if stem == "" {
+			continue
+		}
+
+		ext := path.Ext(from)
+		to := path.Join(path.Dir(from), stem+ext)
+		if to == from {
+			continue
+		}
+		for n := 2; taken[strings.ToLower(to)] && !strings.EqualFold(to, from); n++ {
+			to = path.Join(path.Dir(from), fmt.Sprintf("%s-%d%s", stem, n, ext))
+		}
+		taken[strings.ToLower(to)] = true
+		renames = append(renames, fileRename{From: from, To: to})
+	}
+	return renames
+}
+
+// rewriteMovedLinks updates the links of the document at docPath that point
+// at renamed documents. Only the file name part of each link target changes.
+func rewriteMovedLinks(content, docPath string, moved map[string]string, exists func(string) bool) string {
+	return rewriteLinks(content, func(target string, image bool) string {
+		if image {
+			return target
+		}
+		file, _, ok := resolveDocLink(docPath, target, exists)
+		if !ok {
+			return target
+		}
+		newFile, ok := moved[file]
+		if !ok {
+			return target
+		}
+
+		pathPart, suffix := target, ""
+		if i := strings.IndexAny(target, "#?"); i >= 0 {
+			pathPart, suffix = target[:i], target[i:]
+		}
+		if pathPart == "" || strings.HasSuffix(pathPart, "/") {
+			// Same-page and directory links do not name the renamed file
+			return target
+		}
+
+		pathPart = slashLinkPath(pathPart)
+		base := path.Base(pathPart)
+		newBase := path.Base(newFile)
+		if path.Ext(base) == "" {
+			// Keep extensionless links extensionless
+			newBase = strings.TrimSuffix(newBase, path.Ext(newBase))
+		}
+		return pathPart[:len(pathPart)-len(base)] + newBase + suffix
+	})
+}
+
+// applyRenames renames the documents below dir and rewrites every link in the
+// tree that points at one of them
+func applyRenames(dir string, renames []fileRename) error {
+	files, err := findMarkdownFiles(dir)
+	if err != nil {
+		return err
+	}
+
+	existing := make(map[string]bool)
+	for _, rel := range files {
+		existing[filepath.ToSlash(rel)] = true
+	}
+	exists := func(p string) bool { return existing[p] }
+
+	moved := make(map[string]string)
+	for _, r := range renames {
+		moved[r.From] = r.To
+	}
+
+	// Rewrite inbound links first, while link targets still resolve
+	for _, rel := range files {
+		p := filepath.Join(dir, rel)
+		content, err := os.ReadFile(p)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", p, err)
+		}
+		updated := rewriteMovedLinks(string(content), filepath.ToSlash(rel), moved, exists)
+		if updated == string(content) {
+			continue
+		}
+		if err := writeFileAtomic(p, []byte(updated), 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %w", p, err)
+		}
+	}
+
+	for _, r := range renames {
+		from := filepath.Join(dir, filepath.FromSlash(r.From))
+		to := filepath.Join(dir, filepath.FromSlash(r.To))
+		if err := os.Rename(from, to); err != nil {
+			return fmt.Errorf("failed to rename %s to %s: %w", from, to, err)
+		}
+		fmt.Printf("Renamed %s -> %s\n", r.From, r.To)
+	}
+	return nil
+}
+
+// writeRenameMap writes the renames to path as JSON
+func writeRenameMap(path string, renames []fileRename) error {
+	if renames == nil {
+		renames = []fileRename{}
+	}
+	data, err := json.MarshalIndent(renames, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal rename map: %w", err)
+	}
+	if err := writeFileAtomic(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write rename map %s: %w", path, err)
+	}
+	return nil
+}
+
+// writeRenameStubs keeps old paths of renamed documents working, either by
+// leaving a stub page at the old path that links to the new one, or by adding
+// the old URL to the aliases front matter of the renamed document
+func writeRenameStubs(dir, style string, renames []fileRename) error {
+	for _, r := range renames {
+		newFile := filepath.Join(dir, filepath.FromSlash(r.To))
+		content, err := os.ReadFile(newFile)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", newFile, err)
+		}
+
+		switch style {
+		case "stub":
+			title := documentTitle(string(content), r.To)
+			stub := fmt.Sprintf("# %s\n\nThis page has moved to [%s](%s).\n", title, title, path.Base(r.To))
+			oldFile := filepath.Join(dir, filepath.FromSlash(r.From))
+			if err := writeFileAtomic(oldFile, []byte(stub), 0644); err != nil {
+				return fmt.Errorf("failed to write stub %s: %w", oldFile, err)
+			}
+		case "aliases":
+			frontMatter, _ := mdrefactor.SplitFrontMatter(string(content))
+			aliases := frontMatterList(frontMatter, "aliases")
+			alias := pagePath(r.From)
+			for _, a := range aliases {
+				if a == alias {
+					alias = ""
+				}
+			}
+			if alias == "" {
+				continue
+			}
+			updated, _ := setFrontMatterFields(string(content), []frontMatterField{{key: "aliases", value: append(aliases, alias)}}, true)
+			if err := writeFileAtomic(newFile, []byte(updated), 0644); err != nil {
+				return fmt.Errorf("failed to write %s: %w", newFile, err)
+			}
+		default:
+			return fmt.Errorf("unknown rename stub style %q, expected stub or aliases", style)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Instruction added to the prompt when a single section is sent back for repair
+const repairInstruction = "You get one section of a document twice: the original and a refactored version that broke " +
+	"the rules above. Reply with the refactored version repaired: keep its improvements, but restore what the rules " +
+	"require from the original, such as code blocks verbatim and tables with all of their rows and columns. Reply " +
+	"with the repaired section only, starting with its heading if it has one."
+
+// brokenSection is a section of a refactored document that lost code blocks
+// or tables of the section it was refactored from
+type brokenSection struct {
+	original, refactored section
+	problems             []string
+}
+
+// pairSections pairs every section of original with the section of
+// refactored it became: the one with the same anchor, or the one at the same
+// position if the model reworded headings without adding or removing any.
+// ok is false if the sections cannot be paired.
+func pairSections(original, refactored []section) ([]int, bool) {
+	pairs := make([]int, len(original))
+	used := make(map[int]bool)
+	for i, o := range original {
+		pairs[i] = -1
+		for j, r := range refactored {
+			if !used[j] && r.Anchor == o.Anchor && r.Level == o.Level {
+				pairs[i] = j
+				used[j] = true
+				break
+			}
+		}
+		if pairs[i] < 0 {
+			if len(original) != len(refactored) {
+				return nil, false
+			}
+			pairs[i] = i
+		}
+	}
+	return pairs, true
+}
+
+// brokenSections returns the sections of refactored that lost code blocks or
+// tables of their original section. ok is false if the sections cannot be
+// paired, or the invariants broken cannot be pinned to sections.
+func (inv structureInvariants) brokenSections(original, refactored string) ([]brokenSection, bool) {
+	perSection := structureInvariants{code: inv.code, tables: inv.tables}
+	if !perSection.enabled() {
+		return nil, false
+	}
+	before, after := splitSections(original), splitSections(refactored)
+	pairs, ok := pairSections(before, after)
+	if !ok {
+		return nil, false
+	}
+	var broken []brokenSection
+	for i, j := range pairs {
+		if problems := perSection.violations(before[i].Text, after[j].Text); len(problems) > 0 {
+			broken = append(broken, brokenSection{original: before[i], refactored: after[j], problems: problems})
+		}
+	}
+	// Repairing most of the document costs as much as regenerating it
+	if len(broken) == 0 || len(broken) > len(after)/2 {
+		return nil, false
+	}
+	return broken, true
+}
+
+// repairSections sends every section of refactored that broke the invariants
+// back to the model with its original, and returns the document with the
+// repaired sections and their number. The number is 0 if the problems cannot
+// be repaired section by section, so the whole document has to be regenerated.
+func (inv structureInvariants) repairSections(refactor refactorFunc, systemPrompt, original, refactored string) (string, int, error) {
+	broken, ok := inv.brokenSections(original, refactored)
+	if !ok {
+		return "", 0, nil
+	}
+	lines := strings.Split(refactored, "\n")
+	// Later sections first, so the line numbers of earlier ones stay valid
+	for k := len(broken) - 1; k >= 0; k-- {
+		b := broken[k]
+		prompt := fmt.Sprintf("%s\n\n%s\n\n%s\nThe refactored version broke these rules: %s.", systemPrompt, inv.instruction(), repairInstruction, strings.Join(b.problems, "; "))
+		repaired, err := refactor(prompt, fmt.Sprintf("Original section:\n\n%s\n\nRefactored section to repair:\n\n%s", b.original.Text, b.refactored.Text))
+		if err != nil {
+			return "", 0, err
+		}
+		repairedLines := strings.Split(strings.TrimRight(repaired, "\n"), "\n")
+		if strings.HasSuffix(b.refactored.Text, "\n") {
+			// Keep the blank line before the next heading, or the final newline
+			repairedLines = append(repairedLines, "")
+		}
+		lines = append(lines[:b.refactored.StartLine], append(repairedLines, lines[b.refactored.EndLine:]...)...)
+	}
+	return strings.Join(lines, "\n"), len(broken), nil
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackmbuda/go-mdrefactor/mdrefactor"
+)
+
+// Reading grade level above which a page loses quality points
+const reportMaxGrade = 12
+
+// pageReport is the maintenance state of one document of a docs tree
+type pageReport struct {
+	File         string   `json:"file"`
+	LastChanged  string   `json:"last_changed,omitempty"`  // Date of the last commit touching the file, or its modification time outside of git
+	LastReviewed string   `json:"last_reviewed,omitempty"` // Date of the last_reviewed front matter field
+	AgeDays      int      `json:"age_days"`
+	Stale        bool     `json:"stale"`
+	Quality      int      `json:"quality"` // 0-100, see qualityScore
+	Grade        float64  `json:"grade"`   // Reading grade level
+	Problems     []string `json:"problems,omitempty"`
+	BrokenLinks  []string `json:"broken_links,omitempty"` // line: target
+	Acronyms     []string `json:"acronyms,omitempty"`     // Acronyms not spelled out on first use, see acronymProblems
+	Orphan       bool     `json:"orphan"`
+}
+
+// docsReport is the maintenance report of a docs tree
+type docsReport struct {
+	Dir       string       `json:"dir"`
+	Generated string       `json:"generated"`
+	StaleDays int          `json:"stale_days"`
+	Pages     []pageReport `json:"pages"`
+	// Acronyms spelled out differently across the tree
+	AcronymConflicts []acronymConflict `json:"acronym_conflicts,omitempty"`
+}
+
+// gitLastChanged returns the date of the last commit touching each file below
+// dir, by slash-separated path relative to dir. Outside of a git repository
+// it returns nil.
+func gitLastChanged(dir string) map[string]time.Time {
+	out, err := exec.Command("git", "-C", dir, "-c", "core.quotePath=false", "log", "--format=%x1e%cI", "--name-only", "--relative", "--", ".").Output()
+	if err != nil {
+		return nil
+	}
+	dates := make(map[string]time.Time)
+	// Commits come newest first, so the first date seen for a file is its last change
+	for _, record := range strings.Split(string(out), "\x1e") {
+		lines := strings.Split(strings.TrimSpace(record), "\n")
+		date, err := time.Parse(time.RFC3339, strings.TrimSpace(lines[0]))
+		if err != nil {
+			continue
+		}
+		for _, name := range lines[1:] {
+			if name = strings.TrimSpace(name); name != "" {
+				if _, ok := dates[name]; !ok {
+					dates[name] = date
+				}
+			}
+		}
+	}
+	return dates
+}
+
+// qualityScore rates a document from 0 to 100: every lint problem and broken
+// link costs 15 points, and every reading grade level above reportMaxGrade 5
+func qualityScore(problems, brokenLinks int, grade float64) int {
+	score := 100 - 15*(problems+brokenLinks)
+	if grade > reportMaxGrade {
+		score -= int(5 * (grade - reportMaxGrade))
+	}
+	return max(score, 0)
+}
+
+// brokenLinks returns the links of file with an empty destination, to
+// documents missing from the tree or to headings missing from their document,
+// in the order of their lines
+func brokenLinks(g *linkGraph, file string) []string {
+	type brokenLink struct {
+		line    int
+		problem string
+	}
+	var broken []brokenLink
+	for _, l := range parseLinks(g.contents[file]) {
+		if strings.TrimSpace(l.target) == "" {
+			broken = append(broken, brokenLink{l.line, fmt.Sprintf("[%s]() (empty link)", l.text)})
+		}
+	}
+	for _, l := range g.links[file] {
+		content, ok := g.contents[l.file]
+		if !ok {
+			broken = append(broken, brokenLink{l.line, l.target})
+			continue
+		}
+		if l.anchor == "" {
+			continue
+		}
+		_, body := mdrefactor.SplitFrontMatter(content)
+		found := false
+		for _, a := range headingAnchors(parseHeadings(body)) {
+			if a == l.anchor {
+				found = true
+				break
+			}
+		}
+		if !found {
+			broken = append(broken, brokenLink{l.line, l.target + " (no such heading)"})
+		}
+	}
+	sort.SliceStable(broken, func(i, j int) bool { return broken[i].line < broken[j].line })
+	lines := make([]string, len(broken))
+	for i, b := range broken {
+		lines[i] = fmt.Sprintf("%d: %s", b.line+1, b.problem)
+	}
+	return lines
+}
+
+// buildDocsReport combines the staleness, quality, broken links and orphan
+// pages of the docs tree in dir. Pages unchanged for staleDays are stale.
+func buildDocsReport(dir string, staleDays int) (*docsReport, error) {
+	g, err := buildLinkGraph(dir)
+	if err != nil {
+		return nil, err
+	}
+	orphans := make(map[string]bool)
+	for _, p := range findOrphans(g, 0).pages {
+		orphans[p] = true
+	}
+	changed := gitLastChanged(dir)
+
+	now := time.Now()
+	report := &docsReport{Dir: dir, Generated: now.Format("2006-01-02"), StaleDays: staleDays}
+	for _, file := range g.files {
+		page := pageReport{File: file, Orphan: orphans[file]}
+		modified, ok := changed[file]
+		if !ok {
+			if info, err := os.Stat(filepath.Join(dir, filepath.FromSlash(file))); err == nil {
+				modified = info.ModTime()
+			}
+		}
+		if !modified.IsZero() {
+			page.LastChanged = modified.Format("2006-01-02")
+		}
+		frontMatter, body := mdrefactor.SplitFrontMatter(g.contents[file])
+		// A review date says more about whether the page is current than its last edit
+		if reviewed, ok := lastReviewed(frontMatter); ok {
+			page.LastReviewed = reviewed.Format("2006-01-02")
+			modified = reviewed
+		}
+		if !modified.IsZero() {
+			page.AgeDays = int(now.Sub(modified).Hours() / 24)
+			page.Stale = staleDays > 0 && page.AgeDays >= staleDays
+		}
+
+		page.Problems = lintMarkdown(body)
+		page.BrokenLinks = brokenLinks(g, file)
+		page.Grade = float64(int(max(gradeLevel(body), 0)*10)) / 10
+		page.Quality = qualityScore(len(page.Problems), len(page.BrokenLinks), page.Grade)
+		page.Acronyms = acronymProblems(g.contents[file])
+		report.Pages = append(report.Pages, page)
+	}
+	report.AcronymConflicts = findAcronymConflicts(g.contents)
+	return report, nil
+}
+
+// renderDocsReport renders the report as Markdown for docs owners to triage
+func renderDocsReport(r *docsReport) string {
+	var stale, broken, orphans, poor []pageReport
+	for _, p := range r.Pages {
+		if p.Stale {
+			stale = append(stale, p)
+		}
+		if len(p.BrokenLinks) > 0 {
+			broken = append(broken, p)
+		}
+		if p.Orphan {
+			orphans = append(orphans, p)
+		}
+		if p.Quality < 70 {
+			poor = append(poor, p)
+		}
+	}
+	sort.SliceStable(stale, func(i, j int) bool { return stale[i].AgeDays > stale[j].AgeDays })
+	sort.SliceStable(poor, func(i, j int) bool { return poor[i].Quality < poor[j].Quality })
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Docs maintenance report\n\n")
+	fmt.Fprintf(&b, "Generated %s for `%s`: %d pages, %d stale (not reviewed or changed for %d days or more), %d with broken links, %d orphan, %d with a quality score below 70.\n",
+		r.Generated, r.Dir, len(r.Pages), len(stale), r.StaleDays, len(broken), len(orphans), len(poor))
+
+	fmt.Fprintf(&b, "\n## Broken links\n\n")
+	if len(broken) == 0 {
+		b.WriteString("None.\n")
+	}
+	for _, p := range broken {
+		for _, l := range p.BrokenLinks {
+			fmt.Fprintf(&b, "- `%s:%s`\n", p.File, l)
+		}
+	}
+
+	fmt.Fprintf(&b, "\n## Stale pages\n\n")
+	if len(stale) == 0 {
+		b.WriteString("None.\n")
+	}
+	for _, p := range stale {
+		if p.LastReviewed != "" {
+			fmt.Fprintf(&b, "- `%s`: last reviewed %s (%d days ago)\n", p.File, p.LastReviewed, p.AgeDays)
+		} else {
+			fmt.Fprintf(&b, "- `%s`: last changed %s (%d days ago)\n", p.File, p.LastChanged, p.AgeDays)
+		}
+	}
+
+	fmt.Fprintf(&b, "\n## Low quality\n\n")
+	if len(poor) == 0 {
+		b.WriteString("None.\n")
+	}
+	for _, p := range poor {
+		fmt.Fprintf(&b, "- `%s`: score %d, grade %.1f", p.File, p.Quality, p.Grade)
+		if len(p.Problems) > 0 {
+			fmt.Fprintf(&b, "; %s", strings.Join(p.Problems, "; "))
+		}
+		b.WriteString("\n")
+	}
+
+	fmt.Fprintf(&b, "\n## Acronyms\n\n")
+	acronyms := len(r.AcronymConflicts)
+	for _, c := range r.AcronymConflicts {
+		var uses []string
+		for _, expansion := range sortedKeys(c.Expansions) {
+			uses = append(uses, fmt.Sprintf("%q in %s", expansion, strings.Join(c.Expansions[expansion], ", ")))
+		}
+		fmt.Fprintf(&b, "- %s is spelled out inconsistently: %s\n", c.Acronym, strings.Join(uses, "; "))
+	}
+	for _, p := range r.Pages {
+		for _, a := range p.Acronyms {
+			fmt.Fprintf(&b, "- `%s:%s`\n", p.File, a)
+			acronyms++
+		}
+	}
+	if acronyms == 0 {
+		b.WriteString("None.\n")
+	}
+
+	fmt.Fprintf(&b, "\n## Orphan pages\n\n")
+	if len(orphans) == 0 {
+		b.WriteString("None.\n")
+	}
+	for _, p := range orphans {
+		fmt.Fprintf(&b, "- `%s`\n", p.File)
+	}
+
+	fmt.Fprintf(&b, "\n## All pages\n\n| Page | Last changed | Quality | Grade | Broken links | Orphan |\n| --- | --- | --- | --- | --- | --- |\n")
+	for _, p := range r.Pages {
+		orphan := ""
+		if p.Orphan {
+			orphan = "yes"
+		}
+		fmt.Fprintf(&b, "| `%s` | %s | %d | %.1f | %d | %s |\n", p.File, p.LastChanged, p.Quality, p.Grade, len(p.BrokenLinks), orphan)
+	}
+	return b.String()
+}
+
+// runReportCommand implements the report subcommand
+func runReportCommand(args []string) error {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	format := fs.String("format", "markdown", "Output format (markdown, json)")
+	output := fs.String("o", "", "Write the report to this file instead of stdout")
+	staleDays := fs.Int("stale-days", staleMaxAgeDays, "Report pages not reviewed or changed for this many days as stale, 0 to disable")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: mdrefactor report [flags] <docs-dir>")
+		fmt.Fprintln(fs.Output(), "Reports stale pages, quality scores, broken links, acronym usage and orphan pages of a docs tree. No API calls are made.")
+		fs.PrintDefaults()
+	}
+	positional := parseArgs(fs, args)
+	if len(positional) != 1 {
+		fs.Usage()
+		return fmt.Errorf("a docs directory is required")
+	}
+
+	report, err := buildDocsReport(positional[0], *staleDays)
+	if err != nil {
+		return err
+	}
+	var out string
+	switch *format {
+	case "markdown":
+		out = renderDocsReport(report)
+	case "json":
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		out = string(data) + "\n"
+	default:
+		return fmt.Errorf("unknown report format %q, expected markdown or json", *format)
+	}
+
+	if *output == "" {
+		fmt.Print(out)
+		return nil
+	}
+	if err := writeFileAtomic(*output, []byte(out), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", *output, err)
+	}
+	fmt.Fprintf(os.Stderr, "Report written to %s\n", *output)
+	return nil
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Files of an entry of the review queue
+const (
+	reviewEntryFile    = "entry.json"
+	reviewOriginalFile = "original.md"
+	reviewProposedFile = "proposed.md"
+	reviewDiffFile     = "changes.diff"
+)
+
+// reviewEntry describes an output held in the review queue
+type reviewEntry struct {
+	Target     string   `json:"target"`     // Absolute path of the file the output is written to when accepted
+	Confidence float64  `json:"confidence"` // Confidence score of the output
+	Changed    float64  `json:"changed"`    // Share of lines changed
+	Problems   []string `json:"problems,omitempty"`
+}
+
+// absTarget returns the absolute path of target, so that entries do not
+// depend on the working directory they were saved from
+func absTarget(target string) string {
+	abs, err := filepath.Abs(target)
+	if err != nil {
+		return filepath.Clean(target)
+	}
+	return abs
+}
+
+// reviewKey returns the path of the entry for target below the review
+// directory, made from its absolute path
+func reviewKey(target string) string {
+	return strings.NewReplacer(":", "", `\`, "/").Replace(strings.TrimLeft(absTarget(target), `/\`))
+}
+
+// saveForReview adds an output to the review queue in dir, as the original,
+// the proposed content and the diff between them, and returns the entry's directory
+func saveForReview(dir string, entry reviewEntry, original, proposed string) (string, error) {
+	entry.Target = absTarget(entry.Target)
+	entryDir := filepath.Join(dir, reviewKey(entry.Target))
+	if err := os.MkdirAll(entryDir, 0755); err != nil {
+		return "", err
+	}
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	diff := lineDiff(filepath.ToSlash(entry.Target), filepath.ToSlash(entry.Target)+" (proposed)", original, proposed)
+	files := map[string][]byte{
+		reviewEntryFile:    append(data, '\n'),
+		reviewOriginalFile: []byte(original),
+		reviewProposedFile: []byte(proposed),
+		reviewDiffFile:     []byte(diff),
+	}
+	for _, name := range sortedKeys(files) {
+		if err := writeFileAtomic(filepath.Join(entryDir, name), files[name], 0644); err != nil {
+			return "", fmt.Errorf("failed to write %s: %w", filepath.Join(entryDir, name), err)
+		}
+	}
+	return entryDir, nil
+}
+
+// readReviewEntry reads the entry of the review queue in dir for arg, which
+// is either the entry's directory or the file it proposes to change
+func readReviewEntry(dir, arg string) (string, reviewEntry, error) {
+	var entry reviewEntry
+	entryDir := arg
+	if _, err := os.Stat(filepath.Join(entryDir, reviewEntryFile)); err != nil {
+		entryDir = filepath.Join(dir, reviewKey(arg))
+	}
+	data, err := os.ReadFile(filepath.Join(entryDir, reviewEntryFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", entry, fmt.Errorf("%s is not in the review queue %s", arg, dir)
+	} else if err != nil {
+		return "", entry, err
+	}
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return "", entry, fmt.Errorf("failed to parse %s: %w", filepath.Join(entryDir, reviewEntryFile), err)
+	}
+	return entryDir, entry, nil
+}
+
+// removeReviewEntry deletes an entry and the directories of the queue it leaves empty
+func removeReviewEntry(dir, entryDir string) error {
+	if err := os.RemoveAll(entryDir); err != nil {
+		return err
+	}
+	root := filepath.Clean(dir)
+	for parent := filepath.Dir(entryDir); parent != root && parent != "." && len(parent) > len(root); parent = filepath.Dir(parent) {
+		if os.Remove(parent) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// acceptReview writes the proposed content of an entry to its target and
+// removes the entry. A target changed since the entry was created is only
+// overwritten with force.
+func acceptReview(dir, arg string, force bool) (string, error) {
+	entryDir, entry, err := readReviewEntry(dir, arg)
+	if err != nil {
+		return "", err
+	}
+	original, err := os.ReadFile(filepath.Join(entryDir, reviewOriginalFile))
+	if err != nil {
+		return "", err
+	}
+	proposed, err := os.ReadFile(filepath.Join(entryDir, reviewProposedFile))
+	if err != nil {
+		return "", err
+	}
+
+	data := proposed
+	current, err := os.ReadFile(entry.Target)
+	switch {
+	case err == nil:
+		source := decodeSource(current)
+		if source.text != string(original) && !force {
+			return "", fmt.Errorf("%s changed since its output was held for review, use -force to overwrite it or reject the output", entry.Target)
+		}
+		// Keep the line endings and encoding of the file
+		if data, err = source.encode(string(proposed), outputPolicy{eol: "preserve", encoding: "preserve"}); err != nil {
+			return "", err
+		}
+	case !errors.Is(err, fs.ErrNotExist):
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(entry.Target), 0755); err != nil {
+		return "", err
+	}
+	if err := writeFileAtomic(entry.Target, data, 0644); err != nil {
+		return "", fmt.Errorf("failed to write %s: %w", entry.Target, err)
+	}
+	return entry.Target, removeReviewEntry(dir, entryDir)
+}
+
+// listReviews returns the entries of the review queue in dir by directory
+func listReviews(dir string) (map[string]reviewEntry, error) {
+	entries := make(map[string]reviewEntry)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) && path == dir {
+			return filepath.SkipAll
+		}
+		if err != nil || d.IsDir() || d.Name() != reviewEntryFile {
+			return err
+		}
+		entryDir, entry, err := readReviewEntry(dir, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		entries[entryDir] = entry
+		return nil
+	})
+	return entries, err
+}
+
+// runReviewCommand implements the review subcommand
+func runReviewCommand(args []string) error {
+	fs := flag.NewFlagSet("review", flag.ExitOnError)
+	dir := fs.String("dir", defaultReviewDir, "Directory of the review queue")
+	force := fs.Bool("force", false, "With accept, overwrite files that changed since their output was held for review")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: mdrefactor review list|accept|reject [flags] [<file>...]")
+		fmt.Fprintln(fs.Output(), "Lists the outputs held for review, writes them to their files (accept) or discards them (reject).")
+		fmt.Fprintln(fs.Output(), "A <file> is the file an output was meant for or its directory in the queue.")
+		fs.PrintDefaults()
+	}
+	positional := parseArgs(fs, args)
+	if len(positional) == 0 {
+		fs.Usage()
+		return fmt.Errorf("a review command is required")
+	}
+
+	switch command, files := positional[0], positional[1:]; command {
+	case "list":
+		entries, err := listReviews(*dir)
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			fmt.Printf("No outputs held for review in %s\n", *dir)
+			return nil
+		}
+		for _, entryDir := range sortedKeys(entries) {
+			e := entries[entryDir]
+			fmt.Printf("%s\tconfidence %.2f, %.0f%% of lines changed\t%s\n", e.Target, e.Confidence, 100*e.Changed, filepath.Join(entryDir, reviewDiffFile))
+		}
+		return nil
+	case "accept", "reject":
+		if len(files) == 0 {
+			fs.Usage()
+			return fmt.Errorf("at least one file is required")
+		}
+		for _, file := range files {
+			if command == "accept" {
+				target, err := acceptReview(*dir, file, *force)
+				if err != nil {
+					return err
+				}
+				fmt.Printf("Accepted the proposed output, %s updated\n", target)
+				continue
+			}
+			entryDir, entry, err := readReviewEntry(*dir, file)
+			if err != nil {
+				return err
+			}
+			if err := removeReviewEntry(*dir, entryDir); err != nil {
+				return err
+			}
+			fmt.Printf("Rejected the proposed output for %s\n", entry.Target)
+		}
+		return nil
+	}
+	fs.Usage()
+	return fmt.Errorf("unknown review command %q", positional[0])
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// System prompt used to explain the changes of the sections of a document
+const reviewNotesSystemPrompt = "You help reviewers of a documentation change. For every numbered section diff of the " +
+	"document, explain in one or two sentences what changed and why it improves the document, such as clearer " +
+	"structure, fixed facts or removed duplication. Name risks a reviewer should check, such as dropped information. " +
+	"Base the notes on the diffs only."
+
+// reviewNotesResponseFormat makes the API return one note per section as JSON
+var reviewNotesResponseFormat = map[string]any{
+	"type": "json_schema",
+	"json_schema": map[string]any{
+		"name":   "review_notes",
+		"strict": true,
+		"schema": map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"notes": map[string]any{
+					"type": "array",
+					"items": map[string]any{
+						"type": "object",
+						"properties": map[string]any{
+							"section":   map[string]any{"type": "integer", "description": "Number of the section diff"},
+							"rationale": map[string]any{"type": "string", "description": "What changed and why"},
+						},
+						"required":             []string{"section", "rationale"},
+						"additionalProperties": false,
+					},
+				},
+			},
+			"required":             []string{"notes"},
+			"additionalProperties": false,
+		},
+	},
+}
+
+// sectionChange is the part of the changes of a document that falls into
+// one of its sections, anchored at the first changed line for a review
+// comment
+type sectionChange struct {
+	File      string `json:"file"` // Slash-separated path relative to the repository root
+	Heading   string `json:"heading,omitempty"`
+	Anchor    string `json:"anchor,omitempty"`
+	Line      int    `json:"line"` // 1-based line the comment is anchored at
+	Side      string `json:"side"` // RIGHT for a line of the new version, LEFT for one of the old version
+	Diff      string `json:"diff"`
+	Rationale string `json:"rationale,omitempty"`
+}
+
+// title returns the heading of the section, or a description of the part
+// of the document before the first heading
+func (c sectionChange) title() string {
+	if c.Heading == "" {
+		return "Top of the document"
+	}
+	return c.Heading
+}
+
+// sectionChanges splits the changes from original to updated by the section
+// of updated they fall into. A run of changed lines belongs to the section
+// of its first added line, a run of removed lines alone to the section of
+// the line before it.
+func sectionChanges(file, original, updated string) []sectionChange {
+	var originalLines []string
+	if original != "" {
+		originalLines = strings.Split(original, "\n")
+	}
+	edits := diffLines(originalLines, strings.Split(updated, "\n"))
+	sections := splitSections(updated)
+	sectionOf := func(line int) int {
+		for i, s := range sections {
+			if line < s.EndLine {
+				return i
+			}
+		}
+		return len(sections) - 1
+	}
+
+	type run struct{ start, end, section int }
+	var runs []run
+	for k := 0; k < len(edits); {
+		if edits[k].kind == ' ' {
+			k++
+			continue
+		}
+		r := run{start: k, section: -1}
+		for k < len(edits) && edits[k].kind != ' ' {
+			if edits[k].kind == '+' && r.section < 0 {
+				r.section = sectionOf(edits[k].bi)
+			}
+			k++
+		}
+		r.end = k
+		if r.section < 0 {
+			r.section = sectionOf(max(edits[r.start].bi-1, 0))
+		}
+		runs = append(runs, r)
+	}
+
+	var changes []sectionChange
+	for i := 0; i < len(runs); {
+		j := i
+		for j+1 < len(runs) && runs[j+1].section == runs[i].section {
+			j++
+		}
+		// Context lines stop where the changes of another section start
+		lo, hi := max(runs[i].start-diffContext, 0), min(runs[j].end+diffContext, len(edits))
+		if i > 0 {
+			lo = max(lo, runs[i-1].end)
+		}
+		if j+1 < len(runs) {
+			hi = min(hi, runs[j+1].start)
+		}
+		c := sectionChange{File: file, Diff: formatHunks(edits[lo:hi])}
+		if s := sections[runs[i].section]; s.Heading != "" {
+			c.Heading, c.Anchor = s.Heading, s.Anchor
+		}
+		for _, e := range edits[runs[i].start:runs[j].end] {
+			if e.kind == '+' {
+				c.Line, c.Side = e.bi+1, "RIGHT"
+				break
+			}
+		}
+		if c.Line == 0 {
+			c.Line, c.Side = edits[runs[i].start].ai+1, "LEFT"
+		}
+		changes = append(changes, c)
+		i = j + 1
+	}
+	return changes
+}
+
+// gitOriginal returns the content of the file at rel, relative to the
+// repository root, in revision base, or "" if it does not exist there
+func gitOriginal(root, base, rel string) string {
+	out, err := exec.Command("git", "-C", root, "show", base+":"+rel).Output()
+	if err != nil {
+		return ""
+	}
+	return decodeSource(out).text
+}
+
+// annotateChanges sets the rationale of the changed sections of a document
+// from the change notes of the run that made them. Notes on sections that
+// have no changes of their own, such as removed ones, go to the first change.
+func annotateChanges(changes []sectionChange, notes []changeNote) {
+	rationales := make([][]string, len(changes))
+	for _, note := range notes {
+		text := strings.TrimSuffix(strings.TrimSpace(note.Change), ".") + "."
+		if reason := strings.TrimSpace(note.Reason); reason != "" {
+			text += " " + reason
+		}
+		target := 0
+		for i, c := range changes {
+			if strings.EqualFold(strings.TrimSpace(strings.TrimLeft(note.Section, "# ")), c.Heading) {
+				target = i
+				break
+			}
+		}
+		rationales[target] = append(rationales[target], text)
+	}
+	for i, r := range rationales {
+		if len(r) > 0 {
+			changes[i].Rationale = strings.Join(r, " ")
+		}
+	}
+}
+
+// explainChanges asks the model for the rationale of every changed section
+// of a document that has none yet
+func explainChanges(apiKey, model string, changes []sectionChange) error {
+	var prompt strings.Builder
+	fmt.Fprintf(&prompt, "Document: %s\n\n", changes[0].File)
+	for i, c := range changes {
+		fmt.Fprintf(&prompt, "[%d] Section: %s\n```diff\n%s```\n\n", i+1, c.title(), c.Diff)
+	}
+	reply, err := chatCompletionParams(context.Background(), apiKey, model, []Message{
+		{Role: "system", Content: reviewNotesSystemPrompt},
+		{Role: "user", Content: prompt.String()},
+	}, completionParams{responseFormat: reviewNotesResponseFormat})
+	if err != nil {
+		return err
+	}
+	var notes struct {
+		Notes []struct {
+			Section   int    `json:"section"`
+			Rationale string `json:"rationale"`
+		} `json:"notes"`
+	}
+	if err := decodeJSONReply(reply, &notes); err != nil {
+		return err
+	}
+	for _, n := range notes.Notes {
+		if n.Section >= 1 && n.Section <= len(changes) && changes[n.Section-1].Rationale == "" {
+			changes[n.Section-1].Rationale = strings.TrimSpace(n.Rationale)
+		}
+	}
+	return nil
+}
+
+// writeReviewMarkdown writes the changes as a Markdown document with a
+// section per changed file and a diff per changed section
+func writeReviewMarkdown(w io.Writer, changes []sectionChange, files int) {
+	fmt.Fprintf(w, "# Review of %d changed sections in %d files\n", len(changes), files)
+	file := ""
+	for _, c := range changes {
+		if c.File != file {
+			file = c.File
+			fmt.Fprintf(w, "\n## %s\n", file)
+		}
+		fmt.Fprintf(w, "\n### %s (line %d)\n\n", c.title(), c.Line)
+		if c.Rationale != "" {
+			fmt.Fprintf(w, "%s\n\n", c.Rationale)
+		}
+		fmt.Fprintf(w, "```diff\n%s```\n", c.Diff)
+	}
+}
+
+// reviewCommentBody returns the body of the review comment of a change
+func reviewCommentBody(c sectionChange) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "**%s**\n\n", c.title())
+	if c.Rationale != "" {
+		fmt.Fprintf(&b, "%s\n\n", c.Rationale)
+	}
+	fmt.Fprintf(&b, "<details><summary>Changes to this section</summary>\n\n```diff\n%s```\n\n</details>\n", c.Diff)
+	return b.String()
+}
+
+// postReview posts the changes as a pull request review with one comment
+// per changed section
+func postReview(gh *githubClient, number int, changes []sectionChange, files int) error {
+	type comment struct {
+		Path string `json:"path"`
+		Line int    `json:"line"`
+		Side string `json:"side"`
+		Body string `json:"body"`
+	}
+	review := struct {
+		Event    string    `json:"event"`
+		Body     string    `json:"body"`
+		Comments []comment `json:"comments"`
+	}{
+		Event: "COMMENT",
+		Body:  fmt.Sprintf("Section-by-section review of the documentation changes: %d changed sections in %d files.", len(changes), files),
+	}
+	for _, c := range changes {
+		review.Comments = append(review.Comments, comment{Path: c.File, Line: c.Line, Side: c.Side, Body: reviewCommentBody(c)})
+	}
+	return gh.do("POST", fmt.Sprintf("/pulls/%d/reviews", number), review, nil)
+}
+
+// runReviewCommentsCommand implements the review-comments subcommand
+func runReviewCommentsCommand(args []string) error {
+	fs := flag.NewFlagSet("review-comments", flag.ExitOnError)
+	apiKey := fs.String("apikey", os.Getenv("OPENAI_API_KEY"), "OpenAI API key (can also be set via OPENAI_API_KEY environment variable)")
+	addAPIFlags(fs)
+	model := fs.String("model", defaultModel, "OpenAI model to use for -explain (must support structured outputs)")
+	base := fs.String("base", "HEAD", "Git revision the documents are compared with")
+	explain := fs.Bool("explain", false, "Ask the model for the rationale of every changed section the change notes do not explain")
+	changeNotesFile := fs.String("change-notes", defaultChangeNotesFile, "Change notes saved by a run with -change-notes, used as the rationale of the sections they name (ignored if missing)")
+	format := fs.String("format", "markdown", "Format of the review artifact: markdown or json")
+	outputFile := fs.String("o", "", "File to write the review artifact to (stdout by default)")
+	pr := fs.Int("pr", 0, "Post the changes as a review of this GitHub pull request, one comment per changed section, instead of writing the artifact")
+	repo := fs.String("repo", "", "With -pr, the GitHub repository as owner/name or URL, the origin remote of the current directory by default")
+	token := fs.String("github-token", "", "With -pr, the GitHub token, GITHUB_TOKEN or GH_TOKEN by default")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: mdrefactor review-comments [flags] <file-or-dir>...")
+		fmt.Fprintln(fs.Output(), "Splits the changes of documents since a git revision by section, each with its diff and rationale, for a review per section instead of one large diff.")
+		fs.PrintDefaults()
+	}
+	positional := parseArgs(fs, args)
+	if len(positional) == 0 {
+		fs.Usage()
+		return fmt.Errorf("at least one file or directory is required")
+	}
+	if *format != "markdown" && *format != "json" {
+		return fmt.Errorf("unknown format %q, expected markdown or json", *format)
+	}
+	files, err := expandMarkdownArgs(positional)
+	if err != nil {
+		return err
+	}
+	savedNotes, err := loadChangeNotes(*changeNotesFile)
+	if err != nil {
+		return err
+	}
+	notes := make(map[string][]changeNote, len(savedNotes))
+	for file, fileNotes := range savedNotes {
+		notes[mustAbs(file)] = fileNotes
+	}
+
+	var changes []sectionChange
+	changedFiles := 0
+	for _, file := range files {
+		abs := mustAbs(file)
+		root := treeRoot(filepath.Dir(abs))
+		if err := exec.Command("git", "-C", root, "rev-parse", "--verify", "--quiet", *base+"^{commit}").Run(); err != nil {
+			return fmt.Errorf("%s is not in a git repository with revision %s", file, *base)
+		}
+		rel, err := filepath.Rel(root, abs)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", file, err)
+		}
+		fileChanges := sectionChanges(rel, gitOriginal(root, *base, rel), decodeSource(data).text)
+		if len(fileChanges) == 0 {
+			continue
+		}
+		annotateChanges(fileChanges, notes[abs])
+		if *explain && slices.ContainsFunc(fileChanges, func(c sectionChange) bool { return c.Rationale == "" }) {
+			fmt.Fprintf(os.Stderr, "Explaining the changes of %s...\n", rel)
+			if err := explainChanges(*apiKey, *model, fileChanges); err != nil {
+				return fmt.Errorf("failed to explain the changes of %s: %w", rel, err)
+			}
+		}
+		changes = append(changes, fileChanges...)
+		changedFiles++
+	}
+	if len(changes) == 0 {
+		fmt.Fprintf(os.Stderr, "No document changed since %s.\n", *base)
+		return nil
+	}
+
+	if *pr > 0 {
+		gh, err := newGitHubClient(*repo, *token)
+		if err != nil {
+			return err
+		}
+		if err := postReview(gh, *pr, changes, changedFiles); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Posted a review of #%d with %d comments on %d files\n", *pr, len(changes), changedFiles)
+		return nil
+	}
+
+	out := os.Stdout
+	if *outputFile != "" {
+		f, err := os.Create(*outputFile)
+		if err != nil {
+			return fmt.Errorf("failed to create %s: %w", *outputFile, err)
+		}
+		defer f.Close()
+		out = f
+	}
+	if *format == "json" {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(changes); err != nil {
+			return err
+		}
+	} else {
+		writeReviewMarkdown(out, changes, changedFiles)
+	}
+	if *outputFile != "" {
+		fmt.Fprintf(os.Stderr, "Review of %d changed sections in %d files written to %s\n", len(changes), changedFiles, *outputFile)
+	}
+	return nil
+}
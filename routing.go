@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/yuin/goldmark/ast"
+	extast "github.com/yuin/goldmark/extension/ast"
+)
+
+// Limits up to which a document counts as simple enough for the cheap model
+const (
+	defaultRoutingMaxTokens       = 1500
+	defaultRoutingMaxTableDensity = 0.2
+	defaultRoutingMaxCodeRatio    = 0.3
+)
+
+// routingConfig is the routing section of the config file
+type routingConfig struct {
+	CheapModel      string  `json:"cheap_model"`       // Model simple documents are sent to, no routing if empty
+	MaxTokens       int     `json:"max_tokens"`        // Longest simple document, in estimated tokens
+	MaxTableDensity float64 `json:"max_table_density"` // Largest share of table lines of a simple document
+	MaxCodeRatio    float64 `json:"max_code_ratio"`    // Largest share of code lines of a simple document
+}
+
+// Routing policy of the project, set from the routing section of the config file
+var configRouting routingConfig
+
+// applyRoutingConfig applies the routing section of the config file
+func applyRoutingConfig(cfg routingConfig) error {
+	if cfg.MaxTokens < 0 || cfg.MaxTableDensity < 0 || cfg.MaxTableDensity > 1 || cfg.MaxCodeRatio < 0 || cfg.MaxCodeRatio > 1 {
+		return fmt.Errorf("routing: max_tokens must not be negative, max_table_density and max_code_ratio must be between 0 and 1")
+	}
+	configRouting = cfg
+	return nil
+}
+
+// withDefaults returns the config with the default limits for omitted values
+func (c routingConfig) withDefaults() routingConfig {
+	if c.MaxTokens == 0 {
+		c.MaxTokens = defaultRoutingMaxTokens
+	}
+	if c.MaxTableDensity == 0 {
+		c.MaxTableDensity = defaultRoutingMaxTableDensity
+	}
+	if c.MaxCodeRatio == 0 {
+		c.MaxCodeRatio = defaultRoutingMaxCodeRatio
+	}
+	return c
+}
+
+// complexity is what routing looks at to judge how hard a document is to
+// refactor well
+type complexity struct {
+	tokens       int     // Estimated tokens
+	tableDensity float64 // Share of non-blank lines in tables
+	codeRatio    float64 // Share of non-blank lines in code blocks
+}
+
+// measureComplexity measures content
+func measureComplexity(content string) complexity {
+	d := parseMarkdown(content)
+	table := make([]bool, len(d.lines))
+	ast.Walk(d.root, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if entering && n.Kind() == extast.KindTable {
+			if first, last, ok := d.span(n); ok {
+				for i := first; i <= last; i++ {
+					table[i] = true
+				}
+			}
+			return ast.WalkSkipChildren, nil
+		}
+		return ast.WalkContinue, nil
+	})
+	code := d.codeLines()
+
+	nonBlank, tableLines, codeLines := 0, 0, 0
+	for i, line := range d.lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		nonBlank++
+		switch {
+		case table[i]:
+			tableLines++
+		case code[i]:
+			codeLines++
+		}
+	}
+	c := complexity{tokens: estimateTokens(content)}
+	if nonBlank > 0 {
+		c.tableDensity = float64(tableLines) / float64(nonBlank)
+		c.codeRatio = float64(codeLines) / float64(nonBlank)
+	}
+	return c
+}
+
+func (c complexity) String() string {
+	return fmt.Sprintf("about %d tokens, %.0f%% tables, %.0f%% code", c.tokens, c.tableDensity*100, c.codeRatio*100)
+}
+
+// modelRouter sends simple documents to a cheap model and the others to a
+// strong one, and keeps count for the summary at the end of a run. It is
+// safe for concurrent use by the workers of a -dir run.
+type modelRouter struct {
+	cheap, strong string
+	limits        routingConfig
+
+	mu     sync.Mutex
+	files  map[string]int // Documents sent by model
+	tokens map[string]int // Estimated input tokens sent by model
+}
+
+// newModelRouter returns a router choosing between cheap and strong
+func newModelRouter(cheap, strong string, limits routingConfig) *modelRouter {
+	return &modelRouter{cheap: cheap, strong: strong, limits: limits.withDefaults(), files: make(map[string]int), tokens: make(map[string]int)}
+}
+
+// route returns the model content is sent to and why
+func (r *modelRouter) route(content string) (string, string) {
+	c := measureComplexity(content)
+	var reasons []string
+	if c.tokens > r.limits.MaxTokens {
+		reasons = append(reasons, fmt.Sprintf("longer than %d tokens", r.limits.MaxTokens))
+	}
+	if c.tableDensity > r.limits.MaxTableDensity {
+		reasons = append(reasons, fmt.Sprintf("more than %.0f%% tables", r.limits.MaxTableDensity*100))
+	}
+	if c.codeRatio > r.limits.MaxCodeRatio {
+		reasons = append(reasons, fmt.Sprintf("more than %.0f%% code", r.limits.MaxCodeRatio*100))
+	}
+	// The reply has to fit as well, which the strong model is sized for
+	if info, ok := lookupModel(r.cheap); ok && info.inputTokens() > 0 && c.tokens > info.inputTokens() {
+		reasons = append(reasons, "too large for "+r.cheap)
+	}
+
+	model := r.cheap
+	if len(reasons) > 0 {
+		model = r.strong
+	}
+	r.mu.Lock()
+	r.files[model]++
+	r.tokens[model] += c.tokens
+	r.mu.Unlock()
+	if len(reasons) == 0 {
+		return model, c.String()
+	}
+	return model, c.String() + "; " + strings.Join(reasons, ", ")
+}
+
+// reset forgets the documents counted so far
+func (r *modelRouter) reset() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	clear(r.files)
+	clear(r.tokens)
+}
+
+// estimateCost estimates the price in USD of refactoring tokens of input
+// with model, whose reply is about as long. ok is false if the model has no
+// known prices.
+func estimateCost(model string, tokens int) (float64, bool) {
+	info, ok := lookupModel(model)
+	if !ok || info.InputPrice == 0 {
+		return 0, false
+	}
+	return float64(tokens) * (info.InputPrice + info.OutputPrice) / 1e6, true
+}
+
+// printSummary prints how many documents went to each model and what the
+// routing saved compared to sending all of them to the strong model
+func (r *modelRouter) printSummary() {
+	if r == nil || len(r.files) == 0 {
+		return
+	}
+	fmt.Printf("Routed %d documents to %s and %d to %s", r.files[r.cheap], r.cheap, r.files[r.strong], r.strong)
+	cheap, cheapOK := estimateCost(r.cheap, r.tokens[r.cheap])
+	strong, strongOK := estimateCost(r.strong, r.tokens[r.strong])
+	unrouted, _ := estimateCost(r.strong, r.tokens[r.cheap]+r.tokens[r.strong])
+	if cheapOK && strongOK {
+		fmt.Printf(", an estimated $%.2f instead of $%.2f", cheap+strong, unrouted)
+	}
+	fmt.Println(".")
+}
+
+// routedRefactor returns the base of the refactoring pipeline, sending every
+// document to the model the router picks for it
+func routedRefactor(apiKey string, r *modelRouter) refactorFunc {
+	return func(systemPrompt, content string) (string, error) {
+		model, reason := r.route(content)
+		fmt.Printf("Routing to %s (%s)\n", model, reason)
+		return refactorMarkdown(apiKey, model, systemPrompt, content)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strconv"
+	"sync"
+)
+
+// JSON-RPC error codes
+const (
+	rpcParseError     = -32700
+	rpcInvalidParams  = -32602
+	rpcMethodNotFound = -32601
+	rpcInternalError  = -32603
+)
+
+// rpcMessage is a JSON-RPC 2.0 request, notification or response
+type rpcMessage struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id,omitempty"`
+	Method  string           `json:"method,omitempty"`
+	Params  json.RawMessage  `json:"params,omitempty"`
+	Result  any              `json:"result,omitempty"`
+	Error   *rpcError        `json:"error,omitempty"`
+}
+
+// rpcError is the error object of a failed JSON-RPC request
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// Error implements the error interface
+func (e *rpcError) Error() string {
+	return e.Message
+}
+
+// rpcConn reads and writes JSON-RPC messages framed with Content-Length
+// headers, as used by the Language Server Protocol, or one per line
+type rpcConn struct {
+	r         *textproto.Reader
+	delimited bool       // One message per line instead of Content-Length framing
+	mu        sync.Mutex // Serializes writes from concurrent handlers
+	w         io.Writer
+}
+
+// newRPCConn creates a connection with Content-Length framing reading from r and writing to w
+func newRPCConn(r io.Reader, w io.Writer) *rpcConn {
+	return &rpcConn{r: textproto.NewReader(bufio.NewReader(r)), w: w}
+}
+
+// newLineRPCConn creates a connection exchanging one message per line
+func newLineRPCConn(r io.Reader, w io.Writer) *rpcConn {
+	return &rpcConn{r: textproto.NewReader(bufio.NewReader(r)), delimited: true, w: w}
+}
+
+// read returns the next message
+func (c *rpcConn) read() (*rpcMessage, error) {
+	if c.delimited {
+		line, err := c.r.R.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) == 0 {
+			if err == nil {
+				return c.read()
+			}
+			return nil, err
+		}
+		return decodeRPCMessage(line)
+	}
+
+	header, err := c.r.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	length, err := strconv.Atoi(header.Get("Content-Length"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid Content-Length header: %w", err)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(c.r.R, body); err != nil {
+		return nil, err
+	}
+	return decodeRPCMessage(body)
+}
+
+// decodeRPCMessage decodes the JSON body of a message
+func decodeRPCMessage(body []byte) (*rpcMessage, error) {
+	var msg rpcMessage
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return nil, &rpcError{Code: rpcParseError, Message: err.Error()}
+	}
+	return &msg, nil
+}
+
+// write sends a message
+func (c *rpcConn) write(msg *rpcMessage) error {
+	msg.JSONRPC = "2.0"
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.delimited {
+		_, err := c.w.Write(append(body, '\n'))
+		return err
+	}
+	if _, err := fmt.Fprintf(c.w, "Content-Length: %d\r\n\r\n", len(body)); err != nil {
+		return err
+	}
+	_, err = c.w.Write(body)
+	return err
+}
+
+// reply answers the request with the given id with a result or an error
+func (c *rpcConn) reply(id *json.RawMessage, result any, err error) error {
+	if id == nil {
+		// Notifications are never answered
+		return nil
+	}
+	msg := &rpcMessage{ID: id}
+	if err != nil {
+		rerr, ok := err.(*rpcError)
+		if !ok {
+			rerr = &rpcError{Code: rpcInternalError, Message: err.Error()}
+		}
+		msg.Error = rerr
+	} else {
+		if result == nil {
+			result = json.RawMessage("null")
+		}
+		msg.Result = result
+	}
+	return c.write(msg)
+}
+
+// notify sends a notification
+func (c *rpcConn) notify(method string, params any) error {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	return c.write(&rpcMessage{Method: method, Params: data})
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// System prompt used by the summarize method
+const summarizeSystemPrompt = "You are a technical writer. Summarize the Markdown content in one short paragraph. Reply with the summary only."
+
+// rpcTextParams are the parameters of the refactor, proofread and summarize methods
+type rpcTextParams struct {
+	Content string `json:"content"`
+	Prompt  string `json:"prompt,omitempty"` // Overrides the system prompt of refactor
+	Model   string `json:"model,omitempty"`
+	Stream  bool   `json:"stream,omitempty"` // Send the reply as chunk notifications while it is generated
+}
+
+// rpcChunk is the params of a chunk notification carrying part of a streamed reply
+type rpcChunk struct {
+	ID   *json.RawMessage `json:"id"`
+	Text string           `json:"text"`
+}
+
+// rpcSectionParams are the parameters of the sections and replaceSection methods
+type rpcSectionParams struct {
+	Content string `json:"content"`
+	Anchor  string `json:"anchor,omitempty"` // Section to replace, empty for the part before the first heading
+	Text    string `json:"text,omitempty"`   // Replacement of the section, including its heading
+}
+
+// rpcSection is a section of a document as returned by the sections method
+type rpcSection struct {
+	Heading string `json:"heading"`
+	Anchor  string `json:"anchor"`
+	Level   int    `json:"level"`
+	Line    int    `json:"line"`     // 1-based line of the heading
+	EndLine int    `json:"end_line"` // 1-based last line of the section
+	Start   int    `json:"start"`    // Byte offset of the section in the content
+	End     int    `json:"end"`      // Byte offset one past the end of the section
+}
+
+// sectionCall runs one of the methods working on the sections of a document,
+// so that frontends can offer to refactor a document section by section
+func sectionCall(msg *rpcMessage) (any, error) {
+	var p rpcSectionParams
+	if err := json.Unmarshal(msg.Params, &p); err != nil {
+		return nil, &rpcError{Code: rpcInvalidParams, Message: err.Error()}
+	}
+	if msg.Method == "replaceSection" {
+		content, err := replaceSection(p.Content, p.Anchor, p.Text)
+		if err != nil {
+			return nil, &rpcError{Code: rpcInvalidParams, Message: err.Error()}
+		}
+		return map[string]string{"content": content}, nil
+	}
+	sections := []rpcSection{}
+	for _, sec := range splitSections(p.Content) {
+		sections = append(sections, rpcSection{
+			Heading: sec.Heading,
+			Anchor:  sec.Anchor,
+			Level:   sec.Level,
+			Line:    sec.StartLine + 1,
+			EndLine: sec.EndLine,
+			Start:   sec.Start,
+			End:     sec.End,
+		})
+	}
+	return map[string][]rpcSection{"sections": sections}, nil
+}
+
+// rpcServer serves refactoring methods over JSON-RPC, one message per line,
+// for editor plugins that do not speak the full Language Server Protocol
+type rpcServer struct {
+	conn   *rpcConn
+	apiKey string
+	model  string
+	prompt string
+
+	mu      sync.Mutex
+	cancels map[string]context.CancelFunc // Running requests by id
+	running sync.WaitGroup
+}
+
+// call runs one of the text methods and replies with its result
+func (s *rpcServer) call(ctx context.Context, msg *rpcMessage) (any, error) {
+	var p rpcTextParams
+	if err := json.Unmarshal(msg.Params, &p); err != nil {
+		return nil, &rpcError{Code: rpcInvalidParams, Message: err.Error()}
+	}
+	model := s.model
+	if p.Model != "" {
+		model = p.Model
+	}
+
+	var messages []Message
+	switch msg.Method {
+	case "refactor":
+		prompt := s.prompt
+		if p.Prompt != "" {
+			prompt = p.Prompt
+		}
+		messages = []Message{
+			{Role: "system", Content: prompt},
+			{Role: "user", Content: fmt.Sprintf("Refactor the following Markdown content:\n\n%s", p.Content)},
+		}
+	case "proofread":
+		messages = []Message{{Role: "system", Content: proofreadSystemPrompt}, {Role: "user", Content: p.Content}}
+	case "summarize":
+		messages = []Message{{Role: "system", Content: summarizeSystemPrompt}, {Role: "user", Content: p.Content}}
+	}
+
+	if !p.Stream {
+		content, err := chatCompletionContext(ctx, s.apiKey, model, messages)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]string{"content": content}, nil
+	}
+
+	var content strings.Builder
+	err := chatCompletionStream(ctx, s.apiKey, model, messages, func(chunk string) error {
+		content.WriteString(chunk)
+		return s.conn.notify("chunk", rpcChunk{ID: msg.ID, Text: chunk})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"content": content.String()}, nil
+}
+
+// handle processes one message; API calls run concurrently so that requests
+// can be cancelled while they are in flight
+func (s *rpcServer) handle(msg *rpcMessage) {
+	switch msg.Method {
+	case "refactor", "proofread", "summarize":
+		ctx, cancel := context.WithCancel(withRetryBudget(context.Background()))
+		key := ""
+		if msg.ID != nil {
+			key = string(*msg.ID)
+			s.mu.Lock()
+			s.cancels[key] = cancel
+			s.mu.Unlock()
+		}
+		s.running.Add(1)
+		go func() {
+			defer s.running.Done()
+			defer func() {
+				s.mu.Lock()
+				delete(s.cancels, key)
+				s.mu.Unlock()
+				cancel()
+			}()
+			result, err := s.call(ctx, msg)
+			if err := s.conn.reply(msg.ID, result, err); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			}
+		}()
+	case "sections", "replaceSection":
+		result, err := sectionCall(msg)
+		s.conn.reply(msg.ID, result, err)
+	case "cancel":
+		var p struct {
+			ID json.RawMessage `json:"id"`
+		}
+		if json.Unmarshal(msg.Params, &p) == nil {
+			s.mu.Lock()
+			if cancel, ok := s.cancels[string(p.ID)]; ok {
+				cancel()
+			}
+			s.mu.Unlock()
+		}
+		s.conn.reply(msg.ID, nil, nil)
+	default:
+		s.conn.reply(msg.ID, nil, &rpcError{Code: rpcMethodNotFound, Message: "method not supported: " + msg.Method})
+	}
+}
+
+// runRPCCommand implements the rpc subcommand
+func runRPCCommand(args []string) error {
+	fs := flag.NewFlagSet("rpc", flag.ExitOnError)
+	apiKey := fs.String("apikey", os.Getenv("OPENAI_API_KEY"), "OpenAI API key (can also be set via OPENAI_API_KEY environment variable)")
+	addAPIFlags(fs)
+	model := fs.String("model", defaultModel, "OpenAI model to use unless a request names another")
+	prompt := fs.String("prompt", defaultSystemPrompt, "System prompt of the refactor method")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: mdrefactor rpc [flags]")
+		fmt.Fprintln(fs.Output(), "Serves the refactor, proofread, summarize, sections, replaceSection and cancel methods as JSON-RPC 2.0, one message per line on stdin and stdout.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	// stdout belongs to the protocol; progress messages go to stderr
+	conn := newLineRPCConn(os.Stdin, os.Stdout)
+	os.Stdout = os.Stderr
+
+	s := &rpcServer{conn: conn, apiKey: *apiKey, model: *model, prompt: *prompt, cancels: make(map[string]context.CancelFunc)}
+	for {
+		msg, err := conn.read()
+		if err == io.EOF {
+			// Answer the requests still in flight before exiting
+			s.running.Wait()
+			return nil
+		}
+		if rerr, ok := err.(*rpcError); ok {
+			id := json.RawMessage("null")
+			conn.write(&rpcMessage{ID: &id, Error: rerr})
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		s.handle(msg)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sampleSize is the size of a -sample, a share of the files or a count
+type sampleSize struct {
+	share float64 // Between 0 and 1, used if count is 0
+	count int
+}
+
+// parseSample parses the value of -sample: a percentage such as 5% or a
+// number of files
+func parseSample(s string) (sampleSize, error) {
+	if pct, ok := strings.CutSuffix(strings.TrimSpace(s), "%"); ok {
+		share, err := strconv.ParseFloat(pct, 64)
+		if err != nil || share <= 0 || share > 100 {
+			return sampleSize{}, fmt.Errorf("invalid sample %q, expected a percentage between 0 and 100%% or a number of files", s)
+		}
+		return sampleSize{share: share / 100}, nil
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || count <= 0 {
+		return sampleSize{}, fmt.Errorf("invalid sample %q, expected a percentage such as 5%% or a number of files", s)
+	}
+	return sampleSize{count: count}, nil
+}
+
+// of returns the number of files sampled from total, at least one
+func (s sampleSize) of(total int) int {
+	n := s.count
+	if n == 0 {
+		n = int(math.Ceil(s.share * float64(total)))
+	}
+	return max(1, min(n, total))
+}
+
+// newSampleSeed returns a random seed short enough to type on the next run
+func newSampleSeed() int64 {
+	return rand.New(rand.NewSource(time.Now().UnixNano())).Int63n(1_000_000) + 1
+}
+
+// sampleFiles picks a random sample of files, drawn from every directory in
+// proportion to its number of files so that the sample represents the whole
+// tree. The same seed picks the same files. Files keep their order.
+func sampleFiles(files []string, size sampleSize, seed int64) []string {
+	n := size.of(len(files))
+	if n == len(files) {
+		return files
+	}
+	rng := rand.New(rand.NewSource(seed))
+
+	groups := make(map[string][]string)
+	for _, f := range files {
+		dir := path.Dir(filepath.ToSlash(f))
+		groups[dir] = append(groups[dir], f)
+	}
+	dirs := sortedKeys(groups)
+
+	// Largest remainder allocation of the sample to the directories
+	quotas := make(map[string]int)
+	remainders := make([]float64, len(dirs))
+	allocated := 0
+	for i, dir := range dirs {
+		exact := float64(n) * float64(len(groups[dir])) / float64(len(files))
+		quotas[dir] = int(exact)
+		remainders[i] = exact - float64(quotas[dir])
+		allocated += quotas[dir]
+	}
+	order := rng.Perm(len(dirs)) // Breaks ties between equal remainders at random
+	sort.SliceStable(order, func(i, j int) bool { return remainders[order[i]] > remainders[order[j]] })
+	for _, i := range order[:n-allocated] {
+		quotas[dirs[i]]++
+	}
+
+	picked := make(map[string]bool, n)
+	for _, dir := range dirs {
+		group := groups[dir]
+		for _, i := range rng.Perm(len(group))[:quotas[dir]] {
+			picked[group[i]] = true
+		}
+	}
+	sample := make([]string, 0, n)
+	for _, f := range files {
+		if picked[f] {
+			sample = append(sample, f)
+		}
+	}
+	return sample
+}
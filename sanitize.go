@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Number of trailing paragraphs of a reply searched for commentary
+const maxCommentaryParagraphs = 3
+
+var (
+	// Opening line of a fence wrapping the whole reply
+	wrapFenceOpenRe = regexp.MustCompile("^(`{3,}|~{3,})\\s*(?:markdown|md)?\\s*$")
+	// Lead-in lines such as "Here is the refactored Markdown:"
+	preambleRe = regexp.MustCompile(`(?i)^(?:here(?:'s| is| are)|below is|sure|certainly|of course|okay|ok)\b.*\b(?:markdown|document|version|refactor\w*|restructur\w*|revis\w*|rewrit\w*|improv\w*|clean\w*)\b.*$`)
+	// Thematic breaks such as --- or * * *
+	thematicBreakRe = regexp.MustCompile(`^\s*(?:(?:-\s*){3,}|(?:\*\s*){3,}|(?:_\s*){3,})$`)
+	// Opening lines of commentary appended after the document
+	commentaryRe = regexp.MustCompile(`(?i)^(?:i(?:'ve| have) (?:refactored|restructured|rewritten|updated|revised|made)|this (?:version|refactored|restructured|revised)|the (?:refactored|restructured|revised) (?:document|version|content)|let me know\b|feel free\b|(?:summary of )?changes(?: made)?:|key (?:changes|improvements):)`)
+)
+
+// sanitizeOptions selects which model artifacts are stripped from replies
+type sanitizeOptions struct {
+	preamble   bool // Lead-in lines before the document
+	commentary bool // Remarks after the document
+	fence      bool // A code fence wrapping the whole document
+}
+
+// parseSanitize parses a comma-separated list of artifacts to strip, "all" or "none"
+func parseSanitize(s string) (sanitizeOptions, error) {
+	var opts sanitizeOptions
+	for _, name := range strings.Split(s, ",") {
+		switch strings.TrimSpace(name) {
+		case "", "none":
+		case "preamble":
+			opts.preamble = true
+		case "commentary":
+			opts.commentary = true
+		case "fence":
+			opts.fence = true
+		case "all":
+			opts = sanitizeOptions{preamble: true, commentary: true, fence: true}
+		default:
+			return opts, fmt.Errorf("unknown sanitization %q, expected preamble, commentary, fence, all or none", name)
+		}
+	}
+	return opts, nil
+}
+
+// stripPreamble removes a lead-in line the input does not start with
+func stripPreamble(input, output string) string {
+	lines := strings.Split(output, "\n")
+	first := 0
+	for first < len(lines) && strings.TrimSpace(lines[first]) == "" {
+		first++
+	}
+	if first == len(lines) {
+		return output
+	}
+	line := strings.TrimSpace(lines[first])
+	if !preambleRe.MatchString(line) || strings.HasPrefix(strings.TrimSpace(input), line) {
+		return output
+	}
+	rest := first + 1
+	for rest < len(lines) && strings.TrimSpace(lines[rest]) == "" {
+		rest++
+	}
+	return strings.Join(lines[rest:], "\n")
+}
+
+// fenceLine returns the fence character and length of a line opening or
+// closing a fenced code block, and whether it has an info string
+func fenceLine(line string) (char byte, n int, info bool) {
+	t := strings.TrimSpace(line)
+	if !strings.HasPrefix(t, "```") && !strings.HasPrefix(t, "~~~") {
+		return 0, 0, false
+	}
+	for n < len(t) && t[n] == t[0] {
+		n++
+	}
+	return t[0], n, strings.TrimSpace(t[n:]) != ""
+}
+
+// fencesBalanced reports whether every fenced code block of lines is closed
+func fencesBalanced(lines []string) bool {
+	var open byte
+	openLen := 0
+	for _, line := range lines {
+		char, n, info := fenceLine(line)
+		switch {
+		case n == 0:
+		case open == 0:
+			open, openLen = char, n
+		case char == open && n >= openLen && !info:
+			open = 0
+		}
+	}
+	return open == 0
+}
+
+// wrappingFence returns the lines inside a fence that wraps the whole reply,
+// if there is one. Models often nest the fences of code blocks inside a
+// ```markdown fence without lengthening it, so a fence tagged markdown wraps
+// the reply if the fences inside it are balanced; an untagged fence must not
+// be closed before the last line.
+func wrappingFence(output string) ([]string, bool) {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) < 2 {
+		return nil, false
+	}
+	m := wrapFenceOpenRe.FindStringSubmatch(strings.TrimSpace(lines[0]))
+	if m == nil {
+		return nil, false
+	}
+	char, n, _ := fenceLine(lines[0])
+	if c, cn, info := fenceLine(lines[len(lines)-1]); c != char || cn < n || info {
+		return nil, false
+	}
+	inner := lines[1 : len(lines)-1]
+	if strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(lines[0]), m[1])) != "" {
+		return inner, fencesBalanced(inner)
+	}
+	for _, line := range inner {
+		if c, cn, info := fenceLine(line); c == char && cn >= n && !info {
+			return nil, false
+		}
+	}
+	return inner, true
+}
+
+// stripWrappingFence removes a code fence around the whole document, unless
+// the input is wrapped the same way
+func stripWrappingFence(input, output string) string {
+	inner, ok := wrappingFence(output)
+	if !ok {
+		return output
+	}
+	if _, wrapped := wrappingFence(input); wrapped {
+		return output
+	}
+	if verbose {
+		fmt.Fprintln(os.Stderr, "Warning: the reply was wrapped in a code fence as a whole, unwrapped it")
+	}
+	return strings.Join(inner, "\n") + "\n"
+}
+
+// stripCommentary removes the trailing paragraphs from the first one that
+// comments on the document instead of belonging to it
+func stripCommentary(input, output string) string {
+	lines := strings.Split(strings.TrimRight(output, "\n"), "\n")
+	code := codeLines(strings.Join(lines, "\n"))
+
+	// Start lines of the trailing paragraphs, last first
+	var starts []int
+	for i := len(lines) - 1; i >= 0 && len(starts) < maxCommentaryParagraphs; i-- {
+		if code[i] {
+			break
+		}
+		if strings.TrimSpace(lines[i]) != "" && (i == 0 || strings.TrimSpace(lines[i-1]) == "") {
+			starts = append(starts, i)
+		}
+	}
+	cut := -1
+	for _, start := range starts {
+		line := strings.TrimSpace(strings.TrimLeft(lines[start], "#*_> "))
+		if commentaryRe.MatchString(line) && !strings.Contains(input, line) {
+			cut = start
+		}
+	}
+	if cut < 0 {
+		return output
+	}
+	kept := lines[:cut]
+	trimBlank := func() {
+		for len(kept) > 0 && strings.TrimSpace(kept[len(kept)-1]) == "" {
+			kept = kept[:len(kept)-1]
+		}
+	}
+	trimBlank()
+	// A rule separating the commentary from the document goes with it, but
+	// not a setext underline
+	if n := len(kept); n > 0 && thematicBreakRe.MatchString(kept[n-1]) && (n == 1 || strings.TrimSpace(kept[n-2]) == "") {
+		kept = kept[:n-1]
+		trimBlank()
+	}
+	return strings.Join(kept, "\n") + "\n"
+}
+
+// sanitize strips the selected artifacts from a reply to input
+func (o sanitizeOptions) sanitize(input, output string) string {
+	if o.preamble {
+		output = stripPreamble(input, output)
+	}
+	if o.fence {
+		output = stripWrappingFence(input, output)
+	}
+	if o.commentary {
+		output = stripCommentary(input, output)
+	}
+	return output
+}
+
+// withOutputSanitizer wraps refactor so that its replies are sanitized
+func withOutputSanitizer(opts sanitizeOptions, refactor refactorFunc) refactorFunc {
+	if opts == (sanitizeOptions{}) {
+		return refactor
+	}
+	return func(systemPrompt, content string) (string, error) {
+		refactored, err := refactor(systemPrompt, content)
+		if err != nil {
+			return "", err
+		}
+		return opts.sanitize(content, refactored), nil
+	}
+}
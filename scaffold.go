@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// System prompt used to write issue and pull request templates
+const issueTemplatesSystemPrompt = "You are a maintainer setting up the contribution workflow of a repository. " +
+	"Write GitHub issue templates and a pull request template tailored to the project: ask for the versions, " +
+	"platforms, commands and logs that matter for its language and tooling, and reference its real build, test " +
+	"and lint commands in the checklists. Keep each template short. Every issue template starts with GitHub " +
+	"front matter with name, about, title, labels and assignees."
+
+// Files that tell the model about the stack and conventions of a repository
+var scaffoldContextFiles = []string{
+	"go.mod", "package.json", "Cargo.toml", "pyproject.toml", "setup.py", "requirements.txt", "Gemfile", "pom.xml",
+	"build.gradle", "Makefile", "CONTRIBUTING.md", ".github/CONTRIBUTING.md", "README.md",
+}
+
+// Maximum number of bytes of each context file sent to the model
+const maxScaffoldFileBytes = 6000
+
+// issueTemplates is the reply of the model with the templates to write
+type issueTemplates struct {
+	IssueTemplates []struct {
+		FileName string `json:"file_name"`
+		Content  string `json:"content"`
+	} `json:"issue_templates"`
+	PullRequestTemplate string `json:"pull_request_template"`
+}
+
+// issueTemplatesResponseFormat makes the API return issueTemplates as JSON
+var issueTemplatesResponseFormat = map[string]any{
+	"type": "json_schema",
+	"json_schema": map[string]any{
+		"name":   "issue_templates",
+		"strict": true,
+		"schema": map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"issue_templates": map[string]any{
+					"type": "array",
+					"items": map[string]any{
+						"type": "object",
+						"properties": map[string]any{
+							"file_name": map[string]any{"type": "string", "description": "File name such as bug_report.md"},
+							"content":   map[string]any{"type": "string", "description": "Markdown template including its front matter"},
+						},
+						"required":             []string{"file_name", "content"},
+						"additionalProperties": false,
+					},
+					"description": "Issue templates, e.g. a bug report and a feature request",
+				},
+				"pull_request_template": map[string]any{"type": "string", "description": "Markdown pull request template"},
+			},
+			"required":             []string{"issue_templates", "pull_request_template"},
+			"additionalProperties": false,
+		},
+	},
+}
+
+// describeRepository returns the file tree and the key manifest and
+// convention files of the repository at dir as context for the model
+func describeRepository(dir string) string {
+	explorer := &repoExplorer{root: dir}
+	var b strings.Builder
+	fmt.Fprintf(&b, "Files of the repository:\n\n%s\n", explorer.tree())
+	for _, name := range scaffoldContextFiles {
+		content, err := explorer.readFile(name)
+		if err != nil {
+			continue
+		}
+		if len(content) > maxScaffoldFileBytes {
+			content = content[:maxScaffoldFileBytes] + "\n[truncated]"
+		}
+		fmt.Fprintf(&b, "\n%s:\n\n%s\n", name, content)
+	}
+	if targets, err := explorer.makeTargets(); err == nil {
+		fmt.Fprintf(&b, "\nMake targets:\n\n%s\n", targets)
+	}
+	return b.String()
+}
+
+// generateIssueTemplates asks the model for the issue and pull request
+// templates of the repository at dir and returns them by path relative to dir
+func generateIssueTemplates(apiKey, model, dir string) (map[string]string, error) {
+	reply, err := chatCompletionParams(context.Background(), apiKey, model, []Message{
+		{Role: "system", Content: issueTemplatesSystemPrompt},
+		{Role: "user", Content: "Write the issue templates and the pull request template for this repository.\n\n" + describeRepository(dir)},
+	}, completionParams{responseFormat: issueTemplatesResponseFormat})
+	if err != nil {
+		return nil, err
+	}
+	var templates issueTemplates
+	if err := decodeJSONReply(reply, &templates); err != nil {
+		return nil, err
+	}
+
+	files := make(map[string]string)
+	for _, t := range templates.IssueTemplates {
+		name := strings.TrimSuffix(filepath.Base(filepath.FromSlash(t.FileName)), filepath.Ext(t.FileName))
+		if name == "" || name == "." || strings.TrimSpace(t.Content) == "" {
+			continue
+		}
+		files[filepath.Join(".github", "ISSUE_TEMPLATE", name+".md")] = strings.TrimSpace(t.Content) + "\n"
+	}
+	if strings.TrimSpace(templates.PullRequestTemplate) != "" {
+		files[filepath.Join(".github", "PULL_REQUEST_TEMPLATE.md")] = strings.TrimSpace(templates.PullRequestTemplate) + "\n"
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("the model returned no templates")
+	}
+	return files, nil
+}
+
+// runScaffoldCommand implements the scaffold subcommand
+func runScaffoldCommand(args []string) error {
+	fs := flag.NewFlagSet("scaffold", flag.ExitOnError)
+	apiKey := fs.String("apikey", os.Getenv("OPENAI_API_KEY"), "OpenAI API key (can also be set via OPENAI_API_KEY environment variable)")
+	addAPIFlags(fs)
+	model := fs.String("model", defaultModel, "OpenAI model to use (must support structured outputs)")
+	dir := fs.String("dir", ".", "Root of the repository to scaffold")
+	overwrite := fs.Bool("overwrite", false, "Replace templates that already exist")
+	dryRun := fs.Bool("dry-run", false, "Print the generated files without writing them")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: mdrefactor scaffold [flags] issue-templates")
+		fmt.Fprintln(fs.Output(), "Generates .github/ISSUE_TEMPLATE/*.md and .github/PULL_REQUEST_TEMPLATE.md tailored to the repository.")
+		fs.PrintDefaults()
+	}
+	positional := parseArgs(fs, args)
+	if len(positional) != 1 {
+		fs.Usage()
+		return fmt.Errorf("what to scaffold is required")
+	}
+	if positional[0] != "issue-templates" {
+		return fmt.Errorf("unknown scaffold %q, expected issue-templates", positional[0])
+	}
+
+	fmt.Printf("Inspecting %s...\n", *dir)
+	files, err := generateIssueTemplates(*apiKey, *model, *dir)
+	if err != nil {
+		return err
+	}
+
+	written := 0
+	for _, rel := range sortedKeys(files) {
+		path := filepath.Join(*dir, rel)
+		if *dryRun {
+			fmt.Printf("\n==> %s <==\n%s", path, files[rel])
+			continue
+		}
+		if _, err := os.Stat(path); err == nil && !*overwrite {
+			fmt.Printf("Skipped %s, which already exists (use -overwrite to replace it)\n", path)
+			continue
+		} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := writeFileAtomic(path, []byte(files[rel]), 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %w", path, err)
+		}
+		fmt.Printf("Wrote %s\n", path)
+		written++
+	}
+	if !*dryRun {
+		fmt.Printf("Wrote %d of %d templates\n", written, len(files))
+	}
+	return nil
+}
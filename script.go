@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/jackmbuda/go-mdrefactor/mdrefactor"
+)
+
+const (
+	scriptAuto  = "auto"
+	scriptLatin = "latin"
+	scriptCJK   = "cjk"
+	scriptRTL   = "rtl"
+	// Share of a document's letters from a script for auto to pick it
+	scriptDetectShare = 0.2
+)
+
+var (
+	// A space between two Chinese or Japanese characters, which the scripts do not use
+	cjkSpaceRe = regexp.MustCompile(`([\p{Han}\p{Hiragana}\p{Katakana}\x{3000}-\x{303F}\x{FF00}-\x{FFEF}]) +([\p{Han}\p{Hiragana}\p{Katakana}\x{3000}-\x{303F}\x{FF00}-\x{FFEF}])`)
+	// ASCII punctuation following a Chinese or Japanese character, with the spacing after it
+	cjkPunctRe = regexp.MustCompile(`([\p{Han}\p{Hiragana}\p{Katakana}])([,.:;!?])(?: +|$)`)
+	// ASCII punctuation following a letter of the Arabic script
+	arabicPunctRe = regexp.MustCompile(`(\p{Arabic})([,;?])`)
+	// Directional marks RTL documents rely on: LRM, RLM and the Arabic letter mark
+	bidiMarkRe = regexp.MustCompile(`[\x{200E}\x{200F}\x{061C}]`)
+	// Lines that start a block of their own and are never joined to the previous line
+	blockStartRe = regexp.MustCompile(`^\s*(?:#|>|\||<|[-*+]\s|\d+[.)]\s|(?:[-*_]\s*){3,}$|=+\s*$|\[[^\]]+\]:)`)
+	// Lines that end their block, so the next line is never joined to them
+	blockEndRe = regexp.MustCompile(`^\s*(?:#|\||<|(?:[-*_]\s*){3,}$|=+\s*$)`)
+)
+
+// Fullwidth forms of ASCII punctuation in Chinese and Japanese text
+var fullwidthPunct = map[string]string{",": "，", ".": "。", ":": "：", ";": "；", "!": "！", "?": "？"}
+
+// Arabic forms of ASCII punctuation
+var arabicPunct = map[string]string{",": "،", ";": "؛", "?": "؟"}
+
+// scriptOptions control how text in scripts other than Latin is treated
+type scriptOptions struct {
+	script      string // auto, latin, cjk or rtl
+	unwrap      bool   // Join hard-wrapped paragraph lines
+	punctuation bool   // Normalize ASCII punctuation to the script's own forms
+}
+
+// parseScript validates a -script value
+func parseScript(s string) (string, error) {
+	switch s {
+	case scriptAuto, scriptLatin, scriptCJK, scriptRTL:
+		return s, nil
+	}
+	return "", fmt.Errorf("invalid script %q, expected auto, latin, cjk or rtl", s)
+}
+
+// isCJK reports whether r is a Chinese or Japanese character, which are
+// written without spaces between words. Korean Hangul is not: Korean uses spaces.
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana)
+}
+
+// isRTL reports whether r is a letter of a right-to-left script
+func isRTL(r rune) bool {
+	return unicode.In(r, unicode.Arabic, unicode.Hebrew, unicode.Syriac, unicode.Thaana, unicode.Nko)
+}
+
+// detectScript returns the script typography rules should follow for
+// content: cjk or rtl if enough of its letters are written in them
+func detectScript(content string) string {
+	var letters, cjk, rtl int
+	for _, r := range content {
+		switch {
+		case isCJK(r) || unicode.Is(unicode.Hangul, r):
+			cjk++
+		case isRTL(r):
+			rtl++
+		case !unicode.IsLetter(r):
+			continue
+		}
+		letters++
+	}
+	switch {
+	case letters == 0:
+		return scriptLatin
+	case float64(cjk) >= scriptDetectShare*float64(letters):
+		return scriptCJK
+	case float64(rtl) >= scriptDetectShare*float64(letters):
+		return scriptRTL
+	}
+	return scriptLatin
+}
+
+// resolve returns the script of content, detecting it if set to auto
+func (o scriptOptions) resolve(content string) string {
+	if o.script == scriptAuto || o.script == "" {
+		return detectScript(content)
+	}
+	return o.script
+}
+
+// instructions returns the prompt instructions that keep the model from
+// applying Latin typography to text in script
+func (o scriptOptions) instructions(script string) string {
+	switch script {
+	case scriptCJK:
+		return "The document is written in Chinese, Japanese or Korean. Do not insert spaces between Chinese or Japanese characters, " +
+			"keep fullwidth punctuation such as 。，、：「」 as it is, and do not convert it to ASCII punctuation."
+	case scriptRTL:
+		return "The document is written in a right-to-left script. Keep its own punctuation such as ، ؛ ؟, keep directional marks " +
+			"(U+200E, U+200F, U+061C) exactly where they are, and do not reorder text or swap brackets or quotes to compensate for the direction."
+	}
+	return ""
+}
+
+// withScriptRules wraps refactor so that documents in CJK and right-to-left
+// scripts get typography instructions, and repairs the output: spaces put
+// between CJK characters are removed, punctuation is optionally normalized
+// to the script's forms and hard-wrapped paragraphs are optionally joined
+func withScriptRules(opts scriptOptions, refactor refactorFunc) refactorFunc {
+	return func(systemPrompt, content string) (string, error) {
+		if instruction := opts.instructions(opts.resolve(content)); instruction != "" {
+			systemPrompt += "\n\n" + instruction
+		}
+		refactored, err := refactor(systemPrompt, content)
+		if err != nil {
+			return "", err
+		}
+
+		// The output decides the rules, it may be a translation into another script
+		script := opts.resolve(refactored)
+		japanese := strings.IndexFunc(refactored, func(r rune) bool { return unicode.In(r, unicode.Hiragana, unicode.Katakana) }) >= 0
+		keepSpaces := cjkSpaceRe.MatchString(content)
+		if n := len(bidiMarkRe.FindAllString(content, -1)) - len(bidiMarkRe.FindAllString(refactored, -1)); n > 0 && script == scriptRTL {
+			fmt.Fprintf(os.Stderr, "Warning: the output lost %d directional marks (LRM, RLM or ALM); check the rendering of mixed-direction text\n", n)
+		}
+
+		// Front matter is data, not text to set
+		frontMatter, body := mdrefactor.SplitFrontMatter(refactored)
+		lines := strings.Split(body, "\n")
+		code := codeLines(body)
+		for i, line := range lines {
+			if code[i] {
+				continue
+			}
+			lines[i] = mapOutsideInlineCode(line, func(text string) string {
+				if script == scriptCJK && !keepSpaces {
+					// Twice, since matches share the character between them
+					text = cjkSpaceRe.ReplaceAllString(cjkSpaceRe.ReplaceAllString(text, "$1$2"), "$1$2")
+				}
+				if !opts.punctuation {
+					return text
+				}
+				switch script {
+				case scriptCJK:
+					text = cjkPunctRe.ReplaceAllStringFunc(text, func(m string) string {
+						sub := cjkPunctRe.FindStringSubmatch(m)
+						if sub[2] == "," && japanese {
+							return sub[1] + "、"
+						}
+						return sub[1] + fullwidthPunct[sub[2]]
+					})
+				case scriptRTL:
+					text = arabicPunctRe.ReplaceAllStringFunc(text, func(m string) string {
+						sub := arabicPunctRe.FindStringSubmatch(m)
+						return sub[1] + arabicPunct[sub[2]]
+					})
+				}
+				return text
+			})
+		}
+		if opts.unwrap {
+			lines = unwrapParagraphs(lines, code)
+		}
+		return frontMatter + strings.Join(lines, "\n"), nil
+	}
+}
+
+// mapOutsideInlineCode applies f to the parts of line outside inline code spans
+func mapOutsideInlineCode(line string, f func(string) string) string {
+	var b strings.Builder
+	last := 0
+	for _, loc := range inlineCodeRe.FindAllStringIndex(line, -1) {
+		b.WriteString(f(line[last:loc[0]]))
+		b.WriteString(line[loc[0]:loc[1]])
+		last = loc[1]
+	}
+	b.WriteString(f(line[last:]))
+	return b.String()
+}
+
+// unwrapParagraphs joins the hard-wrapped lines of every paragraph into one.
+// Lines are joined without a space between CJK characters, since renderers
+// would show the line break as one. Hard breaks and block starts are kept.
+func unwrapParagraphs(lines []string, code []bool) []string {
+	var out []string
+	for i, line := range lines {
+		if i > 0 && len(out) > 0 && !code[i] && !code[i-1] && joinable(lines[i-1], line) {
+			prev := strings.TrimRight(out[len(out)-1], " \t")
+			next := strings.TrimLeft(line, " \t")
+			last, _ := utf8.DecodeLastRuneInString(prev)
+			first, _ := utf8.DecodeRuneInString(next)
+			if (isCJK(last) || isFullwidthPunct(last)) && (isCJK(first) || isFullwidthPunct(first)) {
+				out[len(out)-1] = prev + next
+			} else {
+				out[len(out)-1] = prev + " " + next
+			}
+			continue
+		}
+		out = append(out, line)
+	}
+	return out
+}
+
+// joinable reports whether next continues the paragraph that prev belongs to
+func joinable(prev, next string) bool {
+	if strings.TrimSpace(prev) == "" || strings.TrimSpace(next) == "" {
+		return false
+	}
+	// Hard line breaks: two trailing spaces or a backslash
+	if strings.HasSuffix(prev, "  ") || strings.HasSuffix(prev, "\\") {
+		return false
+	}
+	if blockStartRe.MatchString(next) || blockEndRe.MatchString(prev) {
+		return false
+	}
+	// Deeply indented lines may be code blocks or nested list content
+	return !strings.HasPrefix(next, "    ") && !strings.HasPrefix(next, "\t")
+}
+
+// isFullwidthPunct reports whether r is CJK or fullwidth punctuation
+func isFullwidthPunct(r rune) bool {
+	return r >= 0x3000 && r <= 0x303F || r >= 0xFF00 && r <= 0xFFEF
+}
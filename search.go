@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// searchHit is a section matching a query
+type searchHit struct {
+	indexedSection
+	similarity float64
+}
+
+// search returns the k sections most similar to the query vector, ignoring
+// those below minSimilarity
+func (idx *docIndex) search(query []float64, k int, minSimilarity float64) []searchHit {
+	var hits []searchHit
+	for _, s := range idx.sections() {
+		if sim := cosineSimilarity(query, s.Vector); sim >= minSimilarity {
+			hits = append(hits, searchHit{indexedSection: s, similarity: sim})
+		}
+	}
+	sort.SliceStable(hits, func(i, j int) bool { return hits[i].similarity > hits[j].similarity })
+	if len(hits) > k {
+		hits = hits[:k]
+	}
+	return hits
+}
+
+// searchDocs returns the sections of the docs tree in dir most relevant to query
+func searchDocs(embedder embeddingProvider, dir, indexFile, query string, k int, minSimilarity float64) ([]searchHit, error) {
+	index, err := updateIndex(embedder, dir, indexPathFor(dir, indexFile))
+	if err != nil {
+		return nil, err
+	}
+	vectors, err := createEmbeddings(embedder, []string{query})
+	if err != nil {
+		return nil, err
+	}
+	return index.search(vectors[0], k, minSimilarity), nil
+}
+
+// runSearchCommand implements the search subcommand
+func runSearchCommand(args []string) error {
+	fs := flag.NewFlagSet("search", flag.ExitOnError)
+	apiKey := fs.String("apikey", os.Getenv("OPENAI_API_KEY"), "OpenAI API key (can also be set via OPENAI_API_KEY environment variable)")
+	addAPIFlags(fs)
+	embedding := addEmbeddingFlags(fs)
+	k := fs.Int("k", 5, "Number of sections to return")
+	minSimilarity := fs.Float64("min-similarity", 0.2, "Minimum cosine similarity (0-1) for a section to be returned")
+	indexFile := fs.String("index", "", "Path of the embedding index (defaults to <docs-dir>/"+defaultIndexFile+")")
+	jsonOutput := fs.Bool("json", false, "Print the results as JSON")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: mdrefactor search [flags] <query> <docs-dir>")
+		fmt.Fprintln(fs.Output(), "Returns the sections of the docs tree most relevant to the query. The embedding index is built on first use; later runs only embed documents that changed.")
+		fs.PrintDefaults()
+	}
+	positional := parseArgs(fs, args)
+	if len(positional) != 2 {
+		fs.Usage()
+		return fmt.Errorf("a query and a docs directory are required")
+	}
+
+	embedder, err := embedding.open(*apiKey)
+	if err != nil {
+		return err
+	}
+	hits, err := searchDocs(embedder, positional[1], *indexFile, positional[0], *k, *minSimilarity)
+	if err != nil {
+		return err
+	}
+
+	if *jsonOutput {
+		type result struct {
+			Location   string  `json:"location"`
+			Line       int     `json:"line"`
+			Title      string  `json:"title"`
+			Heading    string  `json:"heading,omitempty"`
+			Excerpt    string  `json:"excerpt"`
+			Similarity float64 `json:"similarity"`
+		}
+		results := []result{}
+		for _, h := range hits {
+			results = append(results, result{h.location(), h.Line, h.Title, h.Heading, h.Excerpt, h.similarity})
+		}
+		data, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+
+	if len(hits) == 0 {
+		fmt.Println("No matching sections found.")
+		return nil
+	}
+	for _, h := range hits {
+		fmt.Printf("%.2f  %s:%d  %s\n", h.similarity, h.File, h.Line, h.name())
+		if h.Excerpt != "" {
+			fmt.Printf("      %s\n", h.Excerpt)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"github.com/jackmbuda/go-mdrefactor/mdrefactor"
+)
+
+// section is the part of a document from one heading up to the next
+type section = mdrefactor.Section
+
+// splitSections splits content into sections at every heading, with the
+// anchors of the configured slug style
+func splitSections(content string) []section {
+	return document(content).Sections()
+}
+
+// replaceSection returns content with the section with the given anchor,
+// from its heading up to the next heading, replaced by text. The empty
+// anchor names the part before the first heading. The blank lines that
+// separated the section from the next one are kept.
+func replaceSection(content, anchor, text string) (string, error) {
+	return document(content).ReplaceSection(anchor, text)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jackmbuda/go-mdrefactor/mdrefactor"
+)
+
+// System prompt used to generate SEO metadata
+const seoSystemPrompt = "You are an SEO specialist for technical documentation. Write accurate, specific metadata based only on the page content. Reply with JSON only."
+
+// seoMetadata is the metadata the model generates for a page
+type seoMetadata struct {
+	Description   string   `json:"description"`
+	Keywords      []string `json:"keywords"`
+	OGTitle       string   `json:"og_title"`
+	OGDescription string   `json:"og_description"`
+}
+
+// generateSEOMetadata asks the model for the SEO metadata of a page
+func generateSEOMetadata(apiKey, model, content string) (seoMetadata, error) {
+	_, body := mdrefactor.SplitFrontMatter(content)
+	prompt := "Generate SEO metadata for the following documentation page. Reply with a JSON object with the keys " +
+		"\"description\" (at most 160 characters), \"keywords\" (3 to 8 lowercase keywords), " +
+		"\"og_title\" (at most 60 characters) and \"og_description\" (at most 200 characters).\n\n" + body
+
+	var meta seoMetadata
+	reply, err := chatCompletion(apiKey, model, []Message{
+		{Role: "system", Content: seoSystemPrompt},
+		{Role: "user", Content: prompt},
+	})
+	if err != nil {
+		return meta, err
+	}
+	if err := decodeJSONReply(reply, &meta); err != nil {
+		return meta, err
+	}
+	return meta, nil
+}
+
+// fields returns the front matter fields for the metadata, skipping empty values
+func (m seoMetadata) fields() []frontMatterField {
+	var fields []frontMatterField
+	add := func(key string, value any, empty bool) {
+		if !empty {
+			fields = append(fields, frontMatterField{key: key, value: value})
+		}
+	}
+	add("description", m.Description, m.Description == "")
+	add("keywords", m.Keywords, len(m.Keywords) == 0)
+	add("og:title", m.OGTitle, m.OGTitle == "")
+	add("og:description", m.OGDescription, m.OGDescription == "")
+	return fields
+}
+
+// expandMarkdownArgs turns file and directory arguments into a list of Markdown files
+func expandMarkdownArgs(args []string) ([]string, error) {
+	var files []string
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, arg)
+			continue
+		}
+		found, err := findMarkdownFiles(arg)
+		if err != nil {
+			return nil, err
+		}
+		for _, rel := range found {
+			files = append(files, filepath.Join(arg, rel))
+		}
+	}
+	return files, nil
+}
+
+// runSEOCommand implements the seo subcommand
+func runSEOCommand(args []string) error {
+	fs := flag.NewFlagSet("seo", flag.ExitOnError)
+	apiKey := fs.String("apikey", os.Getenv("OPENAI_API_KEY"), "OpenAI API key (can also be set via OPENAI_API_KEY environment variable)")
+	addAPIFlags(fs)
+	model := fs.String("model", defaultModel, "OpenAI model to use")
+	overwrite := fs.Bool("overwrite", false, "Replace existing description, keywords and og:* fields instead of keeping them")
+	dryRun := fs.Bool("dry-run", false, "Print the generated metadata without modifying any file")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: mdrefactor seo [flags] <file-or-dir>...")
+		fs.PrintDefaults()
+	}
+	positional := parseArgs(fs, args)
+	if len(positional) == 0 {
+		fs.Usage()
+		return fmt.Errorf("at least one file or directory is required")
+	}
+
+	files, err := expandMarkdownArgs(positional)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", file, err)
+		}
+
+		// Pages that are already fully described need no API call
+		frontMatter, _ := mdrefactor.SplitFrontMatter(string(content))
+		if !*overwrite && hasFrontMatterKey(frontMatter, "description") && hasFrontMatterKey(frontMatter, "keywords") &&
+			hasFrontMatterKey(frontMatter, "og:title") && hasFrontMatterKey(frontMatter, "og:description") {
+			fmt.Printf("%s: metadata already present, skipping\n", file)
+			continue
+		}
+
+		meta, err := generateSEOMetadata(*apiKey, *model, string(content))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error generating metadata for %s: %v\n", file, err)
+			failed++
+			continue
+		}
+
+		updated, written := setFrontMatterFields(string(content), meta.fields(), *overwrite)
+		if *dryRun {
+			fmt.Printf("%s: description=%q keywords=%s og:title=%q\n", file, meta.Description, strings.Join(meta.Keywords, ","), meta.OGTitle)
+			continue
+		}
+		if len(written) == 0 {
+			fmt.Printf("%s: no fields changed\n", file)
+			continue
+		}
+		if err := writeFileAtomic(file, []byte(updated), 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %w", file, err)
+		}
+		fmt.Printf("%s: wrote %s\n", file, strings.Join(written, ", "))
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("failed to generate metadata for %d of %d files", failed, len(files))
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// Anchors keep non-ASCII letters, like GitHub, GitLab and Hugo generate them
+	slugStyleGitHub = "github"
+	// Anchors are transliterated to ASCII, like generators with ASCII-only ids produce them
+	slugStyleASCII = "ascii"
+)
+
+// Style and language of generated anchors, set by the slugs config section,
+// -slug-style and -slug-locale
+var (
+	slugStyle  = slugStyleGitHub
+	slugLocale string
+)
+
+// slugConfig is the slugs section of the config file
+type slugConfig struct {
+	Style  string `json:"style"`  // github or ascii
+	Locale string `json:"locale"` // Language whose transliteration rules apply, e.g. de
+}
+
+// applySlugConfig applies the slugs section of the config file
+func applySlugConfig(cfg slugConfig) error {
+	if cfg.Style != "" {
+		if err := (slugStyleFlag{}).Set(cfg.Style); err != nil {
+			return err
+		}
+	}
+	if cfg.Locale != "" {
+		slugLocale = cfg.Locale
+	}
+	return nil
+}
+
+// slugStyleFlag is a flag setting slugStyle
+type slugStyleFlag struct{}
+
+func (slugStyleFlag) String() string { return slugStyle }
+
+func (slugStyleFlag) Set(s string) error {
+	switch s {
+	case slugStyleGitHub, slugStyleASCII:
+		slugStyle = s
+		return nil
+	}
+	return fmt.Errorf("invalid slug style %q, expected %s or %s", s, slugStyleGitHub, slugStyleASCII)
+}
+
+// Transliterations of lowercase letters to ASCII, as "letter replacement"
+// pairs. Letters without a replacement are dropped from ASCII slugs.
+var transliterations = parseTransliterations(
+	// Latin letters with diacritics and ligatures
+	"à a á a â a ã a ä a å a ā a ă a ą a æ ae ç c ć c ĉ c ċ c č c ď d đ d ð d " +
+		"è e é e ê e ë e ē e ĕ e ė e ę e ě e ĝ g ğ g ġ g ģ g ĥ h ħ h " +
+		"ì i í i î i ï i ĩ i ī i ĭ i į i ı i ĳ ij ĵ j ķ k ĺ l ļ l ľ l ŀ l ł l " +
+		"ñ n ń n ņ n ň n ŋ n ò o ó o ô o õ o ö o ø o ō o ŏ o ő o œ oe " +
+		"ŕ r ŗ r ř r ś s ŝ s ş s š s ș s ß ss ţ t ť t ŧ t ț t þ th " +
+		"ù u ú u û u ü u ũ u ū u ŭ u ů u ű u ų u ŵ w ý y ÿ y ŷ y ź z ż z ž z " +
+		// Cyrillic
+		"а a б b в v г g ґ g д d е e ё yo є ye ж zh з z и i і i ї yi й y к k л l м m " +
+		"н n о o п p р r с s т t у u ф f х kh ц ts ч ch ш sh щ shch ъ  ы y ь  э e ю yu я ya " +
+		// Greek
+		"α a ά a β v γ g δ d ε e έ e ζ z η i ή i θ th ι i ί i ϊ i ΐ i κ k λ l μ m ν n ξ x " +
+		"ο o ό o π p ρ r σ s ς s τ t υ y ύ y ϋ y ΰ y φ f χ ch ψ ps ω o ώ o")
+
+// Transliterations that differ by language
+var localeTransliterations = map[string]map[rune]string{
+	"de": parseTransliterations("ä ae ö oe ü ue"),
+	"da": parseTransliterations("å aa æ ae ø oe"),
+	"nb": parseTransliterations("å aa æ ae ø oe"),
+	"no": parseTransliterations("å aa æ ae ø oe"),
+	"uk": parseTransliterations("г h и y й i"),
+}
+
+// parseTransliterations parses space-separated "letter replacement" pairs,
+// where a doubled space stands for an empty replacement
+func parseTransliterations(pairs string) map[rune]string {
+	table := make(map[rune]string)
+	fields := strings.Split(pairs, " ")
+	for i := 0; i+1 < len(fields); i += 2 {
+		r := []rune(fields[i])
+		table[r[0]] = fields[i+1]
+	}
+	return table
+}
+
+// transliterate replaces the non-ASCII letters of lowercase text with ASCII
+// following the rules of locale, e.g. "über" becomes "uber", or "ueber" in German
+func transliterate(text, locale string) string {
+	overrides := localeTransliterations[strings.ToLower(strings.SplitN(strings.ReplaceAll(locale, "_", "-"), "-", 2)[0])]
+	var b strings.Builder
+	for _, r := range text {
+		if s, ok := overrides[r]; ok {
+			b.WriteString(s)
+		} else if s, ok := transliterations[r]; ok {
+			b.WriteString(s)
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
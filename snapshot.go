@@ -0,0 +1,289 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Snapshot store of a tree, below its root
+const snapshotDir = ".mdrefactor/snapshots"
+
+// snapshotFile is a file an in-place run changed, by the hashes of its
+// contents before and after the run. An empty hash means the file did not
+// exist at that point.
+type snapshotFile struct {
+	Path     string `json:"path"` // Slash-separated path relative to the tree root
+	Original string `json:"original,omitempty"`
+	Written  string `json:"written,omitempty"`
+}
+
+// snapshotRun records the originals of the files of an in-place batch run,
+// whose contents are kept in a content-addressed store, so the run can be
+// rolled back independently of version control
+type snapshotRun struct {
+	ID      string         `json:"id"`
+	Started time.Time      `json:"started"`
+	Command string         `json:"command"`
+	Dir     string         `json:"dir"` // Docs directory relative to the tree root
+	Files   []snapshotFile `json:"files"`
+
+	root     string            // Tree root
+	original map[string]string // Hash of every file before the run, by path
+}
+
+// snapshotStore returns the snapshot store of the tree containing dir
+func snapshotStore(dir string) string {
+	return filepath.Join(treeRoot(dir), filepath.FromSlash(snapshotDir))
+}
+
+// storeObject adds data to the content-addressed store and returns its hash
+func storeObject(store string, data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	path := filepath.Join(store, "objects", hash[:2], hash[2:])
+	if _, err := os.Stat(path); err == nil {
+		return hash, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	return hash, writeFileAtomic(path, data, 0644)
+}
+
+// markdownHashes returns the content hash of every Markdown file below dir,
+// by path relative to root
+func markdownHashes(root, dir string) (map[string]string, error) {
+	files, err := findMarkdownFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	hashes := make(map[string]string)
+	for _, rel := range files {
+		data, err := os.ReadFile(fsPath(filepath.Join(dir, rel)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", rel, err)
+		}
+		sum := sha256.Sum256(data)
+		p, err := filepath.Rel(root, filepath.Join(dir, rel))
+		if err != nil {
+			return nil, err
+		}
+		hashes[filepath.ToSlash(p)] = hex.EncodeToString(sum[:])
+	}
+	return hashes, nil
+}
+
+// takeSnapshot stores the current contents of every Markdown file below
+// dir before an in-place run changes them
+func takeSnapshot(dir string) (*snapshotRun, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	root := treeRoot(abs)
+	store := snapshotStore(abs)
+	hashes, err := markdownHashes(root, abs)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range sortedKeys(hashes) {
+		data, err := os.ReadFile(fsPath(filepath.Join(root, filepath.FromSlash(p))))
+		if err != nil {
+			return nil, err
+		}
+		if _, err := storeObject(store, data); err != nil {
+			return nil, fmt.Errorf("failed to snapshot %s: %w", p, err)
+		}
+	}
+	rel, err := filepath.Rel(root, abs)
+	if err != nil {
+		return nil, err
+	}
+	return &snapshotRun{
+		ID:       time.Now().Format("20060102-150405"),
+		Started:  time.Now(),
+		Command:  strings.Join(os.Args, " "),
+		Dir:      filepath.ToSlash(rel),
+		root:     root,
+		original: hashes,
+	}, nil
+}
+
+// finish records which files the run changed, created or removed and saves
+// the run, unless it changed nothing
+func (r *snapshotRun) finish() error {
+	after, err := markdownHashes(r.root, filepath.Join(r.root, filepath.FromSlash(r.Dir)))
+	if err != nil {
+		return err
+	}
+	paths := make(map[string]bool)
+	for p := range r.original {
+		paths[p] = true
+	}
+	for p := range after {
+		paths[p] = true
+	}
+	for _, p := range sortedKeys(paths) {
+		if r.original[p] != after[p] {
+			r.Files = append(r.Files, snapshotFile{Path: p, Original: r.original[p], Written: after[p]})
+		}
+	}
+	if len(r.Files) == 0 {
+		return nil
+	}
+
+	runs := filepath.Join(r.root, filepath.FromSlash(snapshotDir), "runs")
+	base := r.ID
+	for n := 2; ; n++ {
+		// Another run may have started within the same second
+		if _, err := os.Stat(filepath.Join(runs, r.ID+".json")); err != nil {
+			break
+		}
+		r.ID = fmt.Sprintf("%s-%d", base, n)
+	}
+	path := filepath.Join(runs, r.ID+".json")
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to save snapshot %s: %w", path, err)
+	}
+	fmt.Printf("Snapshot of the %d changed files saved as run %s, undo it with: mdrefactor rollback %s\n", len(r.Files), r.ID, r.ID)
+	return nil
+}
+
+// readSnapshotRuns returns the runs recorded in the store, oldest first
+func readSnapshotRuns(store string) ([]snapshotRun, error) {
+	entries, err := os.ReadDir(filepath.Join(store, "runs"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var runs []snapshotRun
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(store, "runs", e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var run snapshotRun
+		if err := json.Unmarshal(data, &run); err != nil {
+			return nil, fmt.Errorf("failed to parse snapshot %s: %w", e.Name(), err)
+		}
+		runs = append(runs, run)
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].ID < runs[j].ID })
+	return runs, nil
+}
+
+// rollback restores the files of a run to their contents before it. Files
+// changed again since the run are skipped unless force is set.
+func rollback(store, root string, run snapshotRun, force bool) (restored, skipped int, err error) {
+	for _, f := range run.Files {
+		path := filepath.Join(root, filepath.FromSlash(f.Path))
+		current := ""
+		if data, err := os.ReadFile(fsPath(path)); err == nil {
+			sum := sha256.Sum256(data)
+			current = hex.EncodeToString(sum[:])
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return restored, skipped, err
+		}
+		if current == f.Original {
+			continue
+		}
+		if current != f.Written && !force {
+			fmt.Fprintf(os.Stderr, "Skipping %s, it changed since run %s (use -force to restore it anyway)\n", f.Path, run.ID)
+			skipped++
+			continue
+		}
+
+		if f.Original == "" {
+			// Created by the run
+			if err := os.Remove(fsPath(path)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return restored, skipped, err
+			}
+			fmt.Printf("Removed %s\n", f.Path)
+			restored++
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(store, "objects", f.Original[:2], f.Original[2:]))
+		if err != nil {
+			return restored, skipped, fmt.Errorf("the snapshot of %s is missing from the store: %w", f.Path, err)
+		}
+		if err := os.MkdirAll(fsPath(filepath.Dir(path)), 0755); err != nil {
+			return restored, skipped, err
+		}
+		if err := writeFileAtomic(path, data, 0644); err != nil {
+			return restored, skipped, fmt.Errorf("failed to restore %s: %w", f.Path, err)
+		}
+		fmt.Printf("Restored %s\n", f.Path)
+		restored++
+	}
+	return restored, skipped, nil
+}
+
+// runRollbackCommand implements the rollback subcommand
+func runRollbackCommand(args []string) error {
+	fs := flag.NewFlagSet("rollback", flag.ExitOnError)
+	dir := fs.String("dir", ".", "Directory in the tree whose runs to list or roll back")
+	force := fs.Bool("force", false, "Also restore files that changed again since the run")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: mdrefactor rollback [flags] [<run-id>]")
+		fmt.Fprintln(fs.Output(), "Restores the files of an in-place batch run from its snapshot, or lists the recorded runs if no run is given.")
+		fs.PrintDefaults()
+	}
+	positional := parseArgs(fs, args)
+	if len(positional) > 1 {
+		fs.Usage()
+		return fmt.Errorf("at most one run ID is expected")
+	}
+
+	store := snapshotStore(*dir)
+	runs, err := readSnapshotRuns(store)
+	if err != nil {
+		return err
+	}
+	if len(positional) == 0 {
+		if len(runs) == 0 {
+			fmt.Println("No runs recorded.")
+		}
+		for _, run := range runs {
+			fmt.Printf("%s  %d files in %s  %s\n", run.ID, len(run.Files), run.Dir, run.Command)
+		}
+		return nil
+	}
+
+	for _, run := range runs {
+		if run.ID != positional[0] {
+			continue
+		}
+		restored, skipped, err := rollback(store, treeRoot(*dir), run, *force)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Rolled back run %s: %d files restored", run.ID, restored)
+		if skipped > 0 {
+			fmt.Printf(", %d skipped", skipped)
+		}
+		fmt.Println()
+		return nil
+	}
+	return fmt.Errorf("no run %q recorded in %s", positional[0], store)
+}
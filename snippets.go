@@ -0,0 +1,390 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	// Annotation tying the code block below it to a source file, e.g.
+	// <!-- source: ../cmd/main.go#L10-L25 --> or <!-- source: server.go#setup -->.
+	// Include directives tie their expanded block to the source the same way.
+	snippetSourceRe = regexp.MustCompile(`^\s*<!--\s*(?:source|include):\s*(\S+?)\s*-->\s*$`)
+	// Line range of a snippet reference, e.g. L10-L25 or L10
+	snippetLinesRe = regexp.MustCompile(`^L(\d+)(?:-L?(\d+))?$`)
+	// Region markers in source files, in any comment syntax:
+	// #region name / #endregion, or [START name] / [END name]
+	regionStartRe = regexp.MustCompile(`(?:#region\s+(\S+)|\[START\s+(\S+?)\])`)
+	regionEndRe   = regexp.MustCompile(`(?:#endregion\b\s*(\S*)|\[END\s+(\S+?)\])`)
+)
+
+// snippetRef is the source reference of an annotated code block
+type snippetRef struct {
+	file       string // Path as written, relative to the document or, with a leading /, to the tree root
+	start, end int    // 1-based line range, inclusive, 0 if the reference is not a range
+	region     string // Name of a marked region
+}
+
+// String returns the reference the way it is written in annotations
+func (r snippetRef) String() string {
+	switch {
+	case r.region != "":
+		return r.file + "#" + r.region
+	case r.start == r.end && r.start > 0:
+		return fmt.Sprintf("%s#L%d", r.file, r.start)
+	case r.start > 0:
+		return fmt.Sprintf("%s#L%d-L%d", r.file, r.start, r.end)
+	}
+	return r.file
+}
+
+// parseSnippetRef parses a reference such as file.go, file.go#L3-L9 or file.go#region
+func parseSnippetRef(s string) (snippetRef, error) {
+	file, fragment, _ := strings.Cut(s, "#")
+	ref := snippetRef{file: file}
+	if file == "" {
+		return ref, fmt.Errorf("invalid snippet reference %q, expected a file", s)
+	}
+	if m := snippetLinesRe.FindStringSubmatch(fragment); m != nil {
+		ref.start, _ = strconv.Atoi(m[1])
+		ref.end = ref.start
+		if m[2] != "" {
+			ref.end, _ = strconv.Atoi(m[2])
+		}
+		if ref.start < 1 || ref.end < ref.start {
+			return ref, fmt.Errorf("invalid line range in snippet reference %q", s)
+		}
+	} else {
+		ref.region = fragment
+	}
+	return ref, nil
+}
+
+// resolve returns the path of the referenced file for a document in docDir.
+// Paths are relative to the document, falling back to the root of its tree.
+func (r snippetRef) resolve(docDir string) string {
+	if rest, ok := strings.CutPrefix(r.file, "/"); ok {
+		return filepath.Join(treeRoot(docDir), filepath.FromSlash(rest))
+	}
+	p := filepath.Join(docDir, filepath.FromSlash(r.file))
+	if _, err := os.Stat(p); err != nil {
+		if fallback := filepath.Join(treeRoot(docDir), filepath.FromSlash(r.file)); fileExists(fallback) {
+			return fallback
+		}
+	}
+	return p
+}
+
+// fileExists reports whether path names an existing file
+func fileExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir()
+}
+
+// extractRegion returns the lines between the start and end markers of the
+// named region, without the marker lines of nested regions
+func extractRegion(lines []string, name string) ([]string, bool) {
+	start := -1
+	for i, line := range lines {
+		if m := regionStartRe.FindStringSubmatch(line); m != nil && (m[1] == name || m[2] == name) {
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		return nil, false
+	}
+	var region []string
+	depth := 0
+	for _, line := range lines[start+1:] {
+		if regionStartRe.MatchString(line) {
+			depth++
+			continue
+		}
+		if m := regionEndRe.FindStringSubmatch(line); m != nil {
+			if depth == 0 || m[1] == name || m[2] == name {
+				return region, true
+			}
+			depth--
+			continue
+		}
+		region = append(region, line)
+	}
+	return nil, false
+}
+
+// dedent trims trailing whitespace and surrounding blank lines and removes
+// the indentation all lines share
+func dedent(lines []string) []string {
+	out := make([]string, 0, len(lines))
+	for _, line := range lines {
+		out = append(out, strings.TrimRight(line, " \t\r"))
+	}
+	for len(out) > 0 && out[0] == "" {
+		out = out[1:]
+	}
+	for len(out) > 0 && out[len(out)-1] == "" {
+		out = out[:len(out)-1]
+	}
+	indent, first := "", true
+	for _, line := range out {
+		if line == "" {
+			continue
+		}
+		lead := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		if first || len(lead) < len(indent) {
+			indent, first = lead, false
+		}
+	}
+	for i, line := range out {
+		out[i] = strings.TrimPrefix(line, indent)
+	}
+	return out
+}
+
+// loadSnippet returns the lines a reference points at, dedented
+func loadSnippet(docDir string, ref snippetRef) ([]string, error) {
+	path := ref.resolve(docDir)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", ref, err)
+	}
+	lines := strings.Split(strings.TrimRight(decodeSource(data).text, "\n"), "\n")
+	switch {
+	case ref.region != "":
+		region, ok := extractRegion(lines, ref.region)
+		if !ok {
+			return nil, fmt.Errorf("%s: no region %q in %s", ref, ref.region, path)
+		}
+		return dedent(region), nil
+	case ref.start > 0:
+		if ref.end > len(lines) {
+			return nil, fmt.Errorf("%s: %s has only %d lines", ref, path, len(lines))
+		}
+		return dedent(lines[ref.start-1 : ref.end]), nil
+	}
+	return dedent(lines), nil
+}
+
+// findLines returns the 1-based line where want starts in the file of ref,
+// compared after dedenting, or 0
+func findLines(docDir string, ref snippetRef, want []string) int {
+	data, err := os.ReadFile(ref.resolve(docDir))
+	if err != nil || len(want) == 0 {
+		return 0
+	}
+	lines := strings.Split(decodeSource(data).text, "\n")
+	for i := 0; i+len(want) <= len(lines); i++ {
+		if equalLines(dedent(lines[i:i+len(want)]), want) {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// annotatedSnippet is a fenced code block with a source annotation
+type annotatedSnippet struct {
+	directive   int // 0-based line of the annotation
+	open, close int // 0-based lines of the opening and closing fence
+	ref         snippetRef
+	err         error // Set if the reference does not parse
+}
+
+// fenceMarker returns the run of backticks or tildes opening a fence line
+func fenceMarker(line string) string {
+	trimmed := strings.TrimSpace(line)
+	n := len(trimmed) - len(strings.TrimLeft(trimmed, string(trimmed[0])))
+	return trimmed[:n]
+}
+
+// findAnnotatedSnippets returns the fenced code blocks of content directly
+// preceded by a line matching re, whose first group is the reference
+func findAnnotatedSnippets(content string, re *regexp.Regexp) []annotatedSnippet {
+	lines := strings.Split(content, "\n")
+	code := codeLines(content)
+	var snippets []annotatedSnippet
+	for i := 0; i < len(lines); i++ {
+		m := re.FindStringSubmatch(lines[i])
+		if m == nil || code[i] {
+			continue
+		}
+		open := i + 1
+		for open < len(lines) && strings.TrimSpace(lines[open]) == "" {
+			open++
+		}
+		if open == len(lines) || !code[open] || !isFenceLine(lines[open]) {
+			continue
+		}
+		marker := fenceMarker(lines[open])
+		end := -1
+		for j := open + 1; j < len(lines) && code[j]; j++ {
+			trimmed := strings.TrimSpace(lines[j])
+			if strings.HasPrefix(trimmed, marker) && strings.Trim(trimmed, marker[:1]) == "" {
+				end = j
+				break
+			}
+		}
+		if end < 0 {
+			continue
+		}
+		ref, err := parseSnippetRef(m[1])
+		snippets = append(snippets, annotatedSnippet{directive: i, open: open, close: end, ref: ref, err: err})
+		i = end
+	}
+	return snippets
+}
+
+// snippetDrift is an annotated snippet that no longer matches its source
+type snippetDrift struct {
+	line    int // 1-based line of the annotation
+	ref     snippetRef
+	diff    string
+	moved   snippetRef // For line ranges whose code only moved, the range it is at now
+	current []string
+	err     error // Set if the source cannot be read
+}
+
+// checkSnippets compares the annotated snippets of the document at path
+// with their sources and returns the ones that drifted
+func checkSnippets(path, content string) []snippetDrift {
+	docDir := filepath.Dir(path)
+	lines := strings.Split(content, "\n")
+	var drifts []snippetDrift
+	for _, s := range findAnnotatedSnippets(content, snippetSourceRe) {
+		if s.err != nil {
+			drifts = append(drifts, snippetDrift{line: s.directive + 1, ref: s.ref, err: s.err})
+			continue
+		}
+		current, err := loadSnippet(docDir, s.ref)
+		if err != nil {
+			drifts = append(drifts, snippetDrift{line: s.directive + 1, ref: s.ref, err: err})
+			continue
+		}
+		documented := dedent(lines[s.open+1 : s.close])
+		if equalLines(documented, current) {
+			continue
+		}
+		drift := snippetDrift{line: s.directive + 1, ref: s.ref, current: current}
+		if s.ref.start > 0 {
+			if start := findLines(docDir, s.ref, documented); start > 0 {
+				drift.moved = s.ref
+				drift.moved.start, drift.moved.end = start, start+len(documented)-1
+			}
+		}
+		if drift.moved.start == 0 {
+			drift.diff = lineDiff(path, s.ref.String(), strings.Join(documented, "\n")+"\n", strings.Join(current, "\n")+"\n")
+		}
+		drifts = append(drifts, drift)
+	}
+	return drifts
+}
+
+// fixSnippets updates the annotated snippets of content that drifted: line
+// ranges whose code moved are pointed at its new lines, and other snippets
+// get the current source. It returns the new content and the number fixed.
+func fixSnippets(content string, drifts []snippetDrift) (string, int) {
+	lines := strings.Split(content, "\n")
+	snippets := findAnnotatedSnippets(content, snippetSourceRe)
+	fixed := 0
+	// Replace from the end so earlier line numbers stay valid
+	for i := len(snippets) - 1; i >= 0; i-- {
+		s := snippets[i]
+		for _, d := range drifts {
+			if d.line != s.directive+1 || d.err != nil {
+				continue
+			}
+			if d.moved.start > 0 {
+				lines[s.directive] = strings.Replace(lines[s.directive], s.ref.String(), d.moved.String(), 1)
+			} else {
+				indent := lines[s.open][:len(lines[s.open])-len(strings.TrimLeft(lines[s.open], " "))]
+				body := make([]string, len(d.current))
+				for j, line := range d.current {
+					if line != "" {
+						line = indent + line
+					}
+					body[j] = line
+				}
+				lines = append(lines[:s.open+1], append(body, lines[s.close:]...)...)
+			}
+			fixed++
+		}
+	}
+	return strings.Join(lines, "\n"), fixed
+}
+
+// runSnippetsCommand implements the snippets subcommand
+func runSnippetsCommand(args []string) error {
+	fs := flag.NewFlagSet("snippets", flag.ExitOnError)
+	fix := fs.Bool("fix", false, "Update drifted snippets from their sources, or their line ranges if the code only moved")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: mdrefactor snippets [flags] <file-or-dir>...")
+		fmt.Fprintln(fs.Output(), "Checks that code blocks annotated with <!-- source: file#L10-L20 --> or <!-- source: file#region --> still match the source.")
+		fs.PrintDefaults()
+	}
+	positional := parseArgs(fs, args)
+	if len(positional) == 0 {
+		fs.Usage()
+		return fmt.Errorf("at least one file or directory is required")
+	}
+	files, err := expandMarkdownArgs(positional)
+	if err != nil {
+		return err
+	}
+
+	drifted, broken := 0, 0
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", file, err)
+		}
+		source := decodeSource(data)
+		drifts := checkSnippets(file, source.text)
+		for _, d := range drifts {
+			switch {
+			case d.err != nil:
+				fmt.Printf("%s:%d: %v\n", file, d.line, d.err)
+				broken++
+				continue
+			case d.moved.start > 0:
+				fmt.Printf("%s:%d: %s moved to %s\n", file, d.line, d.ref, d.moved)
+			default:
+				fmt.Printf("%s:%d: snippet differs from %s\n%s", file, d.line, d.ref, d.diff)
+			}
+			drifted++
+		}
+		if !*fix {
+			continue
+		}
+		updated, fixed := fixSnippets(source.text, drifts)
+		// Include directives without a block yet get one as well. Unresolvable
+		// references were reported above.
+		if expanded, _, err := expandIncludes(file, updated); err == nil {
+			updated = expanded
+		}
+		if updated == source.text {
+			continue
+		}
+		out, err := source.encode(updated, outputPolicy{eol: "preserve", encoding: "preserve"})
+		if err != nil {
+			return fmt.Errorf("failed to encode %s: %w", file, err)
+		}
+		if err := writeFileAtomic(file, out, 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %w", file, err)
+		}
+		fmt.Printf("%s: updated %d snippets and expanded its include directives\n", file, fixed)
+		drifted -= fixed
+	}
+
+	if broken > 0 {
+		return fmt.Errorf("%d snippet references cannot be resolved", broken)
+	}
+	if drifted > 0 {
+		return fmt.Errorf("%d snippets drifted from their sources, run with -fix to update them", drifted)
+	}
+	return nil
+}
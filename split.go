@@ -0,0 +1,188 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/jackmbuda/go-mdrefactor/mdrefactor"
+)
+
+// splitChunk is one file produced by splitting a document
+type splitChunk struct {
+	file    string // File name inside the output directory
+	heading string // Text of the heading the chunk starts at
+	content string
+}
+
+// parseSplitLevel parses a heading level such as "h2" or "2"
+func parseSplitLevel(s string) (int, error) {
+	level, err := strconv.Atoi(strings.TrimPrefix(strings.ToLower(s), "h"))
+	if err != nil || level < 1 || level > 6 {
+		return 0, fmt.Errorf("invalid heading level %q, expected h1 to h6", s)
+	}
+	return level, nil
+}
+
+// splitDocument breaks content at every heading of the given level, and at
+// higher-level headings after the first split point. Content before the first such heading is returned as the intro,
+// and every chunk has its headings shifted so that it starts at level 1.
+// Links to anchors of the original document are rewritten to point at the
+// chunk the heading ended up in, and other relative links are re-based from
+// srcDir to outDir.
+func splitDocument(content string, level int, indexFile, srcDir, outDir string) (string, []splitChunk) {
+	var intro []string
+	var chunks []splitChunk
+	var chunkSections [][]section
+	taken := map[string]bool{strings.ToLower(indexFile): true}
+
+	for _, s := range splitSections(content) {
+		// Higher-level headings before the first split point, such as the
+		// document title, stay on the index page
+		if s.Level == level || (s.Level > 0 && s.Level < level && len(chunks) > 0) {
+			name := safeFileStem(kebabCase(s.Heading))
+			if name == "" {
+				name = "section"
+			}
+			file := name + ".md"
+			for n := 2; taken[file]; n++ {
+				file = fmt.Sprintf("%s-%d.md", name, n)
+			}
+			taken[file] = true
+			chunks = append(chunks, splitChunk{file: file, heading: s.Heading})
+			chunkSections = append(chunkSections, nil)
+		}
+		if len(chunks) == 0 {
+			intro = append(intro, s.Text)
+			continue
+		}
+		chunkSections[len(chunks)-1] = append(chunkSections[len(chunks)-1], s)
+	}
+
+	// Every anchor of the original document maps to a file and the anchor
+	// the heading has there
+	type location struct {
+		file, anchor string
+		top          bool // The anchor is the first heading of the file
+	}
+	moved := make(map[string]location)
+	for i := range chunks {
+		var texts []string
+		for _, s := range chunkSections[i] {
+			texts = append(texts, s.Text)
+		}
+		text := strings.Join(texts, "\n")
+		text = shiftHeadings(text, 1-chunkSections[i][0].Level)
+		chunks[i].content = text
+
+		anchors := headingAnchors(parseHeadings(text))
+		j := 0
+		for _, s := range chunkSections[i] {
+			if s.Anchor == "" || j >= len(anchors) {
+				continue
+			}
+			moved[s.Anchor] = location{file: chunks[i].file, anchor: anchors[j], top: j == 0}
+			j++
+		}
+	}
+
+	rewrite := func(current string) func(string, bool) string {
+		return func(target string, image bool) string {
+			if target == "" || isExternalLink(target) || strings.HasPrefix(target, "/") {
+				return target
+			}
+			if strings.HasPrefix(target, "#") {
+				loc, ok := moved[strings.TrimPrefix(target, "#")]
+				switch {
+				case !ok:
+					return target
+				case loc.file == current:
+					return "#" + loc.anchor
+				case loc.top:
+					// Links to the top heading point at the page itself
+					return loc.file
+				default:
+					return loc.file + "#" + loc.anchor
+				}
+			}
+			return rebaseLink(target, srcDir, outDir)
+		}
+	}
+
+	for i := range chunks {
+		chunks[i].content = strings.TrimSpace(rewriteLinks(chunks[i].content, rewrite(chunks[i].file))) + "\n"
+	}
+	return rewriteLinks(strings.Join(intro, "\n"), rewrite(indexFile)), chunks
+}
+
+// renderSplitIndex builds the index page linking to every chunk
+func renderSplitIndex(frontMatter, intro, title string, chunks []splitChunk) string {
+	var b strings.Builder
+	b.WriteString(frontMatter)
+	intro = strings.TrimSpace(intro)
+	if !hasTitle(frontMatter + intro) {
+		fmt.Fprintf(&b, "# %s\n\n", title)
+	}
+	if intro != "" {
+		b.WriteString(intro + "\n\n")
+	}
+	for _, c := range chunks {
+		fmt.Fprintf(&b, "- [%s](%s)\n", c.heading, c.file)
+	}
+	return b.String()
+}
+
+// runSplitCommand implements the split subcommand
+func runSplitCommand(args []string) error {
+	fs := flag.NewFlagSet("split", flag.ExitOnError)
+	by := fs.String("by", "h2", "Heading level to split at (h1 to h6); higher-level headings also start a new file")
+	outDir := fs.String("o", "", "Directory to write the new files to (required)")
+	indexFile := fs.String("index", "index.md", "Name of the generated index page")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: mdrefactor split [flags] <file> -o <dir>")
+		fs.PrintDefaults()
+	}
+	positional := parseArgs(fs, args)
+	if len(positional) != 1 || *outDir == "" {
+		fs.Usage()
+		return fmt.Errorf("a file and -o are required")
+	}
+	level, err := parseSplitLevel(*by)
+	if err != nil {
+		return err
+	}
+
+	file := positional[0]
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", file, err)
+	}
+	frontMatter, body := mdrefactor.SplitFrontMatter(string(content))
+
+	intro, chunks := splitDocument(body, level, *indexFile, filepath.Dir(mustAbs(file)), mustAbs(*outDir))
+	if len(chunks) == 0 {
+		return fmt.Errorf("%s has no level %d headings to split at", file, level)
+	}
+
+	if err := os.MkdirAll(*outDir, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", *outDir, err)
+	}
+	for _, c := range chunks {
+		target := filepath.Join(*outDir, c.file)
+		if err := writeFileAtomic(target, []byte(c.content), 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %w", target, err)
+		}
+		fmt.Printf("Wrote %s\n", target)
+	}
+
+	index := renderSplitIndex(frontMatter, intro, documentTitle(string(content), file), chunks)
+	target := filepath.Join(*outDir, *indexFile)
+	if err := writeFileAtomic(target, []byte(index), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", target, err)
+	}
+	fmt.Printf("Split %s into %d files with index %s\n", file, len(chunks), target)
+	return nil
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jackmbuda/go-mdrefactor/mdrefactor"
+)
+
+// Front matter key holding the date a document was last checked against the code
+const lastReviewedKey = "last_reviewed"
+
+// Maximum number of source files a document is checked against
+const maxStaleSourceFiles = 8
+
+// System prompt used to check a document against the current sources
+const staleCheckSystemPrompt = "You are a technical writer checking whether a document still matches the code it " +
+	"describes. Compare the document with the current versions of the source files it refers to and list every " +
+	"statement, example, flag, option or command that is outdated, wrong or missing, with the section it is in and " +
+	"a concrete update. Only report differences the sources clearly show; do not suggest style changes. If nothing " +
+	"needs updating, set up_to_date to true and return no suggestions."
+
+// stalenessConfig is the staleness section of the config file
+type stalenessConfig struct {
+	MaxAgeDays int `json:"max_age_days"` // Days after its last review a document is stale
+}
+
+// Days after its last review, or last change, a document is stale
+var staleMaxAgeDays = 180
+
+// applyStalenessConfig applies the staleness section of the config file
+func applyStalenessConfig(cfg stalenessConfig) {
+	if cfg.MaxAgeDays > 0 {
+		staleMaxAgeDays = cfg.MaxAgeDays
+	}
+}
+
+// sourcePathRe matches words that look like file paths, such as cmd/main.go or config.yaml
+var sourcePathRe = regexp.MustCompile(`[A-Za-z0-9_][A-Za-z0-9_./-]*\.[A-Za-z0-9]+`)
+
+// staleCheckResponseFormat makes the API return the suggested updates as JSON
+var staleCheckResponseFormat = map[string]any{
+	"type": "json_schema",
+	"json_schema": map[string]any{
+		"name":   "staleness_check",
+		"strict": true,
+		"schema": map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"up_to_date": map[string]any{"type": "boolean"},
+				"suggestions": map[string]any{
+					"type": "array",
+					"items": map[string]any{
+						"type": "object",
+						"properties": map[string]any{
+							"section":    map[string]any{"type": "string", "description": "Heading of the section the statement is in"},
+							"problem":    map[string]any{"type": "string", "description": "What the document says and what the sources show instead"},
+							"suggestion": map[string]any{"type": "string", "description": "The updated text or what to change"},
+						},
+						"required":             []string{"section", "problem", "suggestion"},
+						"additionalProperties": false,
+					},
+				},
+			},
+			"required":             []string{"up_to_date", "suggestions"},
+			"additionalProperties": false,
+		},
+	},
+}
+
+// staleCheck is the result of checking a document against the sources
+type staleCheck struct {
+	UpToDate    bool `json:"up_to_date"`
+	Suggestions []struct {
+		Section    string `json:"section"`
+		Problem    string `json:"problem"`
+		Suggestion string `json:"suggestion"`
+	} `json:"suggestions"`
+}
+
+// lastReviewed returns the last_reviewed date of a document's front matter
+func lastReviewed(frontMatter string) (time.Time, bool) {
+	value := frontMatterValue(frontMatter, lastReviewedKey)
+	if len(value) < len("2006-01-02") {
+		return time.Time{}, false
+	}
+	// Dates may carry a time, only the day matters
+	date, err := time.ParseInLocation("2006-01-02", value[:len("2006-01-02")], time.Local)
+	return date, err == nil
+}
+
+// sourceTree indexes the files of a source tree by path and by base name
+type sourceTree struct {
+	root   string
+	paths  map[string]bool     // Slash-separated paths relative to root
+	byName map[string][]string // Paths by base name
+}
+
+// indexSourceTree lists the files below root, skipping hidden, vendored and
+// Markdown files
+func indexSourceTree(root string) (*sourceTree, error) {
+	tree := &sourceTree{root: root, paths: make(map[string]bool), byName: make(map[string][]string)}
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name := d.Name()
+		if d.IsDir() {
+			if p != root && (strings.HasPrefix(name, ".") || name == "vendor" || name == "node_modules") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(name, ".") || isMarkdownFile(name) {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		tree.paths[rel] = true
+		tree.byName[name] = append(tree.byName[name], rel)
+		return nil
+	})
+	return tree, err
+}
+
+// referencedSources returns the files of the tree a document mentions by
+// path, or by a base name only one file has, in order of first mention
+func (t *sourceTree) referencedSources(content string) []string {
+	var files []string
+	seen := make(map[string]bool)
+	for _, word := range sourcePathRe.FindAllString(content, -1) {
+		word = strings.TrimPrefix(strings.TrimRight(word, "."), "./")
+		file := ""
+		if t.paths[word] {
+			file = word
+		} else if matches := t.byName[path.Base(word)]; len(matches) == 1 && strings.HasSuffix(matches[0], word) {
+			file = matches[0]
+		}
+		if file != "" && !seen[file] {
+			seen[file] = true
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// changedSince returns the files below the tree root committed to after
+// date. Outside of a git repository it returns nil.
+func (t *sourceTree) changedSince(date time.Time) map[string]bool {
+	out, err := exec.Command("git", "-C", t.root, "-c", "core.quotePath=false", "log", "--since="+date.Format("2006-01-02"),
+		"--format=", "--name-only", "--relative", "--", ".").Output()
+	if err != nil {
+		return nil
+	}
+	changed := make(map[string]bool)
+	for _, name := range strings.Split(string(out), "\n") {
+		if name = strings.TrimSpace(name); name != "" {
+			changed[name] = true
+		}
+	}
+	return changed
+}
+
+// checkAgainstSources has the model compare content with the current
+// versions of the source files it refers to
+func checkAgainstSources(apiKey, model string, tree *sourceTree, file, content string, sources []string) (*staleCheck, error) {
+	budget := chunkSizeFor(model) / 2
+	var b strings.Builder
+	for _, src := range sources {
+		data, err := os.ReadFile(filepath.Join(tree.root, filepath.FromSlash(src)))
+		if err != nil {
+			return nil, err
+		}
+		text := string(data)
+		if len(text) > budget/len(sources) {
+			text = text[:budget/len(sources)] + "\n[truncated]"
+		}
+		fmt.Fprintf(&b, "File %s:\n\n%s\n\n", src, text)
+	}
+
+	reply, err := chatCompletionParams(context.Background(), apiKey, model, []Message{
+		{Role: "system", Content: staleCheckSystemPrompt},
+		{Role: "user", Content: fmt.Sprintf("Document %s:\n\n%s\n\nCurrent source files:\n\n%s", file, content, b.String())},
+	}, completionParams{responseFormat: staleCheckResponseFormat})
+	if err != nil {
+		return nil, err
+	}
+	var check staleCheck
+	if err := decodeJSONReply(reply, &check); err != nil {
+		return nil, err
+	}
+	return &check, nil
+}
+
+// runStaleCommand implements the stale subcommand
+func runStaleCommand(args []string) error {
+	fs := flag.NewFlagSet("stale", flag.ExitOnError)
+	apiKey := fs.String("apikey", os.Getenv("OPENAI_API_KEY"), "OpenAI API key (can also be set via OPENAI_API_KEY environment variable)")
+	addAPIFlags(fs)
+	model := fs.String("model", defaultModel, "OpenAI model to use (must support structured outputs)")
+	maxAge := fs.Int("max-age-days", staleMaxAgeDays, "Days after its "+lastReviewedKey+" date a document is stale")
+	check := fs.Bool("check", false, "Have the model check every stale document against the source files it refers to and suggest updates")
+	src := fs.String("src", ".", "Root of the source tree documents refer to")
+	markReviewed := fs.Bool("mark-reviewed", false, "Set "+lastReviewedKey+" to today in the given documents instead of checking them")
+	fail := fs.Bool("fail", false, "Exit with an error if any document is stale, for CI")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: mdrefactor stale [flags] <file-or-dir>...")
+		fmt.Fprintf(fs.Output(), "Lists documents whose %s front matter date is missing or older than -max-age-days.\n", lastReviewedKey)
+		fs.PrintDefaults()
+	}
+	positional := parseArgs(fs, args)
+	if len(positional) == 0 {
+		fs.Usage()
+		return fmt.Errorf("at least one file or directory is required")
+	}
+	files, err := expandMarkdownArgs(positional)
+	if err != nil {
+		return err
+	}
+
+	if *markReviewed {
+		today := time.Now().Format("2006-01-02")
+		for _, file := range files {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return fmt.Errorf("failed to read %s: %w", file, err)
+			}
+			source := decodeSource(data)
+			updated, _ := setFrontMatterFields(source.text, []frontMatterField{{key: lastReviewedKey, value: today}}, true)
+			out, err := source.encode(updated, outputPolicy{eol: "preserve", encoding: "preserve"})
+			if err != nil {
+				return fmt.Errorf("failed to encode %s: %w", file, err)
+			}
+			if err := writeFileAtomic(file, out, 0644); err != nil {
+				return fmt.Errorf("failed to write %s: %w", file, err)
+			}
+			fmt.Printf("%s: %s %s\n", file, lastReviewedKey, today)
+		}
+		return nil
+	}
+
+	tree, err := indexSourceTree(*src)
+	if err != nil {
+		return fmt.Errorf("failed to list the source tree: %w", err)
+	}
+	now := time.Now()
+	stale, failed := 0, 0
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", file, err)
+		}
+		content := decodeSource(data).text
+		frontMatter, _ := mdrefactor.SplitFrontMatter(content)
+		sources := tree.referencedSources(content)
+
+		reviewed, ok := lastReviewed(frontMatter)
+		var changed []string
+		if ok {
+			age := int(now.Sub(reviewed).Hours() / 24)
+			if age < *maxAge {
+				continue
+			}
+			since := tree.changedSince(reviewed)
+			for _, s := range sources {
+				if since[s] {
+					changed = append(changed, s)
+				}
+			}
+			fmt.Printf("%s: last reviewed %s (%d days ago)", file, reviewed.Format("2006-01-02"), age)
+		} else {
+			fmt.Printf("%s: no %s date", file, lastReviewedKey)
+		}
+		if len(changed) > 0 {
+			fmt.Printf(", %d referenced source files changed since: %s", len(changed), strings.Join(changed, ", "))
+		}
+		fmt.Println()
+		stale++
+
+		if !*check {
+			continue
+		}
+		if len(sources) == 0 {
+			fmt.Println("  refers to no file of the source tree, nothing to check against")
+			continue
+		}
+		if len(sources) > maxStaleSourceFiles {
+			sources = sources[:maxStaleSourceFiles]
+		}
+		result, err := checkAgainstSources(*apiKey, *model, tree, file, content, sources)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error checking %s: %v\n", file, err)
+			failed++
+			continue
+		}
+		if result.UpToDate || len(result.Suggestions) == 0 {
+			fmt.Printf("  matches %s, mark it reviewed with: mdrefactor stale -mark-reviewed %s\n", strings.Join(sources, ", "), file)
+			continue
+		}
+		for _, s := range result.Suggestions {
+			fmt.Printf("  - %s: %s\n    Suggested: %s\n", s.Section, s.Problem, s.Suggestion)
+		}
+	}
+
+	if stale == 0 {
+		fmt.Printf("No stale documents (%d checked).\n", len(files))
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d stale documents could not be checked", failed, stale)
+	}
+	if *fail && stale > 0 {
+		return fmt.Errorf("%d of %d documents are stale", stale, len(files))
+	}
+	return nil
+}
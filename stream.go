@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jackmbuda/go-mdrefactor/mdrefactor"
+)
+
+// chatCompletionStream sends the messages to the chat completions API with
+// streaming enabled and passes each content delta of the first choice to fn.
+// A reply cut off at the token limit is continued with follow-up requests,
+// whose deltas are passed to fn as well.
+func chatCompletionStream(ctx context.Context, apiKey, model string, messages []Message, fn func(chunk string) error) error {
+	var reply strings.Builder
+	request := messages
+	for continuation := 0; ; continuation++ {
+		finishReason, err := streamCompletion(ctx, apiKey, model, request, func(chunk string) error {
+			reply.WriteString(chunk)
+			return fn(chunk)
+		})
+		if err != nil || finishReason != "length" {
+			return err
+		}
+		if continuation == maxContinuations {
+			return fmt.Errorf("reply was still truncated at the token limit after %d continuations", maxContinuations)
+		}
+		request = append(messages[:len(messages):len(messages)],
+			Message{Role: "assistant", Content: reply.String()},
+			Message{Role: "user", Content: continuationPrompt})
+	}
+}
+
+// streamCompletion sends a single streamed chat completion request and
+// returns the finish reason of the first choice
+func streamCompletion(ctx context.Context, apiKey, model string, messages []Message, fn func(chunk string) error) (string, error) {
+	apiKey, err := resolveAPIKey(apiKey)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := withBatchDeadline(ctx)
+	defer cancel()
+	completion, err := chatClient(apiKey).Complete(ctx, &mdrefactor.CompletionRequest{Model: model, Messages: messages, OnChunk: fn})
+	if err != nil {
+		return "", err
+	}
+	return completion.FinishReason, nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/yuin/goldmark/ast"
+	extast "github.com/yuin/goldmark/extension/ast"
+)
+
+// Number of extra attempts made when a refactored document breaks a structural invariant
+const structureRetries = 1
+
+// structureInvariants selects the parts of a document's structure that must
+// survive refactoring
+type structureInvariants struct {
+	headings bool // No heading may be removed
+	code     bool // Every code block must be kept verbatim
+	tables   bool // Every table must be kept with its rows and columns
+}
+
+// parseInvariants parses a comma-separated list of invariants such as "headings,code"
+func parseInvariants(s string) (structureInvariants, error) {
+	var inv structureInvariants
+	for _, name := range strings.Split(s, ",") {
+		switch strings.TrimSpace(name) {
+		case "":
+		case "headings":
+			inv.headings = true
+		case "code":
+			inv.code = true
+		case "tables":
+			inv.tables = true
+		case "all":
+			inv = structureInvariants{headings: true, code: true, tables: true}
+		default:
+			return inv, fmt.Errorf("unknown invariant %q, expected headings, code, tables or all", name)
+		}
+	}
+	return inv, nil
+}
+
+// enabled reports whether any invariant is enforced
+func (inv structureInvariants) enabled() bool {
+	return inv.headings || inv.code || inv.tables
+}
+
+// instruction returns the prompt text describing the invariants to the model
+func (inv structureInvariants) instruction() string {
+	var rules []string
+	if inv.headings {
+		rules = append(rules, "Do not remove any heading; you may reword headings but keep all of them.")
+	}
+	if inv.code {
+		rules = append(rules, "Keep every code block, with its content unchanged.")
+	}
+	if inv.tables {
+		rules = append(rules, "Keep every table with all of its rows and columns.")
+	}
+	return strings.Join(rules, "\n")
+}
+
+// documentStructure is the part of a document's AST the invariants look at
+type documentStructure struct {
+	headings   int
+	codeBlocks []string // Content of every code block
+	tables     []string // Shape of every table as "<rows>x<columns>"
+}
+
+// analyzeStructure walks the AST of content and records its structure
+func analyzeStructure(content string) documentStructure {
+	d := parseMarkdown(content)
+	var s documentStructure
+	ast.Walk(d.root, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		switch n.Kind() {
+		case ast.KindHeading:
+			s.headings++
+		case ast.KindFencedCodeBlock, ast.KindCodeBlock:
+			var code strings.Builder
+			lines := n.Lines()
+			for i := 0; i < lines.Len(); i++ {
+				seg := lines.At(i)
+				code.Write(seg.Value(d.source))
+			}
+			s.codeBlocks = append(s.codeBlocks, strings.TrimSpace(code.String()))
+			return ast.WalkSkipChildren, nil
+		case extast.KindTable:
+			rows, columns := 0, 0
+			for row := n.FirstChild(); row != nil; row = row.NextSibling() {
+				rows++
+				if row.Kind() == extast.KindTableHeader {
+					columns = row.ChildCount()
+				}
+			}
+			s.tables = append(s.tables, fmt.Sprintf("%dx%d", rows, columns))
+			return ast.WalkSkipChildren, nil
+		}
+		return ast.WalkContinue, nil
+	})
+	return s
+}
+
+// missing returns the entries of want that are not in have, counting duplicates
+func missing(want, have []string) []string {
+	counts := make(map[string]int)
+	for _, h := range have {
+		counts[h]++
+	}
+	var gone []string
+	for _, w := range want {
+		if counts[w] > 0 {
+			counts[w]--
+			continue
+		}
+		gone = append(gone, w)
+	}
+	return gone
+}
+
+// violations compares the structure of the original and refactored content
+// and describes every invariant the refactored content breaks
+func (inv structureInvariants) violations(original, refactored string) []string {
+	before, after := analyzeStructure(original), analyzeStructure(refactored)
+	var problems []string
+	if inv.headings && after.headings < before.headings {
+		problems = append(problems, fmt.Sprintf("%d of %d headings were removed", before.headings-after.headings, before.headings))
+	}
+	if inv.code {
+		if gone := missing(before.codeBlocks, after.codeBlocks); len(gone) > 0 {
+			problems = append(problems, fmt.Sprintf("%d code blocks were removed or changed", len(gone)))
+		}
+	}
+	if inv.tables {
+		if gone := missing(before.tables, after.tables); len(gone) > 0 {
+			problems = append(problems, fmt.Sprintf("tables of shape %s (rows x columns) were removed or reshaped", strings.Join(gone, ", ")))
+		}
+	}
+	return problems
+}
+
+// withStructureInvariants wraps refactor so that the invariants are added to
+// the prompt and checked against the ASTs of the input and output. Sections
+// that break them are repaired on their own where possible, otherwise the
+// document is retried and finally rejected.
+func withStructureInvariants(inv structureInvariants, refactor refactorFunc) refactorFunc {
+	if !inv.enabled() {
+		return refactor
+	}
+	return func(systemPrompt, content string) (string, error) {
+		prompt := systemPrompt + "\n\n" + inv.instruction()
+		for attempt := 0; ; attempt++ {
+			refactored, err := refactor(prompt, content)
+			if err != nil {
+				return "", err
+			}
+
+			problems := inv.violations(content, refactored)
+			if len(problems) == 0 {
+				return refactored, nil
+			}
+
+			// Sending back only the sections that broke the invariants is
+			// cheaper than regenerating the whole document
+			repaired, n, err := inv.repairSections(refactor, systemPrompt, content, refactored)
+			if err != nil {
+				fmt.Printf("Repairing the sections breaking structural invariants failed: %v\n", err)
+			} else if n > 0 {
+				fmt.Printf("Refactored content breaks structural invariants (%s), repaired %d sections\n", strings.Join(problems, "; "), n)
+				if problems = inv.violations(content, repaired); len(problems) == 0 {
+					return repaired, nil
+				}
+			}
+			if attempt == structureRetries {
+				return "", fmt.Errorf("refactored content breaks structural invariants after %d attempts: %s", attempt+1, strings.Join(problems, "; "))
+			}
+
+			fmt.Printf("Refactored content breaks structural invariants (%s), retrying...\n", strings.Join(problems, "; "))
+			prompt = fmt.Sprintf("%s\n\n%s\nYour previous attempt broke these rules: %s. Respect them strictly.", systemPrompt, inv.instruction(), strings.Join(problems, "; "))
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/jackmbuda/go-mdrefactor/mdrefactor"
+)
+
+// templateData is the data an output template is executed with
+type templateData struct {
+	Content     string // The complete refactored document
+	FrontMatter string // Front matter of the refactored document, including delimiters
+	Body        string // The refactored document without front matter
+	Title       string // Title of the refactored document
+	Path        string // Path of the document (or URL in -git mode)
+	Model       string // Model that refactored the document
+	Date        string // Current date as YYYY-MM-DD
+}
+
+// loadOutputTemplate parses the Go text/template at path
+func loadOutputTemplate(path string) (*template.Template, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read output template %s: %w", path, err)
+	}
+	tmpl, err := template.New(path).Funcs(template.FuncMap{
+		"trim": strings.TrimSpace,
+	}).Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse output template %s: %w", path, err)
+	}
+	return tmpl, nil
+}
+
+// applyOutputTemplate wraps the refactored content of the document at path
+// in the template. A nil template returns the content unchanged.
+func applyOutputTemplate(tmpl *template.Template, path, model, content string) (string, error) {
+	if tmpl == nil {
+		return content, nil
+	}
+	frontMatter, body := mdrefactor.SplitFrontMatter(content)
+	data := templateData{
+		Content:     content,
+		FrontMatter: frontMatter,
+		Body:        body,
+		Title:       documentTitle(content, path),
+		Path:        path,
+		Model:       model,
+		Date:        time.Now().Format("2006-01-02"),
+	}
+
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("failed to apply output template to %s: %w", path, err)
+	}
+	return b.String(), nil
+}
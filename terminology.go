@@ -0,0 +1,297 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/jackmbuda/go-mdrefactor/mdrefactor"
+)
+
+// Terms replaced by default, for inclusive language. The terminology section
+// of the config file adds to them and overrides them.
+var defaultTerminology = map[string]string{
+	"whitelist":     "allowlist",
+	"whitelisted":   "allowlisted",
+	"whitelisting":  "allowlisting",
+	"blacklist":     "denylist",
+	"blacklisted":   "denylisted",
+	"blacklisting":  "denylisting",
+	"master branch": "main branch",
+	"master/slave":  "primary/replica",
+	"slave":         "replica|secondary",
+	"master":        "main|primary",
+	"sanity check":  "quick check|confidence check",
+	"dummy value":   "placeholder value",
+	"man-hours":     "person-hours",
+	"grandfathered": "legacy|exempt",
+}
+
+// Replacements by term, set from the terminology section of the config file.
+// Several replacements separated by | or none leave the choice to the
+// writer, so the term is reported instead of replaced.
+var terminology = defaultTerminology
+
+// applyTerminologyConfig applies the terminology section of the config file
+func applyTerminologyConfig(cfg map[string]string) {
+	if len(cfg) == 0 {
+		return
+	}
+	terms := make(map[string]string, len(defaultTerminology)+len(cfg))
+	for term, replacement := range defaultTerminology {
+		terms[term] = replacement
+	}
+	for term, replacement := range cfg {
+		terms[strings.ToLower(strings.TrimSpace(term))] = strings.TrimSpace(replacement)
+	}
+	terminology = terms
+}
+
+// termRule is an entry of the terminology map
+type termRule struct {
+	term        string
+	replacement string   // Empty if the term cannot be replaced automatically
+	options     []string // What to use instead, if anything
+}
+
+// termRules is the terminology map compiled into a single pattern
+type termRules struct {
+	re    *regexp.Regexp
+	rules map[string]termRule // By lowercase term with single spaces
+}
+
+// compileTerminology compiles terms. Longer terms come first in the pattern,
+// so "master branch" is matched before "master".
+func compileTerminology(terms map[string]string) *termRules {
+	t := &termRules{rules: make(map[string]termRule)}
+	var patterns []string
+	for term, replacement := range terms {
+		term = strings.Join(strings.Fields(strings.ToLower(term)), " ")
+		// A term mapped to itself turns off a default
+		if term == "" || strings.EqualFold(term, replacement) {
+			continue
+		}
+		rule := termRule{term: term}
+		if replacement != "" {
+			rule.options = strings.Split(replacement, "|")
+			if len(rule.options) == 1 {
+				rule.replacement = replacement
+			}
+		}
+		t.rules[term] = rule
+		patterns = append(patterns, strings.ReplaceAll(regexp.QuoteMeta(term), " ", `\s+`))
+	}
+	sort.Slice(patterns, func(i, j int) bool {
+		if len(patterns[i]) != len(patterns[j]) {
+			return len(patterns[i]) > len(patterns[j])
+		}
+		return patterns[i] < patterns[j]
+	})
+	if len(patterns) > 0 {
+		t.re = regexp.MustCompile(`(?i)\b(?:` + strings.Join(patterns, "|") + `)\b`)
+	}
+	return t
+}
+
+// rule returns the rule of a matched term
+func (t *termRules) rule(match string) termRule {
+	return t.rules[strings.Join(strings.Fields(strings.ToLower(match)), " ")]
+}
+
+// matchCase returns replacement in the case of the text it replaces:
+// all caps, capitalized or as written
+func matchCase(text, replacement string) string {
+	first, _ := utf8.DecodeRuneInString(text)
+	switch {
+	case len(text) > 1 && strings.ToUpper(text) == text && strings.ToLower(text) != text:
+		return strings.ToUpper(replacement)
+	case unicode.IsUpper(first):
+		r, size := utf8.DecodeRuneInString(replacement)
+		return string(unicode.ToUpper(r)) + replacement[size:]
+	}
+	return replacement
+}
+
+// termViolation is a use of a term that was not replaced
+type termViolation struct {
+	line   int // 1-based line of the document
+	text   string
+	rule   termRule
+	inCode bool // In code, inline code or a link target, which are never rewritten
+	// Left in place only because replacing was not asked for
+	fixable bool
+}
+
+// String describes the violation and what to use instead
+func (v termViolation) String() string {
+	switch {
+	case len(v.rule.options) == 0:
+		return fmt.Sprintf("%d: avoid %q", v.line, v.text)
+	case v.fixable:
+		return fmt.Sprintf("%d: %q, use %q", v.line, v.text, v.rule.replacement)
+	case v.inCode:
+		return fmt.Sprintf("%d: %q in code or a link, use %s if it can be renamed", v.line, v.text, quoteOptions(v.rule.options))
+	default:
+		return fmt.Sprintf("%d: %q, use %s depending on the meaning", v.line, v.text, quoteOptions(v.rule.options))
+	}
+}
+
+// Parts of a line that are not prose and never rewritten: inline code, link
+// targets and HTML tags
+var nonProseRe = regexp.MustCompile(inlineCodeRe.String() + "|" + linkTargetRe.String() + "|" + htmlTagRe.String())
+
+// apply replaces the terms that have a single replacement in the prose of
+// content, or with replace unset only reports them. It returns the new
+// content, the number of replacements and the uses left.
+func (t *termRules) apply(content string, replace bool) (string, int, []termViolation) {
+	if t.re == nil {
+		return content, 0, nil
+	}
+	frontMatter, body := mdrefactor.SplitFrontMatter(content)
+	offset := strings.Count(frontMatter, "\n")
+	lines := strings.Split(body, "\n")
+	code := codeLines(body)
+	replaced := 0
+	var violations []termViolation
+	for i, line := range lines {
+		report := func(text string, inCode, fixable bool) {
+			violations = append(violations, termViolation{line: offset + i + 1, text: text, rule: t.rule(text), inCode: inCode, fixable: fixable})
+		}
+		if code[i] {
+			for _, m := range t.re.FindAllString(line, -1) {
+				report(m, true, false)
+			}
+			continue
+		}
+		for _, part := range nonProseRe.FindAllString(line, -1) {
+			for _, m := range t.re.FindAllString(part, -1) {
+				report(m, true, false)
+			}
+		}
+		lines[i] = mapOutside(line, nonProseRe, func(text string) string {
+			return t.re.ReplaceAllStringFunc(text, func(m string) string {
+				rule := t.rule(m)
+				if rule.replacement == "" || !replace {
+					report(m, false, rule.replacement != "")
+					return m
+				}
+				replaced++
+				return matchCase(m, rule.replacement)
+			})
+		})
+	}
+	return frontMatter + strings.Join(lines, "\n"), replaced, violations
+}
+
+// instruction returns the system prompt addition listing the terms content uses
+func (t *termRules) instruction(content string) string {
+	if t.re == nil {
+		return ""
+	}
+	seen := make(map[string]bool)
+	var rules []string
+	for _, m := range t.re.FindAllString(content, -1) {
+		rule := t.rule(m)
+		if seen[rule.term] {
+			continue
+		}
+		seen[rule.term] = true
+		if len(rule.options) == 0 {
+			rules = append(rules, fmt.Sprintf("avoid %q", rule.term))
+		} else {
+			rules = append(rules, fmt.Sprintf("use %s instead of %q", quoteOptions(rule.options), rule.term))
+		}
+	}
+	if len(rules) == 0 {
+		return ""
+	}
+	sort.Strings(rules)
+	return "Follow the project's terminology in prose, keeping identifiers, commands and code as they are: " + strings.Join(rules, "; ") + "."
+}
+
+// quoteOptions returns the replacements of a term as "a" or "b"
+func quoteOptions(options []string) string {
+	quoted := make([]string, len(options))
+	for i, o := range options {
+		quoted[i] = fmt.Sprintf("%q", o)
+	}
+	return strings.Join(quoted, " or ")
+}
+
+// withTerminology wraps refactor so that the output follows the terminology
+// map. The model is told the terms the input uses, terms with a single
+// replacement are replaced in its output afterwards, and the uses left are
+// reported.
+func withTerminology(terms *termRules, refactor refactorFunc) refactorFunc {
+	return func(systemPrompt, content string) (string, error) {
+		if instruction := terms.instruction(content); instruction != "" {
+			systemPrompt += "\n\n" + instruction
+		}
+		refactored, err := refactor(systemPrompt, content)
+		if err != nil {
+			return "", err
+		}
+		refactored, _, violations := terms.apply(refactored, true)
+		for _, v := range violations {
+			fmt.Fprintf(os.Stderr, "Warning: terminology: line %s\n", v)
+		}
+		return refactored, nil
+	}
+}
+
+// runTermsCommand implements the terms subcommand
+func runTermsCommand(args []string) error {
+	fs := flag.NewFlagSet("terms", flag.ExitOnError)
+	fix := fs.Bool("fix", false, "Replace terms that have a single replacement in the prose of the documents")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: mdrefactor terms [flags] <file-or-dir>...")
+		fmt.Fprintln(fs.Output(), "Reports uses of terms of the terminology map, such as whitelist or master, per file. No API calls are made.")
+		fs.PrintDefaults()
+	}
+	positional := parseArgs(fs, args)
+	if len(positional) == 0 {
+		fs.Usage()
+		return fmt.Errorf("at least one file or directory is required")
+	}
+	files, err := expandMarkdownArgs(positional)
+	if err != nil {
+		return err
+	}
+
+	terms := compileTerminology(terminology)
+	left := 0
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", file, err)
+		}
+		source := decodeSource(data)
+		updated, replaced, violations := terms.apply(source.text, *fix)
+		for _, v := range violations {
+			fmt.Printf("%s:%s\n", file, v)
+		}
+		left += len(violations)
+		if replaced == 0 {
+			continue
+		}
+		out, err := source.encode(updated, outputPolicy{eol: "preserve", encoding: "preserve"})
+		if err != nil {
+			return fmt.Errorf("failed to encode %s: %w", file, err)
+		}
+		if err := writeFileAtomic(file, out, 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %w", file, err)
+		}
+		fmt.Printf("%s: replaced %d terms\n", file, replaced)
+	}
+
+	if left > 0 {
+		return fmt.Errorf("%d uses of terms to avoid left (%d files checked)", left, len(files))
+	}
+	fmt.Printf("No terms to avoid left (%d files checked).\n", len(files))
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/jackmbuda/go-mdrefactor/mdrefactor"
+)
+
+// System prompt used to infer missing titles
+const titleSystemPrompt = "You are a technical editor. Infer a concise, descriptive title and a one-line summary for documentation pages. Reply with JSON only."
+
+// titleMetadata is the title and summary the model infers for a page
+type titleMetadata struct {
+	Title   string `json:"title"`
+	Summary string `json:"summary"`
+}
+
+// hasTitle reports whether a document has a front matter title or a level-1 heading
+func hasTitle(content string) bool {
+	frontMatter, body := mdrefactor.SplitFrontMatter(content)
+	if frontMatterValue(frontMatter, "title") != "" {
+		return true
+	}
+	for _, h := range parseHeadings(body) {
+		if h.level == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// inferTitle asks the model for the title and summary of a page
+func inferTitle(apiKey, model, file, content string) (titleMetadata, error) {
+	_, body := mdrefactor.SplitFrontMatter(content)
+	prompt := fmt.Sprintf("The documentation page %s has no title. Reply with a JSON object with the keys "+
+		"\"title\" (at most 8 words, no trailing punctuation) and \"summary\" (a single sentence).\n\n%s", file, body)
+
+	var meta titleMetadata
+	reply, err := chatCompletion(apiKey, model, []Message{
+		{Role: "system", Content: titleSystemPrompt},
+		{Role: "user", Content: prompt},
+	})
+	if err != nil {
+		return meta, err
+	}
+	if err := decodeJSONReply(reply, &meta); err != nil {
+		return meta, err
+	}
+	if meta.Title == "" {
+		return meta, fmt.Errorf("model did not return a title")
+	}
+	return meta, nil
+}
+
+// insertTitle adds the title and summary to content, either as front matter
+// fields or as a level-1 heading followed by the summary paragraph
+func insertTitle(content string, meta titleMetadata, style string) string {
+	if style == "frontmatter" {
+		fields := []frontMatterField{{key: "title", value: meta.Title}}
+		if meta.Summary != "" {
+			fields = append(fields, frontMatterField{key: "summary", value: meta.Summary})
+		}
+		updated, _ := setFrontMatterFields(content, fields, false)
+		return updated
+	}
+
+	frontMatter, body := mdrefactor.SplitFrontMatter(content)
+	header := "# " + meta.Title + "\n\n"
+	if meta.Summary != "" {
+		header += meta.Summary + "\n\n"
+	}
+	return frontMatter + header + strings.TrimLeft(body, "\n")
+}
+
+// runTitlesCommand implements the titles subcommand
+func runTitlesCommand(args []string) error {
+	fs := flag.NewFlagSet("titles", flag.ExitOnError)
+	apiKey := fs.String("apikey", os.Getenv("OPENAI_API_KEY"), "OpenAI API key (can also be set via OPENAI_API_KEY environment variable)")
+	addAPIFlags(fs)
+	model := fs.String("model", defaultModel, "OpenAI model to use")
+	style := fs.String("style", "frontmatter", "How to insert titles: frontmatter (title and summary fields) or heading (H1 and summary paragraph)")
+	dryRun := fs.Bool("dry-run", false, "Report the inferred titles without modifying any file")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: mdrefactor titles [flags] <file-or-dir>...")
+		fs.PrintDefaults()
+	}
+	positional := parseArgs(fs, args)
+	if len(positional) == 0 {
+		fs.Usage()
+		return fmt.Errorf("at least one file or directory is required")
+	}
+	if *style != "frontmatter" && *style != "heading" {
+		return fmt.Errorf("unknown title style %q, expected frontmatter or heading", *style)
+	}
+
+	files, err := expandMarkdownArgs(positional)
+	if err != nil {
+		return err
+	}
+
+	invented := make(map[string]string)
+	failed := 0
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", file, err)
+		}
+		if hasTitle(string(content)) {
+			continue
+		}
+
+		meta, err := inferTitle(*apiKey, *model, file, string(content))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error inferring title for %s: %v\n", file, err)
+			failed++
+			continue
+		}
+		invented[file] = meta.Title
+
+		if !*dryRun {
+			if err := writeFileAtomic(file, []byte(insertTitle(string(content), meta, *style)), 0644); err != nil {
+				return fmt.Errorf("failed to write %s: %w", file, err)
+			}
+		}
+	}
+
+	// Every invented title is reported so it can be reviewed
+	fmt.Printf("Invented titles for %d of %d files:\n", len(invented), len(files))
+	for _, file := range sortedKeys(invented) {
+		fmt.Printf("  %s: %s\n", file, invented[file])
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("failed to infer titles for %d files", failed)
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// urlRewriteConfig is the url_rewrites section of the config file
+type urlRewriteConfig struct {
+	HTTPS       bool              `json:"https"`        // Upgrade http:// links to https://, except to local hosts
+	Domains     map[string]string `json:"domains"`      // New host, optionally with a path prefix, by old one
+	StripParams []string          `json:"strip_params"` // Query parameters to remove, as glob patterns such as utm_*
+}
+
+// URL rewrite rules applied to the links of every refactored document, set
+// from the url_rewrites section of the config file
+var urlRewrites urlRewriteConfig
+
+// applyURLRewriteConfig applies the url_rewrites section of the config file
+func applyURLRewriteConfig(cfg urlRewriteConfig) error {
+	for _, pattern := range cfg.StripParams {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid url_rewrites strip_params pattern %q: %w", pattern, err)
+		}
+	}
+	domains := make(map[string]string, len(cfg.Domains))
+	for from, to := range cfg.Domains {
+		from = strings.TrimSuffix(strings.ToLower(strings.TrimPrefix(strings.TrimPrefix(from, "https://"), "http://")), "/")
+		if from == "" || to == "" {
+			return fmt.Errorf("invalid url_rewrites domain rule %q -> %q", from, to)
+		}
+		domains[from] = strings.TrimSuffix(to, "/")
+	}
+	cfg.Domains = domains
+	urlRewrites = cfg
+	return nil
+}
+
+// enabled reports whether any rule is configured
+func (c urlRewriteConfig) enabled() bool {
+	return c.HTTPS || len(c.Domains) > 0 || len(c.StripParams) > 0
+}
+
+// isLocalHost reports whether host is only reachable locally, where https
+// is usually not served
+func isLocalHost(host string) bool {
+	host = strings.ToLower(host)
+	if h, _, ok := strings.Cut(host, ":"); ok && !strings.HasPrefix(host, "[") {
+		host = h
+	}
+	return host == "localhost" || host == "127.0.0.1" || strings.HasPrefix(host, "[::1]") || strings.HasSuffix(host, ".local") || strings.HasSuffix(host, ".localhost")
+}
+
+// rewriteURL applies the rules to raw, returning it unchanged if no rule applies
+func (c urlRewriteConfig) rewriteURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return raw
+	}
+	changed := false
+
+	// The longest matching rule wins, so a path rule beats its domain's rule
+	from := ""
+	for rule := range c.Domains {
+		host, prefix, _ := strings.Cut(rule, "/")
+		if strings.EqualFold(u.Host, host) && len(rule) > len(from) {
+			if prefix == "" || u.Path == "/"+prefix || strings.HasPrefix(u.Path, "/"+prefix+"/") {
+				from = rule
+			}
+		}
+	}
+	if from != "" {
+		to := c.Domains[from]
+		if scheme, rest, ok := strings.Cut(to, "://"); ok {
+			u.Scheme, to = scheme, rest
+		}
+		_, oldPrefix, _ := strings.Cut(from, "/")
+		host, newPrefix, _ := strings.Cut(to, "/")
+		u.Host = host
+		rest := strings.TrimPrefix(u.Path, "/"+oldPrefix)
+		if oldPrefix == "" {
+			rest = u.Path
+		}
+		if newPrefix != "" {
+			u.Path = "/" + newPrefix + rest
+		} else {
+			u.Path = rest
+		}
+		u.RawPath = ""
+		changed = true
+	}
+
+	if c.HTTPS && u.Scheme == "http" && !isLocalHost(u.Host) {
+		u.Scheme = "https"
+		changed = true
+	}
+
+	if len(c.StripParams) > 0 && u.RawQuery != "" {
+		// The raw query is filtered rather than re-encoded, so the
+		// parameters left keep their order and encoding
+		var kept []string
+		for _, param := range strings.Split(u.RawQuery, "&") {
+			name, _, _ := strings.Cut(param, "=")
+			if unescaped, err := url.QueryUnescape(name); err == nil {
+				name = unescaped
+			}
+			strip := false
+			for _, pattern := range c.StripParams {
+				if ok, _ := path.Match(pattern, name); ok {
+					strip = true
+					break
+				}
+			}
+			if !strip {
+				kept = append(kept, param)
+			}
+		}
+		if query := strings.Join(kept, "&"); query != u.RawQuery {
+			u.RawQuery, u.ForceQuery = query, false
+			changed = true
+		}
+	}
+
+	if !changed {
+		return raw
+	}
+	return u.String()
+}
+
+// urlRewriter applies the rules to documents and keeps count of the
+// rewritten URLs for the summary at the end of a run. It is safe for
+// concurrent use by the workers of a -dir run.
+type urlRewriter struct {
+	rules urlRewriteConfig
+
+	mu       sync.Mutex
+	rewrites map[[2]string]int // Number of rewrites by old and new URL
+}
+
+// newURLRewriter returns a rewriter applying rules
+func newURLRewriter(rules urlRewriteConfig) *urlRewriter {
+	return &urlRewriter{rules: rules, rewrites: make(map[[2]string]int)}
+}
+
+// apply rewrites the URLs of content outside of code: link targets,
+// autolinks and bare URLs alike
+func (r *urlRewriter) apply(content string) string {
+	lines := strings.Split(content, "\n")
+	code := codeLines(content)
+	for i, line := range lines {
+		if code[i] {
+			continue
+		}
+		lines[i] = mapOutside(line, inlineCodeRe, func(text string) string {
+			return urlRe.ReplaceAllStringFunc(text, func(raw string) string {
+				// Punctuation ending a sentence is not part of a bare URL
+				trimmed := strings.TrimRight(raw, ".,;:!?")
+				rewritten := r.rules.rewriteURL(trimmed)
+				if rewritten == trimmed {
+					return raw
+				}
+				r.mu.Lock()
+				r.rewrites[[2]string{trimmed, rewritten}]++
+				r.mu.Unlock()
+				return rewritten + raw[len(trimmed):]
+			})
+		})
+	}
+	return strings.Join(lines, "\n")
+}
+
+// printSummary prints the URLs rewritten during the run
+func (r *urlRewriter) printSummary() {
+	if r == nil || len(r.rewrites) == 0 {
+		return
+	}
+	pairs := make([][2]string, 0, len(r.rewrites))
+	total := 0
+	for pair, n := range r.rewrites {
+		pairs = append(pairs, pair)
+		total += n
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i][0] < pairs[j][0] })
+	fmt.Printf("Rewrote %d links to %d URLs:\n", total, len(pairs))
+	for _, pair := range pairs {
+		fmt.Printf("  %s -> %s (%d)\n", pair[0], pair[1], r.rewrites[pair])
+	}
+}
+
+// withURLRewrites wraps refactor so that the links of the output follow the
+// URL rewrite rules
+func withURLRewrites(r *urlRewriter, refactor refactorFunc) refactorFunc {
+	return func(systemPrompt, content string) (string, error) {
+		refactored, err := refactor(systemPrompt, content)
+		if err != nil {
+			return "", err
+		}
+		return r.apply(refactored), nil
+	}
+}